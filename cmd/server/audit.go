@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/example/go-otp-auth/internal/config"
+	"github.com/example/go-otp-auth/internal/storage"
+)
+
+// runAuditVerify recomputes the auth_events hash chain and reports the first
+// tampered row. It exits non-zero if the chain is broken.
+func runAuditVerify(cfg *config.Config) int {
+	var events storage.EventStore
+	switch cfg.StorageBackend {
+	case config.BackendPostgres:
+		pg, err := storage.NewPostgres(cfg.DatabaseURL)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "connect postgres:", err)
+			return 1
+		}
+		defer pg.Close()
+		events = pg
+	case config.BackendSQLite:
+		db, err := storage.NewSQLite(cfg.SQLitePath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "open sqlite:", err)
+			return 1
+		}
+		defer db.Close()
+		events = db
+	default:
+		fmt.Fprintf(os.Stderr, "audit-verify is not supported with STORAGE_BACKEND=%s\n", cfg.StorageBackend)
+		return 2
+	}
+
+	checked, head, err := events.VerifyAuthEvents(context.Background())
+	var chainErr *storage.ChainError
+	if errors.As(err, &chainErr) {
+		fmt.Fprintf(os.Stderr, "FAILED after %d valid events: %v\n", checked, chainErr)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify auth events:", err)
+		return 1
+	}
+
+	fmt.Printf("OK: %d events verified, head hash %s\n", checked, head)
+	return 0
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/example/go-otp-auth/internal/config"
+	"github.com/example/go-otp-auth/internal/keyring"
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
+	"github.com/example/go-otp-auth/internal/util"
+)
+
+// maxReportedErrors bounds the invalid rows listed by import-users
+const maxReportedErrors = 100
+
+// importRecord is one row of an import file. The columns match the export,
+// so exported files can be imported elsewhere.
+type importRecord struct {
+	ID           string `json:"id"`
+	Phone        string `json:"phone"`
+	Status       string `json:"status"`
+	RegisteredAt string `json:"registered_at"`
+	// malformed is set for a line that could not be parsed
+	malformed string
+}
+
+// importReport summarizes an import
+type importReport struct {
+	Read       int
+	Invalid    int
+	Duplicates int
+	Errors     []string
+}
+
+func (rep *importReport) reject(line int, reason string) {
+	rep.Invalid++
+	rep.note(line, reason)
+}
+
+func (rep *importReport) duplicate(line int, reason string) {
+	rep.Duplicates++
+	rep.note(line, reason)
+}
+
+func (rep *importReport) note(line int, reason string) {
+	if len(rep.Errors) < maxReportedErrors {
+		rep.Errors = append(rep.Errors, fmt.Sprintf("line %d: %s", line, reason))
+	}
+}
+
+// userReader turns import records into storage.ImportUser values. Invalid
+// rows and rows repeating an earlier phone number or id are counted in the
+// report and skipped, so only clean rows reach the database.
+type userReader struct {
+	read   func() (importRecord, int, error)
+	report *importReport
+	phones map[string]int // first line of each phone number
+	ids    map[string]int
+}
+
+func newUserReader(r io.Reader, format string, report *importReport) (*userReader, error) {
+	ur := &userReader{report: report, phones: map[string]int{}, ids: map[string]int{}}
+	switch format {
+	case "csv":
+		read, err := csvRecords(r)
+		if err != nil {
+			return nil, err
+		}
+		ur.read = read
+	case "jsonl":
+		ur.read = jsonlRecords(r)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return ur, nil
+}
+
+// Next implements storage.UserSource
+func (ur *userReader) Next() (storage.ImportUser, error) {
+	for {
+		rec, line, err := ur.read()
+		if err != nil {
+			return storage.ImportUser{}, err
+		}
+		ur.report.Read++
+		u, reason := validateRecord(rec)
+		if reason != "" {
+			ur.report.reject(line, reason)
+			continue
+		}
+		if first, ok := ur.phones[u.Phone]; ok {
+			ur.report.duplicate(line, fmt.Sprintf("phone repeats line %d", first))
+			continue
+		}
+		if first, ok := ur.ids[u.PublicID]; ok && u.PublicID != "" {
+			ur.report.duplicate(line, fmt.Sprintf("id repeats line %d", first))
+			continue
+		}
+		ur.phones[u.Phone] = line
+		if u.PublicID != "" {
+			ur.ids[u.PublicID] = line
+		}
+		return u, nil
+	}
+}
+
+// validateRecord returns the user to import or why the record is rejected
+func validateRecord(rec importRecord) (storage.ImportUser, string) {
+	var u storage.ImportUser
+	if rec.malformed != "" {
+		return u, rec.malformed
+	}
+	phone, ok := util.NormalizePhone(rec.Phone)
+	if !ok {
+		return u, fmt.Sprintf("invalid phone %q", rec.Phone)
+	}
+	u.Phone = phone
+	if rec.ID != "" {
+		id, err := uuid.Parse(rec.ID)
+		if err != nil {
+			return u, fmt.Sprintf("invalid id %q", rec.ID)
+		}
+		u.PublicID = id.String()
+	}
+	if rec.Status != "" && !model.ValidUserStatus(rec.Status) {
+		return u, fmt.Sprintf("invalid status %q", rec.Status)
+	}
+	u.Status = rec.Status
+	if rec.RegisteredAt != "" {
+		t, err := time.Parse(time.RFC3339, rec.RegisteredAt)
+		if err != nil {
+			return u, fmt.Sprintf("invalid registered_at %q", rec.RegisteredAt)
+		}
+		u.RegisteredAt = t
+	}
+	return u, ""
+}
+
+// csvRecords reads a CSV file with a header row. phone is required; id,
+// status and registered_at are optional and other columns are ignored.
+func csvRecords(r io.Reader) (func() (importRecord, int, error), error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	cols := map[string]int{}
+	for i, name := range header {
+		cols[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	if _, ok := cols["phone"]; !ok {
+		return nil, errors.New("header has no phone column")
+	}
+	return func() (importRecord, int, error) {
+		fields, err := cr.Read()
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			// the reader goes on with the next line
+			return importRecord{malformed: pe.Err.Error()}, pe.StartLine, nil
+		}
+		if err != nil {
+			return importRecord{}, 0, err
+		}
+		line, _ := cr.FieldPos(0)
+		get := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(fields) {
+				return strings.TrimSpace(fields[i])
+			}
+			return ""
+		}
+		return importRecord{
+			ID:           get("id"),
+			Phone:        get("phone"),
+			Status:       get("status"),
+			RegisteredAt: get("registered_at"),
+		}, line, nil
+	}, nil
+}
+
+// jsonlRecords reads one JSON object per line, skipping blank lines
+func jsonlRecords(r io.Reader) func() (importRecord, int, error) {
+	sc := bufio.NewScanner(r)
+	line := 0
+	return func() (importRecord, int, error) {
+		for sc.Scan() {
+			line++
+			b := strings.TrimSpace(sc.Text())
+			if b == "" {
+				continue
+			}
+			var rec importRecord
+			if err := json.Unmarshal([]byte(b), &rec); err != nil {
+				return importRecord{malformed: "invalid JSON"}, line, nil
+			}
+			return rec, line, nil
+		}
+		if err := sc.Err(); err != nil {
+			return importRecord{}, 0, err
+		}
+		return importRecord{}, 0, io.EOF
+	}
+}
+
+// fileFormat picks the format from the flag or the file extension
+func fileFormat(flagValue, path string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return "csv"
+	}
+	return "jsonl"
+}
+
+// tenantContext returns a context limited to the tenant with slug
+func tenantContext(pg *storage.Postgres, slug, cmd string) (context.Context, int) {
+	ctx := context.Background()
+	t, err := pg.Tenants().TenantBySlug(ctx, slug)
+	if errors.Is(err, storage.ErrNotFound) {
+		fmt.Fprintf(os.Stderr, "%s: no tenant %q\n", cmd, slug)
+		return nil, 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd, err)
+		return nil, 1
+	}
+	return storage.WithTenant(ctx, t.ID), 0
+}
+
+// openBulkPostgres connects to the primary with the phone keyring, if one is
+// configured, so numbers are encrypted and decrypted like in the server
+func openBulkPostgres(cfg *config.Config, cmd string) (*storage.Postgres, int) {
+	if cfg.StorageBackend != config.BackendPostgres {
+		fmt.Fprintf(os.Stderr, "%s requires STORAGE_BACKEND=%s\n", cmd, config.BackendPostgres)
+		return nil, 2
+	}
+	pg, err := storage.NewPostgres(cfg.DatabaseURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "connect postgres:", err)
+		return nil, 1
+	}
+	if cfg.PhoneKeyringFile != "" {
+		kr, err := keyring.Load(cfg.PhoneKeyringFile)
+		if err != nil {
+			pg.Close()
+			fmt.Fprintln(os.Stderr, "load phone keyring:", err)
+			return nil, 1
+		}
+		pg.SetKeyring(kr)
+	}
+	return pg, 0
+}
+
+// runImportUsers loads users from a CSV or JSONL file, or stdin for "-"
+func runImportUsers(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("import-users", flag.ContinueOnError)
+	format := fs.String("format", "", "csv or jsonl (default from the file extension, jsonl for stdin)")
+	dryRun := fs.Bool("dry-run", false, "validate and report without writing anything")
+	tenant := fs.String("tenant", "default", "slug of the tenant the users belong to")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: import-users [-format csv|jsonl] [-dry-run] [-tenant SLUG] FILE|-")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	path := fs.Arg(0)
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	var report importReport
+	src, err := newUserReader(bufio.NewReader(in), fileFormat(*format, path), &report)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import-users:", err)
+		return 2
+	}
+
+	pg, code := openBulkPostgres(cfg, "import-users")
+	if pg == nil {
+		return code
+	}
+	defer pg.Close()
+
+	ctx, code := tenantContext(pg, *tenant, "import-users")
+	if ctx == nil {
+		return code
+	}
+	res, err := pg.ImportUsers(ctx, src, *dryRun)
+	for _, e := range report.Errors {
+		fmt.Fprintln(os.Stderr, e)
+	}
+	if hidden := report.Invalid + report.Duplicates - len(report.Errors); hidden > 0 {
+		fmt.Fprintf(os.Stderr, "... and %d more\n", hidden)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "import-users:", err)
+		return 1
+	}
+
+	imported := "imported"
+	if *dryRun {
+		imported = "would import"
+		fmt.Println("dry run, nothing was written")
+	}
+	fmt.Printf("read %d, invalid %d, duplicates %d, existing %d, %s %d\n",
+		report.Read, report.Invalid, report.Duplicates+res.Duplicates, res.Existing, imported, res.Inserted)
+	return 0
+}
+
+// runExportUsers streams users as CSV or JSONL to stdout or a file
+func runExportUsers(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("export-users", flag.ContinueOnError)
+	format := fs.String("format", "jsonl", "csv or jsonl")
+	out := fs.String("o", "-", "output file, - for stdout")
+	var filter storage.UserFilter
+	var from, to string
+	fs.StringVar(&filter.Status, "status", "", "only users with this status")
+	fs.StringVar(&filter.Search, "search", "", "phone number search")
+	fs.StringVar(&filter.SearchMode, "search-mode", "", "contains, prefix or exact")
+	fs.StringVar(&from, "registered-from", "", "registered at or after (RFC 3339)")
+	fs.StringVar(&to, "registered-to", "", "registered before (RFC 3339)")
+	tenant := fs.String("tenant", "default", "slug of the tenant to export")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *format != "csv" && *format != "jsonl" {
+		fmt.Fprintf(os.Stderr, "export-users: unknown format %q\n", *format)
+		return 2
+	}
+	if filter.Status != "" && !model.ValidUserStatus(filter.Status) {
+		fmt.Fprintf(os.Stderr, "export-users: invalid status %q\n", filter.Status)
+		return 2
+	}
+	if filter.SearchMode != "" && !storage.ValidSearchMode(filter.SearchMode) {
+		fmt.Fprintf(os.Stderr, "export-users: invalid search mode %q\n", filter.SearchMode)
+		return 2
+	}
+	for _, p := range []struct {
+		value string
+		t     *time.Time
+	}{{from, &filter.RegisteredFrom}, {to, &filter.RegisteredTo}} {
+		if p.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, p.value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export-users: invalid time %q\n", p.value)
+			return 2
+		}
+		*p.t = t
+	}
+
+	dst := os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		dst = f
+	}
+
+	pg, code := openBulkPostgres(cfg, "export-users")
+	if pg == nil {
+		return code
+	}
+	defer pg.Close()
+	ctx, code := tenantContext(pg, *tenant, "export-users")
+	if ctx == nil {
+		return code
+	}
+
+	w := bufio.NewWriter(dst)
+	var write func(storage.ListedUser) error
+	flush := w.Flush
+	if *format == "csv" {
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "phone", "status", "registered_at", "last_login_at"})
+		write = func(u storage.ListedUser) error {
+			lastLogin := ""
+			if u.LastLoginAt != nil {
+				lastLogin = *u.LastLoginAt
+			}
+			return cw.Write([]string{u.PublicID, u.Phone, u.Status, u.RegisteredAt, lastLogin})
+		}
+		flush = func() error {
+			if cw.Flush(); cw.Error() != nil {
+				return cw.Error()
+			}
+			return w.Flush()
+		}
+	} else {
+		enc := json.NewEncoder(w)
+		write = func(u storage.ListedUser) error { return enc.Encode(u) }
+	}
+
+	n := 0
+	err := pg.ExportUsers(ctx, filter, func(u storage.ListedUser) error {
+		n++
+		return write(u)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export-users:", err)
+		return 1
+	}
+	if err := flush(); err != nil {
+		fmt.Fprintln(os.Stderr, "export-users:", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "exported %d users\n", n)
+	return 0
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
+)
+
+// readAll drains a userReader, failing the test on a read error
+func readAll(t *testing.T, ur *userReader) []storage.ImportUser {
+	t.Helper()
+	var users []storage.ImportUser
+	for {
+		u, err := ur.Next()
+		if errors.Is(err, io.EOF) {
+			return users
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, u)
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	const id = "0b6f7a4c-3f1e-4a53-9a3e-1f5d2c7e8b90"
+	in := strings.Join([]string{
+		"Phone,ID,status,registered_at,last_login_at",
+		"+1 (555) 000-0001," + id + ",suspended,2025-01-02T03:04:05Z,",
+		"+15550002,,,,",
+		"not a phone,,,,",
+		"+15550003,not-a-uuid,,,",
+		"+15550004,,frozen,,",
+		"+15550005,,,yesterday,",
+		`+15550006,"unterminated`,
+	}, "\n") + "\n"
+
+	var report importReport
+	ur, err := newUserReader(strings.NewReader(in), "csv", &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := readAll(t, ur)
+	if len(users) != 2 {
+		t.Fatalf("users = %+v, want 2", users)
+	}
+	want := storage.ImportUser{
+		PublicID:     id,
+		Phone:        "+15550000001",
+		Status:       model.UserStatusSuspended,
+		RegisteredAt: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if got := users[0]; got.PublicID != want.PublicID || got.Phone != want.Phone || got.Status != want.Status || !got.RegisteredAt.Equal(want.RegisteredAt) {
+		t.Fatalf("first user = %+v, want %+v", got, want)
+	}
+	if users[1].PublicID != "" || users[1].Status != "" || !users[1].RegisteredAt.IsZero() {
+		t.Fatalf("optional columns left empty = %+v", users[1])
+	}
+	if report.Read != 7 || report.Invalid != 5 || report.Duplicates != 0 {
+		t.Fatalf("report = %+v, want 7 read, 5 invalid", report)
+	}
+	for i, prefix := range []string{"line 4: invalid phone", "line 5: invalid id", "line 6: invalid status", "line 7: invalid registered_at", "line 8: "} {
+		if !strings.HasPrefix(report.Errors[i], prefix) {
+			t.Errorf("error %d = %q, want prefix %q", i, report.Errors[i], prefix)
+		}
+	}
+}
+
+func TestImportCSVHeader(t *testing.T) {
+	for _, in := range []string{"", "id,status\n+15550001,active\n"} {
+		if _, err := newUserReader(strings.NewReader(in), "csv", &importReport{}); err == nil {
+			t.Errorf("header %q accepted", in)
+		}
+	}
+}
+
+func TestImportJSONL(t *testing.T) {
+	in := `{"phone": "+15550001", "status": "active"}
+
+{"phone": "+15550002"
+{"phone": "+15550001"}
+{"phone": "+15550003", "id": "0b6f7a4c-3f1e-4a53-9a3e-1f5d2c7e8b90"}
+{"phone": "+15550004", "id": "0B6F7A4C-3F1E-4A53-9A3E-1F5D2C7E8B90"}
+`
+	var report importReport
+	ur, err := newUserReader(strings.NewReader(in), "jsonl", &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := readAll(t, ur)
+	if len(users) != 2 || users[0].Phone != "+15550001" || users[1].Phone != "+15550003" {
+		t.Fatalf("users = %+v", users)
+	}
+	// blank lines are not rows, and in-file repeats are not invalid rows
+	if report.Read != 5 || report.Invalid != 1 || report.Duplicates != 2 {
+		t.Fatalf("report = %+v, want 5 read, 1 invalid, 2 duplicates", report)
+	}
+	want := []string{"line 3: invalid JSON", "line 4: phone repeats line 1", "line 6: id repeats line 5"}
+	if strings.Join(report.Errors, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("errors = %q, want %q", report.Errors, want)
+	}
+}
+
+func TestImportUnknownFormat(t *testing.T) {
+	if _, err := newUserReader(strings.NewReader(""), "xml", &importReport{}); err == nil {
+		t.Fatal("unknown format accepted")
+	}
+}
+
+func TestImportReportCapsErrors(t *testing.T) {
+	var report importReport
+	for i := 0; i < maxReportedErrors+5; i++ {
+		report.reject(i+1, "bad")
+	}
+	if report.Invalid != maxReportedErrors+5 || len(report.Errors) != maxReportedErrors {
+		t.Fatalf("invalid %d, %d errors listed", report.Invalid, len(report.Errors))
+	}
+}
+
+func TestFileFormat(t *testing.T) {
+	for _, tc := range []struct{ flag, path, want string }{
+		{"", "users.csv", "csv"},
+		{"", "USERS.CSV", "csv"},
+		{"", "users.jsonl", "jsonl"},
+		{"", "-", "jsonl"},
+		{"csv", "-", "csv"},
+		{"jsonl", "users.csv", "jsonl"},
+	} {
+		if got := fileFormat(tc.flag, tc.path); got != tc.want {
+			t.Errorf("fileFormat(%q, %q) = %q, want %q", tc.flag, tc.path, got, tc.want)
+		}
+	}
+}
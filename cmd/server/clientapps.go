@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/example/go-otp-auth/internal/config"
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
+)
+
+const clientAppsUsage = "usage: client-apps create -name NAME [flags] | list [-tenant SLUG] | revoke PREFIX"
+
+// runClientApps implements "client-apps create", "client-apps list" and
+// "client-apps revoke"
+func runClientApps(cfg *config.Config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, clientAppsUsage)
+		return 2
+	}
+
+	var stores storage.Stores
+	switch cfg.StorageBackend {
+	case config.BackendPostgres:
+		pg, err := storage.NewPostgres(cfg.DatabaseURL)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "connect postgres:", err)
+			return 1
+		}
+		defer pg.Close()
+		stores = storage.Stores{Tenants: pg.Tenants(), Apps: pg.ClientApps()}
+	case config.BackendSQLite:
+		db, err := storage.NewSQLite(cfg.SQLitePath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "open sqlite:", err)
+			return 1
+		}
+		defer db.Close()
+		stores = storage.Stores{Tenants: db.Tenants(), Apps: db.ClientApps()}
+	default:
+		fmt.Fprintf(os.Stderr, "client-apps is not supported with STORAGE_BACKEND=%s\n", cfg.StorageBackend)
+		return 2
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "create":
+		return createClientApp(ctx, stores, args[1:])
+	case "list":
+		fs := flag.NewFlagSet("client-apps list", flag.ContinueOnError)
+		slug := fs.String("tenant", "default", "tenant slug")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		t, code := lookupTenant(ctx, stores.Tenants, *slug)
+		if t == nil {
+			return code
+		}
+		list, err := stores.Apps.ListClientApps(ctx, t.ID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "list client apps:", err)
+			return 1
+		}
+		enc := json.NewEncoder(os.Stdout)
+		for _, app := range list {
+			enc.Encode(app)
+		}
+		return 0
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, clientAppsUsage)
+			return 2
+		}
+		err := stores.Apps.RevokeClientApp(ctx, args[1])
+		if errors.Is(err, storage.ErrNotFound) {
+			fmt.Fprintf(os.Stderr, "client-apps: no live key with prefix %q\n", args[1])
+			return 1
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "revoke client app:", err)
+			return 1
+		}
+		fmt.Printf("revoked %s\n", args[1])
+		return 0
+	default:
+		fmt.Fprintln(os.Stderr, clientAppsUsage)
+		return 2
+	}
+}
+
+func createClientApp(ctx context.Context, stores storage.Stores, args []string) int {
+	fs := flag.NewFlagSet("client-apps create", flag.ContinueOnError)
+	slug := fs.String("tenant", "default", "tenant slug")
+	name := fs.String("name", "", "app name")
+	origins := fs.String("origins", "", "comma-separated allowed Origin headers, any when empty")
+	rateMax := fs.Int("rate-limit-max", 0, "OTP requests per window with this key, unlimited when 0")
+	rateWindow := fs.Int("rate-limit-window", 0, "rate limit window in seconds")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, "client-apps: -name is required")
+		return 2
+	}
+	if (*rateMax > 0) != (*rateWindow > 0) {
+		fmt.Fprintln(os.Stderr, "client-apps: -rate-limit-max and -rate-limit-window go together")
+		return 2
+	}
+
+	t, code := lookupTenant(ctx, stores.Tenants, *slug)
+	if t == nil {
+		return code
+	}
+	app := &model.ClientApp{TenantID: t.ID, Name: *name, AllowedOrigins: model.StringList{}}
+	for _, o := range strings.Split(*origins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			app.AllowedOrigins = append(app.AllowedOrigins, o)
+		}
+	}
+	if *rateMax > 0 {
+		app.RateLimitMax, app.RateLimitWindowSec = rateMax, rateWindow
+	}
+
+	key, prefix, hash, err := storage.NewClientAppKey()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	app.KeyPrefix = prefix
+	if err := stores.Apps.CreateClientApp(ctx, app, hash); err != nil {
+		fmt.Fprintln(os.Stderr, "create client app:", err)
+		return 1
+	}
+	// only the hash is stored; this is the one chance to see the key
+	fmt.Println(key)
+	return 0
+}
+
+// lookupTenant returns the tenant with slug, or nil and an exit code
+func lookupTenant(ctx context.Context, tenants storage.TenantStore, slug string) (*model.Tenant, int) {
+	t, err := tenants.TenantBySlug(ctx, slug)
+	if errors.Is(err, storage.ErrNotFound) {
+		fmt.Fprintf(os.Stderr, "client-apps: no tenant %q\n", slug)
+		return nil, 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "get tenant:", err)
+		return nil, 1
+	}
+	return t, 0
+}
@@ -17,58 +17,208 @@ import (
 	"os"
 	"os/signal"
 	"time"
+	_ "time/tzdata" // profile timezones must validate without system zoneinfo
 
 	_ "github.com/example/go-otp-auth/docs" // import generated swagger docs
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/rs/zerolog/log"
 	httpSwagger "github.com/swaggo/http-swagger"
 
 	"github.com/example/go-otp-auth/internal/api"
 	"github.com/example/go-otp-auth/internal/auth"
 	"github.com/example/go-otp-auth/internal/config"
+	"github.com/example/go-otp-auth/internal/keyring"
+	"github.com/example/go-otp-auth/internal/model"
 	"github.com/example/go-otp-auth/internal/storage"
 )
 
+// purgeInterval is how often deleted accounts are checked for purging
+const purgeInterval = time.Hour
+
+// eventQueueSize is how many auth events may wait for the background writer
+const eventQueueSize = 4096
+
 func main() {
+	// migrate only needs the database, so it runs before the full config is
+	// required
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		cfg, err := config.LoadDatabaseFromEnv()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if cfg.StorageBackend != config.BackendPostgres {
+			fmt.Fprintf(os.Stderr, "migrate requires STORAGE_BACKEND=%s; sqlite migrates on start\n", config.BackendPostgres)
+			os.Exit(2)
+		}
+		os.Exit(runMigrate(cfg, os.Args[2:]))
+	}
+
 	// load config from env
 	cfg, err := config.LoadFromEnv()
 	if err != nil {
 		panic(err)
 	}
 
+	// maintenance subcommands; no arguments starts the server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "audit-verify":
+			os.Exit(runAuditVerify(cfg))
+		case "import-users":
+			os.Exit(runImportUsers(cfg, os.Args[2:]))
+		case "export-users":
+			os.Exit(runExportUsers(cfg, os.Args[2:]))
+		case "tenants":
+			os.Exit(runTenants(cfg, os.Args[2:]))
+		case "client-apps":
+			os.Exit(runClientApps(cfg, os.Args[2:]))
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %q\nusage: %s [audit-verify | migrate up|down [n]|status | import-users | export-users | tenants | client-apps]\n", os.Args[1], os.Args[0])
+			os.Exit(2)
+		}
+	}
+
 	log.Info().Msg("starting server")
 
-	// init postgres
-	pg, err := storage.NewPostgres(cfg.DatabaseURL)
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to connect postgres")
-	}
-	defer pg.Close()
+	var stores storage.Stores
+	switch cfg.StorageBackend {
+	case config.BackendMemory:
+		log.Warn().Msg("using in-memory storage, all data is lost on restart")
+		stores = storage.NewMemory().Stores()
+	case config.BackendSQLite:
+		db, err := storage.NewSQLite(cfg.SQLitePath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to open sqlite")
+		}
+		defer db.Close()
+		stores = db.Stores()
+	default:
+		// init postgres
+		pg, err := storage.NewPostgres(cfg.DatabaseURL, cfg.DatabaseReplicaURLs...)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to connect postgres")
+		}
+		defer pg.Close()
 
-	// init redis
-	rd, err := storage.NewRedis(cfg.RedisAddr)
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to connect redis")
+		if cfg.MigrateOnStart {
+			if _, err := newMigrator(pg).Up(context.Background()); err != nil {
+				log.Fatal().Err(err).Msg("failed to migrate database")
+			}
+		}
+
+		if cfg.PhoneKeyringFile != "" {
+			kr, err := keyring.Load(cfg.PhoneKeyringFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to load phone keyring")
+			}
+			pg.SetKeyring(kr)
+			// encrypt plaintext numbers and move old ones to the active key
+			go func() {
+				n, err := pg.ReencryptPhones(context.Background())
+				if err != nil {
+					log.Error().Err(err).Int("users", n).Msg("phone re-encryption failed")
+					return
+				}
+				log.Info().Int("users", n).Str("key_id", kr.ActiveKeyID()).Msg("phone re-encryption done")
+			}()
+		}
+
+		// init redis
+		rd, err := storage.NewRedis(storage.RedisOptions{
+			URL:              cfg.RedisURL,
+			Addrs:            cfg.RedisAddrs,
+			Username:         cfg.RedisUsername,
+			Password:         cfg.RedisPassword,
+			DB:               cfg.RedisDB,
+			TLS:              cfg.RedisTLS,
+			TLSCAFile:        cfg.RedisTLSCAFile,
+			SentinelMaster:   cfg.RedisSentinelMaster,
+			SentinelPassword: cfg.RedisSentinelPassword,
+			Cluster:          cfg.RedisCluster,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to connect redis")
+		}
+		defer rd.Close()
+
+		stores = storage.Stores{Users: pg, Events: pg, OTPs: rd, Limiter: rd, Revoker: rd, SCIM: pg, Tenants: pg.Tenants(), Apps: pg.ClientApps()}
 	}
-	defer rd.Close()
+
+	// append auth events in the background, off the request path
+	events := storage.NewEventQueue(stores.Events, eventQueueSize)
+	eventsCtx, stopEvents := context.WithCancel(context.Background())
+	eventsDone := make(chan struct{})
+	go func() {
+		events.Run(eventsCtx)
+		close(eventsDone)
+	}()
+	stores.Events = events
 
 	// init jwt
 	auth.InitJWT(cfg.JWTSecret)
 
 	// build router
 	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
 
-	h := api.NewHandler(pg, rd, cfg)
+	h := api.NewHandler(stores, cfg)
+	r.Use(h.TenantMiddleware)
 
 	// OTP endpoints
-	r.Post("/otp/request", h.RequestOTP)
-	r.Post("/otp/verify", h.VerifyOTP)
+	r.Group(func(r chi.Router) {
+		r.Use(h.ClientAppMiddleware)
+		r.Post("/otp/request", h.RequestOTP)
+		r.Post("/otp/verify", h.VerifyOTP)
+		r.Post("/otp/email/request", h.RequestEmailOTP)
+		r.Post("/otp/email/verify", h.VerifyEmailOTP)
+	})
+
+	// Token exchange for internal services (RFC 8693)
+	r.Post("/token/exchange", h.ExchangeToken)
 
 	// User endpoints
-	r.Get("/users", h.ListUsers) // public
+	r.With(h.AuthMiddleware, api.RequireScope(model.ScopeUsersRead)).Get("/users", h.ListUsers)
 
 	// GetUser endpoint - protected
-	r.With(api.AuthMiddleware).Get("/users/me", h.GetUser)
+	r.With(h.AuthMiddleware).Get("/users/me", h.GetUser)
+	r.With(h.AuthMiddleware).Patch("/users/me", h.UpdateProfile)
+	r.With(h.AuthMiddleware).Delete("/users/me", h.DeleteAccount)
+	r.With(h.AuthMiddleware).Get("/users/me/export", h.ExportAccount)
+	r.With(h.AuthMiddleware).Post("/users/me/logout", h.Logout)
+	r.With(h.AuthMiddleware).Post("/users/me/phone", h.StartPhoneChange)
+	r.With(h.AuthMiddleware).Post("/users/me/phone/verify", h.ConfirmPhoneChange)
+	r.With(h.AuthMiddleware).Get("/users/me/emails", h.ListEmails)
+	r.With(h.AuthMiddleware).Post("/users/me/emails", h.AddEmail)
+	r.With(h.AuthMiddleware).Post("/users/me/emails/verify", h.VerifyEmail)
+	r.With(h.AuthMiddleware).Delete("/users/me/emails/{email}", h.RemoveEmail)
+
+	// Admin endpoints
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(h.AuthMiddleware, api.RequireRole(model.RoleAdmin))
+		r.Get("/users/{id}", h.AdminGetUser)
+		r.Delete("/users/{id}", h.AdminDeleteUser)
+		r.Post("/users/{id}/suspend", h.AdminSuspendUser)
+		r.Post("/users/{id}/unsuspend", h.AdminUnsuspendUser)
+		r.Post("/users/{id}/ban", h.AdminBanUser)
+		r.Post("/users/{id}/unban", h.AdminUnbanUser)
+		r.Post("/users/{id}/restore", h.AdminRestoreUser)
+		r.Post("/users/{id}/logout", h.AdminLogoutUser)
+		r.Put("/users/{id}/phone", h.AdminChangePhone)
+		r.Post("/users/{id}/notes", h.AdminAddNote)
+		r.Get("/phone-history", h.AdminPhoneHistory)
+	})
+
+	// SCIM 2.0 provisioning, authenticated per tenant
+	r.Route("/scim/v2", func(r chi.Router) {
+		r.Use(h.SCIMAuth)
+		r.Get("/Users", h.SCIMListUsers)
+		r.Post("/Users", h.SCIMCreateUser)
+		r.Get("/Users/{id}", h.SCIMGetUser)
+		r.Patch("/Users/{id}", h.SCIMPatchUser)
+		r.Delete("/Users/{id}", h.SCIMDeleteUser)
+	})
 
 	// Swagger UI routes
 	r.Get("/docs", func(w http.ResponseWriter, r *http.Request) {
@@ -76,6 +226,11 @@ func main() {
 	})
 	r.Get("/docs/*", httpSwagger.WrapHandler)
 
+	// purge accounts whose deletion grace period has passed
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	defer stopPurge()
+	go h.RunPurge(purgeCtx, purgeInterval)
+
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", cfg.Port),
 		Handler:      r,
@@ -101,4 +256,7 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatal().Err(err).Msg("server shutdown failed")
 	}
+	stopPurge()
+	stopEvents()
+	<-eventsDone
 }
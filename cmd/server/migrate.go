@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/example/go-otp-auth/internal/config"
+	"github.com/example/go-otp-auth/internal/migrate"
+	"github.com/example/go-otp-auth/internal/storage"
+	"github.com/example/go-otp-auth/migrations"
+)
+
+func newMigrator(pg *storage.Postgres) *migrate.Runner {
+	ms, err := migrate.Load(migrations.FS)
+	if err != nil {
+		// the files are embedded, so this only happens on a broken build
+		panic(err)
+	}
+	return migrate.New(pg.DB(), migrate.Postgres, ms)
+}
+
+// runMigrate implements "migrate up", "migrate down [n]" and "migrate status"
+func runMigrate(cfg *config.Config, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: migrate up|down [n]|status")
+		return 2
+	}
+
+	pg, err := storage.NewPostgres(cfg.DatabaseURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "connect postgres:", err)
+		return 1
+	}
+	defer pg.Close()
+
+	ctx := context.Background()
+	m := newMigrator(pg)
+
+	switch args[0] {
+	case "up":
+		done, err := m.Up(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "migrate up:", err)
+			return 1
+		}
+		fmt.Printf("applied %d migration(s)\n", len(done))
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				fmt.Fprintln(os.Stderr, "migrate down: n must be a positive integer")
+				return 2
+			}
+			steps = n
+		}
+		done, err := m.Down(ctx, steps)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "migrate down:", err)
+			return 1
+		}
+		fmt.Printf("rolled back %d migration(s)\n", len(done))
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "migrate status:", err)
+			return 1
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d  %-24s  %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command %q\n", args[0])
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
+)
+
+// AccountExport is everything stored about a user, returned by
+// GET /users/me/export
+type AccountExport struct {
+	ExportedAt   time.Time           `json:"exported_at"`
+	User         model.User          `json:"user"`
+	Roles        []string            `json:"roles"`
+	Emails       []model.UserEmail   `json:"emails"`
+	PhoneHistory []model.PhoneChange `json:"phone_history"`
+	Notes        []model.UserNote    `json:"notes"`
+	Sessions     []ExportSession     `json:"sessions"`
+	// TokensRevokedAt ends every session that started before it
+	TokensRevokedAt *time.Time        `json:"tokens_revoked_at,omitempty"`
+	AuthEvents      []model.AuthEvent `json:"auth_events"`
+}
+
+// ExportSession is one successful login. Tokens are not stored, so sessions
+// are taken from the auth event log.
+type ExportSession struct {
+	StartedAt time.Time `json:"started_at"`
+	Method    string    `json:"method" example:"phone"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// DeleteAccount godoc
+// @Summary Delete account
+// @Description Close the authenticated user's account and revoke all of their tokens. The account and its data are purged once the grace period has passed; until then an admin can restore it.
+// @Tags users
+// @Produce json
+// @Success 200 {object} map[string]string "deleted and purge_after"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /users/me [delete]
+func (h *Handler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := storage.WithPrimary(r.Context())
+
+	if err := h.users.SetUserStatus(ctx, userID, model.UserStatusDeleted, ""); err != nil {
+		writeStorageError(w, err, "set user status")
+		return
+	}
+	if err := h.revoker.RevokeUserTokens(ctx, userID, h.issuer(ctx).TTL); err != nil {
+		log.Error().Err(err).Msg("redis revoke tokens")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+
+	purgeAfter := time.Now().UTC().Add(h.gracePeriod()).Format(time.RFC3339)
+	h.recordEvent(r, model.AuthEvent{
+		Type:    model.EventAccountDeleted,
+		UserID:  &userID,
+		Details: map[string]string{"purge_after": purgeAfter},
+	})
+	WriteJSON(w, map[string]string{"status": model.UserStatusDeleted, "purge_after": purgeAfter})
+}
+
+// ExportAccount godoc
+// @Summary Export account data
+// @Description Download everything stored about the authenticated user as one JSON document
+// @Tags users
+// @Produce json
+// @Success 200 {object} AccountExport
+// @Failure 401 {string} string "unauthorized"
+// @Failure 404 {string} string "not found"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /users/me/export [get]
+func (h *Handler) ExportAccount(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+
+	u, err := h.users.GetUserByID(ctx, userID)
+	if err != nil {
+		writeStorageError(w, err, "get user")
+		return
+	}
+	exp := AccountExport{ExportedAt: time.Now().UTC(), User: *u}
+	if exp.Roles, _, err = h.users.GetUserAccess(ctx, userID); err != nil {
+		writeStorageError(w, err, "get user access")
+		return
+	}
+	if exp.Emails, err = h.users.ListUserEmails(ctx, userID); err != nil {
+		writeStorageError(w, err, "list user emails")
+		return
+	}
+	if exp.PhoneHistory, err = h.users.ListPhoneHistory(ctx, storage.PhoneHistoryFilter{UserID: userID}); err != nil {
+		writeStorageError(w, err, "list phone history")
+		return
+	}
+	if exp.Notes, err = h.users.ListUserNotes(ctx, userID); err != nil {
+		writeStorageError(w, err, "list user notes")
+		return
+	}
+	if exp.AuthEvents, err = h.events.ListUserAuthEvents(ctx, userID); err != nil {
+		writeStorageError(w, err, "list auth events")
+		return
+	}
+	exp.Sessions = sessionsFromEvents(exp.AuthEvents)
+
+	revokedAt, err := h.revoker.TokensRevokedAt(ctx, userID)
+	if err != nil {
+		log.Error().Err(err).Msg("redis tokens revoked at")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	if !revokedAt.IsZero() {
+		exp.TokensRevokedAt = &revokedAt
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="account-%s.json"`, u.PublicID))
+	WriteJSON(w, exp)
+}
+
+// sessionsFromEvents picks the successful logins out of a user's events.
+// Refused logins carry a result detail.
+func sessionsFromEvents(events []model.AuthEvent) []ExportSession {
+	sessions := []ExportSession{}
+	for _, e := range events {
+		if e.Type != model.EventOTPVerified || e.Details["result"] != "" {
+			continue
+		}
+		method := e.Details["method"]
+		if method == "" {
+			method = "phone"
+		}
+		sessions = append(sessions, ExportSession{
+			StartedAt: e.CreatedAt,
+			Method:    method,
+			IP:        e.IP,
+			UserAgent: e.UserAgent,
+		})
+	}
+	return sessions
+}
+
+func (h *Handler) gracePeriod() time.Duration {
+	return time.Duration(h.cfg.DeletionGraceDays) * 24 * time.Hour
+}
+
+// PurgeDeletedUsers permanently removes the accounts whose grace period has
+// passed, along with their pending codes, rate limit counters and token
+// revocation. Auth events and phone history are kept with the phone numbers
+// redacted. It returns the number of users purged.
+func (h *Handler) PurgeDeletedUsers(ctx context.Context) (int, error) {
+	ctx = storage.WithPrimary(ctx)
+	users, err := h.users.ListDeletedUsers(ctx, time.Now().Add(-h.gracePeriod()))
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, u := range users {
+		ok, err := h.purgeUser(ctx, u)
+		if err != nil {
+			return purged, fmt.Errorf("purge user %d: %w", u.ID, err)
+		}
+		if ok {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// purgeUser clears the user's keys before the row, so a failure is retried
+// on the next run. It reports false if another instance purged it first.
+func (h *Handler) purgeUser(ctx context.Context, u model.User) (bool, error) {
+	emails, err := h.users.ListUserEmails(ctx, u.ID)
+	if err != nil {
+		return false, err
+	}
+	subjects := []string{u.Phone}
+	for _, e := range emails {
+		subjects = append(subjects, emailLoginKey(e.Email))
+	}
+	keys := []string{phoneChangeOldKey(u.ID)}
+	for _, s := range subjects {
+		keys = append(keys, s, "verify:"+s)
+	}
+	for _, k := range keys {
+		k = scopedKey(u.TenantID, k)
+		if err := h.otps.DeleteOTP(ctx, k); err != nil {
+			return false, err
+		}
+		if err := h.limiter.ResetOTPRequests(ctx, k); err != nil {
+			return false, err
+		}
+	}
+	if err := h.revoker.ClearRevocation(ctx, u.ID); err != nil {
+		return false, err
+	}
+	history, err := h.users.ListPhoneHistory(storage.WithTenant(ctx, u.TenantID), storage.PhoneHistoryFilter{UserID: u.ID})
+	if err != nil {
+		return false, err
+	}
+	// numbers the user held, unless a failed purge already redacted them
+	phones := []string{u.Phone}
+	for _, c := range history {
+		for _, phone := range []string{c.OldPhone, c.NewPhone} {
+			if phone != "" && !slices.Contains(phones, phone) {
+				phones = append(phones, phone)
+			}
+		}
+	}
+	if _, err := h.events.RedactUserAuthEvents(ctx, u.ID, phones); err != nil {
+		return false, err
+	}
+	if err := h.users.RedactPhoneHistory(ctx, u.ID); err != nil {
+		return false, err
+	}
+
+	if err := h.users.DeleteUser(ctx, u.ID); errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	e := model.AuthEvent{Type: model.EventAccountPurged, UserID: &u.ID}
+	if err := h.events.RecordAuthEvent(ctx, &e); err != nil {
+		log.Error().Err(err).Str("event", e.Type).Msg("record auth event")
+	}
+	return true, nil
+}
+
+// RunPurge calls PurgeDeletedUsers every interval until ctx is done
+func (h *Handler) RunPurge(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		n, err := h.PurgeDeletedUsers(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("purge deleted users")
+		} else if n > 0 {
+			log.Info().Int("users", n).Msg("purged deleted users")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
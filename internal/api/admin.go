@@ -0,0 +1,488 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
+	"github.com/example/go-otp-auth/internal/util"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// Admin audit actions
+const (
+	actionSuspend     = "suspend"
+	actionUnsuspend   = "unsuspend"
+	actionBan         = "ban"
+	actionUnban       = "unban"
+	actionRestore     = "restore"
+	actionForceLogout = "force_logout"
+	actionChangePhone = "change_phone"
+	actionDelete      = "delete"
+	actionAddNote     = "add_note"
+)
+
+type reqSuspend struct {
+	Reason string `json:"reason"`
+}
+
+type reqNote struct {
+	Body string `json:"body"`
+}
+
+// AdminGetUser godoc
+// @Summary Get user (admin)
+// @Description Retrieve a user with roles and admin notes
+// @Tags admin
+// @Produce json
+// @Param id path string true "Public user ID"
+// @Success 200 {object} AdminUserResponse
+// @Failure 400 {string} string "invalid user id"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "not found"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /admin/users/{id} [get]
+func (h *Handler) AdminGetUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.userIDParam(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	u, err := h.users.GetUserByID(ctx, id)
+	if err != nil {
+		writeStorageError(w, err, "get user")
+		return
+	}
+	roles, _, err := h.users.GetUserAccess(ctx, id)
+	if err != nil {
+		writeStorageError(w, err, "get user access")
+		return
+	}
+	notes, err := h.users.ListUserNotes(ctx, id)
+	if err != nil {
+		writeStorageError(w, err, "list user notes")
+		return
+	}
+	phones, err := h.users.ListPhoneHistory(ctx, storage.PhoneHistoryFilter{UserID: id})
+	if err != nil {
+		writeStorageError(w, err, "list phone history")
+		return
+	}
+
+	WriteJSON(w, AdminUserResponse{User: *u, Roles: roles, Notes: notes, PhoneHistory: phones})
+}
+
+// AdminPhoneHistory godoc
+// @Summary Phone number history (admin)
+// @Description List phone number changes, newest first. Filter by user or by a number that was moved to or away from.
+// @Tags admin
+// @Produce json
+// @Param user_id query string false "Public user ID"
+// @Param phone query string false "Old or new phone number"
+// @Success 200 {array} model.PhoneChange
+// @Failure 400 {string} string "invalid user id or phone"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "not found"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /admin/phone-history [get]
+func (h *Handler) AdminPhoneHistory(w http.ResponseWriter, r *http.Request) {
+	var filter storage.PhoneHistoryFilter
+	if v := r.URL.Query().Get("phone"); v != "" {
+		phone, ok := util.NormalizePhone(v)
+		if !ok {
+			http.Error(w, "invalid phone", http.StatusBadRequest)
+			return
+		}
+		filter.Phone = phone
+	}
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		id, ok := h.resolveUserID(w, r, v)
+		if !ok {
+			return
+		}
+		filter.UserID = id
+	}
+	changes, err := h.users.ListPhoneHistory(r.Context(), filter)
+	if err != nil {
+		writeStorageError(w, err, "list phone history")
+		return
+	}
+	WriteJSON(w, changes)
+}
+
+// AdminSuspendUser godoc
+// @Summary Suspend user (admin)
+// @Description Temporarily suspend a user and revoke all of their tokens
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Public user ID"
+// @Param request body reqSuspend false "Reason shown to the user"
+// @Success 200 {object} map[string]string "suspended"
+// @Failure 400 {string} string "invalid request"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "not found"
+// @Failure 409 {string} string "user is not active"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /admin/users/{id}/suspend [post]
+func (h *Handler) AdminSuspendUser(w http.ResponseWriter, r *http.Request) {
+	// only active users; a suspension must never replace a ban or a deletion
+	h.changeUserStatus(w, r, []string{model.UserStatusActive}, model.UserStatusSuspended, actionSuspend)
+}
+
+// AdminUnsuspendUser godoc
+// @Summary Unsuspend user (admin)
+// @Description Reactivate a suspended user
+// @Tags admin
+// @Produce json
+// @Param id path string true "Public user ID"
+// @Success 200 {object} map[string]string "active"
+// @Failure 400 {string} string "invalid user id"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "not found"
+// @Failure 409 {string} string "user is not in the expected status"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /admin/users/{id}/unsuspend [post]
+func (h *Handler) AdminUnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	h.changeUserStatus(w, r, []string{model.UserStatusSuspended}, model.UserStatusActive, actionUnsuspend)
+}
+
+// AdminBanUser godoc
+// @Summary Ban user (admin)
+// @Description Permanently ban a user and revoke all of their tokens
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Public user ID"
+// @Param request body reqSuspend false "Reason shown to the user"
+// @Success 200 {object} map[string]string "banned"
+// @Failure 400 {string} string "invalid request"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "not found"
+// @Failure 409 {string} string "user is not in the expected status"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /admin/users/{id}/ban [post]
+func (h *Handler) AdminBanUser(w http.ResponseWriter, r *http.Request) {
+	// a deleted user is waiting to be purged, banning would cancel it
+	h.changeUserStatus(w, r, []string{model.UserStatusActive, model.UserStatusSuspended}, model.UserStatusBanned, actionBan)
+}
+
+// AdminUnbanUser godoc
+// @Summary Unban user (admin)
+// @Description Lift a ban and reactivate the user
+// @Tags admin
+// @Produce json
+// @Param id path string true "Public user ID"
+// @Success 200 {object} map[string]string "active"
+// @Failure 400 {string} string "invalid user id"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "not found"
+// @Failure 409 {string} string "user is not in the expected status"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /admin/users/{id}/unban [post]
+func (h *Handler) AdminUnbanUser(w http.ResponseWriter, r *http.Request) {
+	h.changeUserStatus(w, r, []string{model.UserStatusBanned}, model.UserStatusActive, actionUnban)
+}
+
+// AdminRestoreUser godoc
+// @Summary Restore user (admin)
+// @Description Reactivate a deleted user whose data has not been purged yet
+// @Tags admin
+// @Produce json
+// @Param id path string true "Public user ID"
+// @Success 200 {object} map[string]string "active"
+// @Failure 400 {string} string "invalid user id"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "not found"
+// @Failure 409 {string} string "user is not in the expected status"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /admin/users/{id}/restore [post]
+func (h *Handler) AdminRestoreUser(w http.ResponseWriter, r *http.Request) {
+	h.changeUserStatus(w, r, []string{model.UserStatusDeleted}, model.UserStatusActive, actionRestore)
+}
+
+// changeUserStatus moves a user currently in one of the statuses from to
+// status, revoking their tokens unless the user is being reactivated
+func (h *Handler) changeUserStatus(w http.ResponseWriter, r *http.Request, from []string, status, action string) {
+	id, ok := h.userIDParam(w, r)
+	if !ok {
+		return
+	}
+	var req reqSuspend
+	if status != model.UserStatusActive {
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+		if !h.notSelf(w, r, id) {
+			return
+		}
+	}
+	ctx := r.Context()
+
+	err := h.users.ChangeUserStatus(ctx, id, from, status, req.Reason)
+	if errors.Is(err, storage.ErrConflict) {
+		http.Error(w, "user is not "+strings.Join(from, " or "), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err, "set user status")
+		return
+	}
+	if status != model.UserStatusActive {
+		if err := h.revoker.RevokeUserTokens(ctx, id, h.issuer(ctx).TTL); err != nil {
+			log.Error().Err(err).Msg("redis revoke tokens")
+			http.Error(w, "internal", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var details map[string]string
+	if req.Reason != "" {
+		details = map[string]string{"reason": req.Reason}
+	}
+	h.audit(r, action, id, details)
+	WriteJSON(w, map[string]string{"status": status})
+}
+
+// AdminLogoutUser godoc
+// @Summary Force logout (admin)
+// @Description Revoke every token issued to the user so far
+// @Tags admin
+// @Produce json
+// @Param id path string true "Public user ID"
+// @Success 200 {object} map[string]string "logged_out"
+// @Failure 400 {string} string "invalid user id"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "not found"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /admin/users/{id}/logout [post]
+func (h *Handler) AdminLogoutUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.userIDParam(w, r)
+	if !ok {
+		return
+	}
+	ctx := storage.WithPrimary(r.Context())
+
+	if _, err := h.users.GetUserByID(ctx, id); err != nil {
+		writeStorageError(w, err, "get user")
+		return
+	}
+	if err := h.revoker.RevokeUserTokens(ctx, id, h.issuer(ctx).TTL); err != nil {
+		log.Error().Err(err).Msg("redis revoke tokens")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, actionForceLogout, id, nil)
+	WriteJSON(w, map[string]string{"status": "logged_out"})
+}
+
+// AdminChangePhone godoc
+// @Summary Change phone (admin)
+// @Description Move a user to a new phone number and revoke their tokens
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Public user ID"
+// @Param request body reqPhone true "New phone number"
+// @Success 200 {object} UserResponse
+// @Failure 400 {string} string "invalid request or phone"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "not found"
+// @Failure 409 {string} string "phone already in use"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /admin/users/{id}/phone [put]
+func (h *Handler) AdminChangePhone(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.userIDParam(w, r)
+	if !ok {
+		return
+	}
+	var req reqPhone
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Phone == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	phone, ok := util.NormalizePhone(req.Phone)
+	if !ok {
+		http.Error(w, "invalid phone", http.StatusBadRequest)
+		return
+	}
+	req.Phone = phone
+	ctx := storage.WithPrimary(r.Context())
+
+	adminID, _ := GetUserIDFromContext(r)
+	u, err := h.users.UpdateUserPhone(ctx, id, req.Phone, adminID)
+	if errors.Is(err, storage.ErrConflict) {
+		http.Error(w, "phone already in use", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err, "update user phone")
+		return
+	}
+	if err := h.revoker.RevokeUserTokens(ctx, id, h.issuer(ctx).TTL); err != nil {
+		log.Error().Err(err).Msg("redis revoke tokens")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, actionChangePhone, id, nil)
+	WriteJSON(w, u)
+}
+
+// AdminDeleteUser godoc
+// @Summary Delete user (admin)
+// @Description Permanently delete a user and revoke their tokens
+// @Tags admin
+// @Param id path string true "Public user ID"
+// @Success 204
+// @Failure 400 {string} string "invalid user id"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "not found"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /admin/users/{id} [delete]
+func (h *Handler) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.userIDParam(w, r)
+	if !ok {
+		return
+	}
+	if !h.notSelf(w, r, id) {
+		return
+	}
+	ctx := storage.WithPrimary(r.Context())
+
+	if err := h.users.DeleteUser(ctx, id); err != nil {
+		writeStorageError(w, err, "delete user")
+		return
+	}
+	if err := h.revoker.RevokeUserTokens(ctx, id, h.issuer(ctx).TTL); err != nil {
+		log.Error().Err(err).Msg("redis revoke tokens")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+
+	h.audit(r, actionDelete, id, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminAddNote godoc
+// @Summary Add note (admin)
+// @Description Attach a free-form note to a user
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param id path string true "Public user ID"
+// @Param request body reqNote true "Note"
+// @Success 201 {object} model.UserNote
+// @Failure 400 {string} string "invalid request"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 403 {string} string "forbidden"
+// @Failure 404 {string} string "not found"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /admin/users/{id}/notes [post]
+func (h *Handler) AdminAddNote(w http.ResponseWriter, r *http.Request) {
+	id, ok := h.userIDParam(w, r)
+	if !ok {
+		return
+	}
+	var req reqNote
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Body == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	ctx := storage.WithPrimary(r.Context())
+	adminID, _ := GetUserIDFromContext(r)
+
+	if _, err := h.users.GetUserByID(ctx, id); err != nil {
+		writeStorageError(w, err, "get user")
+		return
+	}
+	n, err := h.users.AddUserNote(ctx, id, adminID, req.Body)
+	if err != nil {
+		writeStorageError(w, err, "add user note")
+		return
+	}
+
+	h.audit(r, actionAddNote, id, map[string]string{"note_id": strconv.FormatInt(n.ID, 10)})
+	WriteJSONStatus(w, http.StatusCreated, n)
+}
+
+// audit records an admin action in the auth event log. Failures are logged
+// but do not fail the request since the action itself has already been
+// applied.
+func (h *Handler) audit(r *http.Request, action string, targetID int64, details map[string]string) {
+	actorID, _ := GetUserIDFromContext(r)
+	h.recordEvent(r, model.AuthEvent{
+		Type:    model.EventAdminPrefix + action,
+		UserID:  &targetID,
+		ActorID: &actorID,
+		Details: details,
+	})
+}
+
+// notSelf stops admins from suspending or deleting their own account
+func (h *Handler) notSelf(w http.ResponseWriter, r *http.Request, id int64) bool {
+	if actorID, _ := GetUserIDFromContext(r); actorID == id {
+		http.Error(w, "cannot apply to own account", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// userIDParam resolves the public user id in the route to the internal one
+func (h *Handler) userIDParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	return h.resolveUserID(w, r, chi.URLParam(r, "id"))
+}
+
+func (h *Handler) resolveUserID(w http.ResponseWriter, r *http.Request, publicID string) (int64, bool) {
+	if _, err := uuid.Parse(publicID); err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return 0, false
+	}
+	id, err := h.users.ResolvePublicID(r.Context(), publicID)
+	if err != nil {
+		writeStorageError(w, err, "resolve public id")
+		return 0, false
+	}
+	return id, true
+}
+
+func writeStorageError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	log.Error().Err(err).Msg(msg)
+	http.Error(w, "internal", http.StatusInternalServerError)
+}
@@ -3,9 +3,9 @@ package api
 import (
 	"encoding/json"
 	"net/http"
-	"time"
 
-	"github.com/example/go-otp-auth/internal/auth"
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
 	"github.com/example/go-otp-auth/internal/util"
 	"github.com/rs/zerolog/log"
 )
@@ -26,8 +26,9 @@ type reqVerify struct {
 // @Accept json
 // @Produce json
 // @Param request body reqPhone true "Phone Number"
+// @Param X-Client-Key header string false "Client app key, required with OTP_REQUIRE_CLIENT_KEY"
 // @Success 200 {object} map[string]string "otp_generated"
-// @Failure 400 {string} string "invalid request"
+// @Failure 400 {string} string "invalid request or phone"
 // @Failure 429 {string} string "rate limit exceeded"
 // @Failure 500 {string} string "internal"
 // @Router /otp/request [post]
@@ -37,32 +38,39 @@ func (h *Handler) RequestOTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
+	phone, ok := util.NormalizePhone(req.Phone)
+	if !ok {
+		http.Error(w, "invalid phone", http.StatusBadRequest)
+		return
+	}
+	req.Phone = phone
 
 	ctx := r.Context()
-	allowed, err := h.rd.AllowOTPRequest(ctx, req.Phone, h.cfg.RateLimitMax, time.Duration(h.cfg.RateLimitWindowSeconds)*time.Second)
+	limit, err := h.checkLimits(ctx, h.requestLimits(r, req.Phone))
 	if err != nil {
 		log.Error().Err(err).Msg("redis error")
 		http.Error(w, "internal", http.StatusInternalServerError)
 		return
 	}
-	if !allowed {
+	if limit != "" {
+		h.recordEvent(r, model.AuthEvent{
+			Type:    model.EventOTPRequested,
+			Phone:   req.Phone,
+			Details: map[string]string{"result": "rate_limited", "limit": limit},
+		})
 		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
 		return
 	}
 
-	otp, err := util.GenerateOTP()
+	otp, message, err := h.issueOTP(ctx, req.Phone)
 	if err != nil {
-		http.Error(w, "failed to generate otp", http.StatusInternalServerError)
-		return
-	}
-
-	if err := h.rd.SaveOTP(ctx, req.Phone, otp, time.Duration(h.cfg.OTPTTLSeconds)*time.Second); err != nil {
 		log.Error().Err(err).Msg("redis save otp")
 		http.Error(w, "internal", http.StatusInternalServerError)
 		return
 	}
 
-	log.Info().Str("phone", req.Phone).Str("otp", otp).Msg("generated otp")
+	h.recordEvent(r, model.AuthEvent{Type: model.EventOTPRequested, Phone: req.Phone})
+	log.Info().Str("phone", req.Phone).Str("otp", otp).Str("message", message).Msg("generated otp")
 	WriteJSON(w, map[string]string{"status": "otp_generated"})
 }
 
@@ -73,9 +81,12 @@ func (h *Handler) RequestOTP(w http.ResponseWriter, r *http.Request) {
 // @Accept json
 // @Produce json
 // @Param request body reqVerify true "Phone and OTP"
-// @Success 200 {object} map[string]interface{} "token and user"
-// @Failure 400 {string} string "invalid request"
+// @Param X-Client-Key header string false "Client app key, required with OTP_REQUIRE_CLIENT_KEY"
+// @Success 200 {object} VerifyOTPResponse
+// @Failure 400 {string} string "invalid request or phone"
 // @Failure 401 {string} string "invalid or expired otp"
+// @Failure 403 {object} AccountStatusError "account not active"
+// @Failure 429 {string} string "rate limit exceeded"
 // @Failure 500 {string} string "internal"
 // @Router /otp/verify [post]
 func (h *Handler) VerifyOTP(w http.ResponseWriter, r *http.Request) {
@@ -84,36 +95,101 @@ func (h *Handler) VerifyOTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
+	phone, ok := util.NormalizePhone(req.Phone)
+	if !ok {
+		http.Error(w, "invalid phone", http.StatusBadRequest)
+		return
+	}
+	req.Phone = phone
 
-	ctx := r.Context()
-	ok, err := h.rd.VerifyAndDeleteOTP(ctx, req.Phone, req.OTP)
+	limit, err := h.checkLimits(r.Context(), h.verifyLimits(r, req.Phone))
+	if err != nil {
+		log.Error().Err(err).Msg("redis error")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	if limit != "" {
+		h.recordEvent(r, model.AuthEvent{
+			Type:    model.EventOTPFailed,
+			Phone:   req.Phone,
+			Details: map[string]string{"result": "rate_limited", "limit": limit},
+		})
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	// the user may have been created by this request; read it back from the primary
+	ctx := storage.WithPrimary(r.Context())
+	ok, err = h.verifyOTP(ctx, req.Phone, req.OTP)
 	if err != nil {
 		log.Error().Err(err).Msg("redis verify otp")
 		http.Error(w, "internal", http.StatusInternalServerError)
 		return
 	}
 	if !ok {
+		h.recordEvent(r, model.AuthEvent{Type: model.EventOTPFailed, Phone: req.Phone})
 		http.Error(w, "invalid or expired otp", http.StatusUnauthorized)
 		return
 	}
 
-	user, err := h.pg.FindUserByPhone(ctx, req.Phone)
+	user, created, err := h.users.FindOrCreateUser(ctx, req.Phone)
 	if err != nil {
-		u, cerr := h.pg.CreateUser(ctx, req.Phone)
-		if cerr != nil {
-			log.Error().Err(cerr).Msg("create user")
-			http.Error(w, "internal", http.StatusInternalServerError)
-			return
+		log.Error().Err(err).Msg("find or create user")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	if created {
+		h.recordEvent(r, model.AuthEvent{Type: model.EventUserCreated, UserID: &user.ID, Phone: user.Phone})
+	}
+
+	h.completeLogin(w, r, user, created, nil)
+}
+
+// completeLogin issues a token to a user who has just proven ownership of a
+// phone number or email. details are added to the otp_verified event.
+func (h *Handler) completeLogin(w http.ResponseWriter, r *http.Request, user *model.User, created bool, details map[string]string) {
+	ctx := storage.WithPrimary(r.Context())
+
+	if user.Status != model.UserStatusActive {
+		refused := map[string]string{"result": "account_" + user.Status}
+		for k, v := range details {
+			refused[k] = v
 		}
+		h.recordEvent(r, model.AuthEvent{Type: model.EventOTPVerified, UserID: &user.ID, Phone: user.Phone, Details: refused})
+		writeAccountStatusError(w, user.Status, user.StatusReason)
+		return
+	}
+
+	// login statistics must not block the login itself
+	if u, err := h.users.RecordLogin(ctx, user.ID); err != nil {
+		log.Error().Err(err).Int64("user_id", user.ID).Msg("record login")
+	} else {
 		user = u
 	}
 
-	tok, err := auth.CreateToken(user.ID)
+	roles, scopes, err := h.users.GetUserAccess(ctx, user.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("get user access")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+
+	tok, err := h.issuer(ctx).CreateToken(user.PublicID, roles, scopes)
 	if err != nil {
 		log.Error().Err(err).Msg("create token")
 		http.Error(w, "internal", http.StatusInternalServerError)
 		return
 	}
 
-	WriteJSON(w, map[string]interface{}{"token": tok, "user": user})
+	h.recordEvent(r, model.AuthEvent{Type: model.EventOTPVerified, UserID: &user.ID, Phone: user.Phone, Details: details})
+	WriteJSON(w, VerifyOTPResponse{Token: tok, User: user, IsNewUser: created})
+}
+
+// writeAccountStatusError refuses access to a user that is not active.
+// The error code is account_<status>, e.g. account_suspended.
+func writeAccountStatusError(w http.ResponseWriter, status, reason string) {
+	WriteJSONStatus(w, http.StatusForbidden, AccountStatusError{
+		Error:  "account_" + status,
+		Reason: reason,
+	})
 }
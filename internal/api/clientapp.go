@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// ClientKeyHeader carries the API key of the client app calling the OTP
+// endpoints
+const ClientKeyHeader = "X-Client-Key"
+
+const clientAppKey contextKey = "clientApp"
+
+// ClientAppMiddleware authenticates the client app calling an OTP endpoint.
+// Without a key the request passes unless OTP_REQUIRE_CLIENT_KEY is set. A
+// key must be live, belong to the request's tenant, come from one of its
+// allowed origins and stay within its own rate limit.
+func (h *Handler) ClientAppMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(ClientKeyHeader)
+		if key == "" {
+			if h.cfg.OTPRequireClientKey {
+				http.Error(w, "client key required", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		app, err := h.apps.ClientAppByKey(ctx, storage.HashClientAppKey(key))
+		if err == nil && (app.RevokedAt != nil || app.TenantID != tenant(ctx).ID) {
+			err = storage.ErrNotFound
+		}
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "invalid client key", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("client app by key")
+			http.Error(w, "internal", http.StatusInternalServerError)
+			return
+		}
+		if !app.AllowsOrigin(r.Header.Get("Origin")) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		if app.RateLimitMax != nil && app.RateLimitWindowSec != nil {
+			allowed, err := h.limiter.AllowOTPRequest(ctx, fmt.Sprintf("client:%d", app.ID), storage.RateLimit{
+				Algorithm: h.cfg.ClientRateLimitAlgorithm,
+				Max:       *app.RateLimitMax,
+				Window:    time.Duration(*app.RateLimitWindowSec) * time.Second,
+			})
+			if err != nil {
+				log.Error().Err(err).Msg("redis error")
+				http.Error(w, "internal", http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+		}
+		// usage statistics must not block the request
+		if err := h.apps.TouchClientApp(ctx, app.ID); err != nil {
+			log.Error().Err(err).Int64("client_app", app.ID).Msg("touch client app")
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, clientAppKey, app)))
+	})
+}
+
+// clientApp returns the client app that authenticated the request, if any
+func clientApp(ctx context.Context) *model.ClientApp {
+	app, _ := ctx.Value(clientAppKey).(*model.ClientApp)
+	return app
+}
@@ -0,0 +1,385 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
+)
+
+type reqEmail struct {
+	Email string `json:"email"`
+}
+
+type reqVerifyEmail struct {
+	Email string `json:"email"`
+	OTP   string `json:"otp"`
+}
+
+// Email codes share the OTP and rate limit stores with phone numbers; the
+// keys are prefixed so they can never collide with a phone number.
+func emailLoginKey(email string) string { return "email:" + email }
+
+// the attach code is bound to the user who asked for it
+func emailAttachKey(userID int64, email string) string {
+	return fmt.Sprintf("email-attach:%d:%s", userID, email)
+}
+
+// normalizeEmail validates a bare address and lowercases it
+func normalizeEmail(email string) (string, bool) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || len(email) > maxEmailLen {
+		return "", false
+	}
+	return strings.ToLower(email), true
+}
+
+// sendEmailOTP generates a code for key and "sends" it. Like phone codes it
+// is only logged; a link is included when EMAIL_LINK_BASE_URL is set.
+func (h *Handler) sendEmailOTP(r *http.Request, key, email string) error {
+	otp, message, err := h.issueOTP(r.Context(), key)
+	if err != nil {
+		return err
+	}
+	ev := log.Info().Str("email", email).Str("otp", otp).Str("message", message)
+	if h.cfg.EmailLinkBaseURL != "" {
+		ev = ev.Str("link", h.cfg.EmailLinkBaseURL+"?"+url.Values{"email": {email}, "otp": {otp}}.Encode())
+	}
+	ev.Msg("generated email otp")
+	return nil
+}
+
+// RequestEmailOTP godoc
+// @Summary Request email login code
+// @Description Send a one-time code (and a login link, if configured) to a verified email. The response is the same whether or not the address belongs to a user.
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param request body reqEmail true "Email address"
+// @Param X-Client-Key header string false "Client app key, required with OTP_REQUIRE_CLIENT_KEY"
+// @Success 200 {object} map[string]string "otp_generated"
+// @Failure 400 {string} string "invalid request"
+// @Failure 429 {string} string "rate limit exceeded"
+// @Failure 500 {string} string "internal"
+// @Router /otp/email/request [post]
+func (h *Handler) RequestEmailOTP(w http.ResponseWriter, r *http.Request) {
+	var req reqEmail
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	limit, err := h.checkLimits(r.Context(), h.requestLimits(r, emailLoginKey(email)))
+	if err != nil {
+		log.Error().Err(err).Msg("redis error")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	if limit != "" {
+		h.recordEvent(r, model.AuthEvent{
+			Type:    model.EventOTPRequested,
+			Details: map[string]string{"email": email, "result": "rate_limited", "limit": limit},
+		})
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	// only verified addresses get a code, but the caller cannot tell
+	user, err := h.users.FindUserByEmail(r.Context(), email)
+	if errors.Is(err, storage.ErrNotFound) {
+		WriteJSON(w, map[string]string{"status": "otp_generated"})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("find user by email")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	if err := h.sendEmailOTP(r, emailLoginKey(email), email); err != nil {
+		log.Error().Err(err).Msg("save email otp")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+
+	h.recordEvent(r, model.AuthEvent{Type: model.EventOTPRequested, UserID: &user.ID, Details: map[string]string{"email": email}})
+	WriteJSON(w, map[string]string{"status": "otp_generated"})
+}
+
+// VerifyEmailOTP godoc
+// @Summary Verify email login code
+// @Description Log in with a code sent to a verified email. The code from the login link is accepted the same way.
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param request body reqVerifyEmail true "Email and OTP"
+// @Param X-Client-Key header string false "Client app key, required with OTP_REQUIRE_CLIENT_KEY"
+// @Success 200 {object} VerifyOTPResponse
+// @Failure 400 {string} string "invalid request"
+// @Failure 401 {string} string "invalid or expired otp"
+// @Failure 403 {object} AccountStatusError "account not active"
+// @Failure 429 {string} string "rate limit exceeded"
+// @Failure 500 {string} string "internal"
+// @Router /otp/email/verify [post]
+func (h *Handler) VerifyEmailOTP(w http.ResponseWriter, r *http.Request) {
+	var req reqVerifyEmail
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OTP == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := h.checkLimits(r.Context(), h.verifyLimits(r, emailLoginKey(email)))
+	if err != nil {
+		log.Error().Err(err).Msg("redis error")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	if limit != "" {
+		h.recordEvent(r, model.AuthEvent{
+			Type:    model.EventOTPFailed,
+			Details: map[string]string{"email": email, "result": "rate_limited", "limit": limit},
+		})
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	ctx := storage.WithPrimary(r.Context())
+	ok, err = h.verifyOTP(ctx, emailLoginKey(email), req.OTP)
+	if err != nil {
+		log.Error().Err(err).Msg("redis verify otp")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		h.recordEvent(r, model.AuthEvent{Type: model.EventOTPFailed, Details: map[string]string{"email": email}})
+		http.Error(w, "invalid or expired otp", http.StatusUnauthorized)
+		return
+	}
+
+	// the address may have been detached since the code was sent
+	user, err := h.users.FindUserByEmail(ctx, email)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "invalid or expired otp", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("find user by email")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+
+	h.completeLogin(w, r, user, false, map[string]string{"method": "email", "email": email})
+}
+
+// ListEmails godoc
+// @Summary List verified emails
+// @Description List the verified email addresses of the authenticated user
+// @Tags users
+// @Produce json
+// @Success 200 {array} model.UserEmail
+// @Failure 401 {string} string "unauthorized"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /users/me/emails [get]
+func (h *Handler) ListEmails(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	emails, err := h.users.ListUserEmails(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, err, "list user emails")
+		return
+	}
+	WriteJSON(w, emails)
+}
+
+// AddEmail godoc
+// @Summary Add email
+// @Description Send a verification code to an email address the authenticated user wants to log in with
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param request body reqEmail true "Email address"
+// @Success 200 {object} map[string]string "otp_generated"
+// @Failure 400 {string} string "invalid request"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 409 {string} string "email already in use"
+// @Failure 429 {string} string "rate limit exceeded"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /users/me/emails [post]
+func (h *Handler) AddEmail(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req reqEmail
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	owner, err := h.users.FindUserByEmail(r.Context(), email)
+	if err == nil && owner.ID != userID {
+		http.Error(w, "email already in use", http.StatusConflict)
+		return
+	}
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Error().Err(err).Msg("find user by email")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	// the address draws on the same budget as login codes sent to it
+	limit, err := h.checkLimits(r.Context(), h.requestLimits(r, emailLoginKey(email)))
+	if err != nil {
+		log.Error().Err(err).Msg("redis error")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	if limit != "" {
+		h.recordEvent(r, model.AuthEvent{
+			Type:    model.EventOTPRequested,
+			UserID:  &userID,
+			Details: map[string]string{"email": email, "flow": "email_attach", "result": "rate_limited", "limit": limit},
+		})
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+	if err := h.sendEmailOTP(r, emailAttachKey(userID, email), email); err != nil {
+		log.Error().Err(err).Msg("save email otp")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	WriteJSON(w, map[string]string{"status": "otp_generated"})
+}
+
+// VerifyEmail godoc
+// @Summary Verify email
+// @Description Confirm an email address with the code sent by AddEmail and attach it to the authenticated user
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param request body reqVerifyEmail true "Email and OTP"
+// @Success 201 {object} model.UserEmail
+// @Failure 400 {string} string "invalid request"
+// @Failure 401 {string} string "invalid or expired otp"
+// @Failure 409 {string} string "email already in use"
+// @Failure 429 {string} string "rate limit exceeded"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /users/me/emails/verify [post]
+func (h *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req reqVerifyEmail
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OTP == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	key := emailAttachKey(userID, email)
+
+	limit, err := h.checkLimits(ctx, h.verifyLimits(r, key))
+	if err != nil {
+		log.Error().Err(err).Msg("redis error")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	if limit != "" {
+		h.recordEvent(r, model.AuthEvent{
+			Type:    model.EventOTPFailed,
+			UserID:  &userID,
+			Details: map[string]string{"email": email, "flow": "email_attach", "result": "rate_limited", "limit": limit},
+		})
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	ok, err = h.verifyOTP(ctx, key, req.OTP)
+	if err != nil {
+		log.Error().Err(err).Msg("redis verify otp")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "invalid or expired otp", http.StatusUnauthorized)
+		return
+	}
+
+	e, err := h.users.AddUserEmail(ctx, userID, email)
+	if errors.Is(err, storage.ErrConflict) {
+		http.Error(w, "email already in use", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err, "add user email")
+		return
+	}
+
+	h.recordEvent(r, model.AuthEvent{Type: model.EventEmailAdded, UserID: &userID, Details: map[string]string{"email": email}})
+	WriteJSONStatus(w, http.StatusCreated, e)
+}
+
+// RemoveEmail godoc
+// @Summary Remove email
+// @Description Detach a verified email from the authenticated user
+// @Tags users
+// @Param email path string true "Email address"
+// @Success 204
+// @Failure 401 {string} string "unauthorized"
+// @Failure 404 {string} string "not found"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /users/me/emails/{email} [delete]
+func (h *Handler) RemoveEmail(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	email, ok := normalizeEmail(chi.URLParam(r, "email"))
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err := h.users.DeleteUserEmail(r.Context(), userID, email); err != nil {
+		writeStorageError(w, err, "delete user email")
+		return
+	}
+	h.recordEvent(r, model.AuthEvent{Type: model.EventEmailRemoved, UserID: &userID, Details: map[string]string{"email": email}})
+	w.WriteHeader(http.StatusNoContent)
+}
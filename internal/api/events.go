@@ -0,0 +1,27 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog/log"
+)
+
+// recordEvent appends an event to the auth log, filling in the request
+// metadata. Failures are logged but never fail the request.
+func (h *Handler) recordEvent(r *http.Request, e model.AuthEvent) {
+	e.IP = h.clientIP(r)
+	e.UserAgent = r.UserAgent()
+	e.RequestID = middleware.GetReqID(r.Context())
+	if app := clientApp(r.Context()); app != nil {
+		details := map[string]string{"client_app": app.KeyPrefix}
+		for k, v := range e.Details {
+			details[k] = v
+		}
+		e.Details = details
+	}
+	if err := h.events.RecordAuthEvent(r.Context(), &e); err != nil {
+		log.Error().Err(err).Str("event", e.Type).Msg("record auth event")
+	}
+}
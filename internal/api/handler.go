@@ -2,15 +2,35 @@ package api
 
 import (
 	"github.com/example/go-otp-auth/internal/config"
-	pg "github.com/example/go-otp-auth/internal/storage"
+	"github.com/example/go-otp-auth/internal/storage"
 )
 
 type Handler struct {
-	pg  *pg.Postgres
-	rd  *pg.Redis
-	cfg *config.Config
+	users   storage.UserStore
+	events  storage.EventStore
+	otps    storage.OTPStore
+	limiter storage.RateLimiter
+	revoker storage.TokenRevoker
+	scim    storage.SCIMStore
+	tenants storage.TenantStore
+	apps    storage.ClientAppStore
+	cfg     *config.Config
+
+	tenantCache *tenantCache
 }
 
-func NewHandler(pg *pg.Postgres, rd *pg.Redis, cfg *config.Config) *Handler {
-	return &Handler{pg: pg, rd: rd, cfg: cfg}
+func NewHandler(s storage.Stores, cfg *config.Config) *Handler {
+	return &Handler{
+		users:   s.Users,
+		events:  s.Events,
+		otps:    s.OTPs,
+		limiter: s.Limiter,
+		revoker: s.Revoker,
+		scim:    s.SCIM,
+		tenants: s.Tenants,
+		apps:    s.Apps,
+		cfg:     cfg,
+
+		tenantCache: newTenantCache(),
+	}
 }
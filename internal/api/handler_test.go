@@ -0,0 +1,1378 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/auth"
+	"github.com/example/go-otp-auth/internal/config"
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// recordingOTPs remembers the last code sent to each phone so tests can
+// complete the login flow.
+type recordingOTPs struct {
+	storage.OTPStore
+	codes map[string]string
+}
+
+func (r *recordingOTPs) SaveOTP(ctx context.Context, phone, code string, ttl time.Duration) error {
+	r.codes[phone] = code
+	return r.OTPStore.SaveOTP(ctx, phone, code, ttl)
+}
+
+// recordingEvents keeps the auth events recorded through it
+type recordingEvents struct {
+	storage.EventStore
+	events []model.AuthEvent
+}
+
+func (r *recordingEvents) RecordAuthEvent(ctx context.Context, e *model.AuthEvent) error {
+	r.events = append(r.events, *e)
+	return r.EventStore.RecordAuthEvent(ctx, e)
+}
+
+type testEnv struct {
+	h    *Handler
+	mem  *storage.Memory
+	otps *recordingOTPs
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	auth.InitJWT("test-secret")
+
+	mem := storage.NewMemory()
+	stores := mem.Stores()
+	otps := &recordingOTPs{OTPStore: stores.OTPs, codes: map[string]string{}}
+	stores.OTPs = otps
+
+	cfg := &config.Config{
+		OTPTTLSeconds:          120,
+		RateLimitMax:           3,
+		RateLimitWindowSeconds: 600,
+		DeletionGraceDays:      30,
+	}
+	return &testEnv{h: NewHandler(stores, cfg), mem: mem, otps: otps}
+}
+
+func doJSON(t *testing.T, handler http.HandlerFunc, method, target string, body interface{}, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, target, &buf)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// login runs the request/verify flow and returns the token and user
+func (e *testEnv) login(t *testing.T, phone string) (string, model.User) {
+	t.Helper()
+	if w := doJSON(t, e.h.RequestOTP, "POST", "/otp/request", reqPhone{Phone: phone}, ""); w.Code != http.StatusOK {
+		t.Fatalf("request otp: %d %s", w.Code, w.Body)
+	}
+	w := doJSON(t, e.h.VerifyOTP, "POST", "/otp/verify", reqVerify{Phone: phone, OTP: e.otps.codes[phone]}, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("verify otp: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Token string     `json:"token"`
+		User  model.User `json:"user"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	// the response only carries the public id
+	u, err := e.mem.FindUserByPhone(context.Background(), phone)
+	if err != nil || u.PublicID != resp.User.PublicID {
+		t.Fatalf("logged in as %+v, stored %+v (%v)", resp.User, u, err)
+	}
+	return resp.Token, *u
+}
+
+func TestRequestOTP(t *testing.T) {
+	e := newTestEnv(t)
+
+	w := doJSON(t, e.h.RequestOTP, "POST", "/otp/request", reqPhone{Phone: "+15550001"}, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if code := e.otps.codes["+15550001"]; len(code) != 6 {
+		t.Fatalf("saved otp = %q, want 6 digits", code)
+	}
+}
+
+func TestRequestOTPInvalidBody(t *testing.T) {
+	e := newTestEnv(t)
+
+	for _, body := range []interface{}{nil, reqPhone{}} {
+		w := doJSON(t, e.h.RequestOTP, "POST", "/otp/request", body, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("body %v: status = %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestRequestOTPRateLimit(t *testing.T) {
+	e := newTestEnv(t)
+
+	for i := 0; i < 3; i++ {
+		if w := doJSON(t, e.h.RequestOTP, "POST", "/otp/request", reqPhone{Phone: "+15550001"}, ""); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i+1, w.Code)
+		}
+	}
+	w := doJSON(t, e.h.RequestOTP, "POST", "/otp/request", reqPhone{Phone: "+15550001"}, "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+
+	// other phones are unaffected
+	if w := doJSON(t, e.h.RequestOTP, "POST", "/otp/request", reqPhone{Phone: "+15550002"}, ""); w.Code != http.StatusOK {
+		t.Fatalf("other phone: status = %d, want 200", w.Code)
+	}
+}
+
+func TestOTPRateLimitLayers(t *testing.T) {
+	from := func(e *testEnv, handler http.HandlerFunc, addr string, body interface{}) int {
+		t.Helper()
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(body)
+		req := httptest.NewRequest("POST", "/", &buf)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	t.Run("ip", func(t *testing.T) {
+		e := newTestEnv(t)
+		e.h.cfg.IPRateLimitMax, e.h.cfg.IPRateLimitWindowSeconds = 2, 600
+		e.h.cfg.IPRateLimitIPv6Prefix = 64
+		for i, tc := range []struct {
+			addr, phone string
+			want        int
+		}{
+			{"192.0.2.1:1000", "+15550001", http.StatusOK},
+			{"192.0.2.1:1001", "+15550002", http.StatusOK},
+			// spraying numbers from one address hits the limit
+			{"192.0.2.1:1002", "+15550003", http.StatusTooManyRequests},
+			{"192.0.2.2:1000", "+15550003", http.StatusOK},
+			// addresses in one IPv6 /64 share a budget
+			{"[2001:db8::1]:1000", "+15550004", http.StatusOK},
+			{"[2001:db8::2]:1000", "+15550005", http.StatusOK},
+			{"[2001:db8::3]:1000", "+15550006", http.StatusTooManyRequests},
+			{"[2001:db8:0:1::1]:1000", "+15550006", http.StatusOK},
+		} {
+			if got := from(e, e.h.RequestOTP, tc.addr, reqPhone{Phone: tc.phone}); got != tc.want {
+				t.Errorf("request %d from %s: status = %d, want %d", i+1, tc.addr, got, tc.want)
+			}
+		}
+		// verification attempts are counted separately
+		if got := from(e, e.h.VerifyOTP, "192.0.2.1:1003", reqVerify{Phone: "+15550001", OTP: e.otps.codes["+15550001"]}); got != http.StatusOK {
+			t.Errorf("verify from limited address: status = %d, want 200", got)
+		}
+	})
+
+	t.Run("prefix and global", func(t *testing.T) {
+		e := newTestEnv(t)
+		e.h.cfg.PrefixRateLimitDigits, e.h.cfg.PrefixRateLimitMax, e.h.cfg.PrefixRateLimitWindowSeconds = 4, 2, 3600
+		e.h.cfg.GlobalRateLimitPerMinute = 3
+		events := &recordingEvents{EventStore: e.h.events}
+		e.h.events = events
+		for i, tc := range []struct {
+			phone string
+			want  int
+		}{
+			{"+15550001", http.StatusOK},
+			{"+15559999", http.StatusOK},
+			{"+15551234", http.StatusTooManyRequests},
+			{"+442071234567", http.StatusOK},
+			// the prefix refusal above did not use up the global budget
+			{"+33123456789", http.StatusTooManyRequests},
+		} {
+			if got := from(e, e.h.RequestOTP, "192.0.2.1:1000", reqPhone{Phone: tc.phone}); got != tc.want {
+				t.Errorf("request %d for %s: status = %d, want %d", i+1, tc.phone, got, tc.want)
+			}
+		}
+		limits := map[string]int{}
+		for _, ev := range events.events {
+			if ev.Details["result"] == "rate_limited" {
+				limits[ev.Details["limit"]]++
+			}
+		}
+		if limits["prefix"] != 1 || limits["global"] != 1 {
+			t.Errorf("rate_limited events by limit = %v, want one prefix and one global", limits)
+		}
+	})
+
+	t.Run("phone change and email codes", func(t *testing.T) {
+		e := newTestEnv(t)
+		e.h.cfg.GlobalRateLimitPerMinute = 3
+		start := e.h.AuthMiddleware(http.HandlerFunc(e.h.StartPhoneChange)).ServeHTTP
+		add := e.h.AuthMiddleware(http.HandlerFunc(e.h.AddEmail)).ServeHTTP
+		tok, _ := e.login(t, "+15550001")
+		// the login above used one request of the global budget
+		if w := doJSON(t, start, "POST", "/users/me/phone", reqPhone{Phone: "+15550003"}, tok); w.Code != http.StatusOK {
+			t.Fatalf("start phone change: status = %d, want 200", w.Code)
+		}
+		if w := doJSON(t, add, "POST", "/users/me/emails", reqEmail{Email: "ada@example.com"}, tok); w.Code != http.StatusOK {
+			t.Fatalf("add email: status = %d, want 200", w.Code)
+		}
+		if w := doJSON(t, add, "POST", "/users/me/emails", reqEmail{Email: "bob@example.com"}, tok); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("add email over the global limit: status = %d, want 429", w.Code)
+		}
+		if w := doJSON(t, start, "POST", "/users/me/phone", reqPhone{Phone: "+15550004"}, tok); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("phone change over the global limit: status = %d, want 429", w.Code)
+		}
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		e := newTestEnv(t)
+		e.h.cfg.VerifyRateLimitMax = 2
+		from(e, e.h.RequestOTP, "192.0.2.1:1000", reqPhone{Phone: "+15550001"})
+		code := e.otps.codes["+15550001"]
+		for i := 0; i < 2; i++ {
+			if got := from(e, e.h.VerifyOTP, "192.0.2.1:1000", reqVerify{Phone: "+15550001", OTP: "000000"}); got != http.StatusUnauthorized {
+				t.Fatalf("guess %d: status = %d, want 401", i+1, got)
+			}
+		}
+		// once the guesses are used up even the right code is refused
+		if got := from(e, e.h.VerifyOTP, "192.0.2.9:1000", reqVerify{Phone: "+15550001", OTP: code}); got != http.StatusTooManyRequests {
+			t.Fatalf("third attempt: status = %d, want 429", got)
+		}
+	})
+
+	t.Run("email verify", func(t *testing.T) {
+		e := newTestEnv(t)
+		e.h.cfg.VerifyRateLimitMax = 2
+		add := e.h.AuthMiddleware(http.HandlerFunc(e.h.AddEmail)).ServeHTTP
+		verify := e.h.AuthMiddleware(http.HandlerFunc(e.h.VerifyEmail)).ServeHTTP
+		tok, u := e.login(t, "+15550001")
+		doJSON(t, add, "POST", "/users/me/emails", reqEmail{Email: "ada@example.com"}, tok)
+		code := e.otps.codes[emailAttachKey(u.ID, "ada@example.com")]
+		for i := 0; i < 2; i++ {
+			if w := doJSON(t, verify, "POST", "/users/me/emails/verify", reqVerifyEmail{Email: "ada@example.com", OTP: "000000"}, tok); w.Code != http.StatusUnauthorized {
+				t.Fatalf("guess %d: status = %d, want 401", i+1, w.Code)
+			}
+		}
+		if w := doJSON(t, verify, "POST", "/users/me/emails/verify", reqVerifyEmail{Email: "ada@example.com", OTP: code}, tok); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("third attempt: status = %d, want 429", w.Code)
+		}
+	})
+
+	t.Run("phone change verify", func(t *testing.T) {
+		e := newTestEnv(t)
+		e.h.cfg.VerifyRateLimitMax = 2
+		start := e.h.AuthMiddleware(http.HandlerFunc(e.h.StartPhoneChange)).ServeHTTP
+		confirm := e.h.AuthMiddleware(http.HandlerFunc(e.h.ConfirmPhoneChange)).ServeHTTP
+		tok, u := e.login(t, "+15550001")
+		doJSON(t, start, "POST", "/users/me/phone", reqPhone{Phone: "+15550003"}, tok)
+		code := e.otps.codes[phoneChangeKey(u.ID, "+15550003")]
+		for i := 0; i < 2; i++ {
+			if w := doJSON(t, confirm, "POST", "/users/me/phone/verify", reqConfirmPhone{Phone: "+15550003", OTP: "000000"}, tok); w.Code != http.StatusUnauthorized {
+				t.Fatalf("guess %d: status = %d, want 401", i+1, w.Code)
+			}
+		}
+		if w := doJSON(t, confirm, "POST", "/users/me/phone/verify", reqConfirmPhone{Phone: "+15550003", OTP: code}, tok); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("third attempt: status = %d, want 429", w.Code)
+		}
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	e := newTestEnv(t)
+	e.h.cfg.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")}
+	for _, tc := range []struct {
+		name, remote, xff, want string
+	}{
+		{"direct", "192.0.2.1:1000", "", "192.0.2.1"},
+		{"spoofed header from untrusted peer", "192.0.2.1:1000", "198.51.100.7", "192.0.2.1"},
+		{"one trusted proxy", "10.0.0.1:1000", "198.51.100.7", "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.1:1000", "198.51.100.7, 10.0.0.2,10.0.0.3", "198.51.100.7"},
+		{"client-supplied entries are ignored", "10.0.0.1:1000", "203.0.113.5, 198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{"trusted IPv6 proxy", "[2001:db8::1]:1000", "198.51.100.7", "198.51.100.7"},
+		{"malformed hop", "10.0.0.1:1000", "198.51.100.7, junk, 10.0.0.2", "10.0.0.2"},
+		{"no header", "10.0.0.1:1000", "", "10.0.0.1"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := e.h.clientIP(req); got != tc.want {
+			t.Errorf("%s: clientIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestVerifyOTPCreatesUser(t *testing.T) {
+	e := newTestEnv(t)
+
+	tok, u := e.login(t, "+15550001")
+	if u.PublicID == "" || u.Phone != "+15550001" || u.Status != model.UserStatusActive {
+		t.Fatalf("unexpected user %+v", u)
+	}
+	claims, err := auth.ParseToken(tok)
+	if err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	if claims.Subject != u.PublicID || !claims.HasRole(model.RoleUser) || !claims.HasScope(model.ScopeProfileRead) {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+
+	// logging in again resolves to the same user
+	_, again := e.login(t, "+15550001")
+	if again.ID != u.ID {
+		t.Fatalf("second login user id = %d, want %d", again.ID, u.ID)
+	}
+}
+
+func TestPhoneNormalization(t *testing.T) {
+	e := newTestEnv(t)
+	_, u := e.login(t, "+15550001")
+
+	w := doJSON(t, e.h.RequestOTP, "POST", "/otp/request", reqPhone{Phone: "+1 (555) 000-1"}, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	w = doJSON(t, e.h.VerifyOTP, "POST", "/otp/verify", reqVerify{Phone: "001 555 0001", OTP: e.otps.codes["+15550001"]}, "")
+	var resp VerifyOTPResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || resp.User.PublicID != u.PublicID {
+		t.Fatalf("formatted number: status = %d, user %+v", w.Code, resp.User)
+	}
+
+	for _, phone := range []string{"555", "+1555abc0001", "+1234567890123456"} {
+		if w := doJSON(t, e.h.RequestOTP, "POST", "/otp/request", reqPhone{Phone: phone}, ""); w.Code != http.StatusBadRequest {
+			t.Fatalf("%q: status = %d, want 400", phone, w.Code)
+		}
+	}
+}
+
+func TestVerifyOTPReportsNewUser(t *testing.T) {
+	e := newTestEnv(t)
+
+	for _, want := range []bool{true, false} {
+		doJSON(t, e.h.RequestOTP, "POST", "/otp/request", reqPhone{Phone: "+15550001"}, "")
+		w := doJSON(t, e.h.VerifyOTP, "POST", "/otp/verify", reqVerify{Phone: "+15550001", OTP: e.otps.codes["+15550001"]}, "")
+		var resp VerifyOTPResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if w.Code != http.StatusOK || resp.IsNewUser != want {
+			t.Fatalf("status = %d, is_new_user = %v, want %v", w.Code, resp.IsNewUser, want)
+		}
+	}
+}
+
+func TestVerifyOTPWrongCode(t *testing.T) {
+	e := newTestEnv(t)
+
+	doJSON(t, e.h.RequestOTP, "POST", "/otp/request", reqPhone{Phone: "+15550001"}, "")
+	wrong := "000000"
+	if e.otps.codes["+15550001"] == wrong {
+		wrong = "111111"
+	}
+	w := doJSON(t, e.h.VerifyOTP, "POST", "/otp/verify", reqVerify{Phone: "+15550001", OTP: wrong}, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", w.Code)
+	}
+	if _, err := e.mem.FindUserByPhone(context.Background(), "+15550001"); err != storage.ErrNotFound {
+		t.Fatalf("user created after failed verify: %v", err)
+	}
+}
+
+func TestVerifyOTPIsSingleUse(t *testing.T) {
+	e := newTestEnv(t)
+
+	e.login(t, "+15550001")
+	w := doJSON(t, e.h.VerifyOTP, "POST", "/otp/verify", reqVerify{Phone: "+15550001", OTP: e.otps.codes["+15550001"]}, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("reused otp: status = %d, want 401", w.Code)
+	}
+}
+
+func TestVerifyOTPSuspendedUser(t *testing.T) {
+	e := newTestEnv(t)
+
+	_, u := e.login(t, "+15550001")
+	if err := e.mem.SetUserStatus(context.Background(), u.ID, model.UserStatusSuspended, "fraud review"); err != nil {
+		t.Fatal(err)
+	}
+
+	doJSON(t, e.h.RequestOTP, "POST", "/otp/request", reqPhone{Phone: "+15550001"}, "")
+	w := doJSON(t, e.h.VerifyOTP, "POST", "/otp/verify", reqVerify{Phone: "+15550001", OTP: e.otps.codes["+15550001"]}, "")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", w.Code)
+	}
+	var resp AccountStatusError
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Error != "account_suspended" || resp.Reason != "fraud review" {
+		t.Fatalf("unexpected error %+v", resp)
+	}
+}
+
+func TestGetUserMe(t *testing.T) {
+	e := newTestEnv(t)
+	me := e.h.AuthMiddleware(http.HandlerFunc(e.h.GetUser)).ServeHTTP
+
+	tok, u := e.login(t, "+15550001")
+
+	w := doJSON(t, me, "GET", "/users/me", nil, tok)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	var got model.User
+	json.NewDecoder(w.Body).Decode(&got)
+	if got.PublicID != u.PublicID || got.Phone != u.Phone {
+		t.Fatalf("got %+v, want %+v", got, u)
+	}
+
+	if w := doJSON(t, me, "GET", "/users/me", nil, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("no token: status = %d, want 401", w.Code)
+	}
+	if w := doJSON(t, me, "GET", "/users/me", nil, "garbage"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("bad token: status = %d, want 401", w.Code)
+	}
+}
+
+func TestGetUserMeSubjects(t *testing.T) {
+	e := newTestEnv(t)
+	me := e.h.AuthMiddleware(http.HandlerFunc(e.h.GetUser)).ServeHTTP
+	_, u := e.login(t, "+15550001")
+
+	// tokens minted before public ids name the user by internal id
+	legacy, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":   u.ID,
+		"scope": model.ScopeProfileRead,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("test-secret"))
+	if w := doJSON(t, me, "GET", "/users/me", nil, legacy); w.Code != http.StatusOK {
+		t.Fatalf("numeric subject: status = %d, want 200", w.Code)
+	}
+
+	for _, sub := range []string{"not-a-uuid", "0190b0c4-7f5e-7b3a-9c1d-2e4f6a8b0c1d"} {
+		tok, _ := auth.CreateToken(sub, nil, []string{model.ScopeProfileRead})
+		if w := doJSON(t, me, "GET", "/users/me", nil, tok); w.Code != http.StatusUnauthorized {
+			t.Fatalf("subject %q: status = %d, want 401", sub, w.Code)
+		}
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	e := newTestEnv(t)
+	patch := e.h.AuthMiddleware(http.HandlerFunc(e.h.UpdateProfile)).ServeHTTP
+
+	tok, u := e.login(t, "+15550001")
+	if u.LoginCount != 1 || u.LastLoginAt == nil {
+		t.Fatalf("login not recorded: %+v", u)
+	}
+
+	w := doJSON(t, patch, "PATCH", "/users/me", map[string]interface{}{
+		"display_name": "  Ada  ",
+		"locale":       "en-us",
+		"timezone":     "Europe/Berlin",
+		"metadata":     map[string]interface{}{"plan": "pro"},
+	}, tok)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var got model.User
+	json.NewDecoder(w.Body).Decode(&got)
+	if got.DisplayName != "Ada" || got.Locale != "en-US" || got.Timezone != "Europe/Berlin" || got.Metadata["plan"] != "pro" {
+		t.Fatalf("unexpected profile %+v", got)
+	}
+
+	// omitted fields are kept
+	w = doJSON(t, patch, "PATCH", "/users/me", map[string]interface{}{"email": "ada@example.com"}, tok)
+	json.NewDecoder(w.Body).Decode(&got)
+	if got.Email != "ada@example.com" || got.DisplayName != "Ada" {
+		t.Fatalf("unexpected profile %+v", got)
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"email": "not an email"},
+		{"locale": "xx_!!"},
+		{"timezone": "Mars/Olympus"},
+		{"avatar_url": "http://example.com/a.png"},
+		{"display_name": strings.Repeat("a", maxDisplayNameLen+1)},
+		{"metadata": map[string]interface{}{"blob": strings.Repeat("a", maxMetadataBytes)}},
+	} {
+		if w := doJSON(t, patch, "PATCH", "/users/me", body, tok); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: status = %d, want 400", body, w.Code)
+		}
+	}
+
+	_, again := e.login(t, "+15550001")
+	if again.LoginCount != 2 || again.DisplayName != "Ada" {
+		t.Fatalf("unexpected user after second login %+v", again)
+	}
+}
+
+func TestEmailLogin(t *testing.T) {
+	e := newTestEnv(t)
+	add := e.h.AuthMiddleware(http.HandlerFunc(e.h.AddEmail)).ServeHTTP
+	verify := e.h.AuthMiddleware(http.HandlerFunc(e.h.VerifyEmail)).ServeHTTP
+
+	tok, u := e.login(t, "+15550001")
+
+	// unknown addresses get the same answer but no code
+	if w := doJSON(t, e.h.RequestEmailOTP, "POST", "/otp/email/request", reqEmail{Email: "ada@example.com"}, ""); w.Code != http.StatusOK {
+		t.Fatalf("request for unknown email: status = %d, want 200", w.Code)
+	}
+	if _, ok := e.otps.codes[emailLoginKey("ada@example.com")]; ok {
+		t.Fatal("code sent to an unverified email")
+	}
+
+	if w := doJSON(t, add, "POST", "/users/me/emails", reqEmail{Email: "Ada@Example.com"}, tok); w.Code != http.StatusOK {
+		t.Fatalf("add email: status = %d, want 200", w.Code)
+	}
+	code := e.otps.codes[emailAttachKey(u.ID, "ada@example.com")]
+	if w := doJSON(t, verify, "POST", "/users/me/emails/verify", reqVerifyEmail{Email: "ada@example.com", OTP: code}, tok); w.Code != http.StatusCreated {
+		t.Fatalf("verify email: status = %d, want 201: %s", w.Code, w.Body)
+	}
+
+	doJSON(t, e.h.RequestEmailOTP, "POST", "/otp/email/request", reqEmail{Email: "ada@example.com"}, "")
+	code = e.otps.codes[emailLoginKey("ada@example.com")]
+	w := doJSON(t, e.h.VerifyEmailOTP, "POST", "/otp/email/verify", reqVerifyEmail{Email: "ADA@example.com", OTP: code}, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("email login: status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp VerifyOTPResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.User.PublicID != u.PublicID || resp.IsNewUser {
+		t.Fatalf("email login resolved to %+v, want user %s", resp.User, u.PublicID)
+	}
+
+	// another user cannot claim the address
+	otherTok, _ := e.login(t, "+15550002")
+	if w := doJSON(t, add, "POST", "/users/me/emails", reqEmail{Email: "ada@example.com"}, otherTok); w.Code != http.StatusConflict {
+		t.Fatalf("claim taken email: status = %d, want 409", w.Code)
+	}
+}
+
+func TestChangePhone(t *testing.T) {
+	e := newTestEnv(t)
+	e.h.cfg.PhoneChangeVerifyOld = true
+	start := e.h.AuthMiddleware(http.HandlerFunc(e.h.StartPhoneChange)).ServeHTTP
+	confirm := e.h.AuthMiddleware(http.HandlerFunc(e.h.ConfirmPhoneChange)).ServeHTTP
+	me := e.h.AuthMiddleware(http.HandlerFunc(e.h.GetUser)).ServeHTTP
+
+	tok, u := e.login(t, "+15550001")
+	e.login(t, "+15550002")
+
+	if w := doJSON(t, start, "POST", "/users/me/phone", reqPhone{Phone: "+15550002"}, tok); w.Code != http.StatusConflict {
+		t.Fatalf("taken phone: status = %d, want 409", w.Code)
+	}
+	if w := doJSON(t, start, "POST", "/users/me/phone", reqPhone{Phone: "+15550003"}, tok); w.Code != http.StatusOK {
+		t.Fatalf("start: status = %d, want 200: %s", w.Code, w.Body)
+	}
+	code := e.otps.codes[phoneChangeKey(u.ID, "+15550003")]
+	oldCode := e.otps.codes[phoneChangeOldKey(u.ID)]
+
+	if w := doJSON(t, confirm, "POST", "/users/me/phone/verify", reqConfirmPhone{Phone: "+15550003", OTP: code}, tok); w.Code != http.StatusBadRequest {
+		t.Fatalf("missing old code: status = %d, want 400", w.Code)
+	}
+	w := doJSON(t, confirm, "POST", "/users/me/phone/verify", reqConfirmPhone{Phone: "+15550003", OTP: code, OldOTP: oldCode}, tok)
+	if w.Code != http.StatusOK {
+		t.Fatalf("confirm: status = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	if w := doJSON(t, me, "GET", "/users/me", nil, tok); w.Code != http.StatusUnauthorized {
+		t.Fatalf("old token after phone change: status = %d, want 401", w.Code)
+	}
+	history, err := e.mem.ListPhoneHistory(context.Background(), storage.PhoneHistoryFilter{Phone: "+15550001"})
+	if err != nil || len(history) != 1 || history[0].UserID != u.ID || history[0].NewPhone != "+15550003" {
+		t.Fatalf("history = %+v, %v", history, err)
+	}
+}
+
+func TestDeleteAndExportAccount(t *testing.T) {
+	e := newTestEnv(t)
+	del := e.h.AuthMiddleware(http.HandlerFunc(e.h.DeleteAccount)).ServeHTTP
+	export := e.h.AuthMiddleware(http.HandlerFunc(e.h.ExportAccount)).ServeHTTP
+	ctx := context.Background()
+
+	tok, u := e.login(t, "+15550001")
+	w := doJSON(t, export, "GET", "/users/me/export", nil, tok)
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var exp AccountExport
+	if err := json.NewDecoder(w.Body).Decode(&exp); err != nil {
+		t.Fatal(err)
+	}
+	if exp.User.PublicID != u.PublicID || len(exp.Sessions) != 1 || exp.Sessions[0].Method != "phone" || len(exp.AuthEvents) != 2 {
+		t.Fatalf("unexpected export %+v", exp)
+	}
+
+	if _, err := e.mem.UpdateUserPhone(ctx, u.ID, "+15550002", u.ID); err != nil {
+		t.Fatal(err)
+	}
+	verifyLimit := storage.RateLimit{Max: 1, Window: time.Hour}
+	e.mem.AllowOTPRequest(ctx, "verify:+15550002", verifyLimit)
+	if w := doJSON(t, del, "DELETE", "/users/me", nil, tok); w.Code != http.StatusOK {
+		t.Fatalf("delete: status = %d, want 200", w.Code)
+	}
+	if w := doJSON(t, export, "GET", "/users/me/export", nil, tok); w.Code != http.StatusUnauthorized {
+		t.Fatalf("token after delete: status = %d, want 401", w.Code)
+	}
+
+	// still within the grace period
+	if n, err := e.h.PurgeDeletedUsers(ctx); err != nil || n != 0 {
+		t.Fatalf("purge during grace period: %d, %v", n, err)
+	}
+	e.h.cfg.DeletionGraceDays = 0
+	if n, err := e.h.PurgeDeletedUsers(ctx); err != nil || n != 1 {
+		t.Fatalf("purge: %d, %v", n, err)
+	}
+	if _, err := e.mem.GetUserByID(ctx, u.ID); err != storage.ErrNotFound {
+		t.Fatalf("purged user still present: %v", err)
+	}
+	if ok, _ := e.mem.AllowOTPRequest(ctx, "verify:+15550002", verifyLimit); !ok {
+		t.Fatal("verify limit of the purged number not reset")
+	}
+
+	// the log keeps the events with the numbers redacted, including the
+	// login code sent before the user existed
+	if _, _, err := e.mem.VerifyAuthEvents(ctx); err != nil {
+		t.Fatalf("verify after purge: %v", err)
+	}
+	events, _ := e.mem.ListUserAuthEvents(ctx, u.ID)
+	if len(events) == 0 || events[len(events)-1].Type != model.EventAccountPurged {
+		t.Fatalf("user events after purge = %+v", events)
+	}
+	for _, ev := range events {
+		if ev.Phone != "" {
+			t.Fatalf("phone left in event %+v", ev)
+		}
+	}
+	if n, err := e.mem.RedactUserAuthEvents(ctx, 0, []string{"+15550001"}); err != nil || n != 0 {
+		t.Fatalf("events still naming the old number: %d, %v", n, err)
+	}
+}
+
+func TestGetUserMeRejectsInactiveAndRevoked(t *testing.T) {
+	e := newTestEnv(t)
+	me := e.h.AuthMiddleware(http.HandlerFunc(e.h.GetUser)).ServeHTTP
+	ctx := context.Background()
+
+	tok, u := e.login(t, "+15550001")
+	e.mem.SetUserStatus(ctx, u.ID, model.UserStatusBanned, "")
+	if w := doJSON(t, me, "GET", "/users/me", nil, tok); w.Code != http.StatusForbidden {
+		t.Fatalf("banned: status = %d, want 403", w.Code)
+	}
+
+	e.mem.SetUserStatus(ctx, u.ID, model.UserStatusActive, "")
+	e.mem.RevokeUserTokens(ctx, u.ID, time.Hour)
+	if w := doJSON(t, me, "GET", "/users/me", nil, tok); w.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked: status = %d, want 401", w.Code)
+	}
+}
+
+func TestLoginRightAfterLogout(t *testing.T) {
+	e := newTestEnv(t)
+	me := e.h.AuthMiddleware(http.HandlerFunc(e.h.GetUser)).ServeHTTP
+	logout := e.h.AuthMiddleware(http.HandlerFunc(e.h.Logout)).ServeHTTP
+
+	old, _ := e.login(t, "+15550001")
+	if w := doJSON(t, logout, "POST", "/users/me/logout", nil, old); w.Code != http.StatusOK {
+		t.Fatalf("logout: status = %d", w.Code)
+	}
+	// well within the second of the logout
+	time.Sleep(2 * time.Millisecond)
+	tok, _ := e.login(t, "+15550001")
+	if w := doJSON(t, me, "GET", "/users/me", nil, tok); w.Code != http.StatusOK {
+		t.Fatalf("new token: status = %d, want 200", w.Code)
+	}
+	if w := doJSON(t, me, "GET", "/users/me", nil, old); w.Code != http.StatusUnauthorized {
+		t.Fatalf("old token: status = %d, want 401", w.Code)
+	}
+}
+
+func TestExchangeToken(t *testing.T) {
+	e := newTestEnv(t)
+	e.h.cfg.TokenExchangeClients = map[string]string{"billing": "billing-secret"}
+	e.h.cfg.TokenExchangeTTLSeconds = 300
+	ctx := context.Background()
+	_, u := e.login(t, "+15550001")
+	_, revoked := e.login(t, "+15550002")
+	_, banned := e.login(t, "+15550003")
+
+	issue := func(i auth.Issuer, subject string, ttl time.Duration) string {
+		t.Helper()
+		i.TTL = ttl
+		tok, err := i.CreateToken(subject, []string{model.RoleUser}, []string{model.ScopeProfileRead, model.ScopeUsersRead})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	def := auth.DefaultIssuer()
+	subject := issue(def, u.PublicID, time.Hour)
+	revokedToken := issue(def, revoked.PublicID, time.Hour)
+	bannedToken := issue(def, banned.PublicID, time.Hour)
+	// a token signed with the same key for another tenant
+	other := issue(auth.Issuer{TenantID: 2, Secret: def.Secret}, u.PublicID, time.Hour)
+	exchanged, err := def.CreateExchangedToken(u.PublicID, auth.ExchangeOptions{Audience: "billing", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.mem.RevokeUserTokens(ctx, revoked.ID, time.Hour)
+	e.mem.SetUserStatus(ctx, banned.ID, model.UserStatusBanned, "")
+
+	form := func(token, scope string) url.Values {
+		return url.Values{
+			"grant_type":         {grantTypeTokenExchange},
+			"subject_token":      {token},
+			"subject_token_type": {tokenTypeAccessToken},
+			"audience":           {"billing"},
+			"scope":              {scope},
+		}
+	}
+	for _, tc := range []struct {
+		name           string
+		client, secret string
+		form           url.Values
+		want           int
+		wantError      string
+		wantScope      string
+		maxTTL         int64
+	}{
+		{name: "narrowed scope", client: "billing", secret: "billing-secret", form: form(subject, model.ScopeProfileRead),
+			want: http.StatusOK, wantScope: model.ScopeProfileRead, maxTTL: 300},
+		{name: "subject scopes by default", client: "billing", secret: "billing-secret", form: form(subject, ""),
+			want: http.StatusOK, wantScope: model.ScopeProfileRead + " " + model.ScopeUsersRead, maxTTL: 300},
+		{name: "ttl capped by subject token", client: "billing", secret: "billing-secret", form: form(issue(def, u.PublicID, time.Minute), ""),
+			want: http.StatusOK, wantScope: model.ScopeProfileRead + " " + model.ScopeUsersRead, maxTTL: 60},
+		{name: "wider scope", client: "billing", secret: "billing-secret", form: form(subject, model.ScopeUsersWrite),
+			want: http.StatusBadRequest, wantError: "invalid_scope"},
+		{name: "unknown client", client: "crm", secret: "billing-secret", form: form(subject, ""),
+			want: http.StatusUnauthorized, wantError: "invalid_client"},
+		{name: "wrong secret", client: "billing", secret: "guess", form: form(subject, ""),
+			want: http.StatusUnauthorized, wantError: "invalid_client"},
+		{name: "other tenant's token", client: "billing", secret: "billing-secret", form: form(other, ""),
+			want: http.StatusBadRequest, wantError: "invalid_grant"},
+		{name: "already exchanged token", client: "billing", secret: "billing-secret", form: form(exchanged, ""),
+			want: http.StatusBadRequest, wantError: "invalid_grant"},
+		{name: "revoked token", client: "billing", secret: "billing-secret", form: form(revokedToken, ""),
+			want: http.StatusBadRequest, wantError: "invalid_grant"},
+		{name: "banned user", client: "billing", secret: "billing-secret", form: form(bannedToken, ""),
+			want: http.StatusBadRequest, wantError: "invalid_grant"},
+	} {
+		req := httptest.NewRequest("POST", "/token/exchange", strings.NewReader(tc.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(tc.client, tc.secret)
+		w := httptest.NewRecorder()
+		e.h.ExchangeToken(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d (%s)", tc.name, w.Code, tc.want, w.Body)
+			continue
+		}
+		if tc.want != http.StatusOK {
+			var resp TokenErrorResponse
+			json.NewDecoder(w.Body).Decode(&resp)
+			if resp.Error != tc.wantError {
+				t.Errorf("%s: error = %q, want %q", tc.name, resp.Error, tc.wantError)
+			}
+			continue
+		}
+		var resp TokenExchangeResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if resp.Scope != tc.wantScope || resp.ExpiresIn <= 0 || resp.ExpiresIn > tc.maxTTL {
+			t.Errorf("%s: scope %q, expires in %d; want %q within %ds", tc.name, resp.Scope, resp.ExpiresIn, tc.wantScope, tc.maxTTL)
+		}
+		claims, err := auth.ParseClaims(resp.AccessToken)
+		if err != nil || claims.Audience != "billing" || claims.Actor != "billing" || claims.Subject != u.PublicID {
+			t.Errorf("%s: exchanged claims = %+v, %v", tc.name, claims, err)
+		}
+	}
+}
+
+func TestAdminStatusTransitions(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	_, admin := e.login(t, "+15550009")
+	e.mem.GrantRole(admin.ID, model.RoleAdmin)
+	roles, scopes, _ := e.mem.GetUserAccess(ctx, admin.ID)
+	adminTok, _ := auth.CreateToken(admin.PublicID, roles, scopes)
+	_, u := e.login(t, "+15550001")
+
+	r := chi.NewRouter()
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(e.h.AuthMiddleware, RequireRole(model.RoleAdmin))
+		r.Post("/users/{id}/suspend", e.h.AdminSuspendUser)
+		r.Post("/users/{id}/unsuspend", e.h.AdminUnsuspendUser)
+		r.Post("/users/{id}/ban", e.h.AdminBanUser)
+		r.Post("/users/{id}/unban", e.h.AdminUnbanUser)
+		r.Post("/users/{id}/restore", e.h.AdminRestoreUser)
+	})
+	for _, tc := range []struct {
+		action     string
+		want       int
+		wantStatus string
+	}{
+		{"suspend", http.StatusOK, model.UserStatusSuspended},
+		{"suspend", http.StatusConflict, model.UserStatusSuspended},
+		{"ban", http.StatusOK, model.UserStatusBanned},
+		// suspending must not quietly replace the ban, which unsuspend
+		// would then lift
+		{"suspend", http.StatusConflict, model.UserStatusBanned},
+		{"unsuspend", http.StatusConflict, model.UserStatusBanned},
+		{"unban", http.StatusOK, model.UserStatusActive},
+		{"delete", 0, model.UserStatusDeleted},
+		// banning would cancel the purge of a deleted user
+		{"ban", http.StatusConflict, model.UserStatusDeleted},
+		{"suspend", http.StatusConflict, model.UserStatusDeleted},
+		{"restore", http.StatusOK, model.UserStatusActive},
+		{"ban", http.StatusOK, model.UserStatusBanned},
+	} {
+		if tc.action == "delete" {
+			e.mem.SetUserStatus(ctx, u.ID, model.UserStatusDeleted, "")
+			continue
+		}
+		w := doJSON(t, r.ServeHTTP, "POST", "/admin/users/"+u.PublicID+"/"+tc.action, nil, adminTok)
+		status, _, _ := e.mem.GetUserStatus(ctx, u.ID)
+		if w.Code != tc.want || status != tc.wantStatus {
+			t.Fatalf("%s: status = %d, user %s; want %d, user %s", tc.action, w.Code, status, tc.want, tc.wantStatus)
+		}
+	}
+}
+
+func TestResponsesHideInternalIDs(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	_, admin := e.login(t, "+15550009")
+	e.mem.GrantRole(admin.ID, model.RoleAdmin)
+	roles, scopes, _ := e.mem.GetUserAccess(ctx, admin.ID)
+	adminTok, _ := auth.CreateToken(admin.PublicID, roles, scopes)
+	tok, u := e.login(t, "+15550001")
+
+	r := chi.NewRouter()
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(e.h.AuthMiddleware, RequireRole(model.RoleAdmin))
+		r.Get("/users/{id}", e.h.AdminGetUser)
+		r.Put("/users/{id}/phone", e.h.AdminChangePhone)
+		r.Post("/users/{id}/notes", e.h.AdminAddNote)
+		r.Get("/phone-history", e.h.AdminPhoneHistory)
+	})
+	r.With(e.h.AuthMiddleware).Get("/users/me/export", e.h.ExportAccount)
+
+	userPath := "/admin/users/" + u.PublicID
+	for _, req := range []struct {
+		method, target string
+		body           interface{}
+		token          string
+	}{
+		{"POST", userPath + "/notes", reqNote{Body: "called support"}, adminTok},
+		{"GET", "/users/me/export", nil, tok},
+		{"PUT", userPath + "/phone", reqPhone{Phone: "+15550002"}, adminTok},
+		{"GET", userPath, nil, adminTok},
+		{"GET", "/admin/phone-history?user_id=" + u.PublicID, nil, adminTok},
+	} {
+		w := doJSON(t, r.ServeHTTP, req.method, req.target, req.body, req.token)
+		if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+			t.Fatalf("%s %s: status = %d: %s", req.method, req.target, w.Code, w.Body)
+		}
+		var body interface{}
+		json.NewDecoder(w.Body).Decode(&body)
+		var seen []string
+		var walk func(v interface{})
+		walk = func(v interface{}) {
+			switch v := v.(type) {
+			case map[string]interface{}:
+				for k, x := range v {
+					switch k {
+					case "user_id", "actor_id", "author_id":
+						id, ok := x.(string)
+						if !ok {
+							t.Fatalf("%s %s: internal id in %s: %v", req.method, req.target, k, x)
+						}
+						seen = append(seen, id)
+					}
+					walk(x)
+				}
+			case []interface{}:
+				for _, x := range v {
+					walk(x)
+				}
+			}
+		}
+		walk(body)
+		for _, id := range seen {
+			if id != u.PublicID && id != admin.PublicID && id != "" {
+				t.Fatalf("%s %s: unexpected user id %q", req.method, req.target, id)
+			}
+		}
+		if req.method == "GET" && len(seen) == 0 {
+			t.Fatalf("%s %s: no user ids in %v", req.method, req.target, body)
+		}
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	e := newTestEnv(t)
+	list := e.h.AuthMiddleware(RequireScope(model.ScopeUsersRead)(http.HandlerFunc(e.h.ListUsers))).ServeHTTP
+
+	userTok, _ := e.login(t, "+15550001")
+	e.login(t, "+15550002")
+	e.login(t, "+15560003")
+	_, admin := e.login(t, "+15570004")
+	e.mem.GrantRole(admin.ID, model.RoleAdmin)
+	roles, scopes, _ := e.mem.GetUserAccess(context.Background(), admin.ID)
+	adminTok, _ := auth.CreateToken(admin.PublicID, roles, scopes)
+
+	if w := doJSON(t, list, "GET", "/users", nil, userTok); w.Code != http.StatusForbidden {
+		t.Fatalf("regular user: status = %d, want 403", w.Code)
+	}
+
+	type listResp struct {
+		Total      int                  `json:"total"`
+		Page       int                  `json:"page"`
+		Size       int                  `json:"size"`
+		Data       []storage.ListedUser `json:"data"`
+		NextCursor string               `json:"next_cursor"`
+	}
+	get := func(query string) listResp {
+		t.Helper()
+		w := doJSON(t, list, "GET", "/users"+query, nil, adminTok)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", query, w.Code)
+		}
+		var resp listResp
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp
+	}
+
+	all := get("")
+	if all.Total != 4 || len(all.Data) != 4 || all.Page != 1 || all.Size != 10 {
+		t.Fatalf("unexpected listing %+v", all)
+	}
+
+	page := get("?page=2&size=3")
+	if page.Total != 4 || len(page.Data) != 1 || page.Data[0].Phone != "+15570004" {
+		t.Fatalf("unexpected page %+v", page)
+	}
+
+	search := get("?search=1555")
+	if search.Total != 2 {
+		t.Fatalf("search total = %d, want 2", search.Total)
+	}
+	for _, u := range search.Data {
+		if !strings.Contains(u.Phone, "1555") {
+			t.Fatalf("search returned %s", u.Phone)
+		}
+	}
+
+	if prefix := get("?search=%2B1555&search_mode=prefix"); prefix.Total != 2 {
+		t.Fatalf("prefix search total = %d, want 2", prefix.Total)
+	}
+	if exact := get("?search=%2B1+557-0004&search_mode=exact"); exact.Total != 1 || exact.Data[0].Phone != "+15570004" {
+		t.Fatalf("unexpected exact search %+v", exact)
+	}
+
+	first := get("?sort=registered_at&order=desc&size=3&skip_total=true")
+	if first.Total != 0 || len(first.Data) != 3 || first.Data[0].Phone != "+15570004" || first.NextCursor == "" {
+		t.Fatalf("unexpected first page %+v", first)
+	}
+	rest := get("?sort=registered_at&order=desc&size=3&cursor=" + first.NextCursor)
+	if len(rest.Data) != 1 || rest.Data[0].Phone != "+15550001" || rest.NextCursor != "" {
+		t.Fatalf("unexpected next page %+v", rest)
+	}
+
+	for _, q := range []string{"status=bogus", "search=1_5", "search=1555&search_mode=exact", "search_mode=fuzzy", "sort=phone", "order=up", "registered_from=yesterday", "cursor=garbage"} {
+		if w := doJSON(t, list, "GET", "/users?"+q, nil, adminTok); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status = %d, want 400", q, w.Code)
+		}
+	}
+}
+
+func TestSCIMUsers(t *testing.T) {
+	e := newTestEnv(t)
+	hash := func(token string) string {
+		sum := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(sum[:])
+	}
+	// acme provisions the default tenant, the one e.login signs in to
+	e.h.cfg.SCIMTokens = map[string]string{"default": hash("acme-token"), "globex": hash("globex-token"), "initech": hash("initech-token")}
+	globex := &model.Tenant{Slug: "globex", Name: "Globex", Hosts: []string{"login.globex.example"}}
+	if err := e.mem.SaveTenant(context.Background(), globex); err != nil {
+		t.Fatal(err)
+	}
+	r := chi.NewRouter()
+	r.Use(e.h.TenantMiddleware)
+	r.Route("/scim/v2", func(r chi.Router) {
+		r.Use(e.h.SCIMAuth)
+		r.Get("/Users", e.h.SCIMListUsers)
+		r.Post("/Users", e.h.SCIMCreateUser)
+		r.Get("/Users/{id}", e.h.SCIMGetUser)
+		r.Patch("/Users/{id}", e.h.SCIMPatchUser)
+		r.Delete("/Users/{id}", e.h.SCIMDeleteUser)
+	})
+	scim := r.ServeHTTP
+
+	if w := doJSON(t, scim, "GET", "/scim/v2/Users", nil, "wrong"); w.Code != http.StatusUnauthorized ||
+		w.Header().Get("Content-Type") != scimContentType {
+		t.Fatalf("bad token: status = %d, want 401 as SCIM error", w.Code)
+	}
+	// a token listed under a slug that is no tenant
+	if w := doJSON(t, scim, "GET", "/scim/v2/Users", nil, "initech-token"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown tenant: status = %d, want 401", w.Code)
+	}
+
+	w := doJSON(t, scim, "POST", "/scim/v2/Users", map[string]interface{}{
+		"schemas":      []string{scimUserSchema},
+		"userName":     "alice@acme.example",
+		"externalId":   "idp-1",
+		"displayName":  "Alice",
+		"phoneNumbers": []map[string]string{{"value": "+1 555 0001", "type": "mobile"}},
+	}, "acme-token")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, want 201: %s", w.Code, w.Body)
+	}
+	var created SCIMUser
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.UserName != "+15550001" || created.ExternalID != "idp-1" || created.DisplayName != "Alice" || !created.Active ||
+		w.Header().Get("Location") != "/scim/v2/Users/"+created.ID {
+		t.Fatalf("unexpected created user %+v", created)
+	}
+	userPath := "/scim/v2/Users/" + created.ID
+
+	// a self-registered number and a reused externalId are conflicts
+	e.login(t, "+15550002")
+	for _, body := range []map[string]interface{}{
+		{"userName": "+15550002"},
+		{"userName": "+15550003", "externalId": "idp-1"},
+	} {
+		w := doJSON(t, scim, "POST", "/scim/v2/Users", body, "acme-token")
+		var serr SCIMError
+		json.NewDecoder(w.Body).Decode(&serr)
+		if w.Code != http.StatusConflict || serr.SCIMType != scimTypeUniqueness || serr.Status != "409" {
+			t.Fatalf("create %v: status = %d %+v, want 409 uniqueness", body, w.Code, serr)
+		}
+	}
+	if _, err := e.mem.FindUserByPhone(context.Background(), "+15550003"); err == nil {
+		t.Fatal("user with a conflicting externalId was kept")
+	}
+
+	list := func(query, token string) SCIMListResponse {
+		t.Helper()
+		w := doJSON(t, scim, "GET", "/scim/v2/Users"+query, nil, token)
+		if w.Code != http.StatusOK {
+			t.Fatalf("list %s: status = %d, want 200: %s", query, w.Code, w.Body)
+		}
+		var resp SCIMListResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp
+	}
+	if l := list("", "acme-token"); l.TotalResults != 1 || l.ItemsPerPage != 1 || l.StartIndex != 1 {
+		t.Fatalf("unexpected listing %+v", l)
+	}
+	// tenants only see their own users
+	if l := list("", "globex-token"); l.TotalResults != 0 || l.Resources == nil {
+		t.Fatalf("other tenant sees %+v", l)
+	}
+	if w := doJSON(t, scim, "GET", userPath, nil, "globex-token"); w.Code != http.StatusNotFound {
+		t.Fatalf("other tenant get: status = %d, want 404", w.Code)
+	}
+
+	doJSON(t, scim, "POST", "/scim/v2/Users", map[string]interface{}{"userName": "+15550004", "externalId": "idp-2"}, "acme-token")
+	for _, q := range []string{
+		`userName eq "+15550001"`,
+		`phoneNumbers[type eq "mobile"].value eq "+1-555-0001"`,
+		`externalId eq "idp-1"`,
+		`id eq "` + created.ID + `"`,
+	} {
+		if l := list("?filter="+url.QueryEscape(q), "acme-token"); l.TotalResults != 1 || l.Resources[0].ID != created.ID {
+			t.Fatalf("filter %s: unexpected listing %+v", q, l)
+		}
+	}
+	if l := list("?filter="+url.QueryEscape(`userName eq "+15550002"`), "acme-token"); l.TotalResults != 0 {
+		t.Fatalf("filter matched a user of no tenant: %+v", l)
+	}
+	if l := list("?startIndex=2&count=1", "acme-token"); l.TotalResults != 2 || l.ItemsPerPage != 1 || l.Resources[0].ExternalID != "idp-2" {
+		t.Fatalf("unexpected second page %+v", l)
+	}
+	for _, q := range []string{`userName sw "+1"`, `emails eq "a@example.com"`, `active eq "yes"`} {
+		if w := doJSON(t, scim, "GET", "/scim/v2/Users?filter="+url.QueryEscape(q), nil, "acme-token"); w.Code != http.StatusBadRequest ||
+			!strings.Contains(w.Body.String(), scimTypeFilter) {
+			t.Fatalf("filter %s: status = %d, want 400 invalidFilter", q, w.Code)
+		}
+	}
+
+	// deprovisioning suspends the user and revokes their tokens
+	token, _ := e.login(t, "+15550001")
+	w = doJSON(t, scim, "PATCH", userPath, map[string]interface{}{
+		"schemas": []string{"urn:ietf:params:scim:api:messages:2.0:PatchOp"},
+		"Operations": []map[string]interface{}{
+			{"op": "Replace", "path": "active", "value": "False"},
+			{"op": "replace", "value": map[string]interface{}{"displayName": "Alice B"}},
+		},
+	}, "acme-token")
+	var patched SCIMUser
+	json.NewDecoder(w.Body).Decode(&patched)
+	if w.Code != http.StatusOK || patched.Active || patched.DisplayName != "Alice B" {
+		t.Fatalf("deactivate: status = %d %+v", w.Code, patched)
+	}
+	if l := list("?filter=active+eq+false", "acme-token"); l.TotalResults != 1 || l.Resources[0].ID != created.ID {
+		t.Fatalf("active filter: unexpected listing %+v", l)
+	}
+	if w := doJSON(t, e.h.AuthMiddleware(http.HandlerFunc(e.h.GetUser)).ServeHTTP, "GET", "/users/me", nil, token); w.Code == http.StatusOK {
+		t.Fatal("token still accepted after deprovisioning")
+	}
+
+	w = doJSON(t, scim, "PATCH", userPath, map[string]interface{}{
+		"Operations": []map[string]interface{}{
+			{"op": "replace", "path": "active", "value": true},
+			{"op": "replace", "path": `phoneNumbers[type eq "mobile"].value`, "value": "+15550009"},
+		},
+	}, "acme-token")
+	json.NewDecoder(w.Body).Decode(&patched)
+	if w.Code != http.StatusOK || !patched.Active || patched.UserName != "+15550009" || patched.PhoneNumbers[0].Value != "+15550009" {
+		t.Fatalf("reactivate: status = %d %+v", w.Code, patched)
+	}
+	for _, op := range []map[string]interface{}{
+		{"op": "replace", "path": "userName", "value": "+15550002"},
+		{"op": "replace", "path": "emails", "value": "a@example.com"},
+		{"op": "remove", "path": "active"},
+	} {
+		w := doJSON(t, scim, "PATCH", userPath, map[string]interface{}{"Operations": []interface{}{op}}, "acme-token")
+		if w.Code != http.StatusConflict && w.Code != http.StatusBadRequest {
+			t.Fatalf("patch %v: status = %d, want 400 or 409", op, w.Code)
+		}
+	}
+
+	if w := doJSON(t, scim, "DELETE", userPath, nil, "acme-token"); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d, want 204", w.Code)
+	}
+	if w := doJSON(t, scim, "GET", userPath, nil, "acme-token"); w.Code != http.StatusNotFound {
+		t.Fatalf("get deleted: status = %d, want 404", w.Code)
+	}
+	if l := list("", "acme-token"); l.TotalResults != 1 {
+		t.Fatalf("deleted user still listed: %+v", l)
+	}
+
+	// the token decides the tenant, not the host of the request
+	req := httptest.NewRequest("POST", "/scim/v2/Users", strings.NewReader(`{"userName": "+15550005"}`))
+	req.Host = "login.globex.example"
+	req.Header.Set("Authorization", "Bearer acme-token")
+	rec := httptest.NewRecorder()
+	scim(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create with a foreign host: status = %d, want 201: %s", rec.Code, rec.Body)
+	}
+	if _, err := e.mem.FindUserByPhone(storage.WithTenant(context.Background(), globex.ID), "+15550005"); err == nil {
+		t.Fatal("user created in the tenant of the host")
+	}
+	if _, err := e.mem.FindUserByPhone(context.Background(), "+15550005"); err != nil {
+		t.Fatalf("user not created in the tenant of the token: %v", err)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	length, max := 8, 1
+	acme := &model.Tenant{
+		Slug:         "acme",
+		Name:         "Acme",
+		Hosts:        []string{"login.acme.example"},
+		OTPLength:    &length,
+		RateLimitMax: &max,
+	}
+	if err := e.mem.SaveTenant(ctx, acme); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("acme-key"))
+	if err := e.mem.SetTenantAPIKey(ctx, "acme", hex.EncodeToString(sum[:])); err != nil {
+		t.Fatal(err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(e.h.TenantMiddleware)
+	r.Post("/otp/request", e.h.RequestOTP)
+	r.Post("/otp/verify", e.h.VerifyOTP)
+	r.With(e.h.AuthMiddleware).Get("/users/me", e.h.GetUser)
+	r.With(e.h.AuthMiddleware).Post("/users/me/emails", e.h.AddEmail)
+	do := func(method, target, host string, header http.Header, body interface{}) *httptest.ResponseRecorder {
+		t.Helper()
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(body)
+		req := httptest.NewRequest(method, target, &buf)
+		req.Host = host
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	login := func(host string, header http.Header, codeKey string) (string, model.User) {
+		t.Helper()
+		if w := do("POST", "/otp/request", host, header, reqPhone{Phone: "+15550001"}); w.Code != http.StatusOK {
+			t.Fatalf("%s: request otp: %d %s", host, w.Code, w.Body)
+		}
+		w := do("POST", "/otp/verify", host, header, reqVerify{Phone: "+15550001", OTP: e.otps.codes[codeKey]})
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: verify otp: %d %s", host, w.Code, w.Body)
+		}
+		var resp VerifyOTPResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Token, *resp.User
+	}
+
+	defaultToken, defaultUser := login("auth.example.com", nil, "+15550001")
+	if code := e.otps.codes["+15550001"]; len(code) != 6 {
+		t.Fatalf("default tenant otp = %q, want 6 digits", code)
+	}
+	// the same number registers separately in the other tenant, with its
+	// own code length
+	acmeToken, acmeUser := login("Login.Acme.Example:443", nil, "t2:+15550001")
+	if code := e.otps.codes["t2:+15550001"]; len(code) != 8 {
+		t.Fatalf("acme otp = %q, want 8 digits", code)
+	}
+	if acmeUser.PublicID == defaultUser.PublicID {
+		t.Fatal("acme login reused the default tenant's user")
+	}
+
+	// the tenant's rate limit applies to its own requests only
+	if w := do("POST", "/otp/request", "login.acme.example", nil, reqPhone{Phone: "+15550001"}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("acme second request: status = %d, want 429", w.Code)
+	}
+	if w := do("POST", "/otp/request", "auth.example.com", nil, reqPhone{Phone: "+15550001"}); w.Code != http.StatusOK {
+		t.Fatalf("default second request: status = %d, want 200", w.Code)
+	}
+
+	bearer := func(token string) http.Header { return http.Header{"Authorization": {"Bearer " + token}} }
+	for _, tc := range []struct {
+		name, host, token string
+		want              int
+	}{
+		{"default token at default host", "auth.example.com", defaultToken, http.StatusOK},
+		{"acme token at acme host", "login.acme.example", acmeToken, http.StatusOK},
+		{"default token at acme host", "login.acme.example", defaultToken, http.StatusUnauthorized},
+		{"acme token at default host", "auth.example.com", acmeToken, http.StatusUnauthorized},
+	} {
+		if w := do("GET", "/users/me", tc.host, bearer(tc.token), nil); w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+
+	// an API key selects its tenant whatever the host; an unknown one is
+	// refused rather than served as the default tenant
+	h := bearer(acmeToken)
+	h.Set(APIKeyHeader, "acme-key")
+	if w := do("GET", "/users/me", "auth.example.com", h, nil); w.Code != http.StatusOK {
+		t.Errorf("acme token with acme api key: status = %d, want 200", w.Code)
+	}
+	if w := do("GET", "/users/me", "auth.example.com", http.Header{APIKeyHeader: {"wrong"}}, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown api key: status = %d, want 401", w.Code)
+	}
+
+	// an email taken in the default tenant is free in acme
+	d, _ := e.mem.FindUserByPhone(ctx, "+15550001")
+	a, _ := e.mem.FindUserByPhone(storage.WithTenant(ctx, acme.ID), "+15550001")
+	if _, err := e.mem.AddUserEmail(ctx, d.ID, "ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if w := do("POST", "/users/me/emails", "login.acme.example", bearer(acmeToken), reqEmail{Email: "ada@example.com"}); w.Code != http.StatusOK {
+		t.Fatalf("acme add email taken in default tenant: status = %d, want 200", w.Code)
+	}
+	if _, err := e.mem.AddUserEmail(ctx, a.ID, "ada@example.com"); err != nil {
+		t.Fatalf("attach email in acme: %v", err)
+	}
+}
+
+func TestClientApps(t *testing.T) {
+	e := newTestEnv(t)
+	e.h.cfg.OTPRequireClientKey = true
+	ctx := context.Background()
+	create := func(app *model.ClientApp) string {
+		t.Helper()
+		key, prefix, hash, err := storage.NewClientAppKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.TenantID, app.KeyPrefix = storage.DefaultTenantID, prefix
+		if err := e.mem.CreateClientApp(ctx, app, hash); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	max, window := 2, 60
+	open := create(&model.ClientApp{Name: "mobile", RateLimitMax: &max, RateLimitWindowSec: &window})
+	web := create(&model.ClientApp{Name: "web", AllowedOrigins: model.StringList{"https://app.example"}})
+
+	r := chi.NewRouter()
+	r.Use(e.h.TenantMiddleware)
+	r.With(e.h.ClientAppMiddleware).Post("/otp/request", e.h.RequestOTP)
+	do := func(phone string, header http.Header) int {
+		t.Helper()
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(reqPhone{Phone: phone})
+		req := httptest.NewRequest("POST", "/otp/request", &buf)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, tc := range []struct {
+		name   string
+		phone  string
+		header http.Header
+		want   int
+	}{
+		{"no key", "+15550001", nil, http.StatusUnauthorized},
+		{"unknown key", "+15550001", http.Header{ClientKeyHeader: {"otpk_nope"}}, http.StatusUnauthorized},
+		{"valid key", "+15550001", http.Header{ClientKeyHeader: {open}}, http.StatusOK},
+		{"allowed origin", "+15550002", http.Header{ClientKeyHeader: {web}, "Origin": {"https://APP.example"}}, http.StatusOK},
+		{"other origin", "+15550003", http.Header{ClientKeyHeader: {web}, "Origin": {"https://evil.example"}}, http.StatusForbidden},
+		{"no origin", "+15550003", http.Header{ClientKeyHeader: {web}}, http.StatusForbidden},
+		// the key's limit spans phone numbers
+		{"within key limit", "+15550004", http.Header{ClientKeyHeader: {open}}, http.StatusOK},
+		{"over key limit", "+15550005", http.Header{ClientKeyHeader: {open}}, http.StatusTooManyRequests},
+	} {
+		if got := do(tc.phone, tc.header); got != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	app, err := e.mem.ClientAppByKey(ctx, storage.HashClientAppKey(web))
+	if err != nil || app.LastUsedAt == nil {
+		t.Fatalf("web app = %+v, %v; want last used set", app, err)
+	}
+	if err := e.mem.RevokeClientApp(ctx, app.KeyPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if got := do("+15550006", http.Header{ClientKeyHeader: {web}, "Origin": {"https://app.example"}}); got != http.StatusUnauthorized {
+		t.Errorf("revoked key: status = %d, want 401", got)
+	}
+
+	// without the requirement keyless requests still pass
+	e.h.cfg.OTPRequireClientKey = false
+	if got := do("+15550007", nil); got != http.StatusOK {
+		t.Errorf("optional key: status = %d, want 200", got)
+	}
+}
@@ -2,17 +2,26 @@ package api
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/example/go-otp-auth/internal/auth"
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
 )
 
 type contextKey string
 
 const userIDKey contextKey = "userID"
+const claimsKey contextKey = "claims"
 
-func AuthMiddleware(next http.Handler) http.Handler {
+// AuthMiddleware validates the bearer token and rejects tokens issued before
+// the user's sessions were revoked or belonging to accounts that are no
+// longer active.
+func (h *Handler) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
@@ -26,20 +35,122 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		userID, err := auth.ParseToken(parts[1])
+		claims, err := h.parseToken(r.Context(), parts[1])
 		if err != nil {
 			http.Error(w, "invalid token", http.StatusUnauthorized)
 			return
 		}
+		if err := h.resolveSubject(r.Context(), claims); errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Error().Err(err).Msg("resolve token subject")
+			http.Error(w, "internal", http.StatusInternalServerError)
+			return
+		}
+
+		revokedAt, err := h.revoker.TokensRevokedAt(r.Context(), claims.UserID)
+		if err != nil {
+			log.Error().Err(err).Msg("redis tokens revoked at")
+			http.Error(w, "internal", http.StatusInternalServerError)
+			return
+		}
+		if !revokedAt.IsZero() && !claims.IssuedAt.After(revokedAt) {
+			http.Error(w, "token revoked", http.StatusUnauthorized)
+			return
+		}
 
-		// put userID into context
-		ctx := context.WithValue(r.Context(), userIDKey, userID)
+		// tokens stop working as soon as the account leaves the active state
+		status, reason, err := h.users.GetUserStatus(r.Context(), claims.UserID)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("get user status")
+			http.Error(w, "internal", http.StatusInternalServerError)
+			return
+		}
+		if status != model.UserStatusActive {
+			writeAccountStatusError(w, status, reason)
+			return
+		}
+
+		// put userID and claims into context
+		ctx := context.WithValue(r.Context(), userIDKey, claims.UserID)
+		ctx = context.WithValue(ctx, claimsKey, claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// resolveSubject fills in the internal user id of a token whose subject is a
+// public id. Tokens with a numeric subject already carry it. It returns
+// storage.ErrNotFound if no such user exists.
+func (h *Handler) resolveSubject(ctx context.Context, claims *auth.Claims) error {
+	if claims.Subject == "" {
+		return nil
+	}
+	if _, err := uuid.Parse(claims.Subject); err != nil {
+		return storage.ErrNotFound
+	}
+	id, err := h.users.ResolvePublicID(ctx, claims.Subject)
+	if err != nil {
+		return err
+	}
+	claims.UserID = id
+	return nil
+}
+
+// RequireScope rejects requests whose token lacks any of the given scopes.
+// It must be chained after AuthMiddleware.
+func RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := GetClaimsFromContext(r)
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			for _, s := range scopes {
+				if !claims.HasScope(s) {
+					http.Error(w, "forbidden", http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRole rejects requests whose token has none of the given roles.
+// It must be chained after AuthMiddleware.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := GetClaimsFromContext(r)
+			if !ok {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			for _, role := range roles {
+				if claims.HasRole(role) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			http.Error(w, "forbidden", http.StatusForbidden)
+		})
+	}
+}
+
 // GetUserIDFromContext helper
 func GetUserIDFromContext(r *http.Request) (int64, bool) {
 	uid, ok := r.Context().Value(userIDKey).(int64)
 	return uid, ok
 }
+
+// GetClaimsFromContext helper
+func GetClaimsFromContext(r *http.Request) (*auth.Claims, bool) {
+	c, ok := r.Context().Value(claimsKey).(*auth.Claims)
+	return c, ok
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
+	"github.com/example/go-otp-auth/internal/util"
+)
+
+type reqConfirmPhone struct {
+	Phone string `json:"phone"`
+	// OTP is the code sent to the new number
+	OTP string `json:"otp"`
+	// OldOTP is the code sent to the current number, when required
+	OldOTP string `json:"old_otp,omitempty"`
+}
+
+// Phone change codes are bound to the user, so a code cannot be replayed
+// by another account or for another number
+func phoneChangeKey(userID int64, phone string) string {
+	return fmt.Sprintf("phone-change:%d:%s", userID, phone)
+}
+
+func phoneChangeOldKey(userID int64) string {
+	return fmt.Sprintf("phone-change-old:%d", userID)
+}
+
+// StartPhoneChange godoc
+// @Summary Start phone number change
+// @Description Send a code to the new number and, if required, to the current one
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param request body reqPhone true "New phone number"
+// @Success 200 {object} map[string]interface{} "otp_sent and whether the old number must be verified"
+// @Failure 400 {string} string "invalid request or phone"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 409 {string} string "phone already in use"
+// @Failure 429 {string} string "rate limit exceeded"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /users/me/phone [post]
+func (h *Handler) StartPhoneChange(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req reqPhone
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Phone == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	phone, ok := util.NormalizePhone(req.Phone)
+	if !ok {
+		http.Error(w, "invalid phone", http.StatusBadRequest)
+		return
+	}
+	req.Phone = phone
+	ctx := storage.WithPrimary(r.Context())
+
+	u, err := h.users.GetUserByID(ctx, userID)
+	if err != nil {
+		writeStorageError(w, err, "get user")
+		return
+	}
+	if u.Phone == req.Phone {
+		http.Error(w, "phone unchanged", http.StatusBadRequest)
+		return
+	}
+	if _, err := h.users.FindUserByPhone(ctx, req.Phone); err == nil {
+		http.Error(w, "phone already in use", http.StatusConflict)
+		return
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		log.Error().Err(err).Msg("find user by phone")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+
+	// the new number draws on the same budgets as login codes
+	limit, err := h.checkLimits(ctx, h.requestLimits(r, req.Phone))
+	if err != nil {
+		log.Error().Err(err).Msg("redis error")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	if limit != "" {
+		h.recordEvent(r, model.AuthEvent{
+			Type:    model.EventOTPRequested,
+			UserID:  &userID,
+			Phone:   req.Phone,
+			Details: map[string]string{"flow": "phone_change", "result": "rate_limited", "limit": limit},
+		})
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	if err := h.sendPhoneCode(r, phoneChangeKey(userID, req.Phone), req.Phone); err != nil {
+		log.Error().Err(err).Msg("save phone change otp")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	if h.cfg.PhoneChangeVerifyOld {
+		if err := h.sendPhoneCode(r, phoneChangeOldKey(userID), u.Phone); err != nil {
+			log.Error().Err(err).Msg("save phone change otp")
+			http.Error(w, "internal", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	WriteJSON(w, map[string]interface{}{"status": "otp_sent", "verify_old": h.cfg.PhoneChangeVerifyOld})
+}
+
+// sendPhoneCode stores a new code under key and "sends" it to phone
+func (h *Handler) sendPhoneCode(r *http.Request, key, phone string) error {
+	otp, message, err := h.issueOTP(r.Context(), key)
+	if err != nil {
+		return err
+	}
+	log.Info().Str("phone", phone).Str("otp", otp).Str("message", message).Msg("generated phone change otp")
+	return nil
+}
+
+// ConfirmPhoneChange godoc
+// @Summary Confirm phone number change
+// @Description Move the authenticated user to the new number and revoke all of their tokens, including the one used for this request
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param request body reqConfirmPhone true "New phone number and codes"
+// @Success 200 {object} UserResponse
+// @Failure 400 {string} string "invalid request or phone"
+// @Failure 401 {string} string "invalid or expired otp"
+// @Failure 409 {string} string "phone already in use"
+// @Failure 429 {string} string "rate limit exceeded"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /users/me/phone/verify [post]
+func (h *Handler) ConfirmPhoneChange(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req reqConfirmPhone
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Phone == "" || req.OTP == "" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	phone, ok := util.NormalizePhone(req.Phone)
+	if !ok {
+		http.Error(w, "invalid phone", http.StatusBadRequest)
+		return
+	}
+	req.Phone = phone
+	if h.cfg.PhoneChangeVerifyOld && req.OldOTP == "" {
+		http.Error(w, "old_otp required", http.StatusBadRequest)
+		return
+	}
+	ctx := storage.WithPrimary(r.Context())
+
+	// one limit covers both codes, they are always submitted together
+	limit, err := h.checkLimits(ctx, h.verifyLimits(r, phoneChangeKey(userID, req.Phone)))
+	if err != nil {
+		log.Error().Err(err).Msg("redis error")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	if limit != "" {
+		h.recordEvent(r, model.AuthEvent{
+			Type:    model.EventOTPFailed,
+			UserID:  &userID,
+			Phone:   req.Phone,
+			Details: map[string]string{"flow": "phone_change", "result": "rate_limited", "limit": limit},
+		})
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	ok, err = h.verifyOTP(ctx, phoneChangeKey(userID, req.Phone), req.OTP)
+	if err == nil && ok && h.cfg.PhoneChangeVerifyOld {
+		ok, err = h.verifyOTP(ctx, phoneChangeOldKey(userID), req.OldOTP)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("redis verify otp")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		h.recordEvent(r, model.AuthEvent{
+			Type:    model.EventOTPFailed,
+			UserID:  &userID,
+			Phone:   req.Phone,
+			Details: map[string]string{"flow": "phone_change"},
+		})
+		http.Error(w, "invalid or expired otp", http.StatusUnauthorized)
+		return
+	}
+
+	u, err := h.users.UpdateUserPhone(ctx, userID, req.Phone, userID)
+	if errors.Is(err, storage.ErrConflict) {
+		http.Error(w, "phone already in use", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err, "update user phone")
+		return
+	}
+	if err := h.revoker.RevokeUserTokens(ctx, userID, h.issuer(ctx).TTL); err != nil {
+		log.Error().Err(err).Msg("redis revoke tokens")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+
+	h.recordEvent(r, model.AuthEvent{
+		Type:   model.EventPhoneChanged,
+		UserID: &userID,
+		Phone:  u.Phone,
+	})
+	WriteJSON(w, u)
+}
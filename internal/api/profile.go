@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/language"
+
+	"github.com/example/go-otp-auth/internal/model"
+)
+
+// Profile field limits
+const (
+	maxDisplayNameLen = 100
+	maxEmailLen       = 254
+	maxAvatarURLLen   = 2048
+	maxMetadataBytes  = 4096
+)
+
+// reqUpdateProfile is a partial update; omitted fields are left unchanged
+// and an empty string clears a field
+type reqUpdateProfile struct {
+	DisplayName *string        `json:"display_name"`
+	Email       *string        `json:"email"`
+	Locale      *string        `json:"locale" example:"en-US"`
+	Timezone    *string        `json:"timezone" example:"Europe/Berlin"`
+	AvatarURL   *string        `json:"avatar_url"`
+	Metadata    model.Metadata `json:"metadata" swaggertype:"object"`
+}
+
+// UpdateProfile godoc
+// @Summary Update current user's profile
+// @Description Change profile fields of the authenticated user. Omitted fields are left unchanged, an empty string clears a field and metadata replaces the stored object.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param request body reqUpdateProfile true "Profile fields"
+// @Success 200 {object} UserResponse
+// @Failure 400 {string} string "invalid request"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /users/me [patch]
+func (h *Handler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req reqUpdateProfile
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	pu, err := req.validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u, err := h.users.UpdateUserProfile(r.Context(), userID, pu)
+	if err != nil {
+		writeStorageError(w, err, "update user profile")
+		return
+	}
+	WriteJSON(w, u)
+}
+
+// validate checks and normalizes the request
+func (req reqUpdateProfile) validate() (model.ProfileUpdate, error) {
+	pu := model.ProfileUpdate{Metadata: req.Metadata}
+
+	if req.DisplayName != nil {
+		name := strings.TrimSpace(*req.DisplayName)
+		if utf8.RuneCountInString(name) > maxDisplayNameLen {
+			return pu, errors.New("display_name is too long")
+		}
+		if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+			return pu, errors.New("display_name contains control characters")
+		}
+		pu.DisplayName = &name
+	}
+
+	if req.Email != nil {
+		email := strings.TrimSpace(*req.Email)
+		if email != "" {
+			var ok bool
+			if email, ok = normalizeEmail(email); !ok {
+				return pu, errors.New("invalid email")
+			}
+		}
+		pu.Email = &email
+	}
+
+	if req.Locale != nil {
+		locale := *req.Locale
+		if locale != "" {
+			tag, err := language.Parse(locale)
+			if err != nil {
+				return pu, errors.New("invalid locale")
+			}
+			locale = tag.String()
+		}
+		pu.Locale = &locale
+	}
+
+	if req.Timezone != nil {
+		tz := *req.Timezone
+		if tz != "" {
+			// LoadLocation also accepts "" and "Local", which are not zones
+			if _, err := time.LoadLocation(tz); err != nil || tz == "Local" {
+				return pu, errors.New("invalid timezone")
+			}
+		}
+		pu.Timezone = &tz
+	}
+
+	if req.AvatarURL != nil {
+		avatar := strings.TrimSpace(*req.AvatarURL)
+		if avatar != "" {
+			u, err := url.Parse(avatar)
+			if err != nil || u.Scheme != "https" || u.Host == "" || len(avatar) > maxAvatarURLLen {
+				return pu, errors.New("avatar_url must be an https URL")
+			}
+		}
+		pu.AvatarURL = &avatar
+	}
+
+	if req.Metadata != nil {
+		if b, _ := json.Marshal(req.Metadata); len(b) > maxMetadataBytes {
+			return pu, errors.New("metadata is too large")
+		}
+	}
+	return pu, nil
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/storage"
+)
+
+// rateLimit is one layer of the OTP endpoint limits
+type rateLimit struct {
+	// name is reported as the "limit" of a rate_limited event
+	name string
+	key  string
+	storage.RateLimit
+}
+
+// requestLimits are the limits on sending a code to subject, a phone number
+// or an email key: per client network, per phone number prefix, per subject
+// under the tenant's policy and across the service. The network, prefix and
+// global limits protect the service as a whole and are not split by tenant.
+func (h *Handler) requestLimits(r *http.Request, subject string) []rateLimit {
+	p := h.otpPolicy(r.Context())
+	limits := []rateLimit{h.ipLimit(r, "request")}
+	if digits := h.cfg.PrefixRateLimitDigits; strings.HasPrefix(subject, "+") && digits > 0 && len(subject) > digits+1 {
+		limits = append(limits, rateLimit{name: "prefix", key: "prefix:" + subject[:digits+1], RateLimit: storage.RateLimit{
+			Algorithm: h.cfg.PrefixRateLimitAlgorithm,
+			Max:       h.cfg.PrefixRateLimitMax,
+			Window:    time.Duration(h.cfg.PrefixRateLimitWindowSeconds) * time.Second,
+		}})
+	}
+	return append(limits,
+		rateLimit{name: "subject", key: scopedKey(p.tenantID, subject), RateLimit: p.rateLimit},
+		rateLimit{name: "global", key: "global:request", RateLimit: storage.RateLimit{
+			Algorithm: h.cfg.GlobalRateLimitAlgorithm,
+			Max:       h.cfg.GlobalRateLimitPerMinute,
+			Window:    time.Minute,
+		}},
+	)
+}
+
+// verifyLimits are the limits on guessing the code of subject: per client
+// network and per subject
+func (h *Handler) verifyLimits(r *http.Request, subject string) []rateLimit {
+	p := h.otpPolicy(r.Context())
+	return []rateLimit{
+		h.ipLimit(r, "verify"),
+		{name: "subject", key: scopedKey(p.tenantID, "verify:"+subject), RateLimit: storage.RateLimit{
+			Algorithm: h.cfg.VerifyRateLimitAlgorithm,
+			Max:       h.cfg.VerifyRateLimitMax,
+			Window:    p.rateLimit.Window,
+		}},
+	}
+}
+
+func (h *Handler) ipLimit(r *http.Request, action string) rateLimit {
+	return rateLimit{name: "ip", key: "ip:" + action + ":" + h.clientNetwork(h.clientIP(r)), RateLimit: storage.RateLimit{
+		Algorithm: h.cfg.IPRateLimitAlgorithm,
+		Max:       h.cfg.IPRateLimitMax,
+		Window:    time.Duration(h.cfg.IPRateLimitWindowSeconds) * time.Second,
+	}}
+}
+
+// checkLimits counts a request against each limit in turn and returns the
+// name of the first one exceeded, or "" if all pass. Limits after the
+// exceeded one are not counted, so a flood from one network does not use up
+// the global budget. A limit with max 0 is off.
+func (h *Handler) checkLimits(ctx context.Context, limits []rateLimit) (string, error) {
+	for _, l := range limits {
+		if l.Max <= 0 {
+			continue
+		}
+		allowed, err := h.limiter.AllowOTPRequest(ctx, l.key, l.RateLimit)
+		if err != nil {
+			return "", err
+		}
+		if !allowed {
+			return l.name, nil
+		}
+	}
+	return "", nil
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// believed as far as trusted proxies appended to it: the client is the
+// rightmost address that is not a trusted proxy.
+func (h *Handler) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !h.trustedProxy(addr) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// whatever comes before a malformed hop cannot be trusted
+			break
+		}
+		addr = hop.Unmap()
+		if !h.trustedProxy(addr) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+func (h *Handler) trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range h.cfg.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientNetwork returns the network of ip that shares an IP rate limit, so a
+// client cannot escape the limit by rotating through its IPv6 /64
+func (h *Handler) clientNetwork(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap().WithZone("")
+	bits := h.cfg.IPRateLimitIPv6Prefix
+	if addr.Is4() {
+		bits = h.cfg.IPRateLimitIPv4Prefix
+	}
+	if bits <= 0 || bits > addr.BitLen() {
+		bits = addr.BitLen()
+	}
+	return netip.PrefixFrom(addr, bits).Masked().String()
+}
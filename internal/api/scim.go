@@ -0,0 +1,688 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
+	"github.com/example/go-otp-auth/internal/util"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// SCIM 2.0 schema URNs (RFC 7643, RFC 7644)
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// SCIM error types (RFC 7644 3.12)
+const (
+	scimTypeFilter     = "invalidFilter"
+	scimTypeValue      = "invalidValue"
+	scimTypeSyntax     = "invalidSyntax"
+	scimTypeUniqueness = "uniqueness"
+	scimTypeMutability = "mutability"
+	scimTypeNoTarget   = "noTarget"
+)
+
+// SCIM audit actions not shared with the admin API
+const (
+	actionSCIMCreate = "create"
+	actionSCIMUpdate = "update"
+)
+
+const (
+	scimContentType = "application/scim+json"
+	scimUsersPath   = "/scim/v2/Users/"
+	scimMobile      = "mobile"
+	// scimMobilePath is the lower-cased patch path of the phone number
+	scimMobilePath = `phonenumbers[type eq "mobile"].value`
+	// scimMaxCount is the default and largest page size
+	scimMaxCount      = 100
+	scimSuspendReason = "deprovisioned by identity provider"
+)
+
+const scimTenantKey contextKey = "scimTenant"
+
+// errSCIMFilter wraps the reasons a filter is rejected
+var errSCIMFilter = errors.New("invalid filter")
+
+// reqSCIMUser is the body of a SCIM create. The phone number is taken from
+// the mobile entry of phoneNumbers, or from userName without one.
+type reqSCIMUser struct {
+	ExternalID   string            `json:"externalId"`
+	UserName     string            `json:"userName"`
+	DisplayName  string            `json:"displayName"`
+	Active       *bool             `json:"active"`
+	PhoneNumbers []SCIMPhoneNumber `json:"phoneNumbers"`
+}
+
+// reqSCIMPatch is a SCIM PatchOp request
+type reqSCIMPatch struct {
+	Schemas    []string      `json:"schemas"`
+	Operations []scimPatchOp `json:"Operations"`
+}
+
+type scimPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value" swaggertype:"object"`
+}
+
+// scimChanges collects the attributes set by a PatchOp; nil fields are left
+// alone
+type scimChanges struct {
+	phone       *string
+	displayName *string
+	externalID  *string
+	active      *bool
+}
+
+// SCIMAuth authenticates an identity provider by the bearer token of its
+// tenant and puts the tenant into the request context. SCIM tenants are
+// named by tenant slug and only provision that tenant's users, whatever
+// tenant the Host or API key of the request resolved to. A token of an
+// unknown tenant is refused.
+func (h *Handler) SCIMAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		tenant := ""
+		if ok && token != "" {
+			tenant = h.scimTenant(token)
+		}
+		if tenant == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			writeSCIMError(w, http.StatusUnauthorized, "", "invalid token")
+			return
+		}
+		ctx := context.WithValue(r.Context(), scimTenantKey, tenant)
+		t, err := h.tenants.TenantBySlug(ctx, tenant)
+		if errors.Is(err, storage.ErrNotFound) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			writeSCIMError(w, http.StatusUnauthorized, "", "unknown tenant")
+			return
+		}
+		if err != nil {
+			writeSCIMStorageError(w, err, "tenant by slug")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withTenant(ctx, t)))
+	})
+}
+
+// scimTenant returns the tenant whose token hash matches token. Every hash
+// is compared so the time taken does not depend on which one matched.
+func (h *Handler) scimTenant(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	got := hex.EncodeToString(sum[:])
+	found := ""
+	for tenant, want := range h.cfg.SCIMTokens {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(strings.ToLower(want))) == 1 {
+			found = tenant
+		}
+	}
+	return found
+}
+
+func scimTenantFromContext(r *http.Request) string {
+	tenant, _ := r.Context().Value(scimTenantKey).(string)
+	return tenant
+}
+
+// SCIMListUsers godoc
+// @Summary List users (SCIM)
+// @Description List the users provisioned by the calling tenant. filter supports a single "eq" comparison on id, userName, externalId, phoneNumbers.value, phoneNumbers[type eq "mobile"].value or active.
+// @Tags scim
+// @Produce json
+// @Param filter query string false "SCIM filter, e.g. userName eq \"+15550001\""
+// @Param startIndex query int false "1-based index of the first result"
+// @Param count query int false "Page size (max 100)"
+// @Success 200 {object} SCIMListResponse
+// @Failure 400 {object} SCIMError "invalidFilter"
+// @Failure 401 {object} SCIMError "invalid token"
+// @Failure 500 {object} SCIMError "internal"
+// @Security BearerAuth
+// @Router /scim/v2/Users [get]
+func (h *Handler) SCIMListUsers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start := 1
+	if v := q.Get("startIndex"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeSCIMError(w, http.StatusBadRequest, scimTypeValue, "invalid startIndex")
+			return
+		}
+		// RFC 7644 3.4.2.4: values below 1 are interpreted as 1
+		start = max(n, 1)
+	}
+	count := scimMaxCount
+	if v := q.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeSCIMError(w, http.StatusBadRequest, scimTypeValue, "invalid count")
+			return
+		}
+		// negative counts are interpreted as 0
+		count = min(max(n, 0), scimMaxCount)
+	}
+
+	list := SCIMListResponse{Schemas: []string{scimListSchema}, StartIndex: start, Resources: []SCIMUser{}}
+	filter, none, err := h.scimFilter(r, q.Get("filter"))
+	if errors.Is(err, errSCIMFilter) {
+		writeSCIMError(w, http.StatusBadRequest, scimTypeFilter, err.Error())
+		return
+	}
+	if err != nil {
+		writeSCIMStorageError(w, err, "resolve scim filter")
+		return
+	}
+	if none {
+		writeSCIM(w, http.StatusOK, list)
+		return
+	}
+
+	users, total, err := h.scim.ListSCIMUsers(r.Context(), scimTenantFromContext(r), filter, start-1, count)
+	if err != nil {
+		writeSCIMStorageError(w, err, "list scim users")
+		return
+	}
+	list.TotalResults = total
+	list.ItemsPerPage = len(users)
+	for i := range users {
+		list.Resources = append(list.Resources, scimUser(&users[i]))
+	}
+	writeSCIM(w, http.StatusOK, list)
+}
+
+// scimFilter translates a SCIM filter into a storage filter. none reports a
+// filter that cannot match any user, such as a phone nobody has.
+func (h *Handler) scimFilter(r *http.Request, expr string) (filter storage.SCIMFilter, none bool, err error) {
+	if strings.TrimSpace(expr) == "" {
+		return filter, false, nil
+	}
+	attr, value, quoted, err := parseSCIMFilter(expr)
+	if err != nil {
+		return filter, false, err
+	}
+	if attr == "active" {
+		b, perr := strconv.ParseBool(value)
+		if quoted || perr != nil {
+			return filter, false, fmt.Errorf("%w: active must be compared to true or false", errSCIMFilter)
+		}
+		filter.Active = &b
+		return filter, false, nil
+	}
+	if !quoted {
+		return filter, false, fmt.Errorf("%w: %s must be compared to a string", errSCIMFilter, attr)
+	}
+
+	switch attr {
+	case "externalid":
+		filter.ExternalID = value
+	case "id":
+		if _, perr := uuid.Parse(value); perr != nil {
+			return filter, true, nil
+		}
+		filter.UserID, err = h.users.ResolvePublicID(r.Context(), value)
+	case "username", "phonenumbers.value", scimMobilePath:
+		phone, ok := util.NormalizePhone(value)
+		if !ok {
+			return filter, true, nil
+		}
+		var u *model.User
+		if u, err = h.users.FindUserByPhone(r.Context(), phone); err == nil {
+			filter.UserID = u.ID
+		}
+	default:
+		return filter, false, fmt.Errorf("%w: unsupported attribute %s", errSCIMFilter, attr)
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		return filter, true, nil
+	}
+	return filter, false, err
+}
+
+// parseSCIMFilter parses `attr eq "value"` or `attr eq true`. attr is
+// returned lower-cased, since SCIM attribute names are case-insensitive.
+func parseSCIMFilter(expr string) (attr, value string, quoted bool, err error) {
+	expr = strings.TrimSpace(expr)
+	// the attribute path ends at the first space outside a value filter
+	// such as phoneNumbers[type eq "mobile"]
+	end := len(expr)
+	depth := 0
+	for i, c := range expr {
+		if c == '[' {
+			depth++
+		} else if c == ']' {
+			depth--
+		} else if c == ' ' && depth == 0 {
+			end = i
+			break
+		}
+	}
+	attr = strings.ToLower(expr[:end])
+	op, rest, ok := strings.Cut(strings.TrimSpace(expr[end:]), " ")
+	if !ok || !strings.EqualFold(op, "eq") {
+		return "", "", false, fmt.Errorf(`%w: only "eq" is supported`, errSCIMFilter)
+	}
+	rest = strings.TrimSpace(rest)
+	if strings.HasPrefix(rest, `"`) {
+		if err := json.Unmarshal([]byte(rest), &value); err != nil {
+			return "", "", false, fmt.Errorf("%w: malformed value", errSCIMFilter)
+		}
+		return attr, value, true, nil
+	}
+	return attr, rest, false, nil
+}
+
+// SCIMGetUser godoc
+// @Summary Get user (SCIM)
+// @Tags scim
+// @Produce json
+// @Param id path string true "Public user ID"
+// @Success 200 {object} SCIMUser
+// @Failure 401 {object} SCIMError "invalid token"
+// @Failure 404 {object} SCIMError "not found"
+// @Failure 500 {object} SCIMError "internal"
+// @Security BearerAuth
+// @Router /scim/v2/Users/{id} [get]
+func (h *Handler) SCIMGetUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.scimUserParam(w, r)
+	if !ok {
+		return
+	}
+	writeSCIM(w, http.StatusOK, scimUser(u))
+}
+
+// SCIMCreateUser godoc
+// @Summary Create user (SCIM)
+// @Description Provision a user for the calling tenant. The phone number is the mobile entry of phoneNumbers, or userName without one.
+// @Tags scim
+// @Accept json
+// @Produce json
+// @Param request body reqSCIMUser true "SCIM user"
+// @Success 201 {object} SCIMUser
+// @Failure 400 {object} SCIMError "invalidSyntax or invalidValue"
+// @Failure 401 {object} SCIMError "invalid token"
+// @Failure 409 {object} SCIMError "uniqueness"
+// @Failure 500 {object} SCIMError "internal"
+// @Security BearerAuth
+// @Router /scim/v2/Users [post]
+func (h *Handler) SCIMCreateUser(w http.ResponseWriter, r *http.Request) {
+	var req reqSCIMUser
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeSCIMError(w, http.StatusBadRequest, scimTypeSyntax, "invalid request")
+		return
+	}
+	raw := req.UserName
+	for _, p := range req.PhoneNumbers {
+		if strings.EqualFold(p.Type, scimMobile) {
+			raw = p.Value
+			break
+		}
+	}
+	phone, ok := util.NormalizePhone(raw)
+	if !ok {
+		writeSCIMError(w, http.StatusBadRequest, scimTypeValue, "a mobile phone number or a phone number as userName is required")
+		return
+	}
+	ctx := storage.WithPrimary(r.Context())
+	tenant := scimTenantFromContext(r)
+
+	nu := storage.SCIMUser{ExternalID: req.ExternalID}
+	nu.Phone = phone
+	nu.DisplayName = req.DisplayName
+	if req.Active != nil && !*req.Active {
+		nu.Status, nu.StatusReason = model.UserStatusSuspended, scimSuspendReason
+	}
+	su, err := h.scim.CreateSCIMUser(ctx, tenant, nu)
+	if errors.Is(err, storage.ErrExternalIDConflict) {
+		writeSCIMError(w, http.StatusConflict, scimTypeUniqueness, "externalId already in use")
+		return
+	}
+	if errors.Is(err, storage.ErrConflict) {
+		writeSCIMError(w, http.StatusConflict, scimTypeUniqueness, "phone number already registered")
+		return
+	}
+	if err != nil {
+		writeSCIMStorageError(w, err, "create scim user")
+		return
+	}
+	h.scimAudit(r, actionSCIMCreate, su.ID, nil)
+
+	res := scimUser(su)
+	w.Header().Set("Location", res.Meta.Location)
+	writeSCIM(w, http.StatusCreated, res)
+}
+
+// SCIMPatchUser godoc
+// @Summary Update user (SCIM)
+// @Description Apply a SCIM PatchOp. Supported paths are active, displayName, externalId, userName and phoneNumbers[type eq "mobile"].value. Setting active to false suspends the user and revokes their tokens; true reactivates a suspended user.
+// @Tags scim
+// @Accept json
+// @Produce json
+// @Param id path string true "Public user ID"
+// @Param request body reqSCIMPatch true "SCIM PatchOp"
+// @Success 200 {object} SCIMUser
+// @Failure 400 {object} SCIMError "invalidSyntax, invalidValue, noTarget or mutability"
+// @Failure 401 {object} SCIMError "invalid token"
+// @Failure 404 {object} SCIMError "not found"
+// @Failure 409 {object} SCIMError "uniqueness"
+// @Failure 500 {object} SCIMError "internal"
+// @Security BearerAuth
+// @Router /scim/v2/Users/{id} [patch]
+func (h *Handler) SCIMPatchUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.scimUserParam(w, r)
+	if !ok {
+		return
+	}
+	var req reqSCIMPatch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Operations) == 0 {
+		writeSCIMError(w, http.StatusBadRequest, scimTypeSyntax, "invalid request")
+		return
+	}
+	var c scimChanges
+	for _, op := range req.Operations {
+		if status, scimType, err := c.apply(op); err != nil {
+			writeSCIMError(w, status, scimType, err.Error())
+			return
+		}
+	}
+	ctx := storage.WithPrimary(r.Context())
+	tenant := scimTenantFromContext(r)
+
+	if c.externalID != nil && *c.externalID != u.ExternalID {
+		err := h.scim.SetSCIMExternalID(ctx, tenant, u.ID, *c.externalID)
+		if errors.Is(err, storage.ErrConflict) {
+			writeSCIMError(w, http.StatusConflict, scimTypeUniqueness, "externalId already in use")
+			return
+		}
+		if err != nil {
+			writeSCIMStorageError(w, err, "set scim external id")
+			return
+		}
+	}
+	if c.displayName != nil && *c.displayName != u.DisplayName {
+		if _, err := h.users.UpdateUserProfile(ctx, u.ID, model.ProfileUpdate{DisplayName: c.displayName}); err != nil {
+			writeSCIMStorageError(w, err, "update user profile")
+			return
+		}
+	}
+	revoke := false
+	if c.phone != nil && *c.phone != u.Phone {
+		// actor 0: the change comes from the identity provider, not a user
+		_, err := h.users.UpdateUserPhone(ctx, u.ID, *c.phone, 0)
+		if errors.Is(err, storage.ErrConflict) {
+			writeSCIMError(w, http.StatusConflict, scimTypeUniqueness, "phone number already registered")
+			return
+		}
+		if err != nil {
+			writeSCIMStorageError(w, err, "update user phone")
+			return
+		}
+		h.scimAudit(r, actionChangePhone, u.ID, nil)
+		revoke = true
+	}
+	if c.active != nil {
+		switch {
+		case !*c.active && u.Status == model.UserStatusActive:
+			if err := h.users.SetUserStatus(ctx, u.ID, model.UserStatusSuspended, scimSuspendReason); err != nil {
+				writeSCIMStorageError(w, err, "set user status")
+				return
+			}
+			h.scimAudit(r, actionSuspend, u.ID, nil)
+			revoke = true
+		case *c.active && u.Status == model.UserStatusSuspended:
+			if err := h.users.SetUserStatus(ctx, u.ID, model.UserStatusActive, ""); err != nil {
+				writeSCIMStorageError(w, err, "set user status")
+				return
+			}
+			h.scimAudit(r, actionUnsuspend, u.ID, nil)
+		case *c.active && u.Status != model.UserStatusActive:
+			writeSCIMError(w, http.StatusBadRequest, scimTypeMutability, "user is "+u.Status+" and can only be reactivated by an admin")
+			return
+		}
+	}
+	if revoke {
+		if err := h.revoker.RevokeUserTokens(ctx, u.ID, h.issuer(ctx).TTL); err != nil {
+			log.Error().Err(err).Msg("redis revoke tokens")
+			writeSCIMError(w, http.StatusInternalServerError, "", "internal")
+			return
+		}
+	}
+	if c.externalID != nil || c.displayName != nil {
+		h.scimAudit(r, actionSCIMUpdate, u.ID, nil)
+	}
+
+	su, err := h.scim.GetSCIMUser(ctx, tenant, u.ID)
+	if err != nil {
+		writeSCIMStorageError(w, err, "get scim user")
+		return
+	}
+	writeSCIM(w, http.StatusOK, scimUser(su))
+}
+
+// apply records one PatchOp operation. On failure it returns the HTTP
+// status and scimType to report.
+func (c *scimChanges) apply(op scimPatchOp) (int, string, error) {
+	switch strings.ToLower(op.Op) {
+	case "add", "replace":
+	case "remove":
+		switch strings.ToLower(op.Path) {
+		case "displayname":
+			c.displayName = new(string)
+		case "externalid":
+			c.externalID = new(string)
+		default:
+			return http.StatusBadRequest, scimTypeMutability, errors.New("cannot remove " + op.Path)
+		}
+		return 0, "", nil
+	default:
+		return http.StatusBadRequest, scimTypeSyntax, errors.New("unsupported op " + op.Op)
+	}
+
+	if op.Path == "" {
+		// the value is a partial user: {"active": false, ...}
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &attrs); err != nil {
+			return http.StatusBadRequest, scimTypeSyntax, errors.New("value must be an object without a path")
+		}
+		for name, v := range attrs {
+			if status, scimType, err := c.set(strings.ToLower(name), v); err != nil {
+				return status, scimType, err
+			}
+		}
+		return 0, "", nil
+	}
+	return c.set(strings.ToLower(op.Path), op.Value)
+}
+
+// set records the new value of one attribute; path is lower-cased
+func (c *scimChanges) set(path string, v json.RawMessage) (int, string, error) {
+	var err error
+	switch path {
+	case "active":
+		var b bool
+		if b, err = scimBool(v); err == nil {
+			c.active = &b
+		}
+	case "displayname":
+		var s string
+		if err = json.Unmarshal(v, &s); err == nil {
+			c.displayName = &s
+		}
+	case "externalid":
+		var s string
+		if err = json.Unmarshal(v, &s); err == nil {
+			c.externalID = &s
+		}
+	case "username", scimMobilePath:
+		var s string
+		if err = json.Unmarshal(v, &s); err == nil {
+			err = c.setPhone(s)
+		}
+	case "phonenumbers":
+		var numbers []SCIMPhoneNumber
+		if err = json.Unmarshal(v, &numbers); err != nil {
+			break
+		}
+		err = errors.New("phoneNumbers needs an entry of type mobile")
+		for _, n := range numbers {
+			if strings.EqualFold(n.Type, scimMobile) {
+				err = c.setPhone(n.Value)
+				break
+			}
+		}
+	case "schemas", "id", "meta":
+		// echoed back by some clients with a full replace; read-only
+		return 0, "", nil
+	default:
+		return http.StatusBadRequest, scimTypeNoTarget, errors.New("unsupported path " + path)
+	}
+	if err != nil {
+		return http.StatusBadRequest, scimTypeValue, errors.New("invalid value for " + path)
+	}
+	return 0, "", nil
+}
+
+func (c *scimChanges) setPhone(raw string) error {
+	phone, ok := util.NormalizePhone(raw)
+	if !ok {
+		return errors.New("invalid phone")
+	}
+	c.phone = &phone
+	return nil
+}
+
+// scimBool accepts true/false and, as some identity providers send them,
+// the strings "True" and "False"
+func scimBool(v json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(v, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(v, &s); err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(s)
+}
+
+// SCIMDeleteUser godoc
+// @Summary Delete user (SCIM)
+// @Description Delete a user and revoke their tokens. The account is purged after the deletion grace period and is no longer visible over SCIM.
+// @Tags scim
+// @Param id path string true "Public user ID"
+// @Success 204
+// @Failure 401 {object} SCIMError "invalid token"
+// @Failure 404 {object} SCIMError "not found"
+// @Failure 500 {object} SCIMError "internal"
+// @Security BearerAuth
+// @Router /scim/v2/Users/{id} [delete]
+func (h *Handler) SCIMDeleteUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.scimUserParam(w, r)
+	if !ok {
+		return
+	}
+	ctx := storage.WithPrimary(r.Context())
+
+	if err := h.users.SetUserStatus(ctx, u.ID, model.UserStatusDeleted, scimSuspendReason); err != nil {
+		writeSCIMStorageError(w, err, "set user status")
+		return
+	}
+	if err := h.revoker.RevokeUserTokens(ctx, u.ID, h.issuer(ctx).TTL); err != nil {
+		log.Error().Err(err).Msg("redis revoke tokens")
+		writeSCIMError(w, http.StatusInternalServerError, "", "internal")
+		return
+	}
+
+	h.scimAudit(r, actionDelete, u.ID, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scimUserParam loads the user named in the route, which must belong to the
+// calling tenant
+func (h *Handler) scimUserParam(w http.ResponseWriter, r *http.Request) (*storage.SCIMUser, bool) {
+	publicID := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(publicID); err != nil {
+		writeSCIMError(w, http.StatusNotFound, "", "not found")
+		return nil, false
+	}
+	ctx := storage.WithPrimary(r.Context())
+	id, err := h.users.ResolvePublicID(ctx, publicID)
+	if err == nil {
+		var u *storage.SCIMUser
+		if u, err = h.scim.GetSCIMUser(ctx, scimTenantFromContext(r), id); err == nil {
+			return u, true
+		}
+	}
+	writeSCIMStorageError(w, err, "get scim user")
+	return nil, false
+}
+
+// scimAudit records a change made by the calling tenant's identity provider
+func (h *Handler) scimAudit(r *http.Request, action string, targetID int64, details map[string]string) {
+	if details == nil {
+		details = map[string]string{}
+	}
+	details["tenant"] = scimTenantFromContext(r)
+	h.recordEvent(r, model.AuthEvent{
+		Type:    model.EventSCIMPrefix + action,
+		UserID:  &targetID,
+		Details: details,
+	})
+}
+
+func scimUser(u *storage.SCIMUser) SCIMUser {
+	return SCIMUser{
+		Schemas:      []string{scimUserSchema},
+		ID:           u.PublicID,
+		ExternalID:   u.ExternalID,
+		UserName:     u.Phone,
+		DisplayName:  u.DisplayName,
+		Active:       u.Status == model.UserStatusActive,
+		PhoneNumbers: []SCIMPhoneNumber{{Value: u.Phone, Type: scimMobile, Primary: true}},
+		Meta: SCIMMeta{
+			ResourceType: "User",
+			Created:      u.RegisteredAt.UTC().Format(time.RFC3339),
+			Location:     scimUsersPath + u.PublicID,
+		},
+	}
+}
+
+func writeSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeSCIMError(w http.ResponseWriter, status int, scimType, detail string) {
+	writeSCIM(w, status, SCIMError{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(status),
+		SCIMType: scimType,
+		Detail:   detail,
+	})
+}
+
+func writeSCIMStorageError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, storage.ErrNotFound) {
+		writeSCIMError(w, http.StatusNotFound, "", "not found")
+		return
+	}
+	log.Error().Err(err).Msg(msg)
+	writeSCIMError(w, http.StatusInternalServerError, "", "internal")
+}
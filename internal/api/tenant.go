@@ -0,0 +1,248 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/auth"
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
+	"github.com/example/go-otp-auth/internal/util"
+	"github.com/rs/zerolog/log"
+)
+
+const tenantKey contextKey = "tenant"
+
+// APIKeyHeader carries a tenant's API key. It takes precedence over the Host
+// header when resolving the tenant.
+const APIKeyHeader = "X-API-Key"
+
+// tenantCacheTTL bounds how long a tenant change made with the CLI takes to
+// reach running servers
+const tenantCacheTTL = 30 * time.Second
+
+// tenantCache remembers which tenant a host or API key hash resolved to
+type tenantCache struct {
+	mu      sync.Mutex
+	entries map[string]tenantCacheEntry
+}
+
+type tenantCacheEntry struct {
+	tenant  *model.Tenant
+	expires time.Time
+}
+
+func newTenantCache() *tenantCache {
+	return &tenantCache{entries: map[string]tenantCacheEntry{}}
+}
+
+func (c *tenantCache) get(key string) *model.Tenant {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return e.tenant
+}
+
+func (c *tenantCache) put(key string, t *model.Tenant) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = tenantCacheEntry{tenant: t, expires: time.Now().Add(tenantCacheTTL)}
+}
+
+// TenantMiddleware resolves the tenant of a request from its API key, else
+// its Host header, else falls back to the default tenant. An unknown API key
+// is rejected rather than served as the default tenant.
+func (h *Handler) TenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, err := h.resolveTenant(r)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "invalid api key", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("resolve tenant")
+			http.Error(w, "internal", http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), t)))
+	})
+}
+
+func (h *Handler) resolveTenant(r *http.Request) (*model.Tenant, error) {
+	ctx := r.Context()
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		hash := hex.EncodeToString(sum[:])
+		if t := h.tenantCache.get("key:" + hash); t != nil {
+			return t, nil
+		}
+		t, err := h.tenants.TenantByAPIKey(ctx, hash)
+		if err != nil {
+			return nil, err
+		}
+		h.tenantCache.put("key:"+hash, t)
+		return t, nil
+	}
+
+	host := normalizeHost(r.Host)
+	if t := h.tenantCache.get("host:" + host); t != nil {
+		return t, nil
+	}
+	t, err := h.tenants.TenantByHost(ctx, host)
+	if errors.Is(err, storage.ErrNotFound) {
+		t, err = h.tenants.GetTenant(ctx, storage.DefaultTenantID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.tenantCache.put("host:"+host, t)
+	return t, nil
+}
+
+// normalizeHost lowercases a Host header and strips its port
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// withTenant puts t into ctx and limits the user lookups made with ctx to it
+func withTenant(ctx context.Context, t *model.Tenant) context.Context {
+	ctx = context.WithValue(ctx, tenantKey, t)
+	return storage.WithTenant(ctx, t.ID)
+}
+
+// tenant returns the tenant of the request, or the default tenant with no
+// overrides when TenantMiddleware did not run
+func tenant(ctx context.Context) *model.Tenant {
+	if t, ok := ctx.Value(tenantKey).(*model.Tenant); ok {
+		return t
+	}
+	return &model.Tenant{ID: storage.DefaultTenantID, Slug: "default"}
+}
+
+// scopedKey prefixes an OTP or rate limit key with its tenant so the same
+// phone number or email in two tenants gets separate codes and budgets.
+// Keys of the default tenant are left as they were before tenants.
+func scopedKey(tenantID int64, key string) string {
+	if tenantID == storage.DefaultTenantID {
+		return key
+	}
+	return fmt.Sprintf("t%d:%s", tenantID, key)
+}
+
+// otpPolicy is the OTP settings of a tenant: its overrides on top of the
+// service configuration
+type otpPolicy struct {
+	tenantID  int64
+	brand     string
+	length    int
+	ttl       time.Duration
+	rateLimit storage.RateLimit
+	message   string
+}
+
+func (h *Handler) otpPolicy(ctx context.Context) otpPolicy {
+	t := tenant(ctx)
+	p := otpPolicy{
+		tenantID: t.ID,
+		brand:    t.Name,
+		length:   h.cfg.OTPLength,
+		ttl:      time.Duration(h.cfg.OTPTTLSeconds) * time.Second,
+		rateLimit: storage.RateLimit{
+			Algorithm: h.cfg.RateLimitAlgorithm,
+			Max:       h.cfg.RateLimitMax,
+			Window:    time.Duration(h.cfg.RateLimitWindowSeconds) * time.Second,
+		},
+		message: h.cfg.OTPMessageTemplate,
+	}
+	if t.OTPLength != nil {
+		p.length = *t.OTPLength
+	}
+	if t.OTPTTLSeconds != nil {
+		p.ttl = time.Duration(*t.OTPTTLSeconds) * time.Second
+	}
+	if t.RateLimitMax != nil {
+		p.rateLimit.Max = *t.RateLimitMax
+	}
+	if t.RateLimitWindowSec != nil {
+		p.rateLimit.Window = time.Duration(*t.RateLimitWindowSec) * time.Second
+	}
+	if t.OTPMessageTemplate != nil {
+		p.message = *t.OTPMessageTemplate
+	}
+	if p.length == 0 {
+		p.length = 6
+	}
+	return p
+}
+
+// issueOTP generates a code under the tenant's policy, stores it under key
+// and returns it with the message that would be sent
+func (h *Handler) issueOTP(ctx context.Context, key string) (otp, message string, err error) {
+	p := h.otpPolicy(ctx)
+	otp, err = util.GenerateOTPLength(p.length)
+	if err != nil {
+		return "", "", err
+	}
+	if err := h.otps.SaveOTP(ctx, scopedKey(p.tenantID, key), otp, p.ttl); err != nil {
+		return "", "", err
+	}
+	message = strings.NewReplacer(
+		"{code}", otp,
+		"{ttl}", strconv.Itoa(int(p.ttl.Round(time.Minute)/time.Minute)),
+		"{brand}", p.brand,
+	).Replace(p.message)
+	return otp, message, nil
+}
+
+// verifyOTP checks and consumes the code stored under key
+func (h *Handler) verifyOTP(ctx context.Context, key, otp string) (bool, error) {
+	return h.otps.VerifyAndDeleteOTP(ctx, scopedKey(tenant(ctx).ID, key), otp)
+}
+
+// issuer signs and verifies the tokens of the request's tenant
+func (h *Handler) issuer(ctx context.Context) auth.Issuer {
+	t := tenant(ctx)
+	i := auth.DefaultIssuer()
+	i.TenantID = t.ID
+	if t.SigningKey != nil {
+		i.Secret = []byte(*t.SigningKey)
+	}
+	if t.TokenTTLSeconds != nil {
+		i.TTL = time.Duration(*t.TokenTTLSeconds) * time.Second
+	}
+	return i
+}
+
+// parseToken validates a first-party user token of the request's tenant.
+// Tokens without a tenant predate tenants and belong to the default one.
+func (h *Handler) parseToken(ctx context.Context, token string) (*auth.Claims, error) {
+	i := h.issuer(ctx)
+	claims, err := i.ParseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	tid := claims.TenantID
+	if tid == 0 {
+		tid = storage.DefaultTenantID
+	}
+	if tid != i.TenantID {
+		return nil, errors.New("token issued by another tenant")
+	}
+	return claims, nil
+}
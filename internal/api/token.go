@@ -0,0 +1,213 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/auth"
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
+	"github.com/rs/zerolog/log"
+)
+
+// RFC 8693 identifiers
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+	tokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// TokenExchangeResponse is the RFC 8693 success response
+type TokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in"`
+	Scope           string `json:"scope,omitempty"`
+}
+
+// TokenErrorResponse is the RFC 6749 error response
+type TokenErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// ExchangeToken godoc
+// @Summary Exchange a user token
+// @Description RFC 8693 token exchange. A registered service authenticates with HTTP Basic and trades a user token for a narrowed token bound to one audience, with reduced scopes, a shorter lifetime and an "act" claim naming the service.
+// @Tags Auth
+// @Accept x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "urn:ietf:params:oauth:grant-type:token-exchange"
+// @Param subject_token formData string true "User token issued by /otp/verify"
+// @Param subject_token_type formData string true "urn:ietf:params:oauth:token-type:access_token or urn:ietf:params:oauth:token-type:jwt"
+// @Param audience formData string true "Service the new token is intended for"
+// @Param scope formData string false "Space separated scopes to grant"
+// @Success 200 {object} TokenExchangeResponse
+// @Failure 400 {object} TokenErrorResponse
+// @Failure 401 {object} TokenErrorResponse
+// @Failure 500 {object} TokenErrorResponse
+// @Router /token/exchange [post]
+func (h *Handler) ExchangeToken(w http.ResponseWriter, r *http.Request) {
+	clientID, ok := h.authenticateClient(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="token-exchange"`)
+		writeTokenError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", "malformed form body")
+		return
+	}
+	if r.PostForm.Get("grant_type") != grantTypeTokenExchange {
+		writeTokenError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+	subjectToken := r.PostForm.Get("subject_token")
+	if subjectToken == "" {
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", "subject_token required")
+		return
+	}
+	switch r.PostForm.Get("subject_token_type") {
+	case tokenTypeAccessToken, tokenTypeJWT:
+	default:
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", "unsupported subject_token_type")
+		return
+	}
+	audience := r.PostForm.Get("audience")
+	if audience == "" {
+		writeTokenError(w, http.StatusBadRequest, "invalid_target", "audience required")
+		return
+	}
+	if rt := r.PostForm.Get("requested_token_type"); rt != "" && rt != tokenTypeJWT && rt != tokenTypeAccessToken {
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", "unsupported requested_token_type")
+		return
+	}
+
+	// only first-party user tokens can be exchanged, never already
+	// exchanged ones
+	subject, err := h.parseToken(r.Context(), subjectToken)
+	if err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "invalid subject_token")
+		return
+	}
+	// exchanged tokens always name the user by public id, also when the
+	// subject token still carries a numeric one
+	if subject.Subject == "" {
+		u, err := h.users.GetUserByID(r.Context(), subject.UserID)
+		if h.checkSubject(w, err) != nil {
+			return
+		}
+		subject.Subject = u.PublicID
+	} else if err := h.checkSubject(w, h.resolveSubject(r.Context(), subject)); err != nil {
+		return
+	}
+
+	// a revoked session or an account that is no longer active cannot be
+	// carried over to another service
+	if h.checkSubject(w, h.subjectActive(r.Context(), subject)) != nil {
+		return
+	}
+
+	scopes := strings.Fields(r.PostForm.Get("scope"))
+	if len(scopes) == 0 {
+		scopes = subject.Scopes
+	}
+	for _, s := range scopes {
+		if !subject.HasScope(s) {
+			writeTokenError(w, http.StatusBadRequest, "invalid_scope", "scope exceeds subject_token: "+s)
+			return
+		}
+	}
+
+	// never outlive the subject token
+	ttl := time.Duration(h.cfg.TokenExchangeTTLSeconds) * time.Second
+	if remaining := time.Until(subject.ExpiresAt); remaining < ttl {
+		ttl = remaining
+	}
+	ttl = ttl.Truncate(time.Second)
+	if ttl <= 0 {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "subject_token expired")
+		return
+	}
+
+	tok, err := h.issuer(r.Context()).CreateExchangedToken(subject.Subject, auth.ExchangeOptions{
+		Audience: audience,
+		Scopes:   scopes,
+		Actor:    clientID,
+		TTL:      ttl,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("create exchanged token")
+		writeTokenError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	h.recordEvent(r, model.AuthEvent{
+		Type:    model.EventTokenExchanged,
+		UserID:  &subject.UserID,
+		Details: map[string]string{"client": clientID, "audience": audience, "scope": strings.Join(scopes, " ")},
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, TokenExchangeResponse{
+		AccessToken:     tok,
+		IssuedTokenType: tokenTypeJWT,
+		TokenType:       "Bearer",
+		ExpiresIn:       int64(ttl / time.Second),
+		Scope:           strings.Join(scopes, " "),
+	})
+}
+
+// authenticateClient checks HTTP Basic credentials against the configured
+// token exchange clients and returns the client id.
+func (h *Handler) authenticateClient(r *http.Request) (string, bool) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	want, ok := h.cfg.TokenExchangeClients[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(secret), []byte(want)) != 1 {
+		return "", false
+	}
+	return id, true
+}
+
+// subjectActive returns storage.ErrNotFound if the subject token was revoked
+// or its user is no longer active, like AuthMiddleware refuses them
+func (h *Handler) subjectActive(ctx context.Context, subject *auth.Claims) error {
+	revokedAt, err := h.revoker.TokensRevokedAt(ctx, subject.UserID)
+	if err != nil {
+		return err
+	}
+	if !revokedAt.IsZero() && !subject.IssuedAt.After(revokedAt) {
+		return storage.ErrNotFound
+	}
+	status, _, err := h.users.GetUserStatus(ctx, subject.UserID)
+	if err != nil {
+		return err
+	}
+	if status != model.UserStatusActive {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+// checkSubject writes the token error for a failed subject lookup
+func (h *Handler) checkSubject(w http.ResponseWriter, err error) error {
+	if errors.Is(err, storage.ErrNotFound) {
+		writeTokenError(w, http.StatusBadRequest, "invalid_grant", "invalid subject_token")
+	} else if err != nil {
+		log.Error().Err(err).Msg("resolve token subject")
+		writeTokenError(w, http.StatusInternalServerError, "server_error", "")
+	}
+	return err
+}
+
+func writeTokenError(w http.ResponseWriter, status int, code, desc string) {
+	WriteJSONStatus(w, status, TokenErrorResponse{Error: code, ErrorDescription: desc})
+}
@@ -1,8 +1,89 @@
 package api
 
+import "github.com/example/go-otp-auth/internal/model"
+
 // UserResponse represents the user data returned by the API
 type UserResponse struct {
-	ID           int64  `json:"id"`
+	ID           string `json:"id"`
 	Phone        string `json:"phone"`
+	Status       string `json:"status"`
 	RegisteredAt string `json:"registered_at"`
+
+	DisplayName string                 `json:"display_name,omitempty"`
+	Email       string                 `json:"email,omitempty"`
+	Locale      string                 `json:"locale,omitempty"`
+	Timezone    string                 `json:"timezone,omitempty"`
+	AvatarURL   string                 `json:"avatar_url,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	LastLoginAt string                 `json:"last_login_at,omitempty"`
+	LoginCount  int64                  `json:"login_count"`
+}
+
+// VerifyOTPResponse is returned after a successful login
+type VerifyOTPResponse struct {
+	Token string      `json:"token"`
+	User  *model.User `json:"user"`
+	// IsNewUser is true when this login registered the phone number
+	IsNewUser bool `json:"is_new_user"`
+}
+
+// AccountStatusError is returned when a suspended, banned or deleted user
+// tries to log in or use a token
+type AccountStatusError struct {
+	Error  string `json:"error" example:"account_suspended"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AdminUserResponse is the detailed user view returned by the admin API
+type AdminUserResponse struct {
+	model.User
+	Roles []string         `json:"roles"`
+	Notes []model.UserNote `json:"notes"`
+	// PhoneHistory lists the user's phone number changes, newest first
+	PhoneHistory []model.PhoneChange `json:"phone_history"`
+}
+
+// SCIMUser is the SCIM 2.0 representation of a user. The phone number is
+// both the userName and the mobile entry of phoneNumbers.
+type SCIMUser struct {
+	Schemas      []string          `json:"schemas"`
+	ID           string            `json:"id"`
+	ExternalID   string            `json:"externalId,omitempty"`
+	UserName     string            `json:"userName"`
+	DisplayName  string            `json:"displayName,omitempty"`
+	Active       bool              `json:"active"`
+	PhoneNumbers []SCIMPhoneNumber `json:"phoneNumbers"`
+	Meta         SCIMMeta          `json:"meta"`
+}
+
+// SCIMPhoneNumber is one entry of a SCIM user's phoneNumbers
+type SCIMPhoneNumber struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty" example:"mobile"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// SCIMMeta is the resource metadata of a SCIM user
+type SCIMMeta struct {
+	ResourceType string `json:"resourceType" example:"User"`
+	Created      string `json:"created"`
+	Location     string `json:"location"`
+}
+
+// SCIMListResponse is one page of SCIM users. startIndex is 1-based.
+type SCIMListResponse struct {
+	Schemas      []string   `json:"schemas"`
+	TotalResults int        `json:"totalResults"`
+	StartIndex   int        `json:"startIndex"`
+	ItemsPerPage int        `json:"itemsPerPage"`
+	Resources    []SCIMUser `json:"Resources"`
+}
+
+// SCIMError is the SCIM 2.0 error body. Status is the HTTP status as a
+// string, as the specification requires.
+type SCIMError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status" example:"404"`
+	SCIMType string   `json:"scimType,omitempty" example:"invalidFilter"`
+	Detail   string   `json:"detail,omitempty"`
 }
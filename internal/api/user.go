@@ -1,9 +1,14 @@
 package api
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/internal/storage"
+	"github.com/example/go-otp-auth/internal/util"
 	"github.com/rs/zerolog/log"
 )
 
@@ -24,7 +29,7 @@ func (h *Handler) GetUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := h.pg.GetUserByID(r.Context(), userID)
+	u, err := h.users.GetUserByID(r.Context(), userID)
 	if err != nil {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
@@ -33,28 +38,125 @@ func (h *Handler) GetUser(w http.ResponseWriter, r *http.Request) {
 	WriteJSON(w, u)
 }
 
+// Logout godoc
+// @Summary Log out
+// @Description Revoke every token issued to the authenticated user
+// @Tags users
+// @Produce json
+// @Success 200 {object} map[string]string "logged_out"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 500 {string} string "internal"
+// @Security BearerAuth
+// @Router /users/me/logout [post]
+func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	userID, ok := GetUserIDFromContext(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.revoker.RevokeUserTokens(r.Context(), userID, h.issuer(r.Context()).TTL); err != nil {
+		log.Error().Err(err).Msg("redis revoke tokens")
+		http.Error(w, "internal", http.StatusInternalServerError)
+		return
+	}
+
+	h.recordEvent(r, model.AuthEvent{Type: model.EventLogout, UserID: &userID})
+	WriteJSON(w, map[string]string{"status": "logged_out"})
+}
+
 // ListUsers godoc
 // @Summary List users
-// @Description List users with optional search and pagination
+// @Description List users with optional search, filters and sorting. Pages are fetched by passing the next_cursor of the previous response as cursor; page is still accepted but slower on large tables. Requires the users:read scope.
 // @Tags users
 // @Produce json
-// @Param search query string false "Search by phone (optional)"
-// @Param page query int false "Page number (optional, default 1)" default(1)
+// @Param search query string false "Search by phone (optional). With encrypted phone numbers, a contains search matches the end of the number and needs at least 4 characters."
+// @Param search_mode query string false "How search matches the phone number; prefix is not available with encrypted phone numbers" Enums(contains, prefix, exact) default(contains)
+// @Param status query string false "Filter by status (optional)" Enums(active, suspended, banned, deleted)
+// @Param registered_from query string false "Registered at or after (RFC 3339 or YYYY-MM-DD)"
+// @Param registered_to query string false "Registered before (RFC 3339 or YYYY-MM-DD)"
+// @Param sort query string false "Sort order" Enums(id, registered_at, last_login_at) default(id)
+// @Param order query string false "Sort direction" Enums(asc, desc) default(asc)
+// @Param cursor query string false "next_cursor of the previous page"
+// @Param page query int false "Page number (optional, default 1); ignored with cursor" default(1)
 // @Param size query int false "Page size (optional, default 10)" default(10)
+// @Param skip_total query bool false "Leave out the total count"
 // @Success 200 {object} map[string]interface{}
+// @Failure 400 {string} string "invalid filter, search, sort or cursor"
+// @Failure 401 {string} string "unauthorized"
+// @Failure 403 {string} string "forbidden"
 // @Failure 500 {string} string "internal server error"
+// @Security BearerAuth
 // @Router /users [get]
 func (h *Handler) ListUsers(w http.ResponseWriter, r *http.Request) {
-	search := r.URL.Query().Get("search")
+	q := r.URL.Query()
+	filter := storage.UserFilter{
+		Search:     q.Get("search"),
+		SearchMode: q.Get("search_mode"),
+		Status:     q.Get("status"),
+	}
+	if filter.Status != "" && !model.ValidUserStatus(filter.Status) {
+		http.Error(w, "invalid status", http.StatusBadRequest)
+		return
+	}
+	if filter.SearchMode != "" && !storage.ValidSearchMode(filter.SearchMode) {
+		http.Error(w, "invalid search_mode", http.StatusBadRequest)
+		return
+	}
+	if filter.Search != "" {
+		// searches go through the same normalization as stored numbers;
+		// only an exact search has to be a whole number
+		ok := true
+		if filter.SearchMode == storage.SearchExact {
+			filter.Search, ok = util.NormalizePhone(filter.Search)
+		} else {
+			filter.Search = util.CleanPhone(filter.Search)
+			ok = util.PhoneDigits(filter.Search)
+		}
+		if !ok {
+			http.Error(w, "invalid search", http.StatusBadRequest)
+			return
+		}
+	}
+	var err error
+	if filter.RegisteredFrom, err = parseTimeParam(q.Get("registered_from")); err != nil {
+		http.Error(w, "invalid registered_from", http.StatusBadRequest)
+		return
+	}
+	if filter.RegisteredTo, err = parseTimeParam(q.Get("registered_to")); err != nil {
+		http.Error(w, "invalid registered_to", http.StatusBadRequest)
+		return
+	}
+
+	paging := storage.UserPage{Sort: q.Get("sort"), Cursor: q.Get("cursor")}
+	if paging.Sort != "" && !storage.ValidUserSort(paging.Sort) {
+		http.Error(w, "invalid sort", http.StatusBadRequest)
+		return
+	}
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		paging.Desc = true
+	default:
+		http.Error(w, "invalid order", http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("skip_total"); v != "" {
+		if paging.SkipTotal, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid skip_total", http.StatusBadRequest)
+			return
+		}
+	}
+
 	page := 1
 	size := 10
 
-	if p := r.URL.Query().Get("page"); p != "" {
+	if p := q.Get("page"); p != "" {
 		if pi, err := strconv.Atoi(p); err == nil && pi > 0 {
 			page = pi
 		}
 	}
-	if s := r.URL.Query().Get("size"); s != "" {
+	if s := q.Get("size"); s != "" {
 		if si, err := strconv.Atoi(s); err == nil && si > 0 {
 			if si > 100 {
 				size = 100
@@ -63,19 +165,44 @@ func (h *Handler) ListUsers(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+	paging.Limit = size
+	paging.Offset = (page - 1) * size
 
-	offset := (page - 1) * size
-	users, total, err := h.pg.ListUsers(r.Context(), search, offset, size)
+	list, err := h.users.ListUsers(r.Context(), filter, paging)
+	if errors.Is(err, storage.ErrSearchTooShort) || errors.Is(err, storage.ErrSearchUnsupported) || errors.Is(err, storage.ErrInvalidCursor) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("list users")
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	WriteJSON(w, map[string]interface{}{
-		"total": total,
-		"page":  page,
-		"size":  size,
-		"data":  users,
-	})
+	resp := map[string]interface{}{
+		"size": size,
+		"data": list.Users,
+	}
+	if list.Total != nil {
+		resp["total"] = *list.Total
+	}
+	if paging.Cursor == "" {
+		resp["page"] = page
+	}
+	if list.NextCursor != "" {
+		resp["next_cursor"] = list.NextCursor
+	}
+	WriteJSON(w, resp)
+}
+
+// parseTimeParam accepts an RFC 3339 time or a date, which means midnight
+// UTC. An empty value is the zero time.
+func parseTimeParam(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, v)
 }
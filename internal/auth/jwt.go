@@ -2,6 +2,8 @@ package auth
 
 import (
 	"errors"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -10,6 +12,52 @@ import (
 var jwtSecret []byte
 var tokenExpiry = time.Hour // default 1 hour
 
+// Claims is the parsed view of a token issued by this service.
+type Claims struct {
+	// Subject is the user's public id
+	Subject string
+	// UserID is the internal id. Tokens minted before public ids carry it
+	// as a numeric subject; for newer tokens the caller resolves Subject.
+	UserID    int64
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	Audience  string   // empty for first-party user tokens
+	Roles     []string // only present on first-party user tokens
+	Scopes    []string
+	Actor     string // service acting on the user's behalf, if any
+	// TenantID is the tenant that issued the token; zero for tokens minted
+	// before tenants, which belong to the default tenant
+	TenantID int64
+}
+
+// HasScope reports whether the token carries the given scope.
+func (c *Claims) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole reports whether the token carries the given role.
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// ExchangeOptions describes the narrowed token minted by CreateExchangedToken.
+type ExchangeOptions struct {
+	Audience string
+	Scopes   []string
+	Actor    string
+	TTL      time.Duration
+}
+
 func InitJWT(secret string) {
 	jwtSecret = []byte(secret)
 }
@@ -18,31 +66,169 @@ func SetTokenExpiry(d time.Duration) {
 	tokenExpiry = d
 }
 
-func CreateToken(userID int64) (string, error) {
-	claims := jwt.MapClaims{
-		"sub": userID,
-		"exp": time.Now().Add(tokenExpiry).Unix(),
-		"iat": time.Now().Unix(),
+// TokenExpiry returns the lifetime of user tokens.
+func TokenExpiry() time.Duration {
+	return tokenExpiry
+}
+
+// Issuer signs and verifies the tokens of one tenant. A non-zero TenantID is
+// recorded in a "tid" claim so a tenant sharing the signing key of another
+// cannot accept its tokens.
+type Issuer struct {
+	TenantID int64
+	Secret   []byte
+	// TTL is the lifetime of user tokens
+	TTL time.Duration
+}
+
+// DefaultIssuer returns the issuer configured by InitJWT and SetTokenExpiry,
+// which records no tenant.
+func DefaultIssuer() Issuer {
+	return Issuer{Secret: jwtSecret, TTL: tokenExpiry}
+}
+
+func (i Issuer) sign(claims jwt.MapClaims) (string, error) {
+	if i.TenantID != 0 {
+		claims["tid"] = i.TenantID
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return token.SignedString(i.Secret)
+}
+
+// CreateToken issues a token for the user with the given public id,
+// embedding the user's roles and the scopes granted by them.
+func CreateToken(subject string, roles, scopes []string) (string, error) {
+	return DefaultIssuer().CreateToken(subject, roles, scopes)
+}
+
+// CreateToken issues a token for the user with the given public id,
+// embedding the user's roles and the scopes granted by them.
+func (i Issuer) CreateToken(subject string, roles, scopes []string) (string, error) {
+	claims := jwt.MapClaims{
+		"sub":   subject,
+		"roles": roles,
+		"scope": strings.Join(scopes, " "),
+		"exp":   time.Now().Add(i.TTL).Unix(),
+		"iat":   issuedAt(time.Now()),
+	}
+	return i.sign(claims)
+}
+
+// CreateExchangedToken mints a token for the user with the given public id
+// that is only valid for opts.Audience, carries opts.Scopes and records the
+// calling service in an RFC 8693 "act" claim.
+func CreateExchangedToken(subject string, opts ExchangeOptions) (string, error) {
+	return DefaultIssuer().CreateExchangedToken(subject, opts)
 }
 
-func ParseToken(tokenStr string) (int64, error) {
+// CreateExchangedToken is the package-level CreateExchangedToken for the
+// issuer's tenant.
+func (i Issuer) CreateExchangedToken(subject string, opts ExchangeOptions) (string, error) {
+	if opts.Audience == "" {
+		return "", errors.New("audience required")
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"sub":   subject,
+		"aud":   opts.Audience,
+		"scope": strings.Join(opts.Scopes, " "),
+		"exp":   now.Add(opts.TTL).Unix(),
+		"iat":   issuedAt(now),
+	}
+	if opts.Actor != "" {
+		claims["act"] = map[string]interface{}{"sub": opts.Actor}
+	}
+	return i.sign(claims)
+}
+
+// issuedAt is the iat claim for t. It keeps milliseconds so a token issued
+// right after its user's tokens were revoked is told apart from the ones
+// revoked, even within the same second.
+func issuedAt(t time.Time) float64 {
+	return float64(t.UnixMilli()) / 1000
+}
+
+// ParseToken validates a first-party user token and returns its claims.
+// Exchanged tokens are bound to another audience and are rejected here.
+func ParseToken(tokenStr string) (*Claims, error) {
+	return DefaultIssuer().ParseToken(tokenStr)
+}
+
+// ParseToken validates a first-party user token signed with the issuer's
+// key. The caller checks that Claims.TenantID is the issuer's tenant.
+func (i Issuer) ParseToken(tokenStr string) (*Claims, error) {
+	c, err := i.ParseClaims(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	if c.Audience != "" {
+		return nil, errors.New("token not intended for this service")
+	}
+	return c, nil
+}
+
+// ParseClaims validates any token signed by this service, including
+// exchanged ones, and returns its claims.
+func ParseClaims(tokenStr string) (*Claims, error) {
+	return DefaultIssuer().ParseClaims(tokenStr)
+}
+
+// ParseClaims validates any token signed with the issuer's key, including
+// exchanged ones, and returns its claims.
+func (i Issuer) ParseClaims(tokenStr string) (*Claims, error) {
 	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
 		if t.Method.Alg() != jwt.SigningMethodHS256.Alg() {
 			return nil, errors.New("unexpected signing method")
 		}
-		return jwtSecret, nil
+		return i.Secret, nil
 	})
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
 	}
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		switch v := claims["sub"].(type) {
-		case float64:
-			return int64(v), nil
+
+	c := &Claims{}
+	switch v := claims["sub"].(type) {
+	case string:
+		if v == "" {
+			return nil, errors.New("invalid token")
 		}
+		c.Subject = v
+	case float64:
+		// issued before public ids
+		c.UserID = int64(v)
+	default:
+		return nil, errors.New("invalid token")
+	}
+	if iat, ok := claims["iat"].(float64); ok {
+		// jwt truncates NumericDate to whole seconds, so read the
+		// milliseconds ourselves
+		c.IssuedAt = time.UnixMilli(int64(math.Round(iat * 1000)))
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		c.ExpiresAt = exp.Time
+	}
+	if aud, err := claims.GetAudience(); err == nil && len(aud) > 0 {
+		c.Audience = aud[0]
+	}
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		for _, r := range roles {
+			if s, ok := r.(string); ok {
+				c.Roles = append(c.Roles, s)
+			}
+		}
+	}
+	if scope, ok := claims["scope"].(string); ok {
+		c.Scopes = strings.Fields(scope)
+	}
+	if act, ok := claims["act"].(map[string]interface{}); ok {
+		c.Actor, _ = act["sub"].(string)
+	}
+	if tid, ok := claims["tid"].(float64); ok {
+		c.TenantID = int64(tid)
 	}
-	return 0, errors.New("invalid token")
+	return c, nil
 }
@@ -1,19 +1,122 @@
 package config
 
 import (
+    "crypto/sha256"
+    "encoding/hex"
     "fmt"
+    "net/netip"
     "os"
     "strconv"
+    "strings"
+
+    "github.com/example/go-otp-auth/internal/storage"
+)
+
+// Storage backends
+const (
+    BackendPostgres = "postgres" // Postgres + Redis
+    BackendMemory   = "memory"   // in-process, for tests and local development
+    BackendSQLite   = "sqlite"   // single database file, for single-node deployments
 )
 
 type Config struct {
     Port                     int
+    StorageBackend           string
     DatabaseURL              string
-    RedisAddr                string
+    // read-only replicas for list and lookup queries
+    DatabaseReplicaURLs      []string
+    // REDIS_URL, or the structured REDIS_* settings below
+    RedisURL                 string
+    RedisAddrs               []string
+    RedisUsername            string
+    RedisPassword            string
+    RedisDB                  int
+    RedisTLS                 bool
+    RedisTLSCAFile           string
+    RedisSentinelMaster      string
+    RedisSentinelPassword    string
+    RedisCluster             bool
+    // keyring for encrypting phone numbers at rest; postgres only
+    PhoneKeyringFile         string
+    SQLitePath               string
     JWTSecret                string
     OTPTTLSeconds            int
+    // digits per code; tenants may override it
+    OTPLength                int
+    // text of the code message; {code}, {ttl} (minutes) and {brand} are
+    // filled in
+    OTPMessageTemplate       string
+    // the OTP endpoints refuse requests without a client app key
+    OTPRequireClientKey      bool
     RateLimitMax             int
     RateLimitWindowSeconds   int
+    // algorithm of each rate limit: fixed_window, sliding_window or
+    // token_bucket
+    RateLimitAlgorithm       string
+    IPRateLimitAlgorithm     string
+    PrefixRateLimitAlgorithm string
+    GlobalRateLimitAlgorithm string
+    VerifyRateLimitAlgorithm string
+    ClientRateLimitAlgorithm string
+    // OTP requests, and separately verifications, per client network; 0
+    // turns the limit off
+    IPRateLimitMax           int
+    IPRateLimitWindowSeconds int
+    // networks of this size share an IP limit
+    IPRateLimitIPv4Prefix    int
+    IPRateLimitIPv6Prefix    int
+    // OTP requests per phone number prefix of PrefixRateLimitDigits digits;
+    // 0 turns the limit off
+    PrefixRateLimitDigits    int
+    PrefixRateLimitMax       int
+    PrefixRateLimitWindowSeconds int
+    // OTP requests per minute across the service; 0 turns the limit off
+    GlobalRateLimitPerMinute int
+    // OTP verifications per phone number or email within the rate limit
+    // window; 0 turns the limit off
+    VerifyRateLimitMax       int
+    // proxies whose X-Forwarded-For is believed when finding the client IP
+    TrustedProxies           []netip.Prefix
+    TokenExchangeTTLSeconds  int
+    // changing the phone number also needs a code sent to the old number
+    PhoneChangeVerifyOld     bool
+    // login links in emails point here with ?email=...&otp=...
+    EmailLinkBaseURL         string
+    // deleted accounts are purged this many days after deletion
+    DeletionGraceDays        int
+    // apply pending schema migrations before serving
+    MigrateOnStart           bool
+    // client id -> secret for services allowed to call /token/exchange
+    TokenExchangeClients     map[string]string
+    // tenant slug -> hex SHA-256 of the bearer token its identity provider
+    // presents to the SCIM endpoints
+    SCIMTokens               map[string]string
+}
+
+// LoadDatabaseFromEnv reads only the storage backend and DATABASE_URL, for
+// maintenance commands such as migrate that must not require Redis or JWT
+// settings
+func LoadDatabaseFromEnv() (*Config, error) {
+    backend, db, err := loadDatabase()
+    if err != nil {
+        return nil, err
+    }
+    return &Config{StorageBackend: backend, DatabaseURL: db}, nil
+}
+
+func loadDatabase() (string, string, error) {
+    backend := os.Getenv("STORAGE_BACKEND")
+    if backend == "" {
+        backend = BackendPostgres
+    }
+    if backend != BackendPostgres && backend != BackendMemory && backend != BackendSQLite {
+        return "", "", fmt.Errorf("STORAGE_BACKEND must be %q, %q or %q", BackendPostgres, BackendSQLite, BackendMemory)
+    }
+    db := os.Getenv("DATABASE_URL")
+    if db == "" && backend == BackendPostgres {
+        return "", "", fmt.Errorf("DATABASE_URL required")
+    }
+    return backend, db, nil
 }
 
 func LoadFromEnv() (*Config, error) {
@@ -23,13 +126,42 @@ func LoadFromEnv() (*Config, error) {
             port = pi
         }
     }
-    db := os.Getenv("DATABASE_URL")
-    if db == "" {
-        return nil, fmt.Errorf("DATABASE_URL required")
+    backend, db, err := loadDatabase()
+    if err != nil {
+        return nil, err
+    }
+    redisURL := os.Getenv("REDIS_URL")
+    redisAddrs := splitList(os.Getenv("REDIS_ADDR"))
+    if redisURL == "" && len(redisAddrs) == 0 && backend == BackendPostgres {
+        return nil, fmt.Errorf("REDIS_URL or REDIS_ADDR required")
+    }
+    redisDB := 0
+    if v := os.Getenv("REDIS_DB"); v != "" {
+        vi, err := strconv.Atoi(v)
+        if err != nil {
+            return nil, fmt.Errorf("REDIS_DB: %w", err)
+        }
+        redisDB = vi
+    }
+    redisTLS, err := parseBool("REDIS_TLS")
+    if err != nil {
+        return nil, err
+    }
+    redisCluster, err := parseBool("REDIS_CLUSTER")
+    if err != nil {
+        return nil, err
+    }
+    redisMaster := os.Getenv("REDIS_SENTINEL_MASTER")
+    if redisMaster != "" && redisCluster {
+        return nil, fmt.Errorf("REDIS_SENTINEL_MASTER and REDIS_CLUSTER are mutually exclusive")
+    }
+    keyringFile := os.Getenv("PHONE_KEYRING_FILE")
+    if keyringFile != "" && backend != BackendPostgres {
+        return nil, fmt.Errorf("PHONE_KEYRING_FILE requires STORAGE_BACKEND=%s", BackendPostgres)
     }
-    r := os.Getenv("REDIS_ADDR")
-    if r == "" {
-        return nil, fmt.Errorf("REDIS_ADDR required")
+    sqlitePath := os.Getenv("SQLITE_PATH")
+    if sqlitePath == "" {
+        sqlitePath = "otp-auth.db"
     }
     jwt := os.Getenv("JWT_SECRET")
     if jwt == "" {
@@ -41,6 +173,24 @@ func LoadFromEnv() (*Config, error) {
             otpTTLS = vi
         }
     }
+    otpLength := 6
+    if v := os.Getenv("OTP_LENGTH"); v != "" {
+        vi, err := strconv.Atoi(v)
+        if err != nil || vi < 4 || vi > 10 {
+            return nil, fmt.Errorf("OTP_LENGTH must be between 4 and 10")
+        }
+        otpLength = vi
+    }
+    otpMessage := os.Getenv("OTP_MESSAGE_TEMPLATE")
+    if otpMessage == "" {
+        otpMessage = "Your verification code is {code}"
+    }
+    requireClientKey := false
+    if v := os.Getenv("OTP_REQUIRE_CLIENT_KEY"); v != "" {
+        if vb, err := strconv.ParseBool(v); err == nil {
+            requireClientKey = vb
+        }
+    }
     rlMax := 3
     if v := os.Getenv("RATE_LIMIT_MAX"); v != "" {
         if vi, err := strconv.Atoi(v); err == nil {
@@ -53,13 +203,232 @@ func LoadFromEnv() (*Config, error) {
             rlWindow = vi
         }
     }
+    ipMax, err := parseInt("IP_RATE_LIMIT_MAX", 20)
+    if err != nil {
+        return nil, err
+    }
+    ipWindow, err := parseInt("IP_RATE_LIMIT_WINDOW_SECONDS", 600)
+    if err != nil {
+        return nil, err
+    }
+    ipv4Prefix, err := parseInt("IP_RATE_LIMIT_IPV4_PREFIX", 32)
+    if err != nil || ipv4Prefix < 1 || ipv4Prefix > 32 {
+        return nil, fmt.Errorf("IP_RATE_LIMIT_IPV4_PREFIX must be between 1 and 32")
+    }
+    ipv6Prefix, err := parseInt("IP_RATE_LIMIT_IPV6_PREFIX", 64)
+    if err != nil || ipv6Prefix < 1 || ipv6Prefix > 128 {
+        return nil, fmt.Errorf("IP_RATE_LIMIT_IPV6_PREFIX must be between 1 and 128")
+    }
+    prefixDigits, err := parseInt("PREFIX_RATE_LIMIT_DIGITS", 6)
+    if err != nil {
+        return nil, err
+    }
+    prefixMax, err := parseInt("PREFIX_RATE_LIMIT_MAX", 0)
+    if err != nil {
+        return nil, err
+    }
+    prefixWindow, err := parseInt("PREFIX_RATE_LIMIT_WINDOW_SECONDS", 3600)
+    if err != nil {
+        return nil, err
+    }
+    globalMax, err := parseInt("GLOBAL_RATE_LIMIT_PER_MINUTE", 0)
+    if err != nil {
+        return nil, err
+    }
+    verifyMax, err := parseInt("VERIFY_RATE_LIMIT_MAX", 5)
+    if err != nil {
+        return nil, err
+    }
+    algorithms := map[string]string{}
+    for name, def := range map[string]string{
+        "RATE_LIMIT_ALGORITHM":        storage.SlidingWindow,
+        "IP_RATE_LIMIT_ALGORITHM":     storage.SlidingWindow,
+        "PREFIX_RATE_LIMIT_ALGORITHM": storage.SlidingWindow,
+        "GLOBAL_RATE_LIMIT_ALGORITHM": storage.TokenBucket,
+        "VERIFY_RATE_LIMIT_ALGORITHM": storage.SlidingWindow,
+        "CLIENT_RATE_LIMIT_ALGORITHM": storage.TokenBucket,
+    } {
+        v, err := parseAlgorithm(name, def)
+        if err != nil {
+            return nil, err
+        }
+        algorithms[name] = v
+    }
+    trustedProxies, err := parsePrefixes("TRUSTED_PROXIES")
+    if err != nil {
+        return nil, err
+    }
+    exTTL := 300
+    if v := os.Getenv("TOKEN_EXCHANGE_TTL_SECONDS"); v != "" {
+        if vi, err := strconv.Atoi(v); err == nil {
+            exTTL = vi
+        }
+    }
+    exClients, err := parseClients("TOKEN_EXCHANGE_CLIENTS")
+    if err != nil {
+        return nil, err
+    }
+    scimTokens, err := parseClients("SCIM_TOKENS")
+    if err != nil {
+        return nil, err
+    }
+    for tenant, hash := range scimTokens {
+        if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+            return nil, fmt.Errorf("SCIM_TOKENS: token hash of %q must be a hex SHA-256", tenant)
+        }
+    }
+    migrate := false
+    if v := os.Getenv("MIGRATE_ON_START"); v != "" {
+        if vb, err := strconv.ParseBool(v); err == nil {
+            migrate = vb
+        }
+    }
+    verifyOld := true
+    if v := os.Getenv("PHONE_CHANGE_VERIFY_OLD"); v != "" {
+        if vb, err := strconv.ParseBool(v); err == nil {
+            verifyOld = vb
+        }
+    }
+    graceDays := 30
+    if v := os.Getenv("DELETION_GRACE_DAYS"); v != "" {
+        if vi, err := strconv.Atoi(v); err == nil && vi >= 0 {
+            graceDays = vi
+        }
+    }
     return &Config{
         Port: port,
+        StorageBackend: backend,
         DatabaseURL: db,
-        RedisAddr: r,
+        DatabaseReplicaURLs: splitList(os.Getenv("DATABASE_REPLICA_URLS")),
+        RedisURL: redisURL,
+        RedisAddrs: redisAddrs,
+        RedisUsername: os.Getenv("REDIS_USERNAME"),
+        RedisPassword: os.Getenv("REDIS_PASSWORD"),
+        RedisDB: redisDB,
+        RedisTLS: redisTLS,
+        RedisTLSCAFile: os.Getenv("REDIS_TLS_CA_FILE"),
+        RedisSentinelMaster: redisMaster,
+        RedisSentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+        RedisCluster: redisCluster,
+        PhoneKeyringFile: keyringFile,
+        SQLitePath: sqlitePath,
         JWTSecret: jwt,
         OTPTTLSeconds: otpTTLS,
+        OTPLength: otpLength,
+        OTPMessageTemplate: otpMessage,
+        OTPRequireClientKey: requireClientKey,
         RateLimitMax: rlMax,
         RateLimitWindowSeconds: rlWindow,
+        IPRateLimitMax: ipMax,
+        IPRateLimitWindowSeconds: ipWindow,
+        IPRateLimitIPv4Prefix: ipv4Prefix,
+        IPRateLimitIPv6Prefix: ipv6Prefix,
+        PrefixRateLimitDigits: prefixDigits,
+        PrefixRateLimitMax: prefixMax,
+        PrefixRateLimitWindowSeconds: prefixWindow,
+        GlobalRateLimitPerMinute: globalMax,
+        VerifyRateLimitMax: verifyMax,
+        TrustedProxies: trustedProxies,
+        RateLimitAlgorithm: algorithms["RATE_LIMIT_ALGORITHM"],
+        IPRateLimitAlgorithm: algorithms["IP_RATE_LIMIT_ALGORITHM"],
+        PrefixRateLimitAlgorithm: algorithms["PREFIX_RATE_LIMIT_ALGORITHM"],
+        GlobalRateLimitAlgorithm: algorithms["GLOBAL_RATE_LIMIT_ALGORITHM"],
+        VerifyRateLimitAlgorithm: algorithms["VERIFY_RATE_LIMIT_ALGORITHM"],
+        ClientRateLimitAlgorithm: algorithms["CLIENT_RATE_LIMIT_ALGORITHM"],
+        TokenExchangeTTLSeconds: exTTL,
+        PhoneChangeVerifyOld: verifyOld,
+        EmailLinkBaseURL: os.Getenv("EMAIL_LINK_BASE_URL"),
+        DeletionGraceDays: graceDays,
+        TokenExchangeClients: exClients,
+        SCIMTokens: scimTokens,
+        MigrateOnStart: migrate,
     }, nil
-}
\ No newline at end of file
+}
+
+// parseClients parses the variable name as "id:secret,id2:secret2"
+func parseClients(name string) (map[string]string, error) {
+    clients := map[string]string{}
+    for _, pair := range strings.Split(os.Getenv(name), ",") {
+        pair = strings.TrimSpace(pair)
+        if pair == "" {
+            continue
+        }
+        id, secret, ok := strings.Cut(pair, ":")
+        if !ok || id == "" || secret == "" {
+            return nil, fmt.Errorf("%s: invalid entry %q", name, pair)
+        }
+        clients[id] = secret
+    }
+    return clients, nil
+}
+// splitList splits a comma separated list, dropping empty entries
+func splitList(v string) []string {
+    var out []string
+    for _, item := range strings.Split(v, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            out = append(out, item)
+        }
+    }
+    return out
+}
+
+// parseInt reads an optional non-negative integer variable
+func parseInt(name string, def int) (int, error) {
+    v := os.Getenv(name)
+    if v == "" {
+        return def, nil
+    }
+    i, err := strconv.Atoi(v)
+    if err != nil || i < 0 {
+        return 0, fmt.Errorf("%s must be a non-negative integer", name)
+    }
+    return i, nil
+}
+
+// parseAlgorithm reads an optional rate limit algorithm variable
+func parseAlgorithm(name, def string) (string, error) {
+    v := os.Getenv(name)
+    if v == "" {
+        return def, nil
+    }
+    for _, a := range storage.RateLimitAlgorithms {
+        if v == a {
+            return v, nil
+        }
+    }
+    return "", fmt.Errorf("%s must be one of %s", name, strings.Join(storage.RateLimitAlgorithms, ", "))
+}
+
+// parsePrefixes reads a comma separated list of CIDR ranges; a single
+// address stands for itself
+func parsePrefixes(name string) ([]netip.Prefix, error) {
+    var out []netip.Prefix
+    for _, item := range splitList(os.Getenv(name)) {
+        if !strings.Contains(item, "/") {
+            addr, err := netip.ParseAddr(item)
+            if err != nil {
+                return nil, fmt.Errorf("%s: invalid entry %q", name, item)
+            }
+            item = netip.PrefixFrom(addr, addr.BitLen()).String()
+        }
+        p, err := netip.ParsePrefix(item)
+        if err != nil {
+            return nil, fmt.Errorf("%s: invalid entry %q", name, item)
+        }
+        out = append(out, p.Masked())
+    }
+    return out, nil
+}
+
+// parseBool reads an optional boolean variable
+func parseBool(name string) (bool, error) {
+    v := os.Getenv(name)
+    if v == "" {
+        return false, nil
+    }
+    b, err := strconv.ParseBool(v)
+    if err != nil {
+        return false, fmt.Errorf("%s: %w", name, err)
+    }
+    return b, nil
+}
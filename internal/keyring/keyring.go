@@ -0,0 +1,207 @@
+// Package keyring encrypts individual fields with envelope encryption and
+// derives blind indexes for looking them up.
+//
+// Every value is sealed with its own random data key, and the data key is
+// sealed with a key encryption key (KEK) from the keyring. KEKs are named by
+// an id stored next to the ciphertext, so old keys stay usable for reading
+// while new values are sealed with the active one. Rotating a KEK only means
+// rewrapping the data keys.
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	keySize = 32 // AES-256
+	// wrappedKeySize is the length of a sealed data key: nonce, key and tag
+	wrappedKeySize = 12 + keySize + 16
+)
+
+// ErrUnknownKey is returned when a ciphertext names a key that is not in the
+// keyring
+var ErrUnknownKey = errors.New("keyring: unknown key id")
+
+// file is the JSON layout of a keyring file. Keys are base64 encoded.
+//
+//	{
+//	  "active": "2025-01",
+//	  "keys": {"2024-06": "...", "2025-01": "..."},
+//	  "index_key": "..."
+//	}
+type file struct {
+	Active   string            `json:"active"`
+	Keys     map[string]string `json:"keys"`
+	IndexKey string            `json:"index_key"`
+}
+
+// Keyring holds the key encryption keys and the blind index key
+type Keyring struct {
+	active   string
+	keks     map[string]cipher.AEAD
+	indexKey []byte
+}
+
+// Load reads a keyring file
+func Load(path string) (*Keyring, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f file
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("keyring %s: %w", path, err)
+	}
+	keys := make(map[string][]byte, len(f.Keys))
+	for id, v := range f.Keys {
+		k, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("keyring %s: key %q: %w", path, id, err)
+		}
+		keys[id] = k
+	}
+	indexKey, err := base64.StdEncoding.DecodeString(f.IndexKey)
+	if err != nil {
+		return nil, fmt.Errorf("keyring %s: index_key: %w", path, err)
+	}
+	kr, err := New(f.Active, keys, indexKey)
+	if err != nil {
+		return nil, fmt.Errorf("keyring %s: %w", path, err)
+	}
+	return kr, nil
+}
+
+// New builds a keyring from raw keys. Every KEK must be 32 bytes; the index
+// key at least 32 bytes.
+func New(active string, keys map[string][]byte, indexKey []byte) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active key %q not in keys", active)
+	}
+	if len(indexKey) < keySize {
+		return nil, fmt.Errorf("index key must be at least %d bytes", keySize)
+	}
+	k := &Keyring{active: active, keks: map[string]cipher.AEAD{}, indexKey: indexKey}
+	for id, key := range keys {
+		if len(key) != keySize {
+			return nil, fmt.Errorf("key %q must be %d bytes", id, keySize)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keks[id] = aead
+	}
+	return k, nil
+}
+
+// ActiveKeyID names the KEK used for new values
+func (k *Keyring) ActiveKeyID() string {
+	return k.active
+}
+
+// Encrypt seals plaintext under a new data key wrapped with the active KEK.
+// The returned key id must be stored with the ciphertext.
+func (k *Keyring) Encrypt(plaintext []byte) ([]byte, string, error) {
+	dek := make([]byte, keySize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, "", err
+	}
+	wrapped, err := seal(k.keks[k.active], dek, []byte(k.active))
+	if err != nil {
+		return nil, "", err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := seal(aead, plaintext, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return append(wrapped, body...), k.active, nil
+}
+
+// Decrypt opens a value sealed by Encrypt under the KEK keyID
+func (k *Keyring) Decrypt(ciphertext []byte, keyID string) ([]byte, error) {
+	dek, err := k.unwrap(ciphertext, keyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, ciphertext[wrappedKeySize:], nil)
+}
+
+// Rewrap moves a value to the active KEK without touching the sealed value
+// itself. Values already under the active key are returned unchanged.
+func (k *Keyring) Rewrap(ciphertext []byte, keyID string) ([]byte, string, error) {
+	if keyID == k.active {
+		return ciphertext, keyID, nil
+	}
+	dek, err := k.unwrap(ciphertext, keyID)
+	if err != nil {
+		return nil, "", err
+	}
+	wrapped, err := seal(k.keks[k.active], dek, []byte(k.active))
+	if err != nil {
+		return nil, "", err
+	}
+	return append(wrapped, ciphertext[wrappedKeySize:]...), k.active, nil
+}
+
+// BlindIndex is a keyed hash of value for equality lookups. domain separates
+// indexes of different kinds so their hashes cannot be compared.
+func (k *Keyring) BlindIndex(domain, value string) []byte {
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(domain))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+func (k *Keyring) unwrap(ciphertext []byte, keyID string) ([]byte, error) {
+	kek, ok := k.keks[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	if len(ciphertext) < wrappedKeySize {
+		return nil, errors.New("keyring: ciphertext too short")
+	}
+	return open(kek, ciphertext[:wrappedKeySize], []byte(keyID))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns nonce || ciphertext
+func seal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func open(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("keyring: ciphertext too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], additional)
+}
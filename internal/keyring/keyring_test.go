@@ -0,0 +1,94 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, keySize)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	k, err := New("k1", map[string][]byte{"k1": testKey(1)}, testKey(9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, kid, err := k.Encrypt([]byte("+15550001"))
+	if err != nil || kid != "k1" {
+		t.Fatalf("encrypt: %q, %v", kid, err)
+	}
+	pt, err := k.Decrypt(ct, kid)
+	if err != nil || string(pt) != "+15550001" {
+		t.Fatalf("decrypt = %q, %v", pt, err)
+	}
+
+	ct2, _, _ := k.Encrypt([]byte("+15550001"))
+	if bytes.Equal(ct, ct2) {
+		t.Fatal("equal plaintexts produced equal ciphertexts")
+	}
+
+	ct[len(ct)-1] ^= 1
+	if _, err := k.Decrypt(ct, kid); err == nil {
+		t.Fatal("tampered ciphertext decrypted")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old, _ := New("k1", map[string][]byte{"k1": testKey(1)}, testKey(9))
+	ct, kid, _ := old.Encrypt([]byte("+15550001"))
+
+	k, err := New("k2", map[string][]byte{"k1": testKey(1), "k2": testKey(2)}, testKey(9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt, err := k.Decrypt(ct, kid); err != nil || string(pt) != "+15550001" {
+		t.Fatalf("decrypt under old key = %q, %v", pt, err)
+	}
+	ct, kid, err = k.Rewrap(ct, kid)
+	if err != nil || kid != "k2" {
+		t.Fatalf("rewrap: %q, %v", kid, err)
+	}
+	if pt, err := k.Decrypt(ct, kid); err != nil || string(pt) != "+15550001" {
+		t.Fatalf("decrypt after rewrap = %q, %v", pt, err)
+	}
+
+	// the old keyring no longer has the key
+	if _, err := old.Decrypt(ct, kid); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("err = %v, want ErrUnknownKey", err)
+	}
+	// a ciphertext cannot be passed off as sealed by another key
+	if _, err := k.Decrypt(ct, "k1"); err == nil {
+		t.Fatal("decrypted with the wrong key id")
+	}
+}
+
+func TestBlindIndex(t *testing.T) {
+	a, _ := New("k1", map[string][]byte{"k1": testKey(1)}, testKey(9))
+	b, _ := New("k2", map[string][]byte{"k2": testKey(2)}, testKey(9))
+	if !bytes.Equal(a.BlindIndex("phone", "+1555"), b.BlindIndex("phone", "+1555")) {
+		t.Fatal("index depends on the encryption key")
+	}
+	if bytes.Equal(a.BlindIndex("phone", "+1555"), a.BlindIndex("suffix", "+1555")) {
+		t.Fatal("domains share hashes")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	enc := base64.StdEncoding.EncodeToString
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	os.WriteFile(path, []byte(`{"active": "k1", "keys": {"k1": "`+enc(testKey(1))+`"}, "index_key": "`+enc(testKey(9))+`"}`), 0o600)
+	k, err := Load(path)
+	if err != nil || k.ActiveKeyID() != "k1" {
+		t.Fatalf("load: %v", err)
+	}
+
+	os.WriteFile(path, []byte(`{"active": "k2", "keys": {"k1": "`+enc(testKey(1))+`"}, "index_key": "`+enc(testKey(9))+`"}`), 0o600)
+	if _, err := Load(path); err == nil {
+		t.Fatal("missing active key accepted")
+	}
+}
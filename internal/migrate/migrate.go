@@ -0,0 +1,331 @@
+// Package migrate applies versioned SQL migrations to Postgres or SQLite.
+//
+// Applied versions are tracked in the schema_migrations table together with
+// a checksum of the up script, so edits to an already applied migration are
+// detected. On Postgres a session advisory lock keeps concurrently starting
+// replicas from racing each other.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// lockID is the advisory lock held while migrating
+const lockID = 0x6d696772 // "migr"
+
+// Dialect holds the database specific statements used by a Runner
+type Dialect struct {
+	// CreateTable creates schema_migrations if it does not exist
+	CreateTable string
+	// Lock and Unlock guard a migration run; empty means no locking
+	Lock   string
+	Unlock string
+	// ForeignKeysOff and ForeignKeysOn bracket scripts marked with
+	// noForeignKeys, and ForeignKeyCheck lists the violations they left
+	// behind. Empty where foreign keys need no special handling.
+	ForeignKeysOff  string
+	ForeignKeysOn   string
+	ForeignKeyCheck string
+}
+
+var (
+	// Postgres serializes runners with a session advisory lock
+	Postgres = Dialect{
+		CreateTable: `
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+				version BIGINT PRIMARY KEY,
+				name TEXT NOT NULL,
+				checksum TEXT NOT NULL,
+				applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+			)`,
+		Lock:   fmt.Sprintf("SELECT pg_advisory_lock(%d)", lockID),
+		Unlock: fmt.Sprintf("SELECT pg_advisory_unlock(%d)", lockID),
+	}
+	// SQLite needs no lock; the database file has a single writer
+	SQLite = Dialect{
+		CreateTable: `
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+				version INTEGER PRIMARY KEY,
+				name TEXT NOT NULL,
+				checksum TEXT NOT NULL,
+				applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			)`,
+		ForeignKeysOff:  "PRAGMA foreign_keys = OFF",
+		ForeignKeysOn:   "PRAGMA foreign_keys = ON",
+		ForeignKeyCheck: "PRAGMA foreign_key_check",
+	}
+)
+
+// noForeignKeys marks a script that rebuilds a table other tables
+// reference. SQLite can only change an inherited table constraint by copying
+// the table, and dropping the old copy with foreign keys on would cascade to
+// the referencing rows. Foreign keys cannot be switched off inside a
+// transaction, so the runner does it around the script.
+const noForeignKeys = "-- migrate:no-foreign-keys"
+
+var fileRe = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is one schema version
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// Status describes a known migration and whether it has been applied
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Runner applies migrations to a database
+type Runner struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration
+}
+
+// Load reads NNNN_name.up.sql / NNNN_name.down.sql pairs from fsys
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]*Migration{}
+	for _, e := range entries {
+		m := fileRe.FindStringSubmatch(e.Name())
+		if e.IsDir() || m == nil {
+			continue
+		}
+		version, _ := strconv.ParseInt(m[1], 10, 64)
+		body, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+			sum := sha256.Sum256(body)
+			mig.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// New returns a Runner for the given migrations
+func New(db *sql.DB, dialect Dialect, migrations []Migration) *Runner {
+	return &Runner{db: db, dialect: dialect, migrations: migrations}
+}
+
+// Up applies every pending migration in order and returns the ones applied
+func (r *Runner) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	err := r.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := r.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range r.migrations {
+			if a, ok := applied[m.Version]; ok {
+				if a.checksum != m.Checksum {
+					return fmt.Errorf("migration %d_%s was modified after being applied", m.Version, m.Name)
+				}
+				continue
+			}
+			err := r.run(ctx, conn, m.Up, func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, `
+					INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)`,
+					m.Version, m.Name, m.Checksum)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("apply %d_%s: %w", m.Version, m.Name, err)
+			}
+			log.Info().Int64("version", m.Version).Str("name", m.Name).Msg("applied migration")
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down rolls back the latest steps applied migrations and returns them
+func (r *Runner) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := r.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := r.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(r.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := r.migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %d_%s has no down script", m.Version, m.Name)
+			}
+			err := r.run(ctx, conn, m.Down, func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version=$1", m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("roll back %d_%s: %w", m.Version, m.Name, err)
+			}
+			log.Info().Int64("version", m.Version).Str("name", m.Name).Msg("rolled back migration")
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status lists every known migration with its applied time, if any
+func (r *Runner) Status(ctx context.Context) ([]Status, error) {
+	var out []Status
+	err := r.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := r.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range r.migrations {
+			s := Status{Migration: m}
+			if a, ok := applied[m.Version]; ok {
+				at := a.appliedAt
+				s.AppliedAt = &at
+			}
+			out = append(out, s)
+		}
+		return nil
+	})
+	return out, err
+}
+
+type appliedMigration struct {
+	checksum  string
+	appliedAt time.Time
+}
+
+func (r *Runner) applied(ctx context.Context, conn *sql.Conn) (map[int64]appliedMigration, error) {
+	if _, err := conn.ExecContext(ctx, r.dialect.CreateTable); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int64]appliedMigration{}
+	for rows.Next() {
+		var v int64
+		var a appliedMigration
+		if err := rows.Scan(&v, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[v] = a
+	}
+	return applied, rows.Err()
+}
+
+// withLock runs fn on a dedicated connection holding the migration lock
+func (r *Runner) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if r.dialect.Lock != "" {
+		if _, err := conn.ExecContext(ctx, r.dialect.Lock); err != nil {
+			return fmt.Errorf("acquire migration lock: %w", err)
+		}
+		defer func() {
+			// use a fresh context so the lock is released even after cancellation
+			if _, err := conn.ExecContext(context.Background(), r.dialect.Unlock); err != nil {
+				log.Error().Err(err).Msg("release migration lock")
+			}
+		}()
+	}
+
+	return fn(conn)
+}
+
+// run executes script and then record in one transaction, with foreign keys
+// off if the script asks for it
+func (r *Runner) run(ctx context.Context, conn *sql.Conn, script string, record func(tx *sql.Tx) error) error {
+	fkOff := r.dialect.ForeignKeysOff != "" && strings.Contains(script, noForeignKeys)
+	if fkOff {
+		if _, err := conn.ExecContext(ctx, r.dialect.ForeignKeysOff); err != nil {
+			return err
+		}
+		defer func() {
+			if _, err := conn.ExecContext(context.Background(), r.dialect.ForeignKeysOn); err != nil {
+				log.Error().Err(err).Msg("re-enable foreign keys")
+			}
+		}()
+	}
+	return inTx(ctx, conn, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, script); err != nil {
+			return err
+		}
+		if fkOff {
+			rows, err := tx.QueryContext(ctx, r.dialect.ForeignKeyCheck)
+			if err != nil {
+				return err
+			}
+			violated := rows.Next()
+			rows.Close()
+			if violated {
+				return errors.New("script left foreign key violations behind")
+			}
+		}
+		return record(tx)
+	})
+}
+
+func inTx(ctx context.Context, conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,66 @@
+package model
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ClientApp is an application allowed to call the OTP endpoints of its
+// tenant. Only a hash of its API key is stored; KeyPrefix identifies the key
+// in listings and logs.
+type ClientApp struct {
+	ID        int64  `db:"id" json:"id"`
+	TenantID  int64  `db:"tenant_id" json:"tenant_id"`
+	Name      string `db:"name" json:"name"`
+	KeyPrefix string `db:"key_prefix" json:"key_prefix"`
+	// AllowedOrigins restricts the key to browser requests from these
+	// origins; empty allows any caller
+	AllowedOrigins StringList `db:"allowed_origins" json:"allowed_origins"`
+	// RateLimitMax requests per RateLimitWindowSec are allowed for the key
+	// as a whole; nil means no limit beyond the per-phone one
+	RateLimitMax       *int       `db:"rate_limit_max" json:"rate_limit_max,omitempty"`
+	RateLimitWindowSec *int       `db:"rate_limit_window_seconds" json:"rate_limit_window_seconds,omitempty"`
+	CreatedAt          time.Time  `db:"created_at" json:"created_at"`
+	LastUsedAt         *time.Time `db:"last_used_at" json:"last_used_at,omitempty"`
+	RevokedAt          *time.Time `db:"revoked_at" json:"revoked_at,omitempty"`
+}
+
+// AllowsOrigin reports whether a request with the Origin header origin may
+// use the key
+func (a *ClientApp) AllowsOrigin(origin string) bool {
+	if len(a.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, o := range a.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// StringList is a list of strings without spaces, stored space-separated in
+// a text column
+type StringList []string
+
+// Value implements driver.Valuer
+func (l StringList) Value() (driver.Value, error) {
+	return strings.Join(l, " "), nil
+}
+
+// Scan implements sql.Scanner
+func (l *StringList) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*l = StringList{}
+	case []byte:
+		*l = strings.Fields(string(v))
+	case string:
+		*l = strings.Fields(v)
+	default:
+		return fmt.Errorf("string list: cannot scan %T", src)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package model
+
+import "time"
+
+// Authentication event types. Admin actions are recorded as
+// EventAdminPrefix + action, e.g. "admin.suspend", and changes made by an
+// identity provider over SCIM as EventSCIMPrefix + action.
+const (
+	EventOTPRequested   = "otp_requested"
+	EventOTPVerified    = "otp_verified"
+	EventOTPFailed      = "otp_failed"
+	EventUserCreated    = "user_created"
+	EventTokenExchanged = "token_exchanged"
+	EventLogout         = "logout"
+	EventEmailAdded     = "email_added"
+	EventEmailRemoved   = "email_removed"
+	EventPhoneChanged   = "phone_changed"
+	EventAccountDeleted = "account_deleted"
+	EventAccountPurged  = "account_purged"
+	EventPhonesRedacted = "phones_redacted"
+	EventAdminPrefix    = "admin."
+	EventSCIMPrefix     = "scim."
+)
+
+// AuthEvent is one row of the append-only auth_events log. Hash covers every
+// other stored field but RedactedBy, including PrevHash, chaining each row
+// to the one before it.
+//
+// The phone number of a row can be removed later: the row is then marked
+// RedactedBy a later phones_redacted event, whose details attest the
+// rewritten contents so the chain still verifies.
+type AuthEvent struct {
+	ID      int64  `db:"id" json:"id"`
+	Type    string `db:"event_type" json:"event_type"`
+	UserID  *int64 `db:"user_id" json:"-"`
+	ActorID *int64 `db:"actor_id" json:"-"`
+	// UserPublicID and ActorPublicID are what clients see of the users,
+	// filled in when events are listed
+	UserPublicID  string `db:"user_public_id" json:"user_id,omitempty"`
+	ActorPublicID string `db:"actor_public_id" json:"actor_id,omitempty"`
+	// Phone is empty when numbers are encrypted or the row was redacted;
+	// PhoneIndex then holds the blind index of the number, if known
+	Phone      string            `db:"phone" json:"phone,omitempty"`
+	PhoneIndex []byte            `db:"phone_index" json:"-"`
+	RedactedBy *int64            `db:"redacted_by" json:"redacted_by,omitempty"`
+	IP         string            `db:"ip" json:"ip,omitempty"`
+	UserAgent  string            `db:"user_agent" json:"user_agent,omitempty"`
+	RequestID  string            `db:"request_id" json:"request_id,omitempty"`
+	Details    map[string]string `db:"-" json:"details,omitempty"`
+	CreatedAt  time.Time         `db:"created_at" json:"created_at"`
+	PrevHash   string            `db:"prev_hash" json:"prev_hash"`
+	Hash       string            `db:"hash" json:"hash"`
+}
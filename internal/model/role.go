@@ -0,0 +1,17 @@
+package model
+
+// Built-in roles. Every user implicitly has RoleUser; the others are granted
+// through the user_roles table.
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+// Permissions granted to roles via role_permissions and embedded into tokens
+// as scopes.
+const (
+	ScopeProfileRead = "profile:read"
+	ScopeUsersRead   = "users:read"
+	ScopeUsersWrite  = "users:write"
+)
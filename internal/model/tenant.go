@@ -0,0 +1,53 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Tenant is one brand served by the deployment. Nil policy fields fall back
+// to the service configuration.
+type Tenant struct {
+	ID   int64  `db:"id" json:"id"`
+	Slug string `db:"slug" json:"slug"`
+	Name string `db:"name" json:"name"`
+	// Hosts are the Host headers that select the tenant
+	Hosts []string `db:"-" json:"hosts"`
+
+	OTPLength          *int    `db:"otp_length" json:"otp_length,omitempty"`
+	OTPTTLSeconds      *int    `db:"otp_ttl_seconds" json:"otp_ttl_seconds,omitempty"`
+	RateLimitMax       *int    `db:"rate_limit_max" json:"rate_limit_max,omitempty"`
+	RateLimitWindowSec *int    `db:"rate_limit_window_seconds" json:"rate_limit_window_seconds,omitempty"`
+	OTPMessageTemplate *string `db:"otp_message_template" json:"otp_message_template,omitempty"`
+	TokenTTLSeconds    *int    `db:"token_ttl_seconds" json:"token_ttl_seconds,omitempty"`
+	// SigningKey replaces JWT_SECRET for the tenant's tokens
+	SigningKey *string `db:"signing_key" json:"-"`
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// OTP code lengths a tenant may choose
+const (
+	MinOTPLength = 4
+	MaxOTPLength = 10
+)
+
+// Validate checks the slug and that the policy overrides are usable
+func (t *Tenant) Validate() error {
+	if t.Slug == "" || strings.Trim(t.Slug, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+		return errors.New("slug must be lowercase letters, digits and dashes")
+	}
+	if t.OTPLength != nil && (*t.OTPLength < MinOTPLength || *t.OTPLength > MaxOTPLength) {
+		return errors.New("otp length must be between 4 and 10")
+	}
+	for _, v := range []*int{t.OTPTTLSeconds, t.RateLimitMax, t.RateLimitWindowSec, t.TokenTTLSeconds} {
+		if v != nil && *v <= 0 {
+			return errors.New("ttls, windows and limits must be positive")
+		}
+	}
+	if t.SigningKey != nil && len(*t.SigningKey) < 32 {
+		return errors.New("signing key must be at least 32 characters")
+	}
+	return nil
+}
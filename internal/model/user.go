@@ -1,9 +1,126 @@
 package model
 
-import "time"
+import (
+    "database/sql/driver"
+    "encoding/json"
+    "fmt"
+    "time"
+)
+
+// User statuses. Only active users can log in or use their tokens.
+const (
+    UserStatusActive    = "active"
+    UserStatusSuspended = "suspended" // temporary, lifted by an admin
+    UserStatusBanned    = "banned"    // permanent
+    UserStatusDeleted   = "deleted"   // closed account
+)
+
+// ValidUserStatus reports whether s is a known user status
+func ValidUserStatus(s string) bool {
+    switch s {
+    case UserStatusActive, UserStatusSuspended, UserStatusBanned, UserStatusDeleted:
+        return true
+    }
+    return false
+}
 
 type User struct {
-    ID int64 `db:"id" json:"id"`
+    // ID is internal; clients only ever see PublicID
+    ID int64 `db:"id" json:"-"`
+    // TenantID is the brand the user signed up with
+    TenantID int64 `db:"tenant_id" json:"-"`
+    PublicID string `db:"public_id" json:"id"`
     Phone string `db:"phone" json:"phone"`
+    Status string `db:"status" json:"status"`
+    StatusReason string `db:"status_reason" json:"status_reason,omitempty"`
+    // StatusChangedAt starts the grace period of a deleted account
+    StatusChangedAt *time.Time `db:"status_changed_at" json:"status_changed_at,omitempty"`
     RegisteredAt time.Time `db:"registered_at" json:"registered_at"`
-}
\ No newline at end of file
+
+    // profile, editable by the user
+    DisplayName string `db:"display_name" json:"display_name,omitempty"`
+    Email string `db:"email" json:"email,omitempty"`
+    Locale string `db:"locale" json:"locale,omitempty"`
+    Timezone string `db:"timezone" json:"timezone,omitempty"`
+    AvatarURL string `db:"avatar_url" json:"avatar_url,omitempty"`
+    Metadata Metadata `db:"metadata" json:"metadata,omitempty" swaggertype:"object"`
+
+    LastLoginAt *time.Time `db:"last_login_at" json:"last_login_at,omitempty"`
+    LoginCount int64 `db:"login_count" json:"login_count"`
+}
+
+// ProfileUpdate changes the profile fields that are not nil
+type ProfileUpdate struct {
+    DisplayName *string
+    Email *string
+    Locale *string
+    Timezone *string
+    AvatarURL *string
+    // Metadata replaces the whole object
+    Metadata Metadata
+}
+
+// Metadata is an arbitrary JSON object stored in a JSON column
+type Metadata map[string]interface{}
+
+// Value implements driver.Valuer
+func (m Metadata) Value() (driver.Value, error) {
+    if m == nil {
+        return "{}", nil
+    }
+    b, err := json.Marshal(m)
+    if err != nil {
+        return nil, err
+    }
+    return string(b), nil
+}
+
+// Scan implements sql.Scanner
+func (m *Metadata) Scan(src interface{}) error {
+    var b []byte
+    switch v := src.(type) {
+    case nil:
+        *m = nil
+        return nil
+    case []byte:
+        b = v
+    case string:
+        b = []byte(v)
+    default:
+        return fmt.Errorf("metadata: cannot scan %T", src)
+    }
+    return json.Unmarshal(b, m)
+}
+
+// UserEmail is a verified email address the user can log in with
+type UserEmail struct {
+    UserID int64 `db:"user_id" json:"-"`
+    Email string `db:"email" json:"email"`
+    VerifiedAt time.Time `db:"verified_at" json:"verified_at"`
+}
+
+// PhoneChange records a user moving from one phone number to another.
+// Clients see the public ids of the users, empty once a user is purged.
+type PhoneChange struct {
+    ID int64 `db:"id" json:"id"`
+    UserID int64 `db:"user_id" json:"-"`
+    UserPublicID string `db:"user_public_id" json:"user_id"`
+    OldPhone string `db:"old_phone" json:"old_phone"`
+    NewPhone string `db:"new_phone" json:"new_phone"`
+    // ActorID is the user or admin who made the change, 0 for the
+    // identity provider
+    ActorID int64 `db:"actor_id" json:"-"`
+    ActorPublicID string `db:"actor_public_id" json:"actor_id,omitempty"`
+    ChangedAt time.Time `db:"changed_at" json:"changed_at"`
+}
+
+// UserNote is a free-form note left on a user by an administrator
+type UserNote struct {
+    ID int64 `db:"id" json:"id"`
+    UserID int64 `db:"user_id" json:"-"`
+    UserPublicID string `db:"user_public_id" json:"user_id"`
+    AuthorID *int64 `db:"author_id" json:"-"`
+    AuthorPublicID string `db:"author_public_id" json:"author_id,omitempty"`
+    Body string `db:"body" json:"body"`
+    CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
@@ -0,0 +1,434 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/jmoiron/sqlx"
+)
+
+// authEventsLockID is the advisory lock serializing appends to auth_events
+const authEventsLockID = 0x61757468 // "auth"
+
+const authEventColumns = `id, event_type, user_id, actor_id, phone, phone_index, redacted_by,
+	ip, user_agent, request_id, details, created_at, prev_hash, hash`
+
+// Details of a phones_redacted event: how many rows it redacted and a digest
+// of their rewritten contents
+const (
+	redactedEventsKey = "redacted_events"
+	redactedDigestKey = "redacted_digest"
+)
+
+// phoneDetailKeys are the details in which older events kept phone numbers
+var phoneDetailKeys = []string{"phone", "old_phone", "new_phone"}
+
+// holdsPhoneCond matches the auth_events rows that still hold a phone number
+const holdsPhoneCond = "phone <> '' OR details ?| array['phone', 'old_phone', 'new_phone']"
+
+// Reasons given in the details of a phones_redacted event
+const (
+	redactReencrypt = "reencrypt"
+	redactPurge     = "purge"
+)
+
+func phonesRedactedEvent(userID *int64, reason string) *model.AuthEvent {
+	return &model.AuthEvent{Type: model.EventPhonesRedacted, UserID: userID, Details: map[string]string{"reason": reason}}
+}
+
+// holdsPhone reports whether e still holds a phone number
+func holdsPhone(e *model.AuthEvent) bool {
+	if e.RedactedBy != nil {
+		return false
+	}
+	if e.Phone != "" {
+		return true
+	}
+	for _, k := range phoneDetailKeys {
+		if _, ok := e.Details[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// purgedWith reports whether e is about the purged user userID: one of its
+// events, or one without a user, such as a failed login, naming one of its
+// numbers
+func purgedWith(e *model.AuthEvent, userID int64, phones []string) bool {
+	if e.UserID != nil {
+		return *e.UserID == userID
+	}
+	return slices.Contains(phones, e.Phone)
+}
+
+// ChainError reports the first auth_events row whose hash chain is broken
+type ChainError struct {
+	ID     int64
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("auth_events chain broken at id %d: %s", e.ID, e.Reason)
+}
+
+// hashAuthEvent computes the chained hash of an event. Fields are serialized
+// in a fixed order; encoding/json sorts the details keys. The phone index is
+// left out when empty, so rows written before it existed hash as they did.
+func hashAuthEvent(e *model.AuthEvent) string {
+	details := e.Details
+	if details == nil {
+		details = map[string]string{}
+	}
+	b, _ := json.Marshal(struct {
+		ID         int64             `json:"id"`
+		Type       string            `json:"event_type"`
+		UserID     *int64            `json:"user_id"`
+		ActorID    *int64            `json:"actor_id"`
+		Phone      string            `json:"phone"`
+		PhoneIndex string            `json:"phone_index,omitempty"`
+		IP         string            `json:"ip"`
+		UserAgent  string            `json:"user_agent"`
+		RequestID  string            `json:"request_id"`
+		Details    map[string]string `json:"details"`
+		CreatedAt  string            `json:"created_at"`
+		PrevHash   string            `json:"prev_hash"`
+	}{
+		e.ID, e.Type, e.UserID, e.ActorID, e.Phone, hex.EncodeToString(e.PhoneIndex), e.IP, e.UserAgent, e.RequestID,
+		details, e.CreatedAt.UTC().Format(time.RFC3339Nano), e.PrevHash,
+	})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// redactPhone removes the phone number from e, in the phone column and in
+// the details of older events, and marks it redacted by the event with id
+// by. index, the blind index of the number or nil, is kept in its place.
+func redactPhone(e *model.AuthEvent, index []byte, by int64) {
+	if e.PhoneIndex == nil {
+		e.PhoneIndex = index
+	}
+	e.Phone = ""
+	details := map[string]string{}
+	for k, v := range e.Details {
+		details[k] = v
+	}
+	for _, k := range phoneDetailKeys {
+		delete(details, k)
+	}
+	e.Details = details
+	e.RedactedBy = &by
+}
+
+// attestRedaction adds to the details of the phones_redacted event the
+// digest of the rows it rewrote, given their hashes after the rewrite
+func attestRedaction(tombstone *model.AuthEvent, hashes []string) {
+	details := map[string]string{}
+	for k, v := range tombstone.Details {
+		details[k] = v
+	}
+	details[redactedEventsKey] = strconv.Itoa(len(hashes))
+	details[redactedDigestKey] = redactionDigest(hashes)
+	tombstone.Details = details
+}
+
+func redactionDigest(hashes []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(hashes, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// chainVerifier checks auth_events rows in id order. A redacted row can no
+// longer match its hash, which still links the chain; instead its rewritten
+// contents must match the digest of the later event that redacted it.
+type chainVerifier struct {
+	checked int64
+	prev    string
+	// redacting event id -> hashes of the rows it redacted
+	redacted map[int64][]string
+}
+
+func newChainVerifier() *chainVerifier {
+	return &chainVerifier{redacted: map[int64][]string{}}
+}
+
+func (v *chainVerifier) check(e *model.AuthEvent) error {
+	if e.PrevHash != v.prev {
+		return &ChainError{ID: e.ID, Reason: "prev_hash does not match previous row"}
+	}
+	if e.RedactedBy != nil {
+		if *e.RedactedBy <= e.ID {
+			return &ChainError{ID: e.ID, Reason: "redacted by an earlier row"}
+		}
+		v.redacted[*e.RedactedBy] = append(v.redacted[*e.RedactedBy], hashAuthEvent(e))
+	} else if hashAuthEvent(e) != e.Hash {
+		return &ChainError{ID: e.ID, Reason: "hash does not match contents"}
+	}
+	hashes, redacting := v.redacted[e.ID]
+	delete(v.redacted, e.ID)
+	if _, ok := e.Details[redactedDigestKey]; ok || redacting {
+		if e.Details[redactedEventsKey] != strconv.Itoa(len(hashes)) || e.Details[redactedDigestKey] != redactionDigest(hashes) {
+			return &ChainError{ID: e.ID, Reason: "redacted rows do not match"}
+		}
+	}
+	v.prev = e.Hash
+	v.checked++
+	return nil
+}
+
+// finish reports rows marked redacted by an event that does not exist
+func (v *chainVerifier) finish() error {
+	ids := make([]int64, 0, len(v.redacted))
+	for id := range v.redacted {
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return &ChainError{ID: ids[0], Reason: "redacting row is missing"}
+}
+
+// authEventPublicIDs selects the public ids of the users of an event
+var authEventPublicIDs = publicIDOf("auth_events.user_id", "user_public_id") + ", " +
+	publicIDOf("auth_events.actor_id", "actor_public_id")
+
+type authEventRow struct {
+	model.AuthEvent
+	DetailsJSON []byte `db:"details"`
+}
+
+// RecordAuthEvent appends e to auth_events, filling in its id, hashes and,
+// unless already set, its timestamp. Appends are serialized so every row
+// links to its predecessor.
+func (p *Postgres) RecordAuthEvent(ctx context.Context, e *model.AuthEvent) error {
+	return p.RecordAuthEvents(ctx, []*model.AuthEvent{e})
+}
+
+// RecordAuthEvents appends events in order in one transaction, taking the
+// chain lock once for the whole batch. With a keyring, phone numbers are
+// replaced by their blind index.
+func (p *Postgres) RecordAuthEvents(ctx context.Context, events []*model.AuthEvent) error {
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", authEventsLockID); err != nil {
+		return err
+	}
+	if err := p.appendAuthEvents(ctx, tx, events); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// appendAuthEvents inserts events after the last row. The caller holds the
+// chain lock. Events that already have an id keep it.
+func (p *Postgres) appendAuthEvents(ctx context.Context, tx *sqlx.Tx, events []*model.AuthEvent) error {
+	prev := ""
+	err := tx.GetContext(ctx, &prev, "SELECT hash FROM auth_events ORDER BY id DESC LIMIT 1")
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	now := time.Now()
+	for _, e := range events {
+		if p.keys != nil && e.Phone != "" {
+			e.PhoneIndex = p.phoneIndex(e.Phone)
+			e.Phone = ""
+		}
+		details := e.Details
+		if details == nil {
+			details = map[string]string{}
+		}
+		detailsJSON, err := json.Marshal(details)
+		if err != nil {
+			return err
+		}
+		if e.ID == 0 {
+			if err := tx.GetContext(ctx, &e.ID, "SELECT nextval('auth_events_id_seq')"); err != nil {
+				return err
+			}
+		}
+		e.PrevHash = prev
+		if e.CreatedAt.IsZero() {
+			e.CreatedAt = now
+		}
+		// postgres keeps microseconds
+		e.CreatedAt = e.CreatedAt.UTC().Truncate(time.Microsecond)
+		e.Hash = hashAuthEvent(e)
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO auth_events
+				(id, event_type, user_id, actor_id, phone, phone_index, ip, user_agent, request_id, details, created_at, prev_hash, hash)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+			e.ID, e.Type, e.UserID, e.ActorID, e.Phone, e.PhoneIndex, e.IP, e.UserAgent, e.RequestID,
+			string(detailsJSON), e.CreatedAt, e.PrevHash, e.Hash)
+		if err != nil {
+			return err
+		}
+		prev = e.Hash
+	}
+	return nil
+}
+
+// redactAuthEvents removes the phone numbers from the events matching cond,
+// a condition on auth_events using args, in batches. Every batch is attested
+// by a phones_redacted event built by tombstone. It returns the number of
+// rows redacted.
+func (p *Postgres) redactAuthEvents(ctx context.Context, cond string, args []interface{}, tombstone func() *model.AuthEvent) (int, error) {
+	total := 0
+	after := int64(0)
+	for {
+		n, last, err := p.redactAuthEventBatch(ctx, cond, args, after, tombstone())
+		total += n
+		if err != nil || n == 0 {
+			return total, err
+		}
+		after = last
+	}
+}
+
+func (p *Postgres) redactAuthEventBatch(ctx context.Context, cond string, args []interface{}, after int64, tombstone *model.AuthEvent) (int, int64, error) {
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", authEventsLockID); err != nil {
+		return 0, 0, err
+	}
+	var rows []authEventRow
+	err = tx.SelectContext(ctx, &rows, fmt.Sprintf(`
+		SELECT `+authEventColumns+`
+		FROM auth_events
+		WHERE redacted_by IS NULL AND id > $%d AND (%s)
+		ORDER BY id
+		LIMIT $%d`, len(args)+1, cond, len(args)+2), append(args, after, reencryptBatchSize)...)
+	if err != nil || len(rows) == 0 {
+		return 0, 0, err
+	}
+	if err := tx.GetContext(ctx, &tombstone.ID, "SELECT nextval('auth_events_id_seq')"); err != nil {
+		return 0, 0, err
+	}
+
+	hashes := make([]string, len(rows))
+	for i := range rows {
+		e := &rows[i].AuthEvent
+		if err := json.Unmarshal(rows[i].DetailsJSON, &e.Details); err != nil {
+			return 0, 0, fmt.Errorf("auth event %d: %w", e.ID, err)
+		}
+		var index []byte
+		if e.Phone != "" {
+			index = p.phoneIndex(e.Phone)
+		}
+		redactPhone(e, index, tombstone.ID)
+		detailsJSON, err := json.Marshal(e.Details)
+		if err != nil {
+			return 0, 0, err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE auth_events SET phone='', phone_index=$1, details=$2, redacted_by=$3
+			WHERE id=$4`, e.PhoneIndex, string(detailsJSON), tombstone.ID, e.ID)
+		if err != nil {
+			return 0, 0, err
+		}
+		hashes[i] = hashAuthEvent(e)
+	}
+	attestRedaction(tombstone, hashes)
+	if err := p.appendAuthEvents(ctx, tx, []*model.AuthEvent{tombstone}); err != nil {
+		return 0, 0, err
+	}
+	return len(rows), rows[len(rows)-1].ID, tx.Commit()
+}
+
+// RedactUserAuthEvents removes the phone numbers from the events of a purged
+// user and from the events without a user that name one of its numbers.
+// With a keyring, their blind index is kept. The redaction is recorded by
+// phones_redacted events. It returns the number of rows redacted.
+func (p *Postgres) RedactUserAuthEvents(ctx context.Context, userID int64, phones []string) (int, error) {
+	return p.redactAuthEvents(ctx, "("+holdsPhoneCond+") AND (user_id = $1 OR (user_id IS NULL AND phone = ANY($2)))",
+		[]interface{}{userID, phones}, func() *model.AuthEvent { return phonesRedactedEvent(&userID, redactPurge) })
+}
+
+// VerifyAuthEvents walks auth_events in order and recomputes every hash. It
+// returns the number of rows checked, the hash of the last row and a
+// *ChainError at the first row that was modified, removed or reordered.
+// Rows removed from the end can only be detected by comparing the returned
+// head hash against a previously recorded one.
+func (p *Postgres) VerifyAuthEvents(ctx context.Context) (int64, string, error) {
+	return verifyAuthEvents(ctx, p.db)
+}
+
+func verifyAuthEvents(ctx context.Context, db sqlx.QueryerContext) (int64, string, error) {
+	rows, err := db.QueryxContext(ctx, `
+		SELECT `+authEventColumns+`
+		FROM auth_events
+		ORDER BY id`)
+	if err != nil {
+		return 0, "", err
+	}
+	defer rows.Close()
+
+	v := newChainVerifier()
+	for rows.Next() {
+		var row authEventRow
+		if err := rows.StructScan(&row); err != nil {
+			return v.checked, v.prev, err
+		}
+		e := &row.AuthEvent
+		if err := json.Unmarshal(row.DetailsJSON, &e.Details); err != nil {
+			return v.checked, v.prev, &ChainError{ID: e.ID, Reason: "unreadable details"}
+		}
+		if err := v.check(e); err != nil {
+			return v.checked, v.prev, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return v.checked, v.prev, err
+	}
+	return v.checked, v.prev, v.finish()
+}
+
+// ListUserAuthEvents returns the events about a user in the order they were
+// recorded
+func (p *Postgres) ListUserAuthEvents(ctx context.Context, userID int64) ([]model.AuthEvent, error) {
+	return listUserAuthEvents(ctx, p.reader(ctx), userID)
+}
+
+func listUserAuthEvents(ctx context.Context, db sqlx.QueryerContext, userID int64) ([]model.AuthEvent, error) {
+	rows, err := db.QueryxContext(ctx, `
+		SELECT `+authEventColumns+`, `+authEventPublicIDs+`
+		FROM auth_events
+		WHERE user_id=$1
+		ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []model.AuthEvent{}
+	for rows.Next() {
+		var row authEventRow
+		if err := rows.StructScan(&row); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(row.DetailsJSON, &row.Details); err != nil {
+			return nil, err
+		}
+		events = append(events, row.AuthEvent)
+	}
+	return events, rows.Err()
+}
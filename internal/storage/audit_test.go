@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/example/go-otp-auth/internal/model"
+)
+
+// testRedactUserAuthEvents purges user 1, who held +1555 and +1444, from the
+// log of store
+func testRedactUserAuthEvents(t *testing.T, store EventStore) {
+	t.Helper()
+	ctx := context.Background()
+	uid, other := int64(1), int64(2)
+	for _, e := range []*model.AuthEvent{
+		{Type: model.EventOTPRequested, Phone: "+1444"},
+		{Type: model.EventUserCreated, UserID: &uid, Phone: "+1444"},
+		{Type: model.EventAdminPrefix + "change_phone", UserID: &uid, Details: map[string]string{"old_phone": "+1444", "new_phone": "+1555"}},
+		{Type: model.EventOTPRequested, Phone: "+1666"},
+		{Type: model.EventOTPVerified, UserID: &other, Phone: "+1777"},
+		{Type: model.EventLogout, UserID: &uid},
+	} {
+		if err := store.RecordAuthEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := store.RedactUserAuthEvents(ctx, uid, []string{"+1555", "+1444"})
+	if err != nil || n != 3 {
+		t.Fatalf("RedactUserAuthEvents = %d, %v; want 3", n, err)
+	}
+	if checked, _, err := store.VerifyAuthEvents(ctx); err != nil || checked != 7 {
+		t.Fatalf("verify after redaction: checked %d, err %v", checked, err)
+	}
+	events, err := store.ListUserAuthEvents(ctx, uid)
+	if err != nil || len(events) != 4 {
+		t.Fatalf("user events = %+v, %v", events, err)
+	}
+	for _, e := range events[:2] {
+		if e.Phone != "" || len(e.Details) != 0 || e.RedactedBy == nil || *e.RedactedBy != 7 {
+			t.Fatalf("event not redacted: %+v", e)
+		}
+	}
+	if last := events[3]; last.Type != model.EventPhonesRedacted || last.Details["reason"] != redactPurge {
+		t.Fatalf("tombstone = %+v", last)
+	}
+	if events, _ := store.ListUserAuthEvents(ctx, other); events[0].Phone != "+1777" {
+		t.Fatalf("other user's event redacted: %+v", events[0])
+	}
+
+	if n, err := store.RedactUserAuthEvents(ctx, uid, []string{"+1555", "+1444"}); err != nil || n != 0 {
+		t.Fatalf("second redaction = %d, %v; want nothing left", n, err)
+	}
+	if checked, _, err := store.VerifyAuthEvents(ctx); err != nil || checked != 7 {
+		t.Fatalf("verify after second redaction: checked %d, err %v", checked, err)
+	}
+}
@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// ImportUser is one user loaded by ImportUsers. The phone number must
+// already be normalized.
+type ImportUser struct {
+	PublicID     string // a new id is assigned when empty
+	Phone        string
+	Status       string // model.UserStatusActive when empty
+	RegisteredAt time.Time
+}
+
+// UserSource yields the users to import. Next returns io.EOF after the last
+// one.
+type UserSource interface {
+	Next() (ImportUser, error)
+}
+
+// ImportResult counts the users handled by ImportUsers
+type ImportResult struct {
+	Copied   int // rows streamed to the database
+	Inserted int
+	// Existing rows were skipped because the phone number or public id is
+	// already registered
+	Existing int
+	// Duplicates were skipped because they repeat the phone number or public
+	// id of another row of the same import
+	Duplicates int
+}
+
+// ErrPhonesNotEncrypted is returned by ImportUsers while a keyring is set but
+// plaintext phone numbers remain: imported numbers could not be checked
+// against them
+var ErrPhonesNotEncrypted = errors.New("phone numbers are still being encrypted; retry when re-encryption has finished")
+
+// importColumns are the columns of the user_import staging table
+var importColumns = []string{"public_id", "phone", "phone_ct", "phone_key_id", "phone_index", "suffixes", "status", "registered_at"}
+
+// ImportUsers streams users into a temporary table with COPY and inserts
+// them from there in one transaction, skipping users whose phone number or
+// public id already exists. With dryRun everything runs but the transaction
+// is rolled back, so the result tells what an import would do.
+func (p *Postgres) ImportUsers(ctx context.Context, src UserSource, dryRun bool) (ImportResult, error) {
+	var res ImportResult
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Close()
+
+	err = conn.Raw(func(driverConn interface{}) error {
+		tx, err := driverConn.(*stdlib.Conn).Conn().Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		if p.keys != nil {
+			var plaintext bool
+			if err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE phone IS NOT NULL)").Scan(&plaintext); err != nil {
+				return err
+			}
+			if plaintext {
+				return ErrPhonesNotEncrypted
+			}
+		}
+
+		_, err = tx.Exec(ctx, `
+			CREATE TEMP TABLE user_import (
+				public_id     UUID NOT NULL,
+				phone         TEXT,
+				phone_ct      BYTEA,
+				phone_key_id  TEXT,
+				phone_index   BYTEA,
+				suffixes      BYTEA[],
+				status        TEXT NOT NULL,
+				registered_at TIMESTAMPTZ NOT NULL
+			) ON COMMIT DROP`)
+		if err != nil {
+			return err
+		}
+
+		n, err := tx.CopyFrom(ctx, pgx.Identifier{"user_import"}, importColumns, pgx.CopyFromFunc(func() ([]interface{}, error) {
+			u, err := src.Next()
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return p.importRow(u)
+		}))
+		res.Copied = int(n)
+		if err != nil {
+			return err
+		}
+
+		// counted before the insert, so rows only clashing with each other
+		// are told apart from those already registered
+		err = tx.QueryRow(ctx, `
+			SELECT count(*) FROM user_import i
+			WHERE EXISTS (
+				SELECT 1 FROM users u
+				WHERE u.public_id = i.public_id
+					OR (u.tenant_id = $1 AND (u.phone = i.phone OR u.phone_index = i.phone_index))
+			)`, TenantFromContext(ctx)).Scan(&res.Existing)
+		if err != nil {
+			return err
+		}
+
+		tag, err := tx.Exec(ctx, `
+			INSERT INTO users (tenant_id, public_id, phone, phone_ct, phone_key_id, phone_index, status, status_changed_at, registered_at)
+			SELECT $2, public_id, phone, phone_ct, phone_key_id, phone_index, status,
+				CASE WHEN status <> $1 THEN now() END, registered_at
+			FROM user_import
+			ON CONFLICT DO NOTHING`, model.UserStatusActive, TenantFromContext(ctx))
+		if err != nil {
+			return err
+		}
+		res.Inserted = int(tag.RowsAffected())
+		res.Duplicates = res.Copied - res.Inserted - res.Existing
+
+		// a staged public id only belongs to the inserted row if the phone
+		// matches too; it may have collided with an existing user
+		_, err = tx.Exec(ctx, `
+			INSERT INTO user_phone_suffixes (token, user_id)
+			SELECT unnest(i.suffixes), u.id
+			FROM user_import i JOIN users u
+				ON u.public_id = i.public_id AND u.tenant_id = $1 AND u.phone_index = i.phone_index
+			ON CONFLICT DO NOTHING`, TenantFromContext(ctx))
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			return nil
+		}
+		return tx.Commit(ctx)
+	})
+	return res, err
+}
+
+// importRow returns the staging table values of u
+func (p *Postgres) importRow(u ImportUser) ([]interface{}, error) {
+	id := u.PublicID
+	if id == "" {
+		id = NewPublicID()
+	}
+	publicID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, fmt.Errorf("public id %q: %w", id, err)
+	}
+	sp, err := p.storePhone(u.Phone)
+	if err != nil {
+		return nil, err
+	}
+	status := u.Status
+	if status == "" {
+		status = model.UserStatusActive
+	}
+	registeredAt := u.RegisteredAt
+	if registeredAt.IsZero() {
+		registeredAt = time.Now()
+	}
+	var phone, keyID interface{}
+	if sp.plain.Valid {
+		phone = sp.plain.String
+	}
+	if sp.keyID.Valid {
+		keyID = sp.keyID.String
+	}
+	return []interface{}{publicID, phone, sp.ct, keyID, sp.index, sp.suffixes, status, registeredAt}, nil
+}
+
+// ExportUsers streams the users matching filter in id order to fn, with
+// phone numbers decrypted. It stops at the first error fn returns.
+func (p *Postgres) ExportUsers(ctx context.Context, filter UserFilter, fn func(ListedUser) error) error {
+	where, args, err := p.userConditions(ctx, filter)
+	if err != nil {
+		return err
+	}
+	cond := ""
+	if len(where) > 0 {
+		cond = "WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := p.reader(ctx).QueryxContext(ctx, `
+		SELECT id, public_id, COALESCE(phone, '') AS phone, phone_ct, phone_key_id, status, registered_at, last_login_at
+		FROM users
+		`+cond+`
+		ORDER BY id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r struct {
+			ListedUser
+			encryptedPhone
+		}
+		if err := rows.StructScan(&r); err != nil {
+			return err
+		}
+		if r.Phone, err = p.decryptPhone(r.Phone, r.encryptedPhone); err != nil {
+			return fmt.Errorf("user %d: %w", r.ID, err)
+		}
+		if err := fn(r.ListedUser); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/example/go-otp-auth/internal/model"
+)
+
+// ClientKeyPrefix starts every client app key, so leaked keys are easy to
+// recognize
+const ClientKeyPrefix = "otpk_"
+
+// clientKeyPrefixLen is how much of a key is kept as its KeyPrefix
+const clientKeyPrefixLen = len(ClientKeyPrefix) + 8
+
+// clientAppTouchInterval limits last_used_at updates to one per key and
+// interval
+const clientAppTouchInterval = time.Minute
+
+// NewClientAppKey returns a new client app key with its prefix and hash
+func NewClientAppKey() (key, prefix, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	key = ClientKeyPrefix + hex.EncodeToString(b)
+	return key, key[:clientKeyPrefixLen], HashClientAppKey(key), nil
+}
+
+// HashClientAppKey returns the hash a client app key is stored and looked up
+// by
+func HashClientAppKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+const clientAppColumns = "id, tenant_id, name, key_prefix, allowed_origins, rate_limit_max, " +
+	"rate_limit_window_seconds, created_at, last_used_at, revoked_at"
+
+// sqlClientApps is the ClientAppStore of both SQL backends
+type sqlClientApps struct {
+	db     *sqlx.DB
+	unique func(error) bool
+	now    func() time.Time
+}
+
+// ClientApps returns the client app store backed by p
+func (p *Postgres) ClientApps() ClientAppStore {
+	return &sqlClientApps{db: p.db, unique: isUniqueViolation, now: time.Now}
+}
+
+func (s *sqlClientApps) CreateClientApp(ctx context.Context, app *model.ClientApp, keyHash string) error {
+	app.CreatedAt = s.now().UTC()
+	if app.AllowedOrigins == nil {
+		app.AllowedOrigins = model.StringList{}
+	}
+	err := s.db.GetContext(ctx, &app.ID, `
+		INSERT INTO client_apps (tenant_id, name, key_prefix, key_hash, allowed_origins,
+			rate_limit_max, rate_limit_window_seconds, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id`,
+		app.TenantID, app.Name, app.KeyPrefix, keyHash, app.AllowedOrigins,
+		app.RateLimitMax, app.RateLimitWindowSec, app.CreatedAt)
+	if s.unique(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *sqlClientApps) ClientAppByKey(ctx context.Context, keyHash string) (*model.ClientApp, error) {
+	var app model.ClientApp
+	err := s.db.GetContext(ctx, &app, "SELECT "+clientAppColumns+" FROM client_apps WHERE key_hash=$1", keyHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
+func (s *sqlClientApps) ListClientApps(ctx context.Context, tenantID int64) ([]model.ClientApp, error) {
+	apps := []model.ClientApp{}
+	err := s.db.SelectContext(ctx, &apps, "SELECT "+clientAppColumns+" FROM client_apps WHERE tenant_id=$1 ORDER BY id", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
+
+func (s *sqlClientApps) RevokeClientApp(ctx context.Context, keyPrefix string) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE client_apps SET revoked_at=$1 WHERE key_prefix=$2 AND revoked_at IS NULL`,
+		s.now().UTC(), keyPrefix)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+func (s *sqlClientApps) TouchClientApp(ctx context.Context, id int64) error {
+	now := s.now().UTC()
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE client_apps SET last_used_at=$1
+		WHERE id=$2 AND (last_used_at IS NULL OR last_used_at < $3)`,
+		now, id, now.Add(-clientAppTouchInterval))
+	return err
+}
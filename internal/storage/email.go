@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/example/go-otp-auth/internal/model"
+)
+
+// FindUserByEmail returns the user of the context tenant owning a verified
+// email address
+func (p *Postgres) FindUserByEmail(ctx context.Context, email string) (*model.User, error) {
+	var row userRow
+	err := p.reader(ctx).GetContext(ctx, &row, `
+		SELECT `+pgUserColumns+` FROM users
+		WHERE id = (SELECT user_id FROM user_emails WHERE tenant_id=$2 AND email=$1)`, email, TenantFromContext(ctx))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.user(&row)
+}
+
+// AddUserEmail attaches a verified email to a user. Adding an address the
+// user already has is a no-op; one owned by another user of the same tenant
+// is ErrConflict. Other tenants may use the same address.
+func (p *Postgres) AddUserEmail(ctx context.Context, userID int64, email string) (*model.UserEmail, error) {
+	var e model.UserEmail
+	err := p.db.GetContext(ctx, &e, `
+		INSERT INTO user_emails (tenant_id, email, user_id)
+		SELECT tenant_id, $1, id FROM users WHERE id=$2
+		ON CONFLICT (tenant_id, email) DO UPDATE SET email=EXCLUDED.email WHERE user_emails.user_id=$2
+		RETURNING user_id, email, verified_at`, email, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// the conflicting row belongs to someone else
+		return nil, ErrConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// ListUserEmails returns the verified emails of a user, oldest first
+func (p *Postgres) ListUserEmails(ctx context.Context, userID int64) ([]model.UserEmail, error) {
+	emails := []model.UserEmail{}
+	err := p.reader(ctx).SelectContext(ctx, &emails, `
+		SELECT user_id, email, verified_at FROM user_emails
+		WHERE user_id=$1
+		ORDER BY verified_at, email`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+// DeleteUserEmail detaches an email from a user
+func (p *Postgres) DeleteUserEmail(ctx context.Context, userID int64, email string) error {
+	res, err := p.db.ExecContext(ctx, "DELETE FROM user_emails WHERE user_id=$1 AND email=$2", userID, email)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/rs/zerolog/log"
+)
+
+// maxEventBatch caps how many queued events are appended in one transaction
+const maxEventBatch = 100
+
+// eventWriteTimeout bounds a single batch write, so a stuck database cannot
+// hold the queue forever
+const eventWriteTimeout = 10 * time.Second
+
+// EventBatcher is implemented by event stores that can append several
+// events under a single chain lock
+type EventBatcher interface {
+	RecordAuthEvents(ctx context.Context, events []*model.AuthEvent) error
+}
+
+// EventQueue is an EventStore that takes appends off the request path.
+// RecordAuthEvent stamps the event and queues it; Run writes the queue to
+// the underlying store in batches, so the chain lock is taken once per batch
+// by a single writer instead of once per request. Queued events have no id
+// or hash until they are written. When the queue is full, or Run has
+// stopped, events are written inline rather than dropped.
+type EventQueue struct {
+	store  EventStore
+	events chan *model.AuthEvent
+
+	// mu guards the fields below. Events are only sent to the channel
+	// while holding it, so none can slip in after Run's final drain.
+	mu       sync.Mutex
+	stopped  bool
+	queued   uint64        // events sent to the channel
+	written  uint64        // queued events the writer is done with
+	progress chan struct{} // closed, and replaced, whenever written grows
+}
+
+// NewEventQueue returns a queue of up to size events in front of store
+func NewEventQueue(store EventStore, size int) *EventQueue {
+	return &EventQueue{
+		store:    store,
+		events:   make(chan *model.AuthEvent, size),
+		progress: make(chan struct{}),
+	}
+}
+
+func (q *EventQueue) RecordAuthEvent(ctx context.Context, e *model.AuthEvent) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	q.mu.Lock()
+	if !q.stopped {
+		// the writer owns the event from here
+		queued := *e
+		select {
+		case q.events <- &queued:
+			q.queued++
+			q.mu.Unlock()
+			return nil
+		default:
+		}
+	}
+	q.mu.Unlock()
+	return q.store.RecordAuthEvent(ctx, e)
+}
+
+func (q *EventQueue) VerifyAuthEvents(ctx context.Context) (int64, string, error) {
+	return q.store.VerifyAuthEvents(ctx)
+}
+
+func (q *EventQueue) ListUserAuthEvents(ctx context.Context, userID int64) ([]model.AuthEvent, error) {
+	return q.store.ListUserAuthEvents(ctx, userID)
+}
+
+// RedactUserAuthEvents waits for the events queued so far to be written
+// first, or they would reach the store with the phone numbers still in them.
+func (q *EventQueue) RedactUserAuthEvents(ctx context.Context, userID int64, phones []string) (int, error) {
+	if err := q.flush(ctx); err != nil {
+		return 0, err
+	}
+	return q.store.RedactUserAuthEvents(ctx, userID, phones)
+}
+
+// flush waits until every event queued before the call has been written
+func (q *EventQueue) flush(ctx context.Context) error {
+	q.mu.Lock()
+	target := q.queued
+	for q.written < target {
+		progress := q.progress
+		q.mu.Unlock()
+		select {
+		case <-progress:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		q.mu.Lock()
+	}
+	q.mu.Unlock()
+	return nil
+}
+
+// Run writes queued events until ctx is done, then flushes what is left and
+// returns. Later events are written inline.
+func (q *EventQueue) Run(ctx context.Context) {
+	for {
+		select {
+		case e := <-q.events:
+			q.write(q.batch(e))
+		case <-ctx.Done():
+			q.mu.Lock()
+			q.stopped = true
+			q.mu.Unlock()
+			for {
+				select {
+				case e := <-q.events:
+					q.write(q.batch(e))
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// batch collects first and whatever else is already queued
+func (q *EventQueue) batch(first *model.AuthEvent) []*model.AuthEvent {
+	batch := []*model.AuthEvent{first}
+	for len(batch) < maxEventBatch {
+		select {
+		case e := <-q.events:
+			batch = append(batch, e)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// write appends a batch. Writes are not tied to the Run context, so
+// shutting down still flushes the queue. A batch the store rejects is
+// written again one event at a time, so one bad event or a timeout does
+// not lose the others.
+func (q *EventQueue) write(batch []*model.AuthEvent) {
+	defer q.done(len(batch))
+	if b, ok := q.store.(EventBatcher); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), eventWriteTimeout)
+		err := b.RecordAuthEvents(ctx, batch)
+		cancel()
+		if err == nil {
+			return
+		}
+		log.Error().Err(err).Int("events", len(batch)).Msg("record auth events, retrying one by one")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), eventWriteTimeout)
+	defer cancel()
+	for _, e := range batch {
+		if err := q.store.RecordAuthEvent(ctx, e); err != nil {
+			log.Error().Err(err).Str("event", e.Type).Msg("record auth event")
+		}
+	}
+}
+
+// done records that the writer is through with n queued events
+func (q *EventQueue) done(n int) {
+	q.mu.Lock()
+	q.written += uint64(n)
+	close(q.progress)
+	q.progress = make(chan struct{})
+	q.mu.Unlock()
+}
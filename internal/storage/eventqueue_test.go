@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/model"
+)
+
+func TestEventQueue(t *testing.T) {
+	m, _ := newTestMemory()
+	q := NewEventQueue(m, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// nothing is draining yet: two events are queued, the third is written
+	// inline because the queue is full
+	for i := 0; i < 3; i++ {
+		if err := q.RecordAuthEvent(ctx, &model.AuthEvent{Type: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _, _ := m.VerifyAuthEvents(ctx); n != 1 {
+		t.Fatalf("written before run = %d, want 1", n)
+	}
+
+	cancel()
+	q.Run(ctx) // flushes the queue and returns
+	if err := q.RecordAuthEvent(ctx, &model.AuthEvent{Type: "3"}); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := q.VerifyAuthEvents(ctx)
+	if err != nil || n != 4 {
+		t.Fatalf("VerifyAuthEvents = %d, %v; want 4 events in an intact chain", n, err)
+	}
+	var types string
+	for _, e := range m.events {
+		types += e.Type
+	}
+	if types != "2013" {
+		t.Fatalf("write order = %q, want 2013", types)
+	}
+}
+
+// failingBatcher rejects every batch, leaving single appends to Memory
+type failingBatcher struct{ *Memory }
+
+func (failingBatcher) RecordAuthEvents(ctx context.Context, events []*model.AuthEvent) error {
+	return errors.New("batch failed")
+}
+
+func TestEventQueueRetriesFailedBatch(t *testing.T) {
+	m, _ := newTestMemory()
+	q := NewEventQueue(failingBatcher{m}, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	for i := 0; i < 2; i++ {
+		q.RecordAuthEvent(ctx, &model.AuthEvent{Type: fmt.Sprint(i)})
+	}
+	cancel()
+	q.Run(ctx)
+	if n, _, err := m.VerifyAuthEvents(ctx); err != nil || n != 2 {
+		t.Fatalf("VerifyAuthEvents = %d, %v; want both events written", n, err)
+	}
+}
+
+func TestEventQueueStopLosesNothing(t *testing.T) {
+	m, _ := newTestMemory()
+	q := NewEventQueue(m, 8)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(done)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				q.RecordAuthEvent(context.Background(), &model.AuthEvent{Type: "x"})
+			}
+		}()
+	}
+	cancel()
+	wg.Wait()
+	<-done
+	if n, _, err := m.VerifyAuthEvents(context.Background()); err != nil || n != 200 {
+		t.Fatalf("VerifyAuthEvents = %d, %v; want 200", n, err)
+	}
+}
+
+func TestEventQueueRedactWaitsForQueue(t *testing.T) {
+	m, _ := newTestMemory()
+	q := NewEventQueue(m, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	userID := int64(7)
+	q.RecordAuthEvent(ctx, &model.AuthEvent{Type: model.EventOTPVerified, UserID: &userID, Phone: "+15550001"})
+	redacted := make(chan int)
+	go func() {
+		n, err := q.RedactUserAuthEvents(ctx, userID, []string{"+15550001"})
+		if err != nil {
+			t.Error(err)
+		}
+		redacted <- n
+	}()
+	select {
+	case n := <-redacted:
+		t.Fatalf("redacted %d events before the queue was written", n)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	go q.Run(ctx)
+	if n := <-redacted; n != 1 {
+		t.Fatalf("redacted %d events, want 1", n)
+	}
+	for _, e := range m.events {
+		if e.Phone != "" {
+			t.Fatalf("phone left in event %+v", e)
+		}
+	}
+}
@@ -0,0 +1,1109 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/model"
+)
+
+// defaultRolePermissions mirrors the seed data of the rbac migration
+var defaultRolePermissions = map[string][]string{
+	model.RoleUser:    {model.ScopeProfileRead},
+	model.RoleSupport: {model.ScopeProfileRead, model.ScopeUsersRead},
+	model.RoleAdmin:   {model.ScopeProfileRead, model.ScopeUsersRead, model.ScopeUsersWrite},
+}
+
+// expiring is a value with a TTL, like a Redis key
+type expiring struct {
+	value   string
+	count   int64
+	at      time.Time
+	expires time.Time
+}
+
+// slidingLog holds the times of the requests a sliding window allowed
+type slidingLog struct {
+	entries []time.Time
+	expires time.Time
+}
+
+// bucket is a token bucket as of the time at
+type bucket struct {
+	credit  int64
+	at      time.Time
+	expires time.Time
+}
+
+// sweepInterval bounds how often expired keys are purged
+const sweepInterval = time.Minute
+
+// Memory implements every store in process memory. Data is lost on restart;
+// it is meant for tests and local development.
+type Memory struct {
+	mu sync.Mutex
+	// now is replaceable so tests can move time forward
+	now func() time.Time
+
+	nextUserID int64
+	users      map[int64]*model.User
+	byPhone    map[tenantPhone]int64
+	userRoles  map[int64][]string
+	nextNoteID int64
+	notes      map[int64][]model.UserNote
+	emails     map[tenantEmail]model.UserEmail
+	phones     []model.PhoneChange
+	scim       map[int64]scimLink
+	events     []model.AuthEvent
+	tenants    []memTenant
+	apps       []memClientApp
+
+	otps      map[string]expiring
+	counters  map[string]expiring
+	logs      map[string]slidingLog
+	buckets   map[string]bucket
+	revoked   map[int64]expiring
+	lastSweep time.Time
+}
+
+// NewMemory returns an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{
+		now:       time.Now,
+		users:     map[int64]*model.User{},
+		byPhone:   map[tenantPhone]int64{},
+		userRoles: map[int64][]string{},
+		notes:     map[int64][]model.UserNote{},
+		emails:    map[tenantEmail]model.UserEmail{},
+		scim:      map[int64]scimLink{},
+		tenants: []memTenant{{Tenant: model.Tenant{
+			ID: DefaultTenantID, Slug: "default", Name: "Default", Hosts: []string{}, CreatedAt: time.Now().UTC(),
+		}}},
+		otps:     map[string]expiring{},
+		counters: map[string]expiring{},
+		logs:     map[string]slidingLog{},
+		buckets:  map[string]bucket{},
+		revoked:  map[int64]expiring{},
+	}
+}
+
+// Stores returns a Stores backed entirely by m
+func (m *Memory) Stores() Stores {
+	return Stores{Users: m, Events: m, OTPs: m, Limiter: m, Revoker: m, SCIM: m, Tenants: m, Apps: m}
+}
+
+// tenantPhone keys byPhone: numbers are unique within a tenant
+type tenantPhone struct {
+	tenant int64
+	phone  string
+}
+
+// tenantEmail keys emails: addresses are unique within a tenant
+type tenantEmail struct {
+	tenant int64
+	email  string
+}
+
+func (m *Memory) FindUserByPhone(ctx context.Context, phone string) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.byPhone[tenantPhone{TenantFromContext(ctx), phone}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	u := *m.users[id]
+	return &u, nil
+}
+
+func (m *Memory) CreateUser(ctx context.Context, phone string) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.byPhone[tenantPhone{TenantFromContext(ctx), phone}]; ok {
+		return nil, ErrConflict
+	}
+	return m.createUser(TenantFromContext(ctx), phone), nil
+}
+
+func (m *Memory) FindOrCreateUser(ctx context.Context, phone string) (*model.User, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id, ok := m.byPhone[tenantPhone{TenantFromContext(ctx), phone}]; ok {
+		u := *m.users[id]
+		return &u, false, nil
+	}
+	return m.createUser(TenantFromContext(ctx), phone), true, nil
+}
+
+// createUser inserts a new user and returns a copy. The caller must hold
+// m.mu and have checked that phone is free in tenant.
+func (m *Memory) createUser(tenant int64, phone string) *model.User {
+	m.nextUserID++
+	u := &model.User{
+		ID:           m.nextUserID,
+		TenantID:     tenant,
+		PublicID:     NewPublicID(),
+		Phone:        phone,
+		Status:       model.UserStatusActive,
+		RegisteredAt: m.now().UTC(),
+	}
+	m.users[u.ID] = u
+	m.byPhone[tenantPhone{tenant, phone}] = u.ID
+	cp := *u
+	return &cp
+}
+
+func (m *Memory) GetUserByID(ctx context.Context, id int64) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cp := *u
+	return &cp, nil
+}
+
+func (m *Memory) ResolvePublicID(ctx context.Context, publicID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, u := range m.users {
+		if u.PublicID == publicID && u.TenantID == TenantFromContext(ctx) {
+			return id, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+func (m *Memory) GetUserStatus(ctx context.Context, id int64) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return "", "", ErrNotFound
+	}
+	return u.Status, u.StatusReason, nil
+}
+
+func (m *Memory) ListUsers(ctx context.Context, filter UserFilter, page UserPage) (*UserList, error) {
+	cursor, err := decodeUserCursor(page)
+	if err != nil {
+		return nil, err
+	}
+	var afterID int64
+	if cursor != nil {
+		if afterID, err = m.ResolvePublicID(ctx, cursor.ID); err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// users who never logged in sort first, like in the SQL backends
+	key := func(u *model.User) time.Time {
+		switch page.sort() {
+		case UserSortRegisteredAt:
+			return u.RegisteredAt
+		case UserSortLastLoginAt:
+			if u.LastLoginAt != nil {
+				return *u.LastLoginAt
+			}
+		}
+		return time.Time{}
+	}
+	less := func(ka time.Time, ida int64, kb time.Time, idb int64) bool {
+		if !ka.Equal(kb) {
+			return ka.Before(kb) != page.Desc
+		}
+		if ida == idb {
+			return false
+		}
+		return (ida < idb) != page.Desc
+	}
+
+	matched := []*model.User{}
+	for _, u := range m.users {
+		if u.TenantID != TenantFromContext(ctx) {
+			continue
+		}
+		if filter.Search != "" && !matchPhone(filter, u.Phone) {
+			continue
+		}
+		if filter.Status != "" && u.Status != filter.Status {
+			continue
+		}
+		if !filter.RegisteredFrom.IsZero() && u.RegisteredAt.Before(filter.RegisteredFrom) {
+			continue
+		}
+		if !filter.RegisteredTo.IsZero() && !u.RegisteredAt.Before(filter.RegisteredTo) {
+			continue
+		}
+		matched = append(matched, u)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return less(key(matched[i]), matched[i].ID, key(matched[j]), matched[j].ID)
+	})
+
+	var total *int
+	if !page.SkipTotal {
+		n := len(matched)
+		total = &n
+	}
+	start := page.Offset
+	if cursor != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return less(cursor.keyTime(), afterID, key(matched[i]), matched[i].ID)
+		})
+	}
+
+	users := []ListedUser{}
+	for i := start; i < len(matched) && i <= start+page.Limit; i++ {
+		u := matched[i]
+		listed := ListedUser{
+			ID:           u.ID,
+			PublicID:     u.PublicID,
+			Phone:        u.Phone,
+			Status:       u.Status,
+			RegisteredAt: u.RegisteredAt.Format(time.RFC3339Nano),
+		}
+		if u.LastLoginAt != nil {
+			at := u.LastLoginAt.Format(time.RFC3339Nano)
+			listed.LastLoginAt = &at
+		}
+		users = append(users, listed)
+	}
+	list := finishUserPage(page, users)
+	list.Total = total
+	return list, nil
+}
+
+func matchPhone(filter UserFilter, phone string) bool {
+	switch filter.searchMode() {
+	case SearchPrefix:
+		return strings.HasPrefix(phone, filter.Search)
+	case SearchExact:
+		return phone == filter.Search
+	}
+	return strings.Contains(phone, filter.Search)
+}
+
+func (m *Memory) GetUserAccess(ctx context.Context, userID int64) ([]string, []string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	roles := append([]string{model.RoleUser}, m.userRoles[userID]...)
+	sort.Strings(roles)
+
+	seen := map[string]bool{}
+	perms := []string{}
+	for _, r := range roles {
+		for _, p := range defaultRolePermissions[r] {
+			if !seen[p] {
+				seen[p] = true
+				perms = append(perms, p)
+			}
+		}
+	}
+	sort.Strings(perms)
+	return roles, perms, nil
+}
+
+// GrantRole gives a user an additional role
+func (m *Memory) GrantRole(userID int64, role string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.userRoles[userID] {
+		if r == role {
+			return
+		}
+	}
+	m.userRoles[userID] = append(m.userRoles[userID], role)
+}
+
+func (m *Memory) SetUserStatus(ctx context.Context, id int64, status, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	now := m.now().UTC()
+	u.Status = status
+	u.StatusReason = reason
+	u.StatusChangedAt = &now
+	return nil
+}
+
+func (m *Memory) ChangeUserStatus(ctx context.Context, id int64, from []string, status, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if !slices.Contains(from, u.Status) {
+		return ErrConflict
+	}
+	now := m.now().UTC()
+	u.Status = status
+	u.StatusReason = reason
+	u.StatusChangedAt = &now
+	return nil
+}
+
+func (m *Memory) UpdateUserProfile(ctx context.Context, id int64, pu model.ProfileUpdate) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if pu.DisplayName != nil {
+		u.DisplayName = *pu.DisplayName
+	}
+	if pu.Email != nil {
+		u.Email = *pu.Email
+	}
+	if pu.Locale != nil {
+		u.Locale = *pu.Locale
+	}
+	if pu.Timezone != nil {
+		u.Timezone = *pu.Timezone
+	}
+	if pu.AvatarURL != nil {
+		u.AvatarURL = *pu.AvatarURL
+	}
+	if pu.Metadata != nil {
+		u.Metadata = model.Metadata{}
+		for k, v := range pu.Metadata {
+			u.Metadata[k] = v
+		}
+	}
+	cp := *u
+	return &cp, nil
+}
+
+func (m *Memory) RecordLogin(ctx context.Context, id int64) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	now := m.now().UTC()
+	u.LastLoginAt = &now
+	u.LoginCount++
+	cp := *u
+	return &cp, nil
+}
+
+func (m *Memory) UpdateUserPhone(ctx context.Context, id int64, phone string, actorID int64) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if other, ok := m.byPhone[tenantPhone{u.TenantID, phone}]; ok && other != id {
+		return nil, ErrConflict
+	}
+	if u.Phone != phone {
+		m.phones = append(m.phones, model.PhoneChange{
+			ID:        int64(len(m.phones)) + 1,
+			UserID:    id,
+			OldPhone:  u.Phone,
+			NewPhone:  phone,
+			ActorID:   actorID,
+			ChangedAt: m.now().UTC(),
+		})
+	}
+	delete(m.byPhone, tenantPhone{u.TenantID, u.Phone})
+	u.Phone = phone
+	m.byPhone[tenantPhone{u.TenantID, phone}] = id
+	cp := *u
+	return &cp, nil
+}
+
+func (m *Memory) ListPhoneHistory(ctx context.Context, filter PhoneHistoryFilter) ([]model.PhoneChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changes := []model.PhoneChange{}
+	for i := len(m.phones) - 1; i >= 0; i-- {
+		c := m.phones[i]
+		if u, ok := m.users[c.UserID]; !ok || u.TenantID != TenantFromContext(ctx) {
+			continue
+		}
+		if filter.UserID != 0 && c.UserID != filter.UserID {
+			continue
+		}
+		if filter.Phone != "" && c.OldPhone != filter.Phone && c.NewPhone != filter.Phone {
+			continue
+		}
+		c.UserPublicID, c.ActorPublicID = m.publicID(c.UserID), m.publicID(c.ActorID)
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+func (m *Memory) RedactPhoneHistory(ctx context.Context, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.phones {
+		if m.phones[i].UserID == userID {
+			m.phones[i].OldPhone, m.phones[i].NewPhone = "", ""
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ListDeletedUsers(ctx context.Context, cutoff time.Time) ([]model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := []model.User{}
+	for _, u := range m.users {
+		if u.Status == model.UserStatusDeleted && u.StatusChangedAt != nil && u.StatusChangedAt.Before(cutoff) {
+			users = append(users, *u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (m *Memory) DeleteUser(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(m.byPhone, tenantPhone{u.TenantID, u.Phone})
+	delete(m.users, id)
+	delete(m.userRoles, id)
+	delete(m.notes, id)
+	delete(m.scim, id)
+	for k, e := range m.emails {
+		if e.UserID == id {
+			delete(m.emails, k)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) AddUserNote(ctx context.Context, userID, authorID int64, body string) (*model.UserNote, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userID]; !ok {
+		return nil, ErrNotFound
+	}
+	m.nextNoteID++
+	n := model.UserNote{
+		ID:        m.nextNoteID,
+		UserID:    userID,
+		AuthorID:  &authorID,
+		Body:      body,
+		CreatedAt: m.now().UTC(),
+	}
+	m.notes[userID] = append(m.notes[userID], n)
+	n.UserPublicID, n.AuthorPublicID = m.publicID(userID), m.publicID(authorID)
+	return &n, nil
+}
+
+// publicID returns the public id of a user, or "" once the user is gone
+func (m *Memory) publicID(id int64) string {
+	if u, ok := m.users[id]; ok {
+		return u.PublicID
+	}
+	return ""
+}
+
+func (m *Memory) ListUserNotes(ctx context.Context, userID int64) ([]model.UserNote, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	notes := []model.UserNote{}
+	for i := len(m.notes[userID]) - 1; i >= 0; i-- {
+		n := m.notes[userID][i]
+		n.UserPublicID, n.AuthorPublicID = m.publicID(n.UserID), m.publicID(*n.AuthorID)
+		notes = append(notes, n)
+	}
+	return notes, nil
+}
+
+func (m *Memory) FindUserByEmail(ctx context.Context, email string) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.emails[tenantEmail{TenantFromContext(ctx), email}]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	u := *m.users[e.UserID]
+	return &u, nil
+}
+
+func (m *Memory) AddUserEmail(ctx context.Context, userID int64, email string) (*model.UserEmail, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	k := tenantEmail{u.TenantID, email}
+	e, ok := m.emails[k]
+	if ok && e.UserID != userID {
+		return nil, ErrConflict
+	}
+	if !ok {
+		e = model.UserEmail{UserID: userID, Email: email, VerifiedAt: m.now().UTC()}
+		m.emails[k] = e
+	}
+	return &e, nil
+}
+
+func (m *Memory) ListUserEmails(ctx context.Context, userID int64) ([]model.UserEmail, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	emails := []model.UserEmail{}
+	for _, e := range m.emails {
+		if e.UserID == userID {
+			emails = append(emails, e)
+		}
+	}
+	sort.Slice(emails, func(i, j int) bool {
+		if !emails[i].VerifiedAt.Equal(emails[j].VerifiedAt) {
+			return emails[i].VerifiedAt.Before(emails[j].VerifiedAt)
+		}
+		return emails[i].Email < emails[j].Email
+	})
+	return emails, nil
+}
+
+func (m *Memory) DeleteUserEmail(ctx context.Context, userID int64, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	k := tenantEmail{u.TenantID, email}
+	if e, ok := m.emails[k]; !ok || e.UserID != userID {
+		return ErrNotFound
+	}
+	delete(m.emails, k)
+	return nil
+}
+
+// scimLink is the scim_users row of a user
+type scimLink struct {
+	tenant     string
+	externalID string
+}
+
+func (m *Memory) CreateSCIMUser(ctx context.Context, tenant string, u SCIMUser) (*SCIMUser, error) {
+	m.mu.Lock()
+	if _, ok := m.byPhone[tenantPhone{TenantFromContext(ctx), u.Phone}]; ok {
+		m.mu.Unlock()
+		return nil, ErrConflict
+	}
+	if m.scimExternalIDTaken(tenant, u.ExternalID) {
+		m.mu.Unlock()
+		return nil, ErrExternalIDConflict
+	}
+	created := m.createUser(TenantFromContext(ctx), u.Phone)
+	stored := m.users[created.ID]
+	stored.DisplayName = u.DisplayName
+	if u.Status != "" && u.Status != model.UserStatusActive {
+		now := m.now().UTC()
+		stored.Status = u.Status
+		stored.StatusReason = u.StatusReason
+		stored.StatusChangedAt = &now
+	}
+	m.scim[created.ID] = scimLink{tenant: tenant, externalID: u.ExternalID}
+	m.mu.Unlock()
+	return m.GetSCIMUser(ctx, tenant, created.ID)
+}
+
+func (m *Memory) SetSCIMExternalID(ctx context.Context, tenant string, userID int64, externalID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.scim[userID]
+	if !ok || l.tenant != tenant {
+		return ErrNotFound
+	}
+	if externalID != l.externalID && m.scimExternalIDTaken(tenant, externalID) {
+		return ErrConflict
+	}
+	l.externalID = externalID
+	m.scim[userID] = l
+	return nil
+}
+
+// scimExternalIDTaken reports whether a user of tenant has externalID. The
+// caller must hold m.mu.
+func (m *Memory) scimExternalIDTaken(tenant, externalID string) bool {
+	if externalID == "" {
+		return false
+	}
+	for _, l := range m.scim {
+		if l.tenant == tenant && l.externalID == externalID {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) GetSCIMUser(ctx context.Context, tenant string, userID int64) (*SCIMUser, error) {
+	users, _, err := m.ListSCIMUsers(ctx, tenant, SCIMFilter{UserID: userID}, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, ErrNotFound
+	}
+	return &users[0], nil
+}
+
+func (m *Memory) ListSCIMUsers(ctx context.Context, tenant string, filter SCIMFilter, offset, limit int) ([]SCIMUser, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var matched []SCIMUser
+	for id, l := range m.scim {
+		u := m.users[id]
+		switch {
+		case l.tenant != tenant, u.Status == model.UserStatusDeleted:
+			continue
+		case filter.UserID != 0 && id != filter.UserID:
+			continue
+		case filter.ExternalID != "" && l.externalID != filter.ExternalID:
+			continue
+		case filter.Active != nil && *filter.Active != (u.Status == model.UserStatusActive):
+			continue
+		}
+		matched = append(matched, SCIMUser{User: *u, ExternalID: l.externalID})
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].ID < matched[j].ID })
+
+	users := []SCIMUser{}
+	if offset < len(matched) {
+		users = matched[offset:]
+		if len(users) > limit {
+			users = users[:limit]
+		}
+	}
+	return users, len(matched), nil
+}
+
+// memTenant is a tenant with the hash of its API key
+type memTenant struct {
+	model.Tenant
+	apiKeyHash string
+}
+
+// findTenant returns a copy of the first tenant match accepts. The caller
+// must hold m.mu.
+func (m *Memory) findTenant(match func(*memTenant) bool) (*model.Tenant, error) {
+	for i := range m.tenants {
+		if match(&m.tenants[i]) {
+			t := m.tenants[i].Tenant
+			t.Hosts = append([]string{}, t.Hosts...)
+			return &t, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *Memory) GetTenant(ctx context.Context, id int64) (*model.Tenant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findTenant(func(t *memTenant) bool { return t.ID == id })
+}
+
+func (m *Memory) TenantBySlug(ctx context.Context, slug string) (*model.Tenant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findTenant(func(t *memTenant) bool { return t.Slug == slug })
+}
+
+func (m *Memory) TenantByHost(ctx context.Context, host string) (*model.Tenant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findTenant(func(t *memTenant) bool {
+		for _, h := range t.Hosts {
+			if h == host {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (m *Memory) TenantByAPIKey(ctx context.Context, keyHash string) (*model.Tenant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findTenant(func(t *memTenant) bool { return t.apiKeyHash != "" && t.apiKeyHash == keyHash })
+}
+
+func (m *Memory) ListTenants(ctx context.Context) ([]model.Tenant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tenants := make([]model.Tenant, 0, len(m.tenants))
+	for _, t := range m.tenants {
+		t.Hosts = append([]string{}, t.Hosts...)
+		tenants = append(tenants, t.Tenant)
+	}
+	return tenants, nil
+}
+
+func (m *Memory) SaveTenant(ctx context.Context, t *model.Tenant) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := 0
+	for i < len(m.tenants) && m.tenants[i].Slug != t.Slug {
+		i++
+	}
+	for _, other := range m.tenants {
+		if other.Slug == t.Slug {
+			continue
+		}
+		for _, h := range other.Hosts {
+			for _, host := range t.Hosts {
+				if h == host {
+					return ErrConflict
+				}
+			}
+		}
+	}
+	saved := *t
+	saved.Hosts = append([]string{}, t.Hosts...)
+	sort.Strings(saved.Hosts)
+	if i < len(m.tenants) {
+		saved.ID, saved.CreatedAt = m.tenants[i].ID, m.tenants[i].CreatedAt
+		m.tenants[i].Tenant = saved
+	} else {
+		saved.ID, saved.CreatedAt = m.tenants[i-1].ID+1, m.now().UTC()
+		m.tenants = append(m.tenants, memTenant{Tenant: saved})
+	}
+	t.ID = saved.ID
+	return nil
+}
+
+func (m *Memory) SetTenantAPIKey(ctx context.Context, slug, keyHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.tenants {
+		if m.tenants[i].Slug == slug {
+			m.tenants[i].apiKeyHash = keyHash
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// memClientApp is a client app with the hash of its key
+type memClientApp struct {
+	model.ClientApp
+	keyHash string
+}
+
+func (m *Memory) CreateClientApp(ctx context.Context, app *model.ClientApp, keyHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, a := range m.apps {
+		if a.KeyPrefix == app.KeyPrefix || a.keyHash == keyHash {
+			return ErrConflict
+		}
+	}
+	app.ID = int64(len(m.apps)) + 1
+	app.CreatedAt = m.now().UTC()
+	if app.AllowedOrigins == nil {
+		app.AllowedOrigins = model.StringList{}
+	}
+	m.apps = append(m.apps, memClientApp{ClientApp: *app, keyHash: keyHash})
+	return nil
+}
+
+func (m *Memory) ClientAppByKey(ctx context.Context, keyHash string) (*model.ClientApp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, a := range m.apps {
+		if a.keyHash == keyHash {
+			app := a.ClientApp
+			return &app, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *Memory) ListClientApps(ctx context.Context, tenantID int64) ([]model.ClientApp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	apps := []model.ClientApp{}
+	for _, a := range m.apps {
+		if a.TenantID == tenantID {
+			apps = append(apps, a.ClientApp)
+		}
+	}
+	return apps, nil
+}
+
+func (m *Memory) RevokeClientApp(ctx context.Context, keyPrefix string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.apps {
+		if m.apps[i].KeyPrefix == keyPrefix && m.apps[i].RevokedAt == nil {
+			now := m.now().UTC()
+			m.apps[i].RevokedAt = &now
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) TouchClientApp(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now().UTC()
+	for i := range m.apps {
+		a := &m.apps[i]
+		if a.ID == id && (a.LastUsedAt == nil || a.LastUsedAt.Before(now.Add(-clientAppTouchInterval))) {
+			a.LastUsedAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *Memory) RecordAuthEvent(ctx context.Context, e *model.AuthEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.appendAuthEvent(e)
+	return nil
+}
+
+func (m *Memory) appendAuthEvent(e *model.AuthEvent) {
+	e.ID = int64(len(m.events)) + 1
+	e.PrevHash = ""
+	if len(m.events) > 0 {
+		e.PrevHash = m.events[len(m.events)-1].Hash
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = m.now()
+	}
+	e.CreatedAt = e.CreatedAt.UTC()
+	e.Hash = hashAuthEvent(e)
+	m.events = append(m.events, *e)
+}
+
+func (m *Memory) RedactUserAuthEvents(ctx context.Context, userID int64, phones []string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tombstoneID := int64(len(m.events)) + 1
+	var hashes []string
+	for i := range m.events {
+		e := &m.events[i]
+		if holdsPhone(e) && purgedWith(e, userID, phones) {
+			redactPhone(e, nil, tombstoneID)
+			hashes = append(hashes, hashAuthEvent(e))
+		}
+	}
+	if len(hashes) == 0 {
+		return 0, nil
+	}
+	tombstone := phonesRedactedEvent(&userID, redactPurge)
+	attestRedaction(tombstone, hashes)
+	m.appendAuthEvent(tombstone)
+	return len(hashes), nil
+}
+
+func (m *Memory) VerifyAuthEvents(ctx context.Context) (int64, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v := newChainVerifier()
+	for i := range m.events {
+		if err := v.check(&m.events[i]); err != nil {
+			return v.checked, v.prev, err
+		}
+	}
+	return v.checked, v.prev, v.finish()
+}
+
+func (m *Memory) ListUserAuthEvents(ctx context.Context, userID int64) ([]model.AuthEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := []model.AuthEvent{}
+	for _, e := range m.events {
+		if e.UserID != nil && *e.UserID == userID {
+			e.UserPublicID = m.publicID(userID)
+			if e.ActorID != nil {
+				e.ActorPublicID = m.publicID(*e.ActorID)
+			}
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (m *Memory) SaveOTP(ctx context.Context, phone, code string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep()
+	m.otps[phone] = expiring{value: code, expires: m.now().Add(ttl)}
+	return nil
+}
+
+func (m *Memory) VerifyAndDeleteOTP(ctx context.Context, phone, code string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.otps[phone]
+	if !ok || !m.now().Before(e.expires) {
+		delete(m.otps, phone)
+		return false, nil
+	}
+	if e.value != code {
+		return false, nil
+	}
+	delete(m.otps, phone)
+	return true, nil
+}
+
+func (m *Memory) DeleteOTP(ctx context.Context, phone string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.otps, phone)
+	return nil
+}
+
+// AllowOTPRequest works like the Redis implementation of each algorithm
+func (m *Memory) AllowOTPRequest(ctx context.Context, key string, limit RateLimit) (bool, error) {
+	algorithm, err := limit.algorithm()
+	if err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep()
+	now := m.now()
+	switch algorithm {
+	case SlidingWindow:
+		l := m.logs[key]
+		start := now.Add(-limit.Window)
+		kept := l.entries[:0]
+		for _, at := range l.entries {
+			if at.After(start) {
+				kept = append(kept, at)
+			}
+		}
+		l.entries = kept
+		allowed := len(l.entries) < limit.Max
+		if allowed {
+			l.entries = append(l.entries, now)
+			l.expires = now.Add(limit.Window)
+		}
+		m.logs[key] = l
+		return allowed, nil
+	case TokenBucket:
+		b, ok := m.buckets[key]
+		if !ok || !now.Before(b.expires) {
+			b = bucket{credit: limit.capacity(), at: now}
+		}
+		b.credit = limit.refill(b.credit, b.at, now)
+		if now.After(b.at) {
+			b.at = now
+		}
+		allowed := b.credit >= limit.tokenCost()
+		if allowed {
+			b.credit -= limit.tokenCost()
+		}
+		b.expires = now.Add(limit.Window)
+		m.buckets[key] = b
+		return allowed, nil
+	}
+	e, ok := m.counters[key]
+	if !ok || !now.Before(e.expires) {
+		e = expiring{expires: now.Add(limit.Window)}
+	}
+	e.count++
+	m.counters[key] = e
+	return e.count <= int64(limit.Max), nil
+}
+
+func (m *Memory) ResetOTPRequests(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.counters, key)
+	delete(m.logs, key)
+	delete(m.buckets, key)
+	return nil
+}
+
+func (m *Memory) RevokeUserTokens(ctx context.Context, userID int64, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep()
+	now := m.now()
+	// milliseconds, matching the precision of the iat claim
+	m.revoked[userID] = expiring{at: now.Truncate(time.Millisecond), expires: now.Add(ttl)}
+	return nil
+}
+
+func (m *Memory) TokensRevokedAt(ctx context.Context, userID int64) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.revoked[userID]
+	if !ok || !m.now().Before(e.expires) {
+		delete(m.revoked, userID)
+		return time.Time{}, nil
+	}
+	return e.at, nil
+}
+
+func (m *Memory) ClearRevocation(ctx context.Context, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.revoked, userID)
+	return nil
+}
+
+// sweep drops expired keys so abandoned entries do not accumulate. The
+// caller must hold m.mu.
+func (m *Memory) sweep() {
+	now := m.now()
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for k, e := range m.otps {
+		if !now.Before(e.expires) {
+			delete(m.otps, k)
+		}
+	}
+	for k, e := range m.counters {
+		if !now.Before(e.expires) {
+			delete(m.counters, k)
+		}
+	}
+	for k, l := range m.logs {
+		if !now.Before(l.expires) {
+			delete(m.logs, k)
+		}
+	}
+	for k, b := range m.buckets {
+		if !now.Before(b.expires) {
+			delete(m.buckets, k)
+		}
+	}
+	for k, e := range m.revoked {
+		if !now.Before(e.expires) {
+			delete(m.revoked, k)
+		}
+	}
+}
+
+var (
+	_ UserStore    = (*Memory)(nil)
+	_ EventStore   = (*Memory)(nil)
+	_ OTPStore     = (*Memory)(nil)
+	_ RateLimiter  = (*Memory)(nil)
+	_ TokenRevoker = (*Memory)(nil)
+)
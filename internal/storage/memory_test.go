@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/model"
+)
+
+// newTestMemory returns a Memory whose clock only moves when advance is called
+func newTestMemory() (*Memory, func(time.Duration)) {
+	m := NewMemory()
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	return m, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestMemoryOTPExpires(t *testing.T) {
+	m, advance := newTestMemory()
+	ctx := context.Background()
+
+	m.SaveOTP(ctx, "+1555", "123456", time.Minute)
+	advance(time.Minute)
+	if ok, _ := m.VerifyAndDeleteOTP(ctx, "+1555", "123456"); ok {
+		t.Fatal("expired otp accepted")
+	}
+
+	m.SaveOTP(ctx, "+1555", "123456", time.Minute)
+	advance(59 * time.Second)
+	if ok, _ := m.VerifyAndDeleteOTP(ctx, "+1555", "000000"); ok {
+		t.Fatal("wrong otp accepted")
+	}
+	if ok, _ := m.VerifyAndDeleteOTP(ctx, "+1555", "123456"); !ok {
+		t.Fatal("valid otp rejected")
+	}
+	if ok, _ := m.VerifyAndDeleteOTP(ctx, "+1555", "123456"); ok {
+		t.Fatal("otp accepted twice")
+	}
+}
+
+func TestMemoryRateLimitWindow(t *testing.T) {
+	m, advance := newTestMemory()
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := m.AllowOTPRequest(ctx, "+1555", RateLimit{Max: 2, Window: time.Minute}); !ok {
+			t.Fatalf("request %d denied", i+1)
+		}
+	}
+	if ok, _ := m.AllowOTPRequest(ctx, "+1555", RateLimit{Max: 2, Window: time.Minute}); ok {
+		t.Fatal("request over limit allowed")
+	}
+	advance(time.Minute)
+	if ok, _ := m.AllowOTPRequest(ctx, "+1555", RateLimit{Max: 2, Window: time.Minute}); !ok {
+		t.Fatal("request denied after window reset")
+	}
+}
+
+func TestMemorySweepsExpiredKeys(t *testing.T) {
+	m, advance := newTestMemory()
+	ctx := context.Background()
+
+	m.SaveOTP(ctx, "+1555", "123456", time.Second)
+	m.AllowOTPRequest(ctx, "+1555", RateLimit{Max: 1, Window: time.Second})
+	advance(sweepInterval)
+	m.SaveOTP(ctx, "+1666", "123456", time.Minute)
+
+	if _, ok := m.otps["+1555"]; ok {
+		t.Error("expired otp not swept")
+	}
+	if _, ok := m.counters["+1555"]; ok {
+		t.Error("expired counter not swept")
+	}
+}
+
+func TestMemoryRevokedTokensExpire(t *testing.T) {
+	m, advance := newTestMemory()
+	ctx := context.Background()
+
+	m.RevokeUserTokens(ctx, 1, time.Hour)
+	if at, _ := m.TokensRevokedAt(ctx, 1); at.IsZero() {
+		t.Fatal("revocation not recorded")
+	}
+	advance(time.Hour)
+	if at, _ := m.TokensRevokedAt(ctx, 1); !at.IsZero() {
+		t.Fatal("revocation outlived its ttl")
+	}
+}
+
+func TestMemoryUserPhoneUnique(t *testing.T) {
+	m, _ := newTestMemory()
+	ctx := context.Background()
+
+	a, _ := m.CreateUser(ctx, "+1555")
+	if _, err := m.CreateUser(ctx, "+1555"); !errors.Is(err, ErrConflict) {
+		t.Fatalf("duplicate create: err = %v, want ErrConflict", err)
+	}
+	b, _ := m.CreateUser(ctx, "+1666")
+	if _, err := m.UpdateUserPhone(ctx, b.ID, a.Phone, b.ID); !errors.Is(err, ErrConflict) {
+		t.Fatalf("phone takeover: err = %v, want ErrConflict", err)
+	}
+}
+
+func TestMemoryAuthEventChain(t *testing.T) {
+	m, _ := newTestMemory()
+	ctx := context.Background()
+
+	for _, typ := range []string{model.EventOTPRequested, model.EventOTPVerified, model.EventLogout} {
+		if err := m.RecordAuthEvent(ctx, &model.AuthEvent{Type: typ, Phone: "+1555"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, head, err := m.VerifyAuthEvents(ctx)
+	if err != nil || n != 3 || head != m.events[2].Hash {
+		t.Fatalf("verify = %d, %q, %v", n, head, err)
+	}
+
+	m.events[1].Phone = "+1666"
+	_, _, err = m.VerifyAuthEvents(ctx)
+	var chainErr *ChainError
+	if !errors.As(err, &chainErr) || chainErr.ID != 2 {
+		t.Fatalf("tampered row: err = %v, want chain error at id 2", err)
+	}
+}
+
+func TestMemoryRedactUserAuthEvents(t *testing.T) {
+	m, _ := newTestMemory()
+	testRedactUserAuthEvents(t, m)
+}
+
+func TestMemoryRateLimitAlgorithms(t *testing.T) {
+	m, advance := newTestMemory()
+	testRateLimitAlgorithms(t, m, advance)
+}
@@ -2,20 +2,55 @@ package storage
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/example/go-otp-auth/internal/keyring"
 	"github.com/example/go-otp-auth/internal/model"
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/jmoiron/sqlx"
 	"github.com/rs/zerolog/log"
 )
 
+var (
+	// ErrNotFound is returned when the requested row does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a write violates a unique constraint
+	ErrConflict = errors.New("conflict")
+)
+
+// userColumns are the columns scanned into model.User
+const userColumns = "id, tenant_id, public_id, phone, " + userStateColumns
+
+// pgUserColumns are the columns scanned into userRow. phone is NULL once the
+// number is encrypted.
+const pgUserColumns = "id, tenant_id, public_id, COALESCE(phone, '') AS phone, phone_ct, phone_key_id, " + userStateColumns
+
+const userStateColumns = "status, status_reason, status_changed_at, registered_at, " +
+	"display_name, email, locale, timezone, avatar_url, metadata, last_login_at, login_count"
+
 type Postgres struct {
 	db *sqlx.DB
+
+	// read-only queries are spread over healthy replicas
+	replicas []*replica
+	next     atomic.Uint64
+	stop     chan struct{}
+	done     sync.WaitGroup
+
+	// encrypts phone numbers when set
+	keys *keyring.Keyring
 }
 
-func NewPostgres(dsn string) (*Postgres, error) {
+// NewPostgres connects to the primary at dsn. Optional replica DSNs serve
+// read-only queries while they pass health checks.
+func NewPostgres(dsn string, replicaDSNs ...string) (*Postgres, error) {
 	var db *sqlx.DB
 	var err error
 
@@ -33,7 +68,7 @@ func NewPostgres(dsn string) (*Postgres, error) {
 			defer cancel()
 			if pingErr := db.PingContext(ctx); pingErr == nil {
 				log.Info().Msg("connected to postgres")
-				return &Postgres{db: db}, nil
+				return newPostgres(db, replicaDSNs)
 			} else {
 				err = pingErr
 			}
@@ -47,75 +82,708 @@ func NewPostgres(dsn string) (*Postgres, error) {
 	return nil, fmt.Errorf("unable to connect to postgres after %d attempts: %w", maxAttempts, err)
 }
 
+func newPostgres(db *sqlx.DB, replicaDSNs []string) (*Postgres, error) {
+	p := &Postgres{db: db}
+	for i, dsn := range replicaDSNs {
+		r, err := openReplica(i, dsn)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		r.check()
+		p.replicas = append(p.replicas, r)
+	}
+	if len(p.replicas) > 0 {
+		p.stop = make(chan struct{})
+		p.done.Add(1)
+		go p.checkReplicas(replicaCheckInterval)
+	}
+	return p, nil
+}
+
 func (p *Postgres) Close() error {
+	if p.stop != nil {
+		close(p.stop)
+		p.done.Wait()
+	}
+	for _, r := range p.replicas {
+		r.db.Close()
+	}
 	return p.db.Close()
 }
 
+// DB exposes the underlying connection pool, e.g. for running migrations
+func (p *Postgres) DB() *sql.DB {
+	return p.db.DB
+}
+
 func (p *Postgres) FindUserByPhone(ctx context.Context, phone string) (*model.User, error) {
-	var u model.User
-	err := p.db.GetContext(ctx, &u, "SELECT id, phone, registered_at FROM users WHERE phone=$1", phone)
+	var row userRow
+	err := p.reader(ctx).GetContext(ctx, &row, `
+		SELECT `+pgUserColumns+` FROM users
+		WHERE tenant_id=$1 AND (phone_index=$2 OR phone=$3)`, TenantFromContext(ctx), p.phoneIndex(phone), phone)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &u, nil
+	return p.user(&row)
+}
+
+// ResolvePublicID returns the internal id of the user of the context tenant
+// with publicID. Like GetUserStatus it reads from the primary, so a user is
+// found right after creation.
+func (p *Postgres) ResolvePublicID(ctx context.Context, publicID string) (int64, error) {
+	var id int64
+	err := p.db.GetContext(ctx, &id, "SELECT id FROM users WHERE public_id=$1 AND tenant_id=$2",
+		publicID, TenantFromContext(ctx))
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return id, err
+}
+
+// GetUserStatus returns the status and status reason of a user. It always
+// reads from the primary so suspensions take effect immediately.
+func (p *Postgres) GetUserStatus(ctx context.Context, id int64) (string, string, error) {
+	var row struct {
+		Status string `db:"status"`
+		Reason string `db:"status_reason"`
+	}
+	err := p.db.GetContext(ctx, &row, "SELECT status, status_reason FROM users WHERE id=$1", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrNotFound
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return row.Status, row.Reason, nil
 }
 
 func (p *Postgres) CreateUser(ctx context.Context, phone string) (*model.User, error) {
-	var u model.User
-	err := p.db.GetContext(ctx, &u, "INSERT INTO users (phone) VALUES ($1) RETURNING id, phone, registered_at", phone)
+	tx, err := p.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
-	return &u, nil
+	defer tx.Rollback()
+
+	row, err := p.insertUser(ctx, tx, phone)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return p.user(row)
+}
+
+// insertUser adds a user with phone to the tenant of ctx within tx. A phone
+// number already registered is ErrConflict.
+func (p *Postgres) insertUser(ctx context.Context, tx *sqlx.Tx, phone string) (*userRow, error) {
+	sp, err := p.storePhone(phone)
+	if err != nil {
+		return nil, err
+	}
+	var row userRow
+	err = tx.GetContext(ctx, &row, `
+		INSERT INTO users (tenant_id, public_id, phone, phone_ct, phone_key_id, phone_index) VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING `+pgUserColumns, TenantFromContext(ctx), NewPublicID(), sp.plain, sp.ct, sp.keyID, sp.index)
+	if isUniqueViolation(err) {
+		return nil, ErrConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := setPhoneSuffixes(ctx, tx, row.ID, sp.suffixes); err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
+
+// FindOrCreateUser inserts the user unless the phone is already registered.
+// Concurrent first logins for the same phone resolve to the same row.
+func (p *Postgres) FindOrCreateUser(ctx context.Context, phone string) (*model.User, bool, error) {
+	sp, err := p.storePhone(phone)
+	if err != nil {
+		return nil, false, err
+	}
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	var row struct {
+		userRow
+		Created bool `db:"created"`
+	}
+	// If a concurrent insert commits after this statement's snapshot was
+	// taken, DO NOTHING skips the row but the SELECT cannot see it yet, so
+	// the statement returns nothing and is retried with a fresh snapshot.
+	for attempt := 0; attempt < 3; attempt++ {
+		err := tx.GetContext(ctx, &row, `
+			WITH ins AS (
+				INSERT INTO users (tenant_id, public_id, phone, phone_ct, phone_key_id, phone_index) VALUES ($1, $2, $3, $4, $5, $6)
+				ON CONFLICT DO NOTHING
+				RETURNING `+pgUserColumns+`
+			)
+			SELECT `+pgUserColumns+`, true AS created FROM ins
+			UNION ALL
+			SELECT `+pgUserColumns+`, false AS created FROM users
+			WHERE tenant_id=$1 AND (phone_index=$6 OR phone=$7) AND NOT EXISTS (SELECT 1 FROM ins)`,
+			TenantFromContext(ctx), NewPublicID(), sp.plain, sp.ct, sp.keyID, sp.index, phone)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if row.Created {
+			if err := setPhoneSuffixes(ctx, tx, row.ID, sp.suffixes); err != nil {
+				return nil, false, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, false, err
+		}
+		u, err := p.user(&row.userRow)
+		return u, row.Created, err
+	}
+	return nil, false, fmt.Errorf("find or create user: no row after retries")
 }
 
 func (p *Postgres) GetUserByID(ctx context.Context, id int64) (*model.User, error) {
-	var u model.User
-	err := p.db.GetContext(ctx, &u, "SELECT id, phone, registered_at FROM users WHERE id=$1", id)
+	var row userRow
+	err := p.reader(ctx).GetContext(ctx, &row, "SELECT "+pgUserColumns+" FROM users WHERE id=$1", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &u, nil
+	return p.user(&row)
 }
 
-type User struct {
-	ID           int64  `db:"id" json:"id"`
-	Phone        string `db:"phone" json:"phone"`
-	RegisteredAt string `db:"registered_at" json:"registered_at"`
+// UserFilter narrows down ListUsers. Zero values match everything.
+type UserFilter struct {
+	// Search matches the phone number as selected by SearchMode. With
+	// encrypted numbers a contains search matches the end of the number and
+	// needs MinPhoneSearchLen characters.
+	Search     string
+	SearchMode string // SearchContains when empty
+	Status     string // exact status
+	// RegisteredFrom and RegisteredTo bound the registration time; From is
+	// inclusive, To exclusive
+	RegisteredFrom time.Time
+	RegisteredTo   time.Time
 }
 
-// ListUsers returns users with optional search and pagination
-func (pg *Postgres) ListUsers(ctx context.Context, search string, offset, limit int) ([]User, int, error) {
-	users := []User{}
-	var total int
-	var err error
+// registeredRange appends the registration time conditions of filter
+func (filter UserFilter) registeredRange(where []string, args []interface{}) ([]string, []interface{}) {
+	if !filter.RegisteredFrom.IsZero() {
+		args = append(args, filter.RegisteredFrom)
+		where = append(where, fmt.Sprintf("registered_at >= $%d", len(args)))
+	}
+	if !filter.RegisteredTo.IsZero() {
+		args = append(args, filter.RegisteredTo)
+		where = append(where, fmt.Sprintf("registered_at < $%d", len(args)))
+	}
+	return where, args
+}
+
+// userConditions returns the WHERE conditions selecting the users of the
+// context tenant that match filter
+func (pg *Postgres) userConditions(ctx context.Context, filter UserFilter) ([]string, []interface{}, error) {
+	where := []string{"tenant_id = $1"}
+	args := []interface{}{TenantFromContext(ctx)}
+	switch {
+	case filter.Search == "":
+	case filter.searchMode() == SearchExact:
+		args = append(args, pg.phoneIndex(filter.Search), filter.Search)
+		where = append(where, fmt.Sprintf("(phone_index = $%d OR phone = $%d)", len(args)-1, len(args)))
+	case pg.keys == nil:
+		// served by the users_phone_trgm_idx trigram index
+		args = append(args, filter.phonePattern())
+		where = append(where, fmt.Sprintf(`phone LIKE $%d ESCAPE '\'`, len(args)))
+	case filter.searchMode() == SearchPrefix:
+		return nil, nil, ErrSearchUnsupported
+	case len(filter.Search) < MinPhoneSearchLen:
+		return nil, nil, ErrSearchTooShort
+	default:
+		// rows not yet encrypted are matched on the same suffix
+		args = append(args, pg.keys.BlindIndex(phoneSuffixDomain, filter.Search), "%"+likeEscaper.Replace(filter.Search))
+		where = append(where, fmt.Sprintf(
+			`(id IN (SELECT user_id FROM user_phone_suffixes WHERE token = $%d) OR phone LIKE $%d ESCAPE '\')`,
+			len(args)-1, len(args)))
+	}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		where = append(where, fmt.Sprintf("status = $%d", len(args)))
+	}
+	where, args = filter.registeredRange(where, args)
+	return where, args, nil
+}
+
+// ListUsers returns one page of users matching filter
+func (pg *Postgres) ListUsers(ctx context.Context, filter UserFilter, page UserPage) (*UserList, error) {
+	cursor, err := decodeUserCursor(page)
+	if err != nil {
+		return nil, err
+	}
+
+	where, args, err := pg.userConditions(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	cond := ""
+	if len(where) > 0 {
+		cond = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	db := pg.reader(ctx)
+	var total *int
+	if !page.SkipTotal {
+		total = new(int)
+		if err := db.GetContext(ctx, total, `SELECT COUNT(*) FROM users `+cond, args...); err != nil {
+			return nil, err
+		}
+	}
+
+	var keyExpr string
+	var key interface{}
+	var afterID int64
+	if cursor != nil {
+		if afterID, err = pg.ResolvePublicID(ctx, cursor.ID); errors.Is(err, ErrNotFound) {
+			return nil, ErrInvalidCursor
+		} else if err != nil {
+			return nil, err
+		}
+		key = cursor.keyTime()
+	}
+	switch page.sort() {
+	case UserSortRegisteredAt:
+		keyExpr = "registered_at"
+	case UserSortLastLoginAt:
+		// matches the users_last_login_at_idx expression
+		keyExpr = "COALESCE(last_login_at, to_timestamp(0))"
+		if cursor != nil && cursor.Key == "" {
+			key = neverLoggedIn
+		}
+	}
+	after, order, args := userKeyset(page, keyExpr, cursor, key, afterID, args)
+	if after != "" {
+		where = append(where, after)
+		cond = "WHERE " + strings.Join(where, " AND ")
+	}
+	offset := page.Offset
+	if cursor != nil {
+		offset = 0
+	}
+
+	var rows []struct {
+		ListedUser
+		encryptedPhone
+	}
+	err = db.SelectContext(ctx, &rows, fmt.Sprintf(`
+		SELECT id, public_id, COALESCE(phone, '') AS phone, phone_ct, phone_key_id, status, registered_at, last_login_at
+		FROM users
+		%s
+		%s
+		LIMIT $%d OFFSET $%d`, cond, order, len(args)+1, len(args)+2), append(args, page.Limit+1, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]ListedUser, len(rows))
+	for i, r := range rows {
+		users[i] = r.ListedUser
+		if users[i].Phone, err = pg.decryptPhone(r.Phone, r.encryptedPhone); err != nil {
+			return nil, fmt.Errorf("user %d: %w", r.ID, err)
+		}
+	}
+	list := finishUserPage(page, users)
+	list.Total = total
+	return list, nil
+}
 
-	if search == "" {
-		err = pg.db.SelectContext(ctx, &users, `
-			SELECT id, phone, registered_at
-			FROM users
-			ORDER BY id
-			LIMIT $1 OFFSET $2`, limit, offset)
+// GetUserAccess returns the user's roles, including the implicit user role,
+// and the permissions granted by them.
+func (p *Postgres) GetUserAccess(ctx context.Context, userID int64) ([]string, []string, error) {
+	db := p.reader(ctx)
+	roles := []string{}
+	err := db.SelectContext(ctx, &roles, `
+		SELECT $1::text AS role
+		UNION
+		SELECT role FROM user_roles WHERE user_id=$2
+		ORDER BY role`, model.RoleUser, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	perms := []string{}
+	err = db.SelectContext(ctx, &perms, `
+		SELECT DISTINCT permission
+		FROM role_permissions
+		WHERE role=$1 OR role IN (SELECT role FROM user_roles WHERE user_id=$2)
+		ORDER BY permission`, model.RoleUser, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return roles, perms, nil
+}
+
+// SetUserStatus changes the status of a user. reason is shown to the user
+// when a login is refused.
+func (p *Postgres) SetUserStatus(ctx context.Context, id int64, status, reason string) error {
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE users SET status=$1, status_reason=$2, status_changed_at=now()
+		WHERE id=$3`, status, reason, id)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// ChangeUserStatus changes the status of a user in one of the statuses from
+func (p *Postgres) ChangeUserStatus(ctx context.Context, id int64, from []string, status, reason string) error {
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE users SET status=$1, status_reason=$2, status_changed_at=now()
+		WHERE id=$3 AND status IN (`+placeholders(4, len(from))+`)`,
+		append([]interface{}{status, reason, id}, stringArgs(from)...)...)
+	if err != nil {
+		return err
+	}
+	return statusChanged(ctx, p.db, res, id)
+}
+
+// statusChanged tells a missing user from one in another status when a
+// conditional status update changed nothing
+func statusChanged(ctx context.Context, db sqlx.QueryerContext, res sql.Result, id int64) error {
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	var exists bool
+	if err := sqlx.GetContext(ctx, db, &exists, "SELECT EXISTS (SELECT 1 FROM users WHERE id=$1)", id); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+	return ErrConflict
+}
+
+// placeholders returns n comma-separated placeholders starting at $start
+func placeholders(start, n int) string {
+	ps := make([]string, n)
+	for i := range ps {
+		ps[i] = fmt.Sprintf("$%d", start+i)
+	}
+	return strings.Join(ps, ", ")
+}
+
+func stringArgs(ss []string) []interface{} {
+	args := make([]interface{}, len(ss))
+	for i, s := range ss {
+		args[i] = s
+	}
+	return args
+}
+
+// UpdateUserProfile applies the non-nil fields of pu and returns the user
+func (p *Postgres) UpdateUserProfile(ctx context.Context, id int64, pu model.ProfileUpdate) (*model.User, error) {
+	sets, args := profileAssignments(pu)
+	if len(sets) == 0 {
+		return p.GetUserByID(WithPrimary(ctx), id)
+	}
+	var row userRow
+	err := p.db.GetContext(ctx, &row, fmt.Sprintf(`
+		UPDATE users SET %s WHERE id=$%d
+		RETURNING `+pgUserColumns, strings.Join(sets, ", "), len(args)+1), append(args, id)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.user(&row)
+}
+
+// RecordLogin updates last_login_at and login_count after a successful login
+func (p *Postgres) RecordLogin(ctx context.Context, id int64) (*model.User, error) {
+	var row userRow
+	err := p.db.GetContext(ctx, &row, `
+		UPDATE users SET last_login_at=now(), login_count=login_count+1 WHERE id=$1
+		RETURNING `+pgUserColumns, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.user(&row)
+}
+
+// profileAssignments builds the SET list of a profile update, numbering the
+// placeholders from $1
+func profileAssignments(pu model.ProfileUpdate) ([]string, []interface{}) {
+	var sets []string
+	var args []interface{}
+	add := func(col string, v interface{}) {
+		args = append(args, v)
+		sets = append(sets, fmt.Sprintf("%s=$%d", col, len(args)))
+	}
+	if pu.DisplayName != nil {
+		add("display_name", *pu.DisplayName)
+	}
+	if pu.Email != nil {
+		add("email", *pu.Email)
+	}
+	if pu.Locale != nil {
+		add("locale", *pu.Locale)
+	}
+	if pu.Timezone != nil {
+		add("timezone", *pu.Timezone)
+	}
+	if pu.AvatarURL != nil {
+		add("avatar_url", *pu.AvatarURL)
+	}
+	if pu.Metadata != nil {
+		add("metadata", pu.Metadata)
+	}
+	return sets, args
+}
+
+// UpdateUserPhone moves a user to a new phone number and records the change
+// in phone_history. actorID is the user or admin making the change. It
+// returns ErrConflict if the number already belongs to another user.
+func (p *Postgres) UpdateUserPhone(ctx context.Context, id int64, phone string, actorID int64) (*model.User, error) {
+	sp, err := p.storePhone(phone)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var cur struct {
+		Phone string `db:"phone"`
+		encryptedPhone
+	}
+	err = tx.GetContext(ctx, &cur, `
+		SELECT COALESCE(phone, '') AS phone, phone_ct, phone_key_id FROM users
+		WHERE id=$1 FOR UPDATE`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	old, err := p.decryptPhone(cur.Phone, cur.encryptedPhone)
+	if err != nil {
+		return nil, fmt.Errorf("user %d: %w", id, err)
+	}
+
+	var row userRow
+	err = tx.GetContext(ctx, &row, `
+		UPDATE users SET phone=$1, phone_ct=$2, phone_key_id=$3, phone_index=$4 WHERE id=$5
+		RETURNING `+pgUserColumns, sp.plain, sp.ct, sp.keyID, sp.index, id)
+	if isUniqueViolation(err) {
+		return nil, ErrConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := setPhoneSuffixes(ctx, tx, id, sp.suffixes); err != nil {
+		return nil, err
+	}
+	u, err := p.user(&row)
+	if err != nil {
+		return nil, err
+	}
+	if old != phone {
+		so, err := p.storePhone(old)
 		if err != nil {
-			return nil, 0, err
-		}
-		err = pg.db.GetContext(ctx, &total, `SELECT COUNT(*) FROM users`)
-	} else {
-		err = pg.db.SelectContext(ctx, &users, `
-			SELECT id, phone, registered_at
-			FROM users
-			WHERE phone LIKE $1
-			ORDER BY id
-			LIMIT $2 OFFSET $3`, "%"+search+"%", limit, offset)
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO phone_history
+				(user_id, old_phone, new_phone, old_phone_ct, new_phone_ct, phone_key_id,
+				 old_phone_index, new_phone_index, actor_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			id, so.plain, sp.plain, so.ct, sp.ct, sp.keyID, so.index, sp.index, actorID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return u, tx.Commit()
+}
+
+// PhoneHistoryFilter narrows down ListPhoneHistory. Zero values match
+// everything.
+type PhoneHistoryFilter struct {
+	UserID int64
+	Phone  string // either the old or the new number
+}
+
+// phoneHistoryQuery builds the query shared by the SQL backends, selecting
+// columns. Only changes of users of the context tenant are listed. index is
+// the blind index of filter.Phone, or nil while numbers are not encrypted.
+func phoneHistoryQuery(ctx context.Context, filter PhoneHistoryFilter, columns string, index []byte) (string, []interface{}) {
+	where := []string{"user_id IN (SELECT id FROM users WHERE tenant_id = $1)"}
+	args := []interface{}{TenantFromContext(ctx)}
+	if filter.UserID != 0 {
+		args = append(args, filter.UserID)
+		where = append(where, fmt.Sprintf("user_id = $%d", len(args)))
+	}
+	if filter.Phone != "" {
+		args = append(args, filter.Phone)
+		cond := fmt.Sprintf("old_phone = $%d OR new_phone = $%d", len(args), len(args))
+		if index != nil {
+			args = append(args, index)
+			cond += fmt.Sprintf(" OR old_phone_index = $%d OR new_phone_index = $%d", len(args), len(args))
+		}
+		where = append(where, "("+cond+")")
+	}
+	cond := ""
+	if len(where) > 0 {
+		cond = "WHERE " + strings.Join(where, " AND ")
+	}
+	return `
+		SELECT ` + columns + `
+		FROM phone_history
+		` + cond + `
+		ORDER BY changed_at DESC, id DESC`, args
+}
+
+// phoneChangeRow is a phone_history row before its numbers are decrypted.
+// Both numbers are encrypted under the same key.
+type phoneChangeRow struct {
+	model.PhoneChange
+	OldPhoneCT []byte         `db:"old_phone_ct"`
+	NewPhoneCT []byte         `db:"new_phone_ct"`
+	PhoneKeyID sql.NullString `db:"phone_key_id"`
+}
+
+// publicIDOf selects, as column as, the public id of the user whose id is
+// in column col, or an empty string once the user is gone
+func publicIDOf(col, as string) string {
+	return fmt.Sprintf("COALESCE((SELECT CAST(public_id AS TEXT) FROM users WHERE users.id = %s), '') AS %s", col, as)
+}
+
+// phoneChangePublicIDs selects the public ids of the users of a phone change
+var phoneChangePublicIDs = publicIDOf("phone_history.user_id", "user_public_id") + ", " +
+	publicIDOf("phone_history.actor_id", "actor_public_id")
+
+var pgPhoneChangeColumns = `id, user_id, COALESCE(old_phone, '') AS old_phone,
+	COALESCE(new_phone, '') AS new_phone, actor_id, changed_at,
+	old_phone_ct, new_phone_ct, phone_key_id, ` + phoneChangePublicIDs
+
+// ListPhoneHistory returns phone number changes, newest first
+func (p *Postgres) ListPhoneHistory(ctx context.Context, filter PhoneHistoryFilter) ([]model.PhoneChange, error) {
+	var rows []phoneChangeRow
+	query, args := phoneHistoryQuery(ctx, filter, pgPhoneChangeColumns, p.phoneIndex(filter.Phone))
+	if err := p.reader(ctx).SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	changes := make([]model.PhoneChange, len(rows))
+	for i, r := range rows {
+		c := r.PhoneChange
+		var err error
+		if c.OldPhone, err = p.decryptPhone(c.OldPhone, encryptedPhone{r.OldPhoneCT, r.PhoneKeyID}); err != nil {
+			return nil, fmt.Errorf("phone change %d: %w", c.ID, err)
+		}
+		if c.NewPhone, err = p.decryptPhone(c.NewPhone, encryptedPhone{r.NewPhoneCT, r.PhoneKeyID}); err != nil {
+			return nil, fmt.Errorf("phone change %d: %w", c.ID, err)
+		}
+		changes[i] = c
+	}
+	return changes, nil
+}
+
+// RedactPhoneHistory removes the numbers from the phone changes of a user.
+// The blind indexes are kept, so a number can still be traced to the
+// purged user id.
+func (p *Postgres) RedactPhoneHistory(ctx context.Context, userID int64) error {
+	_, err := p.db.ExecContext(ctx, `
+		UPDATE phone_history SET old_phone=NULL, new_phone=NULL, old_phone_ct=NULL, new_phone_ct=NULL, phone_key_id=NULL
+		WHERE user_id=$1`, userID)
+	return err
+}
+
+// ListDeletedUsers returns the users that were deleted before cutoff and
+// are waiting to be purged
+func (p *Postgres) ListDeletedUsers(ctx context.Context, cutoff time.Time) ([]model.User, error) {
+	var rows []userRow
+	err := p.db.SelectContext(ctx, &rows, `
+		SELECT `+pgUserColumns+` FROM users
+		WHERE status=$1 AND status_changed_at < $2
+		ORDER BY id`, model.UserStatusDeleted, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]model.User, len(rows))
+	for i := range rows {
+		u, err := p.user(&rows[i])
 		if err != nil {
-			return nil, 0, err
+			return nil, err
 		}
-		err = pg.db.GetContext(ctx, &total, `SELECT COUNT(*) FROM users WHERE phone LIKE $1`, "%"+search+"%")
+		users[i] = *u
 	}
+	return users, nil
+}
 
+// DeleteUser removes a user together with its roles and notes
+func (p *Postgres) DeleteUser(ctx context.Context, id int64) error {
+	res, err := p.db.ExecContext(ctx, "DELETE FROM users WHERE id=$1", id)
 	if err != nil {
-		return nil, 0, err
+		return err
 	}
+	return expectRow(res)
+}
+
+var userNoteColumns = "id, user_id, author_id, body, created_at, " +
+	publicIDOf("user_notes.user_id", "user_public_id") + ", " + publicIDOf("user_notes.author_id", "author_public_id")
+
+// AddUserNote attaches a note written by authorID to a user
+func (p *Postgres) AddUserNote(ctx context.Context, userID, authorID int64, body string) (*model.UserNote, error) {
+	var n model.UserNote
+	err := p.db.GetContext(ctx, &n, `
+		INSERT INTO user_notes (user_id, author_id, body) VALUES ($1, $2, $3)
+		RETURNING `+userNoteColumns, userID, authorID, body)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// ListUserNotes returns the notes on a user, newest first
+func (p *Postgres) ListUserNotes(ctx context.Context, userID int64) ([]model.UserNote, error) {
+	notes := []model.UserNote{}
+	err := p.reader(ctx).SelectContext(ctx, &notes, `
+		SELECT `+userNoteColumns+`
+		FROM user_notes
+		WHERE user_id=$1
+		ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+func expectRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
 
-	return users, total, nil
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
 }
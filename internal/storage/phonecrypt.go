@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/example/go-otp-auth/internal/keyring"
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/jmoiron/sqlx"
+)
+
+// MinPhoneSearchLen is the shortest partial phone search accepted while
+// numbers are encrypted. Shorter suffixes are not indexed: they would be
+// shared by too many users to say anything useful, and too little to hide.
+const MinPhoneSearchLen = 4
+
+// ErrSearchTooShort is returned by ListUsers for a phone search shorter than
+// MinPhoneSearchLen when numbers are encrypted
+var ErrSearchTooShort = fmt.Errorf("search must be at least %d characters", MinPhoneSearchLen)
+
+// blind index domains
+const (
+	phoneIndexDomain  = "phone"
+	phoneSuffixDomain = "phone-suffix"
+)
+
+// reencryptBatchSize bounds the rows locked by one re-encryption transaction
+const reencryptBatchSize = 100
+
+// SetKeyring turns on phone number encryption. New and changed numbers are
+// stored encrypted; existing rows are moved over by ReencryptPhones. Lookups
+// still match plaintext rows until then.
+func (p *Postgres) SetKeyring(kr *keyring.Keyring) {
+	p.keys = kr
+}
+
+// encryptedPhone is the encrypted form of users.phone. PhoneKeyID is NULL
+// while the number is stored in plaintext.
+type encryptedPhone struct {
+	PhoneCT    []byte         `db:"phone_ct"`
+	PhoneKeyID sql.NullString `db:"phone_key_id"`
+}
+
+// userRow is a users row before its phone number is decrypted
+type userRow struct {
+	model.User
+	encryptedPhone
+}
+
+// user returns the row with the phone number in plaintext
+func (p *Postgres) user(row *userRow) (*model.User, error) {
+	phone, err := p.decryptPhone(row.Phone, row.encryptedPhone)
+	if err != nil {
+		return nil, fmt.Errorf("user %d: %w", row.ID, err)
+	}
+	u := row.User
+	u.Phone = phone
+	return &u, nil
+}
+
+func (p *Postgres) decryptPhone(plain string, e encryptedPhone) (string, error) {
+	if !e.PhoneKeyID.Valid {
+		return plain, nil
+	}
+	if p.keys == nil {
+		return "", errors.New("phone is encrypted but no keyring is configured")
+	}
+	b, err := p.keys.Decrypt(e.PhoneCT, e.PhoneKeyID.String)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// storedPhone holds the column values written for a phone number: the
+// plaintext without a keyring, otherwise the ciphertext and blind indexes
+type storedPhone struct {
+	plain    sql.NullString
+	ct       []byte
+	keyID    sql.NullString
+	index    []byte
+	suffixes [][]byte
+}
+
+func (p *Postgres) storePhone(phone string) (storedPhone, error) {
+	if p.keys == nil {
+		return storedPhone{plain: sql.NullString{String: phone, Valid: true}}, nil
+	}
+	ct, keyID, err := p.keys.Encrypt([]byte(phone))
+	if err != nil {
+		return storedPhone{}, err
+	}
+	sp := storedPhone{
+		ct:    ct,
+		keyID: sql.NullString{String: keyID, Valid: true},
+		index: p.keys.BlindIndex(phoneIndexDomain, phone),
+	}
+	for i := 0; i+MinPhoneSearchLen <= len(phone); i++ {
+		sp.suffixes = append(sp.suffixes, p.keys.BlindIndex(phoneSuffixDomain, phone[i:]))
+	}
+	return sp, nil
+}
+
+// phoneIndex returns the blind index to look phone up by, or nil without a
+// keyring. Lookups match "phone_index=<index> OR phone=<phone>" so rows not
+// yet encrypted are still found.
+func (p *Postgres) phoneIndex(phone string) []byte {
+	if p.keys == nil {
+		return nil
+	}
+	return p.keys.BlindIndex(phoneIndexDomain, phone)
+}
+
+// setPhoneSuffixes replaces the suffix tokens of a user
+func setPhoneSuffixes(ctx context.Context, tx sqlx.ExtContext, userID int64, tokens [][]byte) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_phone_suffixes WHERE user_id=$1", userID); err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+	values := make([]string, len(tokens))
+	args := []interface{}{userID}
+	for i, t := range tokens {
+		args = append(args, t)
+		values[i] = fmt.Sprintf("($%d, $1)", len(args))
+	}
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO user_phone_suffixes (token, user_id) VALUES `+strings.Join(values, ", ")+`
+		ON CONFLICT DO NOTHING`, args...)
+	return err
+}
+
+// ReencryptPhones moves every phone number onto the active key: plaintext
+// numbers are encrypted and indexed, and numbers under an older key get
+// their data key rewrapped. This covers users and phone_history; numbers
+// left in auth_events are replaced by their blind index and the redaction
+// is recorded in the chain. It runs in batches that skip rows locked by
+// another instance and returns the number of rows changed.
+func (p *Postgres) ReencryptPhones(ctx context.Context) (int, error) {
+	if p.keys == nil {
+		return 0, nil
+	}
+	total := 0
+	for _, batch := range []func(context.Context) (int, error){p.reencryptBatch, p.reencryptHistoryBatch} {
+		for {
+			n, err := batch(ctx)
+			total += n
+			if err != nil {
+				return total, err
+			}
+			if n == 0 {
+				break
+			}
+		}
+	}
+	n, err := p.redactAuthEvents(ctx, holdsPhoneCond, nil,
+		func() *model.AuthEvent { return phonesRedactedEvent(nil, redactReencrypt) })
+	return total + n, err
+}
+
+func (p *Postgres) reencryptBatch(ctx context.Context) (int, error) {
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var rows []struct {
+		ID    int64  `db:"id"`
+		Phone string `db:"phone"`
+		encryptedPhone
+	}
+	err = tx.SelectContext(ctx, &rows, `
+		SELECT id, COALESCE(phone, '') AS phone, phone_ct, phone_key_id FROM users
+		WHERE phone_key_id IS DISTINCT FROM $1
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`, p.keys.ActiveKeyID(), reencryptBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, r := range rows {
+		if r.PhoneKeyID.Valid {
+			ct, keyID, err := p.keys.Rewrap(r.PhoneCT, r.PhoneKeyID.String)
+			if err != nil {
+				return 0, fmt.Errorf("user %d: %w", r.ID, err)
+			}
+			_, err = tx.ExecContext(ctx, "UPDATE users SET phone_ct=$1, phone_key_id=$2 WHERE id=$3", ct, keyID, r.ID)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		sp, err := p.storePhone(r.Phone)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE users SET phone=NULL, phone_ct=$1, phone_key_id=$2, phone_index=$3
+			WHERE id=$4`, sp.ct, sp.keyID, sp.index, r.ID)
+		if err != nil {
+			return 0, err
+		}
+		if err := setPhoneSuffixes(ctx, tx, r.ID, sp.suffixes); err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), tx.Commit()
+}
+
+// reencryptHistoryBatch is reencryptBatch for phone_history. Rows without
+// any number, redacted on purge, are left alone.
+func (p *Postgres) reencryptHistoryBatch(ctx context.Context) (int, error) {
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var rows []phoneChangeRow
+	err = tx.SelectContext(ctx, &rows, `
+		SELECT `+pgPhoneChangeColumns+` FROM phone_history
+		WHERE phone_key_id IS DISTINCT FROM $1 AND (old_phone IS NOT NULL OR old_phone_ct IS NOT NULL)
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED`, p.keys.ActiveKeyID(), reencryptBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, r := range rows {
+		if r.PhoneKeyID.Valid {
+			oldCT, keyID, err := p.keys.Rewrap(r.OldPhoneCT, r.PhoneKeyID.String)
+			if err != nil {
+				return 0, fmt.Errorf("phone change %d: %w", r.ID, err)
+			}
+			newCT, _, err := p.keys.Rewrap(r.NewPhoneCT, r.PhoneKeyID.String)
+			if err != nil {
+				return 0, fmt.Errorf("phone change %d: %w", r.ID, err)
+			}
+			_, err = tx.ExecContext(ctx, `
+				UPDATE phone_history SET old_phone_ct=$1, new_phone_ct=$2, phone_key_id=$3
+				WHERE id=$4`, oldCT, newCT, keyID, r.ID)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		so, err := p.storePhone(r.OldPhone)
+		if err != nil {
+			return 0, err
+		}
+		sn, err := p.storePhone(r.NewPhone)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE phone_history SET old_phone=NULL, new_phone=NULL, old_phone_ct=$1, new_phone_ct=$2,
+				phone_key_id=$3, old_phone_index=$4, new_phone_index=$5
+			WHERE id=$6`, so.ct, sn.ct, sn.keyID, so.index, sn.index, r.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), tx.Commit()
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// Rate limit algorithms
+const (
+	// FixedWindow counts requests in a window that starts with the first
+	// one. It is the cheapest, but up to twice the limit can pass around the
+	// end of a window.
+	FixedWindow = "fixed_window"
+	// SlidingWindow logs every allowed request and allows at most the limit
+	// within any window. It keeps one entry per allowed request.
+	SlidingWindow = "sliding_window"
+	// TokenBucket holds up to the limit in tokens, refilled evenly over the
+	// window, and spends one per request. It allows a burst of the limit
+	// followed by a steady rate.
+	TokenBucket = "token_bucket"
+)
+
+// RateLimitAlgorithms lists the valid values of RateLimit.Algorithm
+var RateLimitAlgorithms = []string{FixedWindow, SlidingWindow, TokenBucket}
+
+// RateLimit allows Max requests per Window under Algorithm; an empty
+// Algorithm is FixedWindow
+type RateLimit struct {
+	Algorithm string
+	Max       int
+	Window    time.Duration
+}
+
+func (l RateLimit) algorithm() (string, error) {
+	switch l.Algorithm {
+	case "", FixedWindow:
+		return FixedWindow, nil
+	case SlidingWindow, TokenBucket:
+		return l.Algorithm, nil
+	}
+	return "", fmt.Errorf("unknown rate limit algorithm %q", l.Algorithm)
+}
+
+// Token buckets hold integer credit so that partial refills add up exactly:
+// a token is worth the window in milliseconds and the bucket gains Max
+// credit per millisecond.
+
+// tokenCost is the credit of one token
+func (l RateLimit) tokenCost() int64 { return l.Window.Milliseconds() }
+
+// capacity is the credit of a full bucket
+func (l RateLimit) capacity() int64 { return int64(l.Max) * l.Window.Milliseconds() }
+
+// refill returns the credit of a bucket that held credit at the time at,
+// once refilled up to now. A clock that went backwards refills nothing.
+func (l RateLimit) refill(credit int64, at, now time.Time) int64 {
+	if elapsed := now.UnixMilli() - at.UnixMilli(); elapsed > 0 {
+		credit += elapsed * int64(l.Max)
+	}
+	return min(credit, l.capacity())
+}
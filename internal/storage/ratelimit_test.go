@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testRateLimitAlgorithms runs the boundary cases of every algorithm against
+// rl, whose clock advance moves forward
+func testRateLimitAlgorithms(t *testing.T, rl RateLimiter, advance func(time.Duration)) {
+	t.Helper()
+	ctx := context.Background()
+	type step struct {
+		advance time.Duration
+		want    []bool
+	}
+	for _, tc := range []struct {
+		algorithm string
+		steps     []step
+	}{
+		{FixedWindow, []step{
+			{0, []bool{true}},
+			{59 * time.Second, []bool{true, false}},
+			// a new window starts a minute after the first request, so
+			// three requests pass within a second
+			{time.Second, []bool{true, true, false}},
+		}},
+		{SlidingWindow, []step{
+			{0, []bool{true}},
+			{59 * time.Second, []bool{true, false}},
+			// the first request leaves the window exactly a minute later
+			{time.Second, []bool{true, false}},
+			{58 * time.Second, []bool{false}},
+			{time.Second, []bool{true, false}},
+		}},
+		{TokenBucket, []step{
+			{0, []bool{true, true, false}},
+			// a token comes back every 30 seconds; the refill of a denied
+			// request is kept, not lost
+			{29 * time.Second, []bool{false}},
+			{time.Second, []bool{true, false}},
+			{15 * time.Second, []bool{false}},
+			{15 * time.Second, []bool{true, false}},
+			// an idle bucket fills up to the limit, no further
+			{5 * time.Minute, []bool{true, true, false}},
+		}},
+	} {
+		limit := RateLimit{Algorithm: tc.algorithm, Max: 2, Window: time.Minute}
+		key := "+1555:" + tc.algorithm
+		for i, s := range tc.steps {
+			advance(s.advance)
+			for j, want := range s.want {
+				got, err := rl.AllowOTPRequest(ctx, key, limit)
+				if err != nil {
+					t.Fatalf("%s step %d request %d: %v", tc.algorithm, i+1, j+1, err)
+				}
+				if got != want {
+					t.Errorf("%s step %d request %d: allowed = %v, want %v", tc.algorithm, i+1, j+1, got, want)
+				}
+			}
+		}
+
+		// a reset clears the key under its algorithm
+		if err := rl.ResetOTPRequests(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 2; j++ {
+			if ok, err := rl.AllowOTPRequest(ctx, key, limit); !ok || err != nil {
+				t.Errorf("%s after reset, request %d: allowed = %v, %v", tc.algorithm, j+1, ok, err)
+			}
+		}
+		advance(time.Hour)
+	}
+
+	// each algorithm keeps its own state for a key
+	for _, algorithm := range RateLimitAlgorithms {
+		limit := RateLimit{Algorithm: algorithm, Max: 1, Window: time.Minute}
+		if ok, err := rl.AllowOTPRequest(ctx, "+1666", limit); !ok || err != nil {
+			t.Errorf("%s on a key used by other algorithms: allowed = %v, %v", algorithm, ok, err)
+		}
+	}
+	if _, err := rl.AllowOTPRequest(ctx, "+1666", RateLimit{Algorithm: "leaky", Max: 1, Window: time.Minute}); err == nil {
+		t.Error("unknown algorithm: no error")
+	}
+}
@@ -2,82 +2,271 @@ package storage
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"math/rand/v2"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
 )
 
+// RedisOptions describes how to reach Redis. A standalone server, a Sentinel
+// managed master or a Cluster are all supported.
+type RedisOptions struct {
+	// URL is a redis:// or rediss:// URL. When set, its host, credentials, DB
+	// and TLS settings take precedence over the fields below.
+	URL string
+	// Addrs are the server addresses; sentinel addresses when SentinelMaster
+	// is set, seed nodes when Cluster is set
+	Addrs    []string
+	Username string
+	Password string
+	DB       int
+
+	// TLS enables TLS; TLSCAFile adds a PEM CA bundle to trust
+	TLS       bool
+	TLSCAFile string
+
+	// SentinelMaster is the master name monitored by the sentinels
+	SentinelMaster   string
+	SentinelPassword string
+
+	// Cluster talks to a Redis Cluster, even through a single seed address
+	Cluster bool
+}
+
+// universal converts o into options for redis.NewUniversalClient
+func (o RedisOptions) universal() (*redis.UniversalOptions, error) {
+	u := &redis.UniversalOptions{
+		Addrs:            o.Addrs,
+		Username:         o.Username,
+		Password:         o.Password,
+		DB:               o.DB,
+		MasterName:       o.SentinelMaster,
+		SentinelPassword: o.SentinelPassword,
+		IsClusterMode:    o.Cluster,
+	}
+
+	if o.URL != "" {
+		if o.Cluster {
+			// cluster URLs may list more seed nodes with ?addr=host:port
+			c, err := redis.ParseClusterURL(o.URL)
+			if err != nil {
+				return nil, fmt.Errorf("parse REDIS_URL: %w", err)
+			}
+			u.Addrs, u.Username, u.Password, u.TLSConfig = c.Addrs, c.Username, c.Password, c.TLSConfig
+		} else {
+			s, err := redis.ParseURL(o.URL)
+			if err != nil {
+				return nil, fmt.Errorf("parse REDIS_URL: %w", err)
+			}
+			u.Addrs, u.Username, u.Password, u.DB, u.TLSConfig = []string{s.Addr}, s.Username, s.Password, s.DB, s.TLSConfig
+		}
+	}
+	if len(u.Addrs) == 0 {
+		return nil, fmt.Errorf("no redis address configured")
+	}
+
+	if (o.TLS || o.TLSCAFile != "") && u.TLSConfig == nil {
+		u.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if o.TLSCAFile != "" {
+		pem, err := os.ReadFile(o.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read redis CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.TLSCAFile)
+		}
+		u.TLSConfig.RootCAs = pool
+	}
+	return u, nil
+}
+
+// Redis stores OTPs, rate limit counters and token revocations.
 type Redis struct {
-	client *redis.Client
+	client redis.UniversalClient
+	// now is replaceable so tests can move time forward. Sliding window and
+	// token bucket scripts take the time from the calling server, so the
+	// clocks of the servers sharing a Redis should be in sync.
+	now func() time.Time
 }
 
-func NewRedis(addr string) (*Redis, error) {
-	opt := &redis.Options{Addr: addr}
-	client := redis.NewClient(opt)
+func NewRedis(opts RedisOptions) (*Redis, error) {
+	uopts, err := opts.universal()
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewUniversalClient(uopts)
+	addrs := strings.Join(uopts.Addrs, ",")
 
 	maxAttempts := 8
 	wait := 1 * time.Second
 
 	for attempt := 1; attempt <= maxAttempts; attempt++ {
 		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		err := client.Ping(ctx).Err()
+		err = client.Ping(ctx).Err()
 		cancel()
 		if err == nil {
-			log.Info().Str("addr", addr).Msg("connected to redis")
-			return &Redis{client: client}, nil
+			log.Info().Str("addrs", addrs).Str("master", opts.SentinelMaster).Bool("cluster", opts.Cluster).Msg("connected to redis")
+			return &Redis{client: client, now: time.Now}, nil
 		}
 		log.Warn().Err(err).Int("attempt", attempt).Msg("redis not ready, retrying")
 		time.Sleep(wait)
 		wait *= 2
 	}
 
-	return nil, fmt.Errorf("unable to connect to redis at %s after %d attempts", addr, maxAttempts)
+	client.Close()
+	return nil, fmt.Errorf("unable to connect to redis at %s after %d attempts: %w", addrs, maxAttempts, err)
 }
 
 func (r *Redis) Close() error {
 	return r.client.Close()
 }
 
+func otpKey(phone string) string       { return fmt.Sprintf("otp:%s", phone) }
+func rateLimitKey(phone string) string { return fmt.Sprintf("rl:%s", phone) }
+func slidingLogKey(key string) string  { return fmt.Sprintf("rl:%s:log", key) }
+func tokenBucketKey(key string) string { return fmt.Sprintf("rl:%s:bucket", key) }
+func revokedKey(userID int64) string   { return fmt.Sprintf("revoked:%d", userID) }
+
+// verifyOTPScript deletes the code only if it matches, so a code cannot be
+// used twice by concurrent requests
+var verifyOTPScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('DEL', KEYS[1])
+	return 1
+end
+return 0`)
+
+// fixedWindowScript increments the counter and starts the window on the
+// first hit in one step, so a counter can never be left without a TTL
+var fixedWindowScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return n`)
+
+// slidingWindowScript drops the log entries that left the window and logs
+// the request if fewer than the limit remain. ARGV: now and window in
+// milliseconds, the limit and a unique member for the entry.
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], window)
+return 1`)
+
+// tokenBucketScript refills the bucket for the time since it was last
+// touched and spends a token if one is left, in the integer credit of
+// RateLimit.refill. A bucket untouched for a whole window is full, so it
+// expires then. ARGV: now and window in milliseconds and the limit.
+var tokenBucketScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local max = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'credit', 'at')
+local credit = tonumber(state[1]) or max * window
+local at = tonumber(state[2]) or now
+if now > at then
+	credit = math.min(max * window, credit + (now - at) * max)
+	at = now
+end
+local allowed = 0
+if credit >= window then
+	credit = credit - window
+	allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'credit', credit, 'at', at)
+redis.call('PEXPIRE', KEYS[1], window)
+return allowed`)
+
 // OTP
 func (r *Redis) SaveOTP(ctx context.Context, phone, code string, ttl time.Duration) error {
-	key := fmt.Sprintf("otp:%s", phone)
-	return r.client.Set(ctx, key, code, ttl).Err()
+	return r.client.Set(ctx, otpKey(phone), code, ttl).Err()
 }
 
 func (r *Redis) VerifyAndDeleteOTP(ctx context.Context, phone, code string) (bool, error) {
-	key := fmt.Sprintf("otp:%s", phone)
-	val, err := r.client.Get(ctx, key).Result()
-	if err == redis.Nil {
-		return false, nil
+	n, err := verifyOTPScript.Run(ctx, r.client, []string{otpKey(phone)}, code).Int()
+	if err != nil {
+		return false, err
 	}
+	return n == 1, nil
+}
+
+// DeleteOTP discards any pending code for phone
+func (r *Redis) DeleteOTP(ctx context.Context, phone string) error {
+	return r.client.Del(ctx, otpKey(phone)).Err()
+}
+
+// AllowOTPRequest counts a request against key and reports whether it is
+// within limit
+func (r *Redis) AllowOTPRequest(ctx context.Context, key string, limit RateLimit) (bool, error) {
+	algorithm, err := limit.algorithm()
 	if err != nil {
 		return false, err
 	}
-	if val != code {
-		return false, nil
+	now, window := r.now().UnixMilli(), limit.Window.Milliseconds()
+	switch algorithm {
+	case SlidingWindow:
+		member := fmt.Sprintf("%d-%x", now, rand.Uint64())
+		n, err := slidingWindowScript.Run(ctx, r.client, []string{slidingLogKey(key)}, now, window, limit.Max, member).Int()
+		return n == 1, err
+	case TokenBucket:
+		n, err := tokenBucketScript.Run(ctx, r.client, []string{tokenBucketKey(key)}, now, window, limit.Max).Int()
+		return n == 1, err
 	}
-	// delete
-	if err := r.client.Del(ctx, key).Err(); err != nil {
+	n, err := fixedWindowScript.Run(ctx, r.client, []string{rateLimitKey(key)}, window).Int64()
+	if err != nil {
 		return false, err
 	}
-	return true, nil
+	return n <= int64(limit.Max), nil
+}
+
+// ResetOTPRequests drops the rate limit state of key under every algorithm
+func (r *Redis) ResetOTPRequests(ctx context.Context, key string) error {
+	return r.client.Del(ctx, rateLimitKey(key), slidingLogKey(key), tokenBucketKey(key)).Err()
+}
+
+// RevokeUserTokens invalidates every token issued to the user up to now.
+// ttl should be at least the token lifetime.
+func (r *Redis) RevokeUserTokens(ctx context.Context, userID int64, ttl time.Duration) error {
+	return r.client.Set(ctx, revokedKey(userID), time.Now().UnixMilli(), ttl).Err()
 }
 
-// Rate limiter: increment and return whether allowed
-func (r *Redis) AllowOTPRequest(ctx context.Context, phone string, max int, window time.Duration) (bool, error) {
-	key := fmt.Sprintf("rl:%s", phone)
-	// INCR
-	n, err := r.client.Incr(ctx, key).Result()
+// TokensRevokedAt returns when the user's tokens were last revoked, or the
+// zero time if they never were.
+func (r *Redis) TokensRevokedAt(ctx context.Context, userID int64) (time.Time, error) {
+	ts, err := r.client.Get(ctx, revokedKey(userID)).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
 	if err != nil {
-		return false, err
+		return time.Time{}, err
 	}
-	if n == 1 {
-		// set expire
-		if err := r.client.Expire(ctx, key, window).Err(); err != nil {
-			return false, err
-		}
+	return revokedAt(ts), nil
+}
+
+// revokedAt reads a stored revocation time. It is kept in milliseconds;
+// values written before that are in seconds.
+func revokedAt(ts int64) time.Time {
+	if ts < 1e11 {
+		return time.Unix(ts, 0)
 	}
-	return n <= int64(max), nil
+	return time.UnixMilli(ts)
+}
+
+// ClearRevocation forgets when the user's tokens were revoked
+func (r *Redis) ClearRevocation(ctx context.Context, userID int64) error {
+	return r.client.Del(ctx, revokedKey(userID)).Err()
 }
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedis returns a Redis backed by an in-process server. Its clock and
+// the server's key expiry only move when advance is called.
+func newTestRedis(t *testing.T) (*Redis, func(time.Duration)) {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mr.Close)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	r := &Redis{client: client, now: func() time.Time { return now }}
+	return r, func(d time.Duration) {
+		now = now.Add(d)
+		mr.FastForward(d)
+	}
+}
+
+func TestRedisRateLimitAlgorithms(t *testing.T) {
+	r, advance := newTestRedis(t)
+	testRateLimitAlgorithms(t, r, advance)
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+)
+
+// replicaCheckInterval is how often replicas are pinged
+const replicaCheckInterval = 5 * time.Second
+
+type primaryKey struct{}
+
+// WithPrimary returns a context whose reads are served by the primary. Use it
+// when reading data the same request has just written.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+func usePrimary(ctx context.Context) bool {
+	v, _ := ctx.Value(primaryKey{}).(bool)
+	return v
+}
+
+// replica is a read-only connection pool with its last known health
+type replica struct {
+	name    string
+	db      *sqlx.DB
+	healthy atomic.Bool
+}
+
+func openReplica(i int, dsn string) (*replica, error) {
+	// Open does not connect; an unreachable replica is just marked unhealthy
+	db, err := sqlx.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("replica %d: %w", i+1, err)
+	}
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(2)
+	db.SetConnMaxLifetime(time.Hour)
+	return &replica{name: fmt.Sprintf("replica-%d", i+1), db: db}, nil
+}
+
+func (r *replica) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := r.db.PingContext(ctx)
+	healthy := err == nil
+	if r.healthy.Swap(healthy) != healthy {
+		if healthy {
+			log.Info().Str("replica", r.name).Msg("postgres replica is healthy")
+		} else {
+			log.Warn().Err(err).Str("replica", r.name).Msg("postgres replica is unhealthy, reading from primary")
+		}
+	}
+}
+
+// reader returns the pool to run a read-only query on: the next healthy
+// replica, or the primary if there is none or ctx asks for it
+func (p *Postgres) reader(ctx context.Context) *sqlx.DB {
+	if len(p.replicas) == 0 || usePrimary(ctx) {
+		return p.db
+	}
+	n := uint64(len(p.replicas))
+	start := p.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		if r := p.replicas[(start+i)%n]; r.healthy.Load() {
+			return r.db
+		}
+	}
+	return p.db
+}
+
+// checkReplicas pings every replica until p is closed
+func (p *Postgres) checkReplicas(interval time.Duration) {
+	defer p.done.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+			for _, r := range p.replicas {
+				r.check()
+			}
+		}
+	}
+}
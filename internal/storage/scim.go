@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/example/go-otp-auth/internal/model"
+)
+
+// SCIMUser is a user provisioned over SCIM by a tenant's identity provider
+type SCIMUser struct {
+	model.User
+	// ExternalID is the identity provider's own id for the user
+	ExternalID string `db:"external_id"`
+}
+
+// SCIMFilter narrows ListSCIMUsers. Zero fields match every user.
+type SCIMFilter struct {
+	UserID     int64
+	ExternalID string
+	Active     *bool
+}
+
+// scimUserQuery returns the FROM and WHERE clauses selecting the users of
+// tenant that match filter. Deleted users are left out: to the identity
+// provider they are gone, even before they are purged.
+func scimUserQuery(tenant string, filter SCIMFilter) (string, []interface{}) {
+	where := []string{"s.tenant = $1", "u.status <> $2"}
+	args := []interface{}{tenant, model.UserStatusDeleted}
+	if filter.UserID != 0 {
+		args = append(args, filter.UserID)
+		where = append(where, fmt.Sprintf("u.id = $%d", len(args)))
+	}
+	if filter.ExternalID != "" {
+		args = append(args, filter.ExternalID)
+		where = append(where, fmt.Sprintf("s.external_id = $%d", len(args)))
+	}
+	if filter.Active != nil {
+		op := "<>"
+		if *filter.Active {
+			op = "="
+		}
+		args = append(args, model.UserStatusActive)
+		where = append(where, fmt.Sprintf("u.status %s $%d", op, len(args)))
+	}
+	return "FROM scim_users s JOIN users u ON u.id = s.user_id WHERE " + strings.Join(where, " AND "), args
+}
+
+// scimUserColumns adds the external id to the users columns. No users
+// column shares a name with scim_users, so they need no table prefix.
+const scimUserColumns = ", COALESCE(s.external_id, '') AS external_id"
+
+type scimUserRow struct {
+	userRow
+	ExternalID string `db:"external_id"`
+}
+
+// ErrExternalIDConflict is the ErrConflict of an external id already used
+// within the tenant
+var ErrExternalIDConflict = fmt.Errorf("external id: %w", ErrConflict)
+
+// CreateSCIMUser creates the user provisioned by tenant in one transaction.
+// A phone number already registered is ErrConflict.
+func (p *Postgres) CreateSCIMUser(ctx context.Context, tenant string, u SCIMUser) (*SCIMUser, error) {
+	tx, err := p.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	row, err := p.insertUser(ctx, tx, u.Phone)
+	if err != nil {
+		return nil, err
+	}
+	if u.DisplayName != "" {
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET display_name=$1 WHERE id=$2", u.DisplayName, row.ID); err != nil {
+			return nil, err
+		}
+	}
+	if u.Status != "" && u.Status != model.UserStatusActive {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE users SET status=$1, status_reason=$2, status_changed_at=now()
+			WHERE id=$3`, u.Status, u.StatusReason, row.ID); err != nil {
+			return nil, err
+		}
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO scim_users (user_id, tenant, external_id) VALUES ($1, $2, NULLIF($3, ''))`,
+		row.ID, tenant, u.ExternalID)
+	if isUniqueViolation(err) {
+		return nil, ErrExternalIDConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return p.GetSCIMUser(WithPrimary(ctx), tenant, row.ID)
+}
+
+// SetSCIMExternalID replaces the external id of a user of tenant
+func (p *Postgres) SetSCIMExternalID(ctx context.Context, tenant string, userID int64, externalID string) error {
+	res, err := p.db.ExecContext(ctx, `
+		UPDATE scim_users SET external_id = NULLIF($3, '')
+		WHERE tenant = $1 AND user_id = $2`, tenant, userID, externalID)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+// GetSCIMUser returns a user provisioned by tenant
+func (p *Postgres) GetSCIMUser(ctx context.Context, tenant string, userID int64) (*SCIMUser, error) {
+	users, _, err := p.ListSCIMUsers(ctx, tenant, SCIMFilter{UserID: userID}, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, ErrNotFound
+	}
+	return &users[0], nil
+}
+
+// ListSCIMUsers returns up to limit users of tenant in id order, starting
+// offset users in, and the number of users matching filter
+func (p *Postgres) ListSCIMUsers(ctx context.Context, tenant string, filter SCIMFilter, offset, limit int) ([]SCIMUser, int, error) {
+	from, args := scimUserQuery(tenant, filter)
+	db := p.reader(ctx)
+
+	var total int
+	if err := db.GetContext(ctx, &total, "SELECT count(*) "+from, args...); err != nil {
+		return nil, 0, err
+	}
+	var rows []scimUserRow
+	err := db.SelectContext(ctx, &rows, "SELECT "+pgUserColumns+scimUserColumns+" "+from+
+		fmt.Sprintf(" ORDER BY u.id LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2), append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	users := make([]SCIMUser, 0, len(rows))
+	for i := range rows {
+		u, err := p.user(&rows[i].userRow)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, SCIMUser{User: *u, ExternalID: rows[i].ExternalID})
+	}
+	return users, total, nil
+}
@@ -0,0 +1,905 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"github.com/example/go-otp-auth/internal/migrate"
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/example/go-otp-auth/migrations"
+)
+
+// SQLite implements every store on a single database file, for deployments
+// that run without Postgres and Redis. Expiring keys are stored with an
+// expires_at timestamp, ignored once past it and purged by a background loop.
+type SQLite struct {
+	db *sqlx.DB
+	// now is replaceable so tests can move time forward
+	now func() time.Time
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// NewSQLite opens (creating if needed) the database at path, applies the
+// embedded schema and starts the cleanup loop
+func NewSQLite(path string) (*SQLite, error) {
+	q := url.Values{}
+	q.Add("_pragma", "foreign_keys(1)")
+	q.Add("_pragma", "busy_timeout(5000)")
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Set("_time_format", "sqlite")
+	db, err := sqlx.Connect("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite %s: %w", path, err)
+	}
+	// sqlite allows one writer at a time; a single connection avoids
+	// SQLITE_BUSY between our own goroutines
+	db.SetMaxOpenConns(1)
+
+	ms, err := migrate.Load(migrations.SQLite)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := migrate.New(db.DB, migrate.SQLite, ms).Up(context.Background()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate sqlite: %w", err)
+	}
+	log.Info().Str("path", path).Msg("opened sqlite database")
+
+	s := &SQLite{db: db, now: time.Now, stop: make(chan struct{})}
+	s.done.Add(1)
+	go s.cleanupLoop(sweepInterval)
+	return s, nil
+}
+
+// Tenants returns the tenant store backed by s
+func (s *SQLite) Tenants() TenantStore {
+	return &sqlTenants{db: s.db, unique: isSQLiteUniqueViolation}
+}
+
+// ClientApps returns the client app store backed by s
+func (s *SQLite) ClientApps() ClientAppStore {
+	return &sqlClientApps{db: s.db, unique: isSQLiteUniqueViolation, now: func() time.Time { return s.now() }}
+}
+
+// Close stops the cleanup loop and closes the database
+func (s *SQLite) Close() error {
+	close(s.stop)
+	s.done.Wait()
+	return s.db.Close()
+}
+
+// Stores returns a Stores backed entirely by s
+func (s *SQLite) Stores() Stores {
+	return Stores{Users: s, Events: s, OTPs: s, Limiter: s, Revoker: s, SCIM: s, Tenants: s.Tenants(), Apps: s.ClientApps()}
+}
+
+func (s *SQLite) FindUserByPhone(ctx context.Context, phone string) (*model.User, error) {
+	var u model.User
+	err := s.db.GetContext(ctx, &u, "SELECT "+userColumns+" FROM users WHERE tenant_id=$1 AND phone=$2",
+		TenantFromContext(ctx), phone)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *SQLite) CreateUser(ctx context.Context, phone string) (*model.User, error) {
+	res, err := s.db.ExecContext(ctx,
+		"INSERT INTO users (tenant_id, public_id, phone, registered_at) VALUES ($1, $2, $3, $4)",
+		TenantFromContext(ctx), NewPublicID(), phone, s.now().UTC())
+	if isSQLiteUniqueViolation(err) {
+		return nil, ErrConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return s.GetUserByID(ctx, id)
+}
+
+// FindOrCreateUser inserts the user unless the phone is already registered
+func (s *SQLite) FindOrCreateUser(ctx context.Context, phone string) (*model.User, bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO users (tenant_id, public_id, phone, registered_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant_id, phone) DO NOTHING`, TenantFromContext(ctx), NewPublicID(), phone, s.now().UTC())
+	if err != nil {
+		return nil, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, false, err
+	} else if n == 0 {
+		u, err := s.FindUserByPhone(ctx, phone)
+		return u, false, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, false, err
+	}
+	u, err := s.GetUserByID(ctx, id)
+	return u, err == nil, err
+}
+
+func (s *SQLite) GetUserByID(ctx context.Context, id int64) (*model.User, error) {
+	var u model.User
+	err := s.db.GetContext(ctx, &u, "SELECT "+userColumns+" FROM users WHERE id=$1", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *SQLite) ResolvePublicID(ctx context.Context, publicID string) (int64, error) {
+	var id int64
+	err := s.db.GetContext(ctx, &id, "SELECT id FROM users WHERE public_id=$1 AND tenant_id=$2",
+		publicID, TenantFromContext(ctx))
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return id, err
+}
+
+func (s *SQLite) GetUserStatus(ctx context.Context, id int64) (string, string, error) {
+	var row struct {
+		Status string `db:"status"`
+		Reason string `db:"status_reason"`
+	}
+	err := s.db.GetContext(ctx, &row, "SELECT status, status_reason FROM users WHERE id=$1", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrNotFound
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return row.Status, row.Reason, nil
+}
+
+func (s *SQLite) ListUsers(ctx context.Context, filter UserFilter, page UserPage) (*UserList, error) {
+	cursor, err := decodeUserCursor(page)
+	if err != nil {
+		return nil, err
+	}
+
+	where := []string{"tenant_id = $1"}
+	args := []interface{}{TenantFromContext(ctx)}
+	switch {
+	case filter.Search == "":
+	case filter.searchMode() == SearchExact:
+		args = append(args, filter.Search)
+		where = append(where, fmt.Sprintf("phone = $%d", len(args)))
+	default:
+		args = append(args, filter.phonePattern())
+		where = append(where, fmt.Sprintf(`phone LIKE $%d ESCAPE '\'`, len(args)))
+	}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		where = append(where, fmt.Sprintf("status = $%d", len(args)))
+	}
+	where, args = filter.registeredRange(where, args)
+	cond := ""
+	if len(where) > 0 {
+		cond = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total *int
+	if !page.SkipTotal {
+		total = new(int)
+		if err := s.db.GetContext(ctx, total, `SELECT COUNT(*) FROM users `+cond, args...); err != nil {
+			return nil, err
+		}
+	}
+
+	var keyExpr string
+	var key interface{}
+	var afterID int64
+	if cursor != nil {
+		if afterID, err = s.ResolvePublicID(ctx, cursor.ID); errors.Is(err, ErrNotFound) {
+			return nil, ErrInvalidCursor
+		} else if err != nil {
+			return nil, err
+		}
+		key = cursor.keyTime()
+	}
+	switch page.sort() {
+	case UserSortRegisteredAt:
+		keyExpr = "registered_at"
+	case UserSortLastLoginAt:
+		// times are stored as text, which sorts after the empty string
+		keyExpr = "COALESCE(last_login_at, '')"
+		if cursor != nil && cursor.Key == "" {
+			key = ""
+		}
+	}
+	after, order, args := userKeyset(page, keyExpr, cursor, key, afterID, args)
+	if after != "" {
+		where = append(where, after)
+		cond = "WHERE " + strings.Join(where, " AND ")
+	}
+	offset := page.Offset
+	if cursor != nil {
+		offset = 0
+	}
+
+	users := []ListedUser{}
+	err = s.db.SelectContext(ctx, &users, fmt.Sprintf(`
+		SELECT id, public_id, phone, status, registered_at, last_login_at
+		FROM users
+		%s
+		%s
+		LIMIT $%d OFFSET $%d`, cond, order, len(args)+1, len(args)+2), append(args, page.Limit+1, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	list := finishUserPage(page, users)
+	list.Total = total
+	return list, nil
+}
+
+func (s *SQLite) GetUserAccess(ctx context.Context, userID int64) ([]string, []string, error) {
+	roles := []string{}
+	err := s.db.SelectContext(ctx, &roles, `
+		SELECT $1 AS role
+		UNION
+		SELECT role FROM user_roles WHERE user_id=$2
+		ORDER BY role`, model.RoleUser, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	perms := []string{}
+	err = s.db.SelectContext(ctx, &perms, `
+		SELECT DISTINCT permission
+		FROM role_permissions
+		WHERE role=$1 OR role IN (SELECT role FROM user_roles WHERE user_id=$2)
+		ORDER BY permission`, model.RoleUser, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return roles, perms, nil
+}
+
+// GrantRole gives a user an additional role
+func (s *SQLite) GrantRole(ctx context.Context, userID int64, role string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO user_roles (user_id, role) VALUES ($1, $2)`, userID, role)
+	return err
+}
+
+func (s *SQLite) SetUserStatus(ctx context.Context, id int64, status, reason string) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users SET status=$1, status_reason=$2, status_changed_at=$3
+		WHERE id=$4`, status, reason, s.now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+func (s *SQLite) ChangeUserStatus(ctx context.Context, id int64, from []string, status, reason string) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users SET status=$1, status_reason=$2, status_changed_at=$3
+		WHERE id=$4 AND status IN (`+placeholders(5, len(from))+`)`,
+		append([]interface{}{status, reason, s.now().UTC(), id}, stringArgs(from)...)...)
+	if err != nil {
+		return err
+	}
+	return statusChanged(ctx, s.db, res, id)
+}
+
+func (s *SQLite) UpdateUserProfile(ctx context.Context, id int64, pu model.ProfileUpdate) (*model.User, error) {
+	sets, args := profileAssignments(pu)
+	if len(sets) > 0 {
+		res, err := s.db.ExecContext(ctx, fmt.Sprintf("UPDATE users SET %s WHERE id=$%d",
+			strings.Join(sets, ", "), len(args)+1), append(args, id)...)
+		if err != nil {
+			return nil, err
+		}
+		if err := expectRow(res); err != nil {
+			return nil, err
+		}
+	}
+	return s.GetUserByID(ctx, id)
+}
+
+func (s *SQLite) RecordLogin(ctx context.Context, id int64) (*model.User, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users SET last_login_at=$1, login_count=login_count+1 WHERE id=$2`, s.now().UTC(), id)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectRow(res); err != nil {
+		return nil, err
+	}
+	return s.GetUserByID(ctx, id)
+}
+
+func (s *SQLite) UpdateUserPhone(ctx context.Context, id int64, phone string, actorID int64) (*model.User, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var old string
+	err = tx.GetContext(ctx, &old, "SELECT phone FROM users WHERE id=$1", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE users SET phone=$1 WHERE id=$2", phone, id)
+	if isSQLiteUniqueViolation(err) {
+		return nil, ErrConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	if old != phone {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO phone_history (user_id, old_phone, new_phone, actor_id, changed_at)
+			VALUES ($1, $2, $3, $4, $5)`, id, old, phone, actorID, s.now().UTC())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.GetUserByID(ctx, id)
+}
+
+func (s *SQLite) ListPhoneHistory(ctx context.Context, filter PhoneHistoryFilter) ([]model.PhoneChange, error) {
+	changes := []model.PhoneChange{}
+	query, args := phoneHistoryQuery(ctx, filter, "id, user_id, old_phone, new_phone, actor_id, changed_at, "+phoneChangePublicIDs, nil)
+	if err := s.db.SelectContext(ctx, &changes, query, args...); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+func (s *SQLite) RedactPhoneHistory(ctx context.Context, userID int64) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE phone_history SET old_phone='', new_phone='' WHERE user_id=$1", userID)
+	return err
+}
+
+func (s *SQLite) ListDeletedUsers(ctx context.Context, cutoff time.Time) ([]model.User, error) {
+	users := []model.User{}
+	err := s.db.SelectContext(ctx, &users, `
+		SELECT `+userColumns+` FROM users
+		WHERE status=$1 AND status_changed_at < $2
+		ORDER BY id`, model.UserStatusDeleted, cutoff.UTC())
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *SQLite) DeleteUser(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM users WHERE id=$1", id)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+func (s *SQLite) AddUserNote(ctx context.Context, userID, authorID int64, body string) (*model.UserNote, error) {
+	var n model.UserNote
+	err := s.db.GetContext(ctx, &n, `
+		INSERT INTO user_notes (user_id, author_id, body, created_at)
+		SELECT id, $2, $3, $4 FROM users WHERE id=$1
+		RETURNING `+userNoteColumns, userID, authorID, body, s.now().UTC())
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func (s *SQLite) ListUserNotes(ctx context.Context, userID int64) ([]model.UserNote, error) {
+	notes := []model.UserNote{}
+	err := s.db.SelectContext(ctx, &notes, `
+		SELECT `+userNoteColumns+`
+		FROM user_notes
+		WHERE user_id=$1
+		ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+func (s *SQLite) FindUserByEmail(ctx context.Context, email string) (*model.User, error) {
+	var u model.User
+	err := s.db.GetContext(ctx, &u, `
+		SELECT `+userColumns+` FROM users
+		WHERE id = (SELECT user_id FROM user_emails WHERE tenant_id=$2 AND email=$1)`, email, TenantFromContext(ctx))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *SQLite) AddUserEmail(ctx context.Context, userID int64, email string) (*model.UserEmail, error) {
+	var tenantID int64
+	err := s.db.GetContext(ctx, &tenantID, "SELECT tenant_id FROM users WHERE id=$1", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO user_emails (tenant_id, email, user_id, verified_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant_id, email) DO NOTHING`, tenantID, email, userID, s.now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	var e model.UserEmail
+	err = s.db.GetContext(ctx, &e, "SELECT user_id, email, verified_at FROM user_emails WHERE tenant_id=$1 AND email=$2", tenantID, email)
+	if err != nil {
+		return nil, err
+	}
+	if e.UserID != userID {
+		return nil, ErrConflict
+	}
+	return &e, nil
+}
+
+func (s *SQLite) ListUserEmails(ctx context.Context, userID int64) ([]model.UserEmail, error) {
+	emails := []model.UserEmail{}
+	err := s.db.SelectContext(ctx, &emails, `
+		SELECT user_id, email, verified_at FROM user_emails
+		WHERE user_id=$1
+		ORDER BY verified_at, email`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+func (s *SQLite) DeleteUserEmail(ctx context.Context, userID int64, email string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM user_emails WHERE user_id=$1 AND email=$2", userID, email)
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+func (s *SQLite) CreateSCIMUser(ctx context.Context, tenant string, u SCIMUser) (*SCIMUser, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := s.now().UTC()
+	var changedAt *time.Time
+	status := model.UserStatusActive
+	if u.Status != "" && u.Status != status {
+		status, changedAt = u.Status, &now
+	}
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO users (tenant_id, public_id, phone, registered_at, display_name, status, status_reason, status_changed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		TenantFromContext(ctx), NewPublicID(), u.Phone, now, u.DisplayName, status, u.StatusReason, changedAt)
+	if isSQLiteUniqueViolation(err) {
+		return nil, ErrConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO scim_users (user_id, tenant, external_id, created_at) VALUES ($1, $2, NULLIF($3, ''), $4)`,
+		id, tenant, u.ExternalID, now)
+	if isSQLiteUniqueViolation(err) {
+		return nil, ErrExternalIDConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return s.GetSCIMUser(ctx, tenant, id)
+}
+
+func (s *SQLite) SetSCIMExternalID(ctx context.Context, tenant string, userID int64, externalID string) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE scim_users SET external_id = NULLIF($3, '')
+		WHERE tenant = $1 AND user_id = $2`, tenant, userID, externalID)
+	if isSQLiteUniqueViolation(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
+
+func (s *SQLite) GetSCIMUser(ctx context.Context, tenant string, userID int64) (*SCIMUser, error) {
+	users, _, err := s.ListSCIMUsers(ctx, tenant, SCIMFilter{UserID: userID}, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, ErrNotFound
+	}
+	return &users[0], nil
+}
+
+func (s *SQLite) ListSCIMUsers(ctx context.Context, tenant string, filter SCIMFilter, offset, limit int) ([]SCIMUser, int, error) {
+	from, args := scimUserQuery(tenant, filter)
+	var total int
+	if err := s.db.GetContext(ctx, &total, "SELECT count(*) "+from, args...); err != nil {
+		return nil, 0, err
+	}
+	users := []SCIMUser{}
+	err := s.db.SelectContext(ctx, &users, "SELECT "+userColumns+scimUserColumns+" "+from+
+		fmt.Sprintf(" ORDER BY u.id LIMIT $%d OFFSET $%d", len(args)+1, len(args)+2), append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// RecordAuthEvent appends e to auth_events, filling in its id, hashes and,
+// unless already set, its timestamp. The single connection serializes appends.
+func (s *SQLite) RecordAuthEvent(ctx context.Context, e *model.AuthEvent) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.appendAuthEvent(ctx, tx, e); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLite) appendAuthEvent(ctx context.Context, tx *sqlx.Tx, e *model.AuthEvent) error {
+	details := e.Details
+	if details == nil {
+		details = map[string]string{}
+	}
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	var last struct {
+		ID   int64  `db:"id"`
+		Hash string `db:"hash"`
+	}
+	err = tx.GetContext(ctx, &last, "SELECT id, hash FROM auth_events ORDER BY id DESC LIMIT 1")
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	e.ID = last.ID + 1
+	e.PrevHash = last.Hash
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = s.now()
+	}
+	e.CreatedAt = e.CreatedAt.UTC()
+	e.Hash = hashAuthEvent(e)
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO auth_events
+			(id, event_type, user_id, actor_id, phone, phone_index, ip, user_agent, request_id, details, created_at, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		e.ID, e.Type, e.UserID, e.ActorID, e.Phone, e.PhoneIndex, e.IP, e.UserAgent, e.RequestID,
+		string(detailsJSON), e.CreatedAt, e.PrevHash, e.Hash)
+	return err
+}
+
+// RedactUserAuthEvents is the Postgres RedactUserAuthEvents, in a single
+// transaction recorded by one phones_redacted event
+func (s *SQLite) RedactUserAuthEvents(ctx context.Context, userID int64, phones []string) (int, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	cond := "user_id = $1"
+	args := []interface{}{userID}
+	if len(phones) > 0 {
+		in := make([]string, len(phones))
+		for i, phone := range phones {
+			args = append(args, phone)
+			in[i] = fmt.Sprintf("$%d", len(args))
+		}
+		cond += " OR (user_id IS NULL AND phone IN (" + strings.Join(in, ", ") + "))"
+	}
+	rows, err := tx.QueryxContext(ctx, `
+		SELECT `+authEventColumns+`
+		FROM auth_events
+		WHERE redacted_by IS NULL AND (`+cond+`)
+		ORDER BY id`, args...)
+	if err != nil {
+		return 0, err
+	}
+	var events []model.AuthEvent
+	for rows.Next() {
+		var row authEventRow
+		if err := rows.StructScan(&row); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if err := json.Unmarshal(row.DetailsJSON, &row.Details); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("auth event %d: %w", row.ID, err)
+		}
+		if holdsPhone(&row.AuthEvent) {
+			events = append(events, row.AuthEvent)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(events) == 0 {
+		return 0, err
+	}
+
+	var tombstoneID int64
+	if err := tx.GetContext(ctx, &tombstoneID, "SELECT MAX(id) + 1 FROM auth_events"); err != nil {
+		return 0, err
+	}
+	hashes := make([]string, len(events))
+	for i := range events {
+		e := &events[i]
+		redactPhone(e, nil, tombstoneID)
+		detailsJSON, err := json.Marshal(e.Details)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE auth_events SET phone='', details=$1, redacted_by=$2
+			WHERE id=$3`, string(detailsJSON), tombstoneID, e.ID)
+		if err != nil {
+			return 0, err
+		}
+		hashes[i] = hashAuthEvent(e)
+	}
+	tombstone := phonesRedactedEvent(&userID, redactPurge)
+	attestRedaction(tombstone, hashes)
+	if err := s.appendAuthEvent(ctx, tx, tombstone); err != nil {
+		return 0, err
+	}
+	return len(events), tx.Commit()
+}
+
+// VerifyAuthEvents walks auth_events in order and recomputes every hash, like
+// the Postgres implementation
+func (s *SQLite) VerifyAuthEvents(ctx context.Context) (int64, string, error) {
+	return verifyAuthEvents(ctx, s.db)
+}
+
+func (s *SQLite) ListUserAuthEvents(ctx context.Context, userID int64) ([]model.AuthEvent, error) {
+	return listUserAuthEvents(ctx, s.db, userID)
+}
+
+func (s *SQLite) SaveOTP(ctx context.Context, phone, code string, ttl time.Duration) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO otps (phone, code, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (phone) DO UPDATE SET code=excluded.code, expires_at=excluded.expires_at`,
+		phone, code, s.now().Add(ttl).UnixMilli())
+	return err
+}
+
+// VerifyAndDeleteOTP consumes the code in a single statement, so a code can
+// only be used once even under concurrent requests
+func (s *SQLite) VerifyAndDeleteOTP(ctx context.Context, phone, code string) (bool, error) {
+	res, err := s.db.ExecContext(ctx, `
+		DELETE FROM otps WHERE phone=$1 AND code=$2 AND expires_at > $3`,
+		phone, code, s.now().UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *SQLite) DeleteOTP(ctx context.Context, phone string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM otps WHERE phone=$1", phone)
+	return err
+}
+
+// AllowOTPRequest works like the Redis implementation of each algorithm
+func (s *SQLite) AllowOTPRequest(ctx context.Context, key string, limit RateLimit) (bool, error) {
+	algorithm, err := limit.algorithm()
+	if err != nil {
+		return false, err
+	}
+	now := s.now()
+	switch algorithm {
+	case SlidingWindow:
+		return s.allowSlidingWindow(ctx, "otp:"+key, limit, now)
+	case TokenBucket:
+		return s.allowTokenBucket(ctx, "otp:"+key, limit, now)
+	}
+	var n int64
+	err = s.db.GetContext(ctx, &n, `
+		INSERT INTO rate_limits (key, count, expires_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			count = CASE WHEN rate_limits.expires_at <= $3 THEN 1 ELSE rate_limits.count + 1 END,
+			expires_at = CASE WHEN rate_limits.expires_at <= $3 THEN excluded.expires_at ELSE rate_limits.expires_at END
+		RETURNING count`,
+		"otp:"+key, now.Add(limit.Window).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	return n <= int64(limit.Max), nil
+}
+
+func (s *SQLite) allowSlidingWindow(ctx context.Context, key string, limit RateLimit, now time.Time) (bool, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var n int
+	err = tx.GetContext(ctx, &n, "SELECT COUNT(*) FROM rate_limit_log WHERE key=$1 AND at > $2",
+		key, now.Add(-limit.Window).UnixMilli())
+	if err != nil || n >= limit.Max {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO rate_limit_log (key, at, expires_at) VALUES ($1, $2, $3)",
+		key, now.UnixMilli(), now.Add(limit.Window).UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *SQLite) allowTokenBucket(ctx context.Context, key string, limit RateLimit, now time.Time) (bool, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	b := struct {
+		Credit    int64 `db:"credit"`
+		At        int64 `db:"at"`
+		ExpiresAt int64 `db:"expires_at"`
+	}{}
+	err = tx.GetContext(ctx, &b, "SELECT credit, at, expires_at FROM rate_limit_buckets WHERE key=$1", key)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && b.ExpiresAt <= now.UnixMilli()) {
+		b.Credit, b.At, err = limit.capacity(), now.UnixMilli(), nil
+	}
+	if err != nil {
+		return false, err
+	}
+	at := time.UnixMilli(b.At)
+	credit := limit.refill(b.Credit, at, now)
+	if now.After(at) {
+		at = now
+	}
+	allowed := credit >= limit.tokenCost()
+	if allowed {
+		credit -= limit.tokenCost()
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO rate_limit_buckets (key, credit, at, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (key) DO UPDATE SET credit=excluded.credit, at=excluded.at, expires_at=excluded.expires_at`,
+		key, credit, at.UnixMilli(), now.Add(limit.Window).UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	return allowed, tx.Commit()
+}
+
+func (s *SQLite) ResetOTPRequests(ctx context.Context, key string) error {
+	for _, table := range []string{"rate_limits", "rate_limit_log", "rate_limit_buckets"} {
+		if _, err := s.db.ExecContext(ctx, "DELETE FROM "+table+" WHERE key=$1", "otp:"+key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLite) RevokeUserTokens(ctx context.Context, userID int64, ttl time.Duration) error {
+	now := s.now()
+	// revoked_at used to be in seconds, revokedAt still reads those rows
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO token_revocations (user_id, revoked_at, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET revoked_at=excluded.revoked_at, expires_at=excluded.expires_at`,
+		userID, now.UnixMilli(), now.Add(ttl).UnixMilli())
+	return err
+}
+
+func (s *SQLite) TokensRevokedAt(ctx context.Context, userID int64) (time.Time, error) {
+	var ts int64
+	err := s.db.GetContext(ctx, &ts, `
+		SELECT revoked_at FROM token_revocations WHERE user_id=$1 AND expires_at > $2`,
+		userID, s.now().UnixMilli())
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return revokedAt(ts), nil
+}
+
+func (s *SQLite) ClearRevocation(ctx context.Context, userID int64) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM token_revocations WHERE user_id=$1", userID)
+	return err
+}
+
+// cleanupLoop periodically deletes expired otps, counters and revocations
+func (s *SQLite) cleanupLoop(interval time.Duration) {
+	defer s.done.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			if err := s.cleanup(context.Background()); err != nil {
+				log.Error().Err(err).Msg("sqlite cleanup failed")
+			}
+		}
+	}
+}
+
+func (s *SQLite) cleanup(ctx context.Context) error {
+	now := s.now().UnixMilli()
+	for _, table := range []string{"otps", "rate_limits", "rate_limit_log", "rate_limit_buckets", "token_revocations"} {
+		if _, err := s.db.ExecContext(ctx, "DELETE FROM "+table+" WHERE expires_at <= $1", now); err != nil {
+			return fmt.Errorf("purge %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func isSQLiteUniqueViolation(err error) bool {
+	var sqlErr *sqlite.Error
+	return errors.As(err, &sqlErr) &&
+		(sqlErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqlErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY)
+}
+
+var (
+	_ UserStore    = (*SQLite)(nil)
+	_ EventStore   = (*SQLite)(nil)
+	_ OTPStore     = (*SQLite)(nil)
+	_ RateLimiter  = (*SQLite)(nil)
+	_ TokenRevoker = (*SQLite)(nil)
+)
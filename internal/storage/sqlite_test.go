@@ -0,0 +1,660 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/model"
+)
+
+// newTestSQLite opens a fresh database whose clock only moves when advance is
+// called
+func newTestSQLite(t *testing.T) (*SQLite, func(time.Duration)) {
+	t.Helper()
+	s, err := NewSQLite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	return s, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestSQLiteOTPExpires(t *testing.T) {
+	s, advance := newTestSQLite(t)
+	ctx := context.Background()
+
+	s.SaveOTP(ctx, "+1555", "123456", time.Minute)
+	advance(time.Minute)
+	if ok, _ := s.VerifyAndDeleteOTP(ctx, "+1555", "123456"); ok {
+		t.Fatal("expired otp accepted")
+	}
+
+	s.SaveOTP(ctx, "+1555", "123456", time.Minute)
+	advance(59 * time.Second)
+	if ok, _ := s.VerifyAndDeleteOTP(ctx, "+1555", "000000"); ok {
+		t.Fatal("wrong otp accepted")
+	}
+	if ok, _ := s.VerifyAndDeleteOTP(ctx, "+1555", "123456"); !ok {
+		t.Fatal("valid otp rejected")
+	}
+	if ok, _ := s.VerifyAndDeleteOTP(ctx, "+1555", "123456"); ok {
+		t.Fatal("otp accepted twice")
+	}
+}
+
+func TestSQLiteRateLimitWindow(t *testing.T) {
+	s, advance := newTestSQLite(t)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if ok, err := s.AllowOTPRequest(ctx, "+1555", RateLimit{Max: 2, Window: time.Minute}); !ok || err != nil {
+			t.Fatalf("request %d denied: %v", i+1, err)
+		}
+	}
+	if ok, _ := s.AllowOTPRequest(ctx, "+1555", RateLimit{Max: 2, Window: time.Minute}); ok {
+		t.Fatal("request over limit allowed")
+	}
+	advance(time.Minute)
+	if ok, _ := s.AllowOTPRequest(ctx, "+1555", RateLimit{Max: 2, Window: time.Minute}); !ok {
+		t.Fatal("request denied after window reset")
+	}
+}
+
+func TestSQLiteCleanupRemovesExpiredRows(t *testing.T) {
+	s, advance := newTestSQLite(t)
+	ctx := context.Background()
+
+	s.SaveOTP(ctx, "+1555", "123456", time.Second)
+	s.SaveOTP(ctx, "+1666", "123456", time.Hour)
+	s.AllowOTPRequest(ctx, "+1555", RateLimit{Max: 1, Window: time.Second})
+	s.RevokeUserTokens(ctx, 1, time.Second)
+	advance(time.Minute)
+	if err := s.cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for table, want := range map[string]int{"otps": 1, "rate_limits": 0, "token_revocations": 0} {
+		var n int
+		if err := s.db.Get(&n, "SELECT COUNT(*) FROM "+table); err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("%s has %d rows, want %d", table, n, want)
+		}
+	}
+}
+
+func TestSQLiteRevokedTokensExpire(t *testing.T) {
+	s, advance := newTestSQLite(t)
+	ctx := context.Background()
+
+	advance(250 * time.Millisecond)
+	s.RevokeUserTokens(ctx, 7, time.Hour)
+	at, err := s.TokensRevokedAt(ctx, 7)
+	if err != nil || !at.Equal(s.now()) {
+		t.Fatalf("revoked at %v, %v", at, err)
+	}
+	advance(time.Hour)
+	if at, _ := s.TokensRevokedAt(ctx, 7); !at.IsZero() {
+		t.Fatalf("revocation still active at %v", at)
+	}
+}
+
+func TestSQLiteUsers(t *testing.T) {
+	s, _ := newTestSQLite(t)
+	ctx := context.Background()
+
+	a, err := s.CreateUser(ctx, "+1555")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Status != model.UserStatusActive || !a.RegisteredAt.Equal(s.now()) {
+		t.Fatalf("unexpected user %+v", a)
+	}
+	if _, err := s.CreateUser(ctx, "+1555"); err != ErrConflict {
+		t.Fatalf("duplicate phone: err = %v, want ErrConflict", err)
+	}
+	b, _ := s.CreateUser(ctx, "+1666")
+	if a.PublicID == "" || a.PublicID == b.PublicID {
+		t.Fatalf("public ids %q, %q", a.PublicID, b.PublicID)
+	}
+	if id, err := s.ResolvePublicID(ctx, b.PublicID); err != nil || id != b.ID {
+		t.Fatalf("resolve public id = %d, %v", id, err)
+	}
+	if _, err := s.UpdateUserPhone(ctx, b.ID, "+1555", b.ID); err != ErrConflict {
+		t.Fatalf("taken phone: err = %v, want ErrConflict", err)
+	}
+	if _, err := s.UpdateUserPhone(ctx, b.ID, "+1667", b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RedactPhoneHistory(ctx, b.ID); err != nil {
+		t.Fatal(err)
+	}
+	history, err := s.ListPhoneHistory(ctx, PhoneHistoryFilter{UserID: b.ID})
+	if err != nil || len(history) != 1 || history[0].OldPhone != "" || history[0].NewPhone != "" || history[0].UserPublicID != b.PublicID {
+		t.Fatalf("redacted history = %+v, %v", history, err)
+	}
+
+	if err := s.GrantRole(ctx, b.ID, model.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	roles, perms, err := s.GetUserAccess(ctx, b.ID)
+	if err != nil || len(roles) != 2 || len(perms) != 3 {
+		t.Fatalf("access = %v %v, %v", roles, perms, err)
+	}
+
+	if _, err := s.AddUserEmail(ctx, a.ID, "a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddUserEmail(ctx, b.ID, "a@example.com"); err != ErrConflict {
+		t.Fatalf("taken email: err = %v, want ErrConflict", err)
+	}
+	if u, err := s.FindUserByEmail(ctx, "a@example.com"); err != nil || u.ID != a.ID {
+		t.Fatalf("find by email = %+v, %v", u, err)
+	}
+
+	if _, err := s.AddUserNote(ctx, 999, b.ID, "hi"); err != ErrNotFound {
+		t.Fatalf("note on missing user: err = %v, want ErrNotFound", err)
+	}
+	n, err := s.AddUserNote(ctx, a.ID, b.ID, "hi")
+	if err != nil || n.UserPublicID != a.PublicID || n.AuthorPublicID != b.PublicID || n.Body != "hi" {
+		t.Fatalf("note = %+v, %v", n, err)
+	}
+	if notes, err := s.ListUserNotes(ctx, a.ID); err != nil || len(notes) != 1 || notes[0].AuthorPublicID != b.PublicID {
+		t.Fatalf("notes = %+v, %v", notes, err)
+	}
+	active := []string{model.UserStatusActive}
+	if err := s.ChangeUserStatus(ctx, a.ID, active, model.UserStatusBanned, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ChangeUserStatus(ctx, a.ID, active, model.UserStatusSuspended, ""); err != ErrConflict {
+		t.Fatalf("suspend banned user: err = %v, want ErrConflict", err)
+	}
+	if status, reason, _ := s.GetUserStatus(ctx, a.ID); status != model.UserStatusBanned || reason != "spam" {
+		t.Fatalf("status = %s %q, want banned", status, reason)
+	}
+	if err := s.ChangeUserStatus(ctx, 999, active, model.UserStatusBanned, ""); err != ErrNotFound {
+		t.Fatalf("missing user: err = %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteUser(ctx, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FindUserByPhone(ctx, "+1555"); err != ErrNotFound {
+		t.Fatalf("deleted user found: %v", err)
+	}
+	if _, err := s.FindUserByEmail(ctx, "a@example.com"); err != ErrNotFound {
+		t.Fatalf("email of deleted user found: %v", err)
+	}
+}
+
+func TestSQLiteListUsersCursor(t *testing.T) {
+	s, advance := newTestSQLite(t)
+	ctx := context.Background()
+
+	// a, b and c register an hour apart; b and c log in, c first
+	var ids []int64
+	for _, phone := range []string{"+1555", "+1666", "+1777"} {
+		u, err := s.CreateUser(ctx, phone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, u.ID)
+		advance(time.Hour)
+	}
+	s.RecordLogin(ctx, ids[2])
+	advance(time.Minute)
+	s.RecordLogin(ctx, ids[1])
+
+	walk := func(filter UserFilter, page UserPage) []int64 {
+		t.Helper()
+		page.Limit = 2
+		var got []int64
+		for {
+			list, err := s.ListUsers(ctx, filter, page)
+			if err != nil {
+				t.Fatalf("%+v: %v", page, err)
+			}
+			for _, u := range list.Users {
+				got = append(got, u.ID)
+			}
+			if list.NextCursor == "" {
+				return got
+			}
+			page.Cursor = list.NextCursor
+		}
+	}
+	for _, tc := range []struct {
+		page UserPage
+		want []int64
+	}{
+		{UserPage{}, []int64{ids[0], ids[1], ids[2]}},
+		{UserPage{Sort: UserSortID, Desc: true}, []int64{ids[2], ids[1], ids[0]}},
+		{UserPage{Sort: UserSortRegisteredAt, Desc: true}, []int64{ids[2], ids[1], ids[0]}},
+		{UserPage{Sort: UserSortLastLoginAt}, []int64{ids[0], ids[2], ids[1]}},
+		{UserPage{Sort: UserSortLastLoginAt, Desc: true}, []int64{ids[1], ids[2], ids[0]}},
+	} {
+		if got := walk(UserFilter{}, tc.page); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%+v: got %v, want %v", tc.page, got, tc.want)
+		}
+	}
+
+	from := time.Date(2025, 1, 1, 13, 0, 0, 0, time.UTC)
+	list, err := s.ListUsers(ctx, UserFilter{RegisteredFrom: from, RegisteredTo: from.Add(time.Hour)}, UserPage{Limit: 10, SkipTotal: true})
+	if err != nil || len(list.Users) != 1 || list.Users[0].ID != ids[1] || list.Total != nil {
+		t.Fatalf("registered range = %+v, %v", list, err)
+	}
+
+	first, _ := s.ListUsers(ctx, UserFilter{}, UserPage{Limit: 1})
+	if first.Total == nil || *first.Total != 3 {
+		t.Fatalf("total = %v", first.Total)
+	}
+	if _, err := s.ListUsers(ctx, UserFilter{}, UserPage{Limit: 1, Cursor: first.NextCursor, Desc: true}); !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("cursor for another order: err = %v", err)
+	}
+	s.DeleteUser(ctx, ids[0])
+	if _, err := s.ListUsers(ctx, UserFilter{}, UserPage{Limit: 1, Cursor: first.NextCursor}); !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("cursor on deleted user: err = %v", err)
+	}
+}
+
+func TestSQLitePhoneSearch(t *testing.T) {
+	s, _ := newTestSQLite(t)
+	ctx := context.Background()
+	s.CreateUser(ctx, "+15550001")
+	s.CreateUser(ctx, "+15551000")
+
+	for _, tc := range []struct {
+		filter UserFilter
+		want   int
+	}{
+		{UserFilter{Search: "555"}, 2},
+		{UserFilter{Search: "1000"}, 1},
+		{UserFilter{Search: "+1555", SearchMode: SearchPrefix}, 2},
+		{UserFilter{Search: "1555", SearchMode: SearchPrefix}, 0},
+		{UserFilter{Search: "+15550001", SearchMode: SearchExact}, 1},
+		{UserFilter{Search: "+1555", SearchMode: SearchExact}, 0},
+		// LIKE metacharacters match themselves
+		{UserFilter{Search: "_555"}, 0},
+		{UserFilter{Search: "5%1"}, 0},
+	} {
+		list, err := s.ListUsers(ctx, tc.filter, UserPage{Limit: 10})
+		if err != nil || len(list.Users) != tc.want {
+			t.Errorf("%+v: got %d users, want %d (%v)", tc.filter, len(list.Users), tc.want, err)
+		}
+	}
+}
+
+func TestSQLiteListDeletedUsers(t *testing.T) {
+	s, advance := newTestSQLite(t)
+	ctx := context.Background()
+
+	a, _ := s.CreateUser(ctx, "+1555")
+	b, _ := s.CreateUser(ctx, "+1666")
+	s.SetUserStatus(ctx, a.ID, model.UserStatusDeleted, "")
+	advance(time.Hour)
+	s.SetUserStatus(ctx, b.ID, model.UserStatusDeleted, "")
+	advance(time.Minute)
+
+	users, err := s.ListDeletedUsers(ctx, s.now().Add(-30*time.Minute))
+	if err != nil || len(users) != 1 || users[0].ID != a.ID || users[0].StatusChangedAt == nil {
+		t.Fatalf("deleted users = %+v, %v", users, err)
+	}
+}
+
+func TestSQLiteSCIMUsers(t *testing.T) {
+	s, _ := newTestSQLite(t)
+	ctx := context.Background()
+
+	create := func(tenant, phone, externalID string) *SCIMUser {
+		t.Helper()
+		u := SCIMUser{ExternalID: externalID}
+		u.Phone = phone
+		su, err := s.CreateSCIMUser(ctx, tenant, u)
+		if err != nil {
+			t.Fatalf("create %s in %s: %v", phone, tenant, err)
+		}
+		return su
+	}
+	a := create("acme", "+1555", "idp-a")
+	b := create("acme", "+1666", "")
+	c := create("globex", "+1777", "idp-a") // external ids are per tenant
+	s.CreateUser(ctx, "+1888")              // self-registered, in no tenant
+	if a.ExternalID != "idp-a" || a.Status != model.UserStatusActive {
+		t.Fatalf("created = %+v", a)
+	}
+
+	// a taken external id or phone number leaves nothing behind
+	taken := SCIMUser{ExternalID: "idp-a"}
+	taken.Phone = "+1999"
+	if _, err := s.CreateSCIMUser(ctx, "acme", taken); err != ErrExternalIDConflict {
+		t.Fatalf("taken external id: err = %v, want ErrExternalIDConflict", err)
+	}
+	if _, err := s.FindUserByPhone(ctx, "+1999"); err != ErrNotFound {
+		t.Fatalf("user left behind by a failed create: err = %v", err)
+	}
+	taken.Phone, taken.ExternalID = "+1555", "idp-x"
+	if _, err := s.CreateSCIMUser(ctx, "acme", taken); !errors.Is(err, ErrConflict) || errors.Is(err, ErrExternalIDConflict) {
+		t.Fatalf("taken phone: err = %v, want ErrConflict", err)
+	}
+
+	suspended := SCIMUser{}
+	suspended.Phone, suspended.DisplayName = "+1444", "Sue"
+	suspended.Status, suspended.StatusReason = model.UserStatusSuspended, "scim"
+	if su, err := s.CreateSCIMUser(ctx, "globex", suspended); err != nil || su.Status != model.UserStatusSuspended ||
+		su.DisplayName != "Sue" || su.StatusChangedAt == nil {
+		t.Fatalf("suspended = %+v, %v", su, err)
+	}
+	if err := s.SetSCIMExternalID(ctx, "acme", b.ID, "idp-a"); err != ErrConflict {
+		t.Fatalf("taken external id: err = %v, want ErrConflict", err)
+	}
+
+	users, total, err := s.ListSCIMUsers(ctx, "acme", SCIMFilter{}, 0, 10)
+	if err != nil || total != 2 || len(users) != 2 || users[0].ExternalID != "idp-a" || users[1].Phone != "+1666" {
+		t.Fatalf("acme users = %+v, %d, %v", users, total, err)
+	}
+	users, total, _ = s.ListSCIMUsers(ctx, "acme", SCIMFilter{}, 1, 1)
+	if total != 2 || len(users) != 1 || users[0].ID != b.ID {
+		t.Fatalf("second page = %+v, %d", users, total)
+	}
+	if u, err := s.GetSCIMUser(ctx, "acme", c.ID); err != ErrNotFound {
+		t.Fatalf("other tenant's user = %+v, %v", u, err)
+	}
+
+	s.SetUserStatus(ctx, a.ID, model.UserStatusSuspended, "")
+	active := true
+	users, total, _ = s.ListSCIMUsers(ctx, "acme", SCIMFilter{Active: &active}, 0, 10)
+	if total != 1 || users[0].ID != b.ID {
+		t.Fatalf("active users = %+v", users)
+	}
+	s.SetUserStatus(ctx, b.ID, model.UserStatusDeleted, "")
+	if _, err := s.GetSCIMUser(ctx, "acme", b.ID); err != ErrNotFound {
+		t.Fatalf("deleted user: err = %v, want ErrNotFound", err)
+	}
+	if _, total, _ := s.ListSCIMUsers(ctx, "acme", SCIMFilter{ExternalID: "idp-a"}, 0, 10); total != 1 {
+		t.Fatalf("external id filter total = %d, want 1", total)
+	}
+}
+
+func TestSQLiteTenants(t *testing.T) {
+	s, _ := newTestSQLite(t)
+	ctx := context.Background()
+	tenants := s.Tenants()
+
+	def, err := tenants.GetTenant(ctx, DefaultTenantID)
+	if err != nil || def.Slug != "default" || def.CreatedAt.IsZero() {
+		t.Fatalf("default tenant = %+v, %v", def, err)
+	}
+	length := 8
+	acme := &model.Tenant{Slug: "acme", Hosts: []string{"a.example", "b.example"}, OTPLength: &length}
+	if err := tenants.SaveTenant(ctx, acme); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenants.SaveTenant(ctx, &model.Tenant{Slug: "globex", Hosts: []string{"b.example"}}); err != ErrConflict {
+		t.Fatalf("taken host: err = %v, want ErrConflict", err)
+	}
+	if err := tenants.SetTenantAPIKey(ctx, "acme", "hash"); err != nil {
+		t.Fatal(err)
+	}
+	for _, lookup := range []func() (*model.Tenant, error){
+		func() (*model.Tenant, error) { return tenants.TenantByHost(ctx, "b.example") },
+		func() (*model.Tenant, error) { return tenants.TenantByAPIKey(ctx, "hash") },
+		func() (*model.Tenant, error) { return tenants.TenantBySlug(ctx, "acme") },
+	} {
+		got, err := lookup()
+		if err != nil || got.ID != acme.ID || len(got.Hosts) != 2 || got.OTPLength == nil || *got.OTPLength != 8 {
+			t.Fatalf("lookup = %+v, %v", got, err)
+		}
+	}
+
+	// the same phone number exists once per tenant
+	acmeCtx := WithTenant(ctx, acme.ID)
+	d, _ := s.CreateUser(ctx, "+1555")
+	a, created, err := s.FindOrCreateUser(acmeCtx, "+1555")
+	if err != nil || !created || a.ID == d.ID || a.TenantID != acme.ID {
+		t.Fatalf("acme user = %+v, %v, %v", a, created, err)
+	}
+	if _, err := s.CreateUser(acmeCtx, "+1555"); err != ErrConflict {
+		t.Fatalf("duplicate in tenant: err = %v, want ErrConflict", err)
+	}
+	if u, err := s.FindUserByPhone(ctx, "+1555"); err != nil || u.ID != d.ID {
+		t.Fatalf("default lookup = %+v, %v", u, err)
+	}
+	if _, err := s.ResolvePublicID(ctx, a.PublicID); err != ErrNotFound {
+		t.Fatalf("other tenant's public id: err = %v, want ErrNotFound", err)
+	}
+	list, err := s.ListUsers(acmeCtx, UserFilter{}, UserPage{Limit: 10})
+	if err != nil || len(list.Users) != 1 || list.Users[0].ID != a.ID {
+		t.Fatalf("acme users = %+v, %v", list, err)
+	}
+
+	// and so does an email address
+	for _, u := range []*model.User{d, a} {
+		if _, err := s.AddUserEmail(ctx, u.ID, "ada@example.com"); err != nil {
+			t.Fatalf("add email to tenant %d: %v", u.TenantID, err)
+		}
+	}
+	if u, err := s.FindUserByEmail(acmeCtx, "ada@example.com"); err != nil || u.ID != a.ID {
+		t.Fatalf("acme email lookup = %+v, %v", u, err)
+	}
+	if err := s.DeleteUserEmail(ctx, a.ID, "ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := s.FindUserByEmail(ctx, "ada@example.com"); err != nil || u.ID != d.ID {
+		t.Fatalf("default email lookup = %+v, %v", u, err)
+	}
+}
+
+func TestSQLiteFindOrCreateUserConcurrent(t *testing.T) {
+	s, _ := newTestSQLite(t)
+	ctx := context.Background()
+
+	type result struct {
+		id      int64
+		created bool
+		err     error
+	}
+	results := make(chan result, 8)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			u, created, err := s.FindOrCreateUser(ctx, "+1555")
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			results <- result{u.ID, created, nil}
+		}()
+	}
+
+	var id int64
+	created := 0
+	for i := 0; i < cap(results); i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if id != 0 && r.id != id {
+			t.Fatalf("got users %d and %d for one phone", id, r.id)
+		}
+		id = r.id
+		if r.created {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d calls reported creating the user, want 1", created)
+	}
+}
+
+func TestSQLiteAuthEventChain(t *testing.T) {
+	s, _ := newTestSQLite(t)
+	ctx := context.Background()
+
+	uid := int64(1)
+	for _, typ := range []string{model.EventOTPRequested, model.EventUserCreated, model.EventOTPVerified} {
+		e := &model.AuthEvent{Type: typ, UserID: &uid, Details: map[string]string{"k": "v"}}
+		if err := s.RecordAuthEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checked, _, err := s.VerifyAuthEvents(ctx)
+	if err != nil || checked != 3 {
+		t.Fatalf("verify: checked %d, err %v", checked, err)
+	}
+	events, err := s.ListUserAuthEvents(ctx, uid)
+	if err != nil || len(events) != 3 || events[2].Type != model.EventOTPVerified || events[2].Details["k"] != "v" {
+		t.Fatalf("user events = %+v, %v", events, err)
+	}
+
+	if _, err := s.db.Exec("UPDATE auth_events SET phone='+1999' WHERE id=2"); err == nil {
+		t.Fatal("update of auth_events allowed")
+	}
+	if _, err := s.db.Exec("DELETE FROM auth_events"); err == nil {
+		t.Fatal("delete from auth_events allowed")
+	}
+
+	// bypass the trigger to simulate tampering with the file
+	s.db.Exec("DROP TRIGGER auth_events_no_update")
+	s.db.Exec("UPDATE auth_events SET phone='+1999' WHERE id=2")
+	_, _, err = s.VerifyAuthEvents(ctx)
+	var chainErr *ChainError
+	if !errors.As(err, &chainErr) || chainErr.ID != 2 {
+		t.Fatalf("tampering not detected: %v", err)
+	}
+}
+
+func TestSQLiteAuthEventRedaction(t *testing.T) {
+	s, _ := newTestSQLite(t)
+	ctx := context.Background()
+
+	uid := int64(1)
+	for _, typ := range []string{model.EventOTPVerified, model.EventPhoneChanged} {
+		e := &model.AuthEvent{Type: typ, UserID: &uid, Phone: "+1555", Details: map[string]string{"old_phone": "+1444", "k": "v"}}
+		if err := s.RecordAuthEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := s.ListUserAuthEvents(ctx, uid)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("user events = %+v, %v", events, err)
+	}
+
+	// redact both rows into a phones_redacted event with id 3
+	var hashes []string
+	for i := range events {
+		e := &events[i]
+		redactPhone(e, nil, 3)
+		details, _ := json.Marshal(e.Details)
+		_, err := s.db.Exec("UPDATE auth_events SET phone='', details=$1, redacted_by=3 WHERE id=$2", string(details), e.ID)
+		if err != nil {
+			t.Fatalf("redact %d: %v", e.ID, err)
+		}
+		hashes = append(hashes, hashAuthEvent(e))
+	}
+	tombstone := &model.AuthEvent{Type: model.EventPhonesRedacted}
+	attestRedaction(tombstone, hashes)
+	if err := s.RecordAuthEvent(ctx, tombstone); err != nil || tombstone.ID != 3 {
+		t.Fatalf("tombstone id %d, err %v", tombstone.ID, err)
+	}
+	if n, _, err := s.VerifyAuthEvents(ctx); err != nil || n != 3 {
+		t.Fatalf("verify after redaction: checked %d, err %v", n, err)
+	}
+	events, _ = s.ListUserAuthEvents(ctx, uid)
+	if events[1].Phone != "" || events[1].Details["old_phone"] != "" || events[1].Details["k"] != "v" {
+		t.Fatalf("redacted event = %+v", events[1])
+	}
+
+	// a row is redacted once, and nothing else may change
+	if _, err := s.db.Exec("UPDATE auth_events SET details='{}', redacted_by=3 WHERE id=1"); err == nil {
+		t.Fatal("second redaction allowed")
+	}
+	if _, err := s.db.Exec("UPDATE auth_events SET ip='1.2.3.4' WHERE id=3"); err == nil {
+		t.Fatal("update of auth_events allowed")
+	}
+
+	s.db.Exec("DROP TRIGGER auth_events_no_update")
+	s.db.Exec("UPDATE auth_events SET details='{}' WHERE id=1")
+	_, _, err = s.VerifyAuthEvents(ctx)
+	var chainErr *ChainError
+	if !errors.As(err, &chainErr) || chainErr.ID != 3 {
+		t.Fatalf("tampering with a redacted row not detected: %v", err)
+	}
+}
+
+func TestSQLiteRedactUserAuthEvents(t *testing.T) {
+	s, _ := newTestSQLite(t)
+	testRedactUserAuthEvents(t, s)
+}
+
+func TestSQLiteClientApps(t *testing.T) {
+	s, advance := newTestSQLite(t)
+	ctx := context.Background()
+	apps := s.ClientApps()
+
+	key, prefix, hash, err := NewClientAppKey()
+	if err != nil || !strings.HasPrefix(key, ClientKeyPrefix) || !strings.HasPrefix(key, prefix) {
+		t.Fatalf("NewClientAppKey = %q, %q, %v", key, prefix, err)
+	}
+	max, window := 5, 60
+	app := &model.ClientApp{
+		TenantID:           DefaultTenantID,
+		Name:               "web",
+		KeyPrefix:          prefix,
+		AllowedOrigins:     model.StringList{"https://app.example"},
+		RateLimitMax:       &max,
+		RateLimitWindowSec: &window,
+	}
+	if err := apps.CreateClientApp(ctx, app, hash); err != nil || app.ID == 0 {
+		t.Fatalf("create: id %d, %v", app.ID, err)
+	}
+	if err := apps.CreateClientApp(ctx, &model.ClientApp{TenantID: DefaultTenantID, Name: "dup", KeyPrefix: prefix}, hash); err != ErrConflict {
+		t.Fatalf("duplicate key: err = %v, want ErrConflict", err)
+	}
+
+	got, err := apps.ClientAppByKey(ctx, HashClientAppKey(key))
+	if err != nil || got.ID != app.ID || len(got.AllowedOrigins) != 1 || *got.RateLimitMax != 5 || got.LastUsedAt != nil {
+		t.Fatalf("by key = %+v, %v", got, err)
+	}
+	if _, err := apps.ClientAppByKey(ctx, HashClientAppKey("otpk_unknown")); err != ErrNotFound {
+		t.Fatalf("unknown key: err = %v, want ErrNotFound", err)
+	}
+
+	// touches within a minute of the last recorded one are not written
+	first := s.now().Truncate(time.Second)
+	if err := apps.TouchClientApp(ctx, app.ID); err != nil {
+		t.Fatal(err)
+	}
+	advance(30 * time.Second)
+	apps.TouchClientApp(ctx, app.ID)
+	if got, _ := apps.ClientAppByKey(ctx, hash); got.LastUsedAt == nil || !got.LastUsedAt.Equal(first) {
+		t.Fatalf("last used = %v, want %v", got.LastUsedAt, first)
+	}
+	advance(time.Minute)
+	apps.TouchClientApp(ctx, app.ID)
+	if got, _ := apps.ClientAppByKey(ctx, hash); !got.LastUsedAt.Equal(s.now().Truncate(time.Second)) {
+		t.Fatalf("last used = %v, want %v", got.LastUsedAt, s.now())
+	}
+
+	if err := apps.RevokeClientApp(ctx, prefix); err != nil {
+		t.Fatal(err)
+	}
+	if err := apps.RevokeClientApp(ctx, prefix); err != ErrNotFound {
+		t.Fatalf("second revoke: err = %v, want ErrNotFound", err)
+	}
+	list, err := apps.ListClientApps(ctx, DefaultTenantID)
+	if err != nil || len(list) != 1 || list[0].RevokedAt == nil {
+		t.Fatalf("list = %+v, %v", list, err)
+	}
+}
+
+func TestSQLiteRateLimitAlgorithms(t *testing.T) {
+	s, advance := newTestSQLite(t)
+	testRateLimitAlgorithms(t, s, advance)
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/example/go-otp-auth/internal/model"
+	"github.com/google/uuid"
+)
+
+// UserStore persists users, their roles and admin notes. Lookups of missing
+// users return ErrNotFound.
+type UserStore interface {
+	FindUserByPhone(ctx context.Context, phone string) (*model.User, error)
+	CreateUser(ctx context.Context, phone string) (*model.User, error)
+	// FindOrCreateUser returns the user with phone, creating it if needed.
+	// created reports whether this call inserted it.
+	FindOrCreateUser(ctx context.Context, phone string) (user *model.User, created bool, err error)
+	GetUserByID(ctx context.Context, id int64) (*model.User, error)
+	// ResolvePublicID maps the id shown to clients to the internal id
+	ResolvePublicID(ctx context.Context, publicID string) (int64, error)
+	GetUserStatus(ctx context.Context, id int64) (status, reason string, err error)
+	ListUsers(ctx context.Context, filter UserFilter, page UserPage) (*UserList, error)
+	GetUserAccess(ctx context.Context, userID int64) (roles, permissions []string, err error)
+	SetUserStatus(ctx context.Context, id int64, status, reason string) error
+	// ChangeUserStatus is SetUserStatus for a user currently in one of the
+	// statuses from, checked in the same statement. It returns ErrConflict
+	// if the user is in another status.
+	ChangeUserStatus(ctx context.Context, id int64, from []string, status, reason string) error
+	UpdateUserProfile(ctx context.Context, id int64, p model.ProfileUpdate) (*model.User, error)
+	// RecordLogin bumps login_count and last_login_at and returns the user
+	RecordLogin(ctx context.Context, id int64) (*model.User, error)
+	// UpdateUserPhone changes the phone number and records it in the
+	// phone history in one transaction
+	UpdateUserPhone(ctx context.Context, id int64, phone string, actorID int64) (*model.User, error)
+	ListPhoneHistory(ctx context.Context, filter PhoneHistoryFilter) ([]model.PhoneChange, error)
+	// RedactPhoneHistory removes the numbers from the phone changes of a
+	// purged user. The changes themselves are kept.
+	RedactPhoneHistory(ctx context.Context, userID int64) error
+	// ListDeletedUsers returns users whose status became deleted before
+	// cutoff
+	ListDeletedUsers(ctx context.Context, cutoff time.Time) ([]model.User, error)
+	DeleteUser(ctx context.Context, id int64) error
+	AddUserNote(ctx context.Context, userID, authorID int64, body string) (*model.UserNote, error)
+	ListUserNotes(ctx context.Context, userID int64) ([]model.UserNote, error)
+
+	// Verified email identities. Addresses are stored normalized by the caller.
+	FindUserByEmail(ctx context.Context, email string) (*model.User, error)
+	AddUserEmail(ctx context.Context, userID int64, email string) (*model.UserEmail, error)
+	ListUserEmails(ctx context.Context, userID int64) ([]model.UserEmail, error)
+	DeleteUserEmail(ctx context.Context, userID int64, email string) error
+}
+
+// EventStore is the append-only, hash-chained auth event log
+type EventStore interface {
+	RecordAuthEvent(ctx context.Context, e *model.AuthEvent) error
+	VerifyAuthEvents(ctx context.Context) (checked int64, head string, err error)
+	ListUserAuthEvents(ctx context.Context, userID int64) ([]model.AuthEvent, error)
+	// RedactUserAuthEvents removes the phone numbers of a purged user, who
+	// held phones, from the log and returns the number of rows redacted
+	RedactUserAuthEvents(ctx context.Context, userID int64, phones []string) (int, error)
+}
+
+// OTPStore keeps one-time codes until they are used or expire
+type OTPStore interface {
+	SaveOTP(ctx context.Context, phone, code string, ttl time.Duration) error
+	VerifyAndDeleteOTP(ctx context.Context, phone, code string) (bool, error)
+	DeleteOTP(ctx context.Context, phone string) error
+}
+
+// RateLimiter counts requests per key under a rate limit
+type RateLimiter interface {
+	// AllowOTPRequest counts a request against key and reports whether it
+	// is within limit. Keys are separate per algorithm.
+	AllowOTPRequest(ctx context.Context, key string, limit RateLimit) (bool, error)
+	// ResetOTPRequests drops the state of key under every algorithm
+	ResetOTPRequests(ctx context.Context, key string) error
+}
+
+// TokenRevoker records when all tokens of a user were invalidated
+type TokenRevoker interface {
+	RevokeUserTokens(ctx context.Context, userID int64, ttl time.Duration) error
+	TokensRevokedAt(ctx context.Context, userID int64) (time.Time, error)
+	// ClearRevocation drops the revocation marker of a purged user
+	ClearRevocation(ctx context.Context, userID int64) error
+}
+
+// SCIMStore links users to the tenant that provisioned them over SCIM. A
+// tenant only sees its own users, and never deleted ones.
+type SCIMStore interface {
+	// CreateSCIMUser creates a user with the phone, display name and status
+	// of u and records that tenant provisioned it under u's external id, all
+	// or nothing. A phone number already registered is ErrConflict, an
+	// external id already used within the tenant ErrExternalIDConflict.
+	CreateSCIMUser(ctx context.Context, tenant string, u SCIMUser) (*SCIMUser, error)
+	SetSCIMExternalID(ctx context.Context, tenant string, userID int64, externalID string) error
+	GetSCIMUser(ctx context.Context, tenant string, userID int64) (*SCIMUser, error)
+	// ListSCIMUsers returns up to limit users in id order, starting offset
+	// users in, and the number of users matching filter
+	ListSCIMUsers(ctx context.Context, tenant string, filter SCIMFilter, offset, limit int) ([]SCIMUser, int, error)
+}
+
+// TenantStore holds the brands served by the deployment and how requests
+// are matched to them. Hosts and API keys select at most one tenant.
+type TenantStore interface {
+	GetTenant(ctx context.Context, id int64) (*model.Tenant, error)
+	TenantBySlug(ctx context.Context, slug string) (*model.Tenant, error)
+	TenantByHost(ctx context.Context, host string) (*model.Tenant, error)
+	// TenantByAPIKey looks a tenant up by the hex SHA-256 of its API key
+	TenantByAPIKey(ctx context.Context, keyHash string) (*model.Tenant, error)
+	ListTenants(ctx context.Context) ([]model.Tenant, error)
+	// SaveTenant creates the tenant or updates the one with the same slug,
+	// replacing its hosts and setting t.ID. A host already used by another
+	// tenant is ErrConflict.
+	SaveTenant(ctx context.Context, t *model.Tenant) error
+	SetTenantAPIKey(ctx context.Context, slug, keyHash string) error
+}
+
+// ClientAppStore holds the applications allowed to call the OTP endpoints
+// and the hashes of their API keys
+type ClientAppStore interface {
+	// CreateClientApp stores app with the hash of its key and sets its ID.
+	// A key prefix already in use is ErrConflict.
+	CreateClientApp(ctx context.Context, app *model.ClientApp, keyHash string) error
+	// ClientAppByKey returns the app with the key hash, revoked or not
+	ClientAppByKey(ctx context.Context, keyHash string) (*model.ClientApp, error)
+	ListClientApps(ctx context.Context, tenantID int64) ([]model.ClientApp, error)
+	// RevokeClientApp revokes the key with keyPrefix for good. An unknown or
+	// already revoked key is ErrNotFound.
+	RevokeClientApp(ctx context.Context, keyPrefix string) error
+	// TouchClientApp records that the app's key was used. It writes at most
+	// once a minute per app.
+	TouchClientApp(ctx context.Context, id int64) error
+}
+
+// NewPublicID returns a new public user id: a UUIDv7, which is opaque to
+// clients but keeps inserts into the unique index roughly in order
+func NewPublicID() string {
+	return uuid.Must(uuid.NewV7()).String()
+}
+
+// Stores bundles the backends used by the API
+type Stores struct {
+	Users   UserStore
+	Events  EventStore
+	OTPs    OTPStore
+	Limiter RateLimiter
+	Revoker TokenRevoker
+	SCIM    SCIMStore
+	Tenants TenantStore
+	Apps    ClientAppStore
+}
+
+var (
+	_ UserStore      = (*Postgres)(nil)
+	_ EventStore     = (*Postgres)(nil)
+	_ SCIMStore      = (*Postgres)(nil)
+	_ TenantStore    = (*sqlTenants)(nil)
+	_ ClientAppStore = (*sqlClientApps)(nil)
+	_ OTPStore       = (*Redis)(nil)
+	_ RateLimiter    = (*Redis)(nil)
+	_ TokenRevoker   = (*Redis)(nil)
+)
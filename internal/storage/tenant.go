@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/example/go-otp-auth/internal/model"
+)
+
+// DefaultTenantID is the tenant of requests that match no other tenant, and
+// of every user created before tenants existed
+const DefaultTenantID int64 = 1
+
+type tenantKey struct{}
+
+// WithTenant returns a context whose phone, email and public id lookups,
+// user creation and listings are limited to tenant id
+func WithTenant(ctx context.Context, id int64) context.Context {
+	return context.WithValue(ctx, tenantKey{}, id)
+}
+
+// TenantFromContext returns the tenant set by WithTenant, or the default
+// tenant
+func TenantFromContext(ctx context.Context) int64 {
+	if id, ok := ctx.Value(tenantKey{}).(int64); ok {
+		return id
+	}
+	return DefaultTenantID
+}
+
+const tenantColumns = "id, slug, name, otp_length, otp_ttl_seconds, rate_limit_max, " +
+	"rate_limit_window_seconds, otp_message_template, token_ttl_seconds, signing_key, created_at"
+
+// sqlTenants is the TenantStore of both SQL backends, which differ only in
+// how they report unique violations
+type sqlTenants struct {
+	db     *sqlx.DB
+	unique func(error) bool
+}
+
+// Tenants returns the tenant store backed by p
+func (p *Postgres) Tenants() TenantStore {
+	return &sqlTenants{db: p.db, unique: isUniqueViolation}
+}
+
+func (s *sqlTenants) get(ctx context.Context, cond string, arg interface{}) (*model.Tenant, error) {
+	var t model.Tenant
+	err := s.db.GetContext(ctx, &t, "SELECT "+tenantColumns+" FROM tenants WHERE "+cond, arg)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.Hosts = []string{}
+	err = s.db.SelectContext(ctx, &t.Hosts, "SELECT host FROM tenant_hosts WHERE tenant_id=$1 ORDER BY host", t.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *sqlTenants) GetTenant(ctx context.Context, id int64) (*model.Tenant, error) {
+	return s.get(ctx, "id=$1", id)
+}
+
+func (s *sqlTenants) TenantBySlug(ctx context.Context, slug string) (*model.Tenant, error) {
+	return s.get(ctx, "slug=$1", slug)
+}
+
+func (s *sqlTenants) TenantByHost(ctx context.Context, host string) (*model.Tenant, error) {
+	return s.get(ctx, "id = (SELECT tenant_id FROM tenant_hosts WHERE host=$1)", host)
+}
+
+func (s *sqlTenants) TenantByAPIKey(ctx context.Context, keyHash string) (*model.Tenant, error) {
+	return s.get(ctx, "api_key_hash=$1", keyHash)
+}
+
+func (s *sqlTenants) ListTenants(ctx context.Context) ([]model.Tenant, error) {
+	var ids []int64
+	if err := s.db.SelectContext(ctx, &ids, "SELECT id FROM tenants ORDER BY id"); err != nil {
+		return nil, err
+	}
+	tenants := make([]model.Tenant, 0, len(ids))
+	for _, id := range ids {
+		t, err := s.GetTenant(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, *t)
+	}
+	return tenants, nil
+}
+
+func (s *sqlTenants) SaveTenant(ctx context.Context, t *model.Tenant) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.GetContext(ctx, &t.ID, `
+		INSERT INTO tenants (slug, name, otp_length, otp_ttl_seconds, rate_limit_max, rate_limit_window_seconds,
+			otp_message_template, token_ttl_seconds, signing_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (slug) DO UPDATE SET name=excluded.name, otp_length=excluded.otp_length,
+			otp_ttl_seconds=excluded.otp_ttl_seconds, rate_limit_max=excluded.rate_limit_max,
+			rate_limit_window_seconds=excluded.rate_limit_window_seconds,
+			otp_message_template=excluded.otp_message_template, token_ttl_seconds=excluded.token_ttl_seconds,
+			signing_key=excluded.signing_key
+		RETURNING id`,
+		t.Slug, t.Name, t.OTPLength, t.OTPTTLSeconds, t.RateLimitMax, t.RateLimitWindowSec,
+		t.OTPMessageTemplate, t.TokenTTLSeconds, t.SigningKey)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tenant_hosts WHERE tenant_id=$1", t.ID); err != nil {
+		return err
+	}
+	for _, host := range t.Hosts {
+		_, err := tx.ExecContext(ctx, "INSERT INTO tenant_hosts (host, tenant_id) VALUES ($1, $2)", host, t.ID)
+		if s.unique(err) {
+			return ErrConflict
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlTenants) SetTenantAPIKey(ctx context.Context, slug, keyHash string) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE tenants SET api_key_hash=$1 WHERE slug=$2", keyHash, slug)
+	if s.unique(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	return expectRow(res)
+}
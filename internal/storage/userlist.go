@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Phone search modes of UserFilter
+const (
+	SearchContains = "contains"
+	SearchPrefix   = "prefix"
+	SearchExact    = "exact"
+)
+
+// ValidSearchMode reports whether m is a known phone search mode
+func ValidSearchMode(m string) bool {
+	switch m {
+	case SearchContains, SearchPrefix, SearchExact:
+		return true
+	}
+	return false
+}
+
+// ListedUser is the summary of a user returned by ListUsers and ExportUsers:
+// the public fields with timestamps already formatted, without roles, emails
+// or profile
+type ListedUser struct {
+	ID           int64   `db:"id" json:"-"`
+	PublicID     string  `db:"public_id" json:"id"`
+	Phone        string  `db:"phone" json:"phone"`
+	Status       string  `db:"status" json:"status"`
+	RegisteredAt string  `db:"registered_at" json:"registered_at"`
+	LastLoginAt  *string `db:"last_login_at" json:"last_login_at,omitempty"`
+}
+
+// ErrSearchUnsupported is returned by ListUsers for a prefix search while
+// phone numbers are encrypted: only the ends of numbers are indexed
+var ErrSearchUnsupported = errors.New("prefix search is not available for encrypted phone numbers")
+
+// likeEscaper escapes LIKE metacharacters for patterns used with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (filter UserFilter) searchMode() string {
+	if filter.SearchMode == "" {
+		return SearchContains
+	}
+	return filter.SearchMode
+}
+
+// phonePattern is the LIKE pattern for a contains or prefix search
+func (filter UserFilter) phonePattern() string {
+	p := likeEscaper.Replace(filter.Search) + "%"
+	if filter.searchMode() == SearchPrefix {
+		return p
+	}
+	return "%" + p
+}
+
+// ListUsers sort orders. Ties are broken by id, which follows registration
+// order.
+const (
+	UserSortID           = "id"
+	UserSortRegisteredAt = "registered_at"
+	UserSortLastLoginAt  = "last_login_at"
+)
+
+// ValidUserSort reports whether s is a known ListUsers sort order
+func ValidUserSort(s string) bool {
+	switch s {
+	case UserSortID, UserSortRegisteredAt, UserSortLastLoginAt:
+		return true
+	}
+	return false
+}
+
+// ErrInvalidCursor is returned by ListUsers for a cursor that is malformed,
+// was issued for another sort order, or names a user that no longer exists
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// neverLoggedIn stands in for a NULL last_login_at when sorting in
+// Postgres, so users who never logged in come first in ascending order
+var neverLoggedIn = time.Unix(0, 0).UTC()
+
+// UserPage selects one page of ListUsers. A page continues after the cursor
+// of the previous one; without a cursor it starts Offset users in, which
+// keeps the old page/size parameters working.
+type UserPage struct {
+	Sort   string // UserSortID when empty
+	Desc   bool
+	Limit  int
+	Cursor string // NextCursor of the previous page
+	Offset int    // ignored with a cursor
+	// SkipTotal leaves out the count of matching users, which needs a
+	// full scan of them
+	SkipTotal bool
+}
+
+func (p UserPage) sort() string {
+	if p.Sort == "" {
+		return UserSortID
+	}
+	return p.Sort
+}
+
+// direction returns the SQL sort direction and keyset comparison
+func (p UserPage) direction() (string, string) {
+	if p.Desc {
+		return "DESC", "<"
+	}
+	return "ASC", ">"
+}
+
+// UserList is one page of users
+type UserList struct {
+	Users []ListedUser
+	// Total counts every matching user; nil with SkipTotal
+	Total *int
+	// NextCursor continues after the last user; empty on the last page
+	NextCursor string
+}
+
+// userCursor is the decoded form of a cursor. It names the last user of the
+// page by public id, so internal ids are not handed out.
+type userCursor struct {
+	Sort string `json:"s"`
+	Desc bool   `json:"d,omitempty"`
+	Key  string `json:"k,omitempty"` // sort value of the last user
+	ID   string `json:"id"`
+}
+
+func (c userCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeUserCursor returns nil without a cursor
+func decodeUserCursor(page UserPage) (*userCursor, error) {
+	if page.Cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(page.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c userCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	if c.Sort != page.sort() || c.Desc != page.Desc {
+		return nil, fmt.Errorf("%w: issued for another sort order", ErrInvalidCursor)
+	}
+	if c.Key != "" {
+		if _, err := time.Parse(time.RFC3339Nano, c.Key); err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+	return &c, nil
+}
+
+// keyTime is the cursor's sort value, the zero time for a user who never
+// logged in
+func (c *userCursor) keyTime() time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, c.Key)
+	return t
+}
+
+// finishUserPage trims the extra row fetched to detect a following page and
+// sets the cursor to continue after the last user
+func finishUserPage(page UserPage, users []ListedUser) *UserList {
+	list := &UserList{Users: users}
+	if len(users) <= page.Limit {
+		return list
+	}
+	list.Users = users[:page.Limit]
+	last := list.Users[page.Limit-1]
+	c := userCursor{Sort: page.sort(), Desc: page.Desc, ID: last.PublicID}
+	switch c.Sort {
+	case UserSortRegisteredAt:
+		c.Key = last.RegisteredAt
+	case UserSortLastLoginAt:
+		if last.LastLoginAt != nil {
+			c.Key = *last.LastLoginAt
+		}
+	}
+	list.NextCursor = c.encode()
+	return list
+}
+
+// userKeyset returns the ORDER BY clause for page and, after a cursor, the
+// condition selecting the users that follow it. keyExpr is the SQL sort
+// value, empty when sorting by id; key is the cursor's value of it and
+// afterID the internal id of the cursor's user.
+func userKeyset(page UserPage, keyExpr string, c *userCursor, key interface{}, afterID int64, args []interface{}) (string, string, []interface{}) {
+	dir, cmp := page.direction()
+	if keyExpr == "" {
+		order := "ORDER BY id " + dir
+		if c == nil {
+			return "", order, args
+		}
+		args = append(args, afterID)
+		return fmt.Sprintf("id %s $%d", cmp, len(args)), order, args
+	}
+	order := fmt.Sprintf("ORDER BY %s %s, id %s", keyExpr, dir, dir)
+	if c == nil {
+		return "", order, args
+	}
+	args = append(args, key, afterID)
+	return fmt.Sprintf("(%s, id) %s ($%d, $%d)", keyExpr, cmp, len(args)-1, len(args)), order, args
+}
@@ -7,13 +7,18 @@ import (
 
 // Generate a secure 6-digit OTP
 func GenerateOTP() (string, error) {
+    return GenerateOTPLength(6)
+}
+
+// GenerateOTPLength generates a secure OTP of n digits
+func GenerateOTPLength(n int) (string, error) {
     const digits = "0123456789"
-    b := make([]byte, 6)
+    b := make([]byte, n)
     _, err := rand.Read(b)
     if err != nil {
         return "", err
     }
-    for i := 0; i < 6; i++ {
+    for i := 0; i < n; i++ {
         b[i] = digits[int(b[i])%10]
     }
     return fmt.Sprintf("%s", string(b)), nil
@@ -0,0 +1,48 @@
+package util
+
+import "strings"
+
+// E.164 numbers have at most 15 digits; shorter than 7 is no phone number
+const (
+	minPhoneDigits = 7
+	maxPhoneDigits = 15
+)
+
+// phoneSeparators are dropped from phone numbers, so "+1 (555) 000-1" and
+// "+15550001" are the same number
+var phoneSeparators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+
+// CleanPhone drops separators and turns an international 00 prefix into +
+func CleanPhone(phone string) string {
+	phone = phoneSeparators.Replace(strings.TrimSpace(phone))
+	if strings.HasPrefix(phone, "00") {
+		phone = "+" + phone[2:]
+	}
+	return phone
+}
+
+// PhoneDigits reports whether phone is a non-empty run of digits with an
+// optional leading +
+func PhoneDigits(phone string) bool {
+	phone = strings.TrimPrefix(phone, "+")
+	if phone == "" {
+		return false
+	}
+	for _, c := range phone {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizePhone validates a phone number and returns it without
+// separators. Every phone number is stored and looked up in this form.
+func NormalizePhone(phone string) (string, bool) {
+	phone = CleanPhone(phone)
+	n := len(strings.TrimPrefix(phone, "+"))
+	if !PhoneDigits(phone) || n < minPhoneDigits || n > maxPhoneDigits {
+		return "", false
+	}
+	return phone, true
+}
@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS roles (
+  name TEXT PRIMARY KEY,
+  description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+  role TEXT NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+  permission TEXT NOT NULL,
+  PRIMARY KEY (role, permission)
+);
+
+-- the "user" role is implicit and never stored here
+CREATE TABLE IF NOT EXISTS user_roles (
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  role TEXT NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+  granted_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  PRIMARY KEY (user_id, role)
+);
+
+INSERT INTO roles (name, description) VALUES
+  ('user', 'Regular end user'),
+  ('support', 'Customer support staff'),
+  ('admin', 'Full administrative access')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+  ('user', 'profile:read'),
+  ('support', 'profile:read'),
+  ('support', 'users:read'),
+  ('admin', 'profile:read'),
+  ('admin', 'users:read'),
+  ('admin', 'users:write')
+ON CONFLICT (role, permission) DO NOTHING;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS user_notes;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_status_check;
+ALTER TABLE users DROP COLUMN IF EXISTS status;
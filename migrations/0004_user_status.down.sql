@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS users_status_idx;
+
+-- banned and deleted did not exist before this migration
+UPDATE users SET status = 'suspended' WHERE status IN ('banned', 'deleted');
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_status_check;
+ALTER TABLE users ADD CONSTRAINT users_status_check CHECK (status IN ('active', 'suspended'));
+
+ALTER TABLE users DROP COLUMN IF EXISTS status_changed_at;
+ALTER TABLE users DROP COLUMN IF EXISTS status_reason;
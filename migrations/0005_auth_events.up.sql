@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS auth_events (
+  id BIGINT PRIMARY KEY,
+  event_type TEXT NOT NULL,
+  user_id BIGINT,
+  actor_id BIGINT,
+  phone TEXT NOT NULL DEFAULT '',
+  ip TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  request_id TEXT NOT NULL DEFAULT '',
+  details JSONB NOT NULL DEFAULT '{}',
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+  prev_hash TEXT NOT NULL,
+  hash TEXT NOT NULL UNIQUE
+);
+CREATE SEQUENCE IF NOT EXISTS auth_events_id_seq OWNED BY auth_events.id;
+CREATE INDEX IF NOT EXISTS auth_events_user_id_idx ON auth_events (user_id);
+
+-- auth_events is append-only
+CREATE OR REPLACE FUNCTION auth_events_immutable() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'auth_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS auth_events_no_update ON auth_events;
+CREATE TRIGGER auth_events_no_update
+  BEFORE UPDATE OR DELETE OR TRUNCATE ON auth_events
+  FOR EACH STATEMENT EXECUTE FUNCTION auth_events_immutable();
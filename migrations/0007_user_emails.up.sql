@@ -0,0 +1,7 @@
+-- verified email addresses; a user may log in with any of them
+CREATE TABLE IF NOT EXISTS user_emails (
+  email TEXT PRIMARY KEY,
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  verified_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS user_emails_user_id_idx ON user_emails (user_id);
@@ -0,0 +1,13 @@
+-- no foreign keys: support must be able to trace who owned a number even
+-- after the user is gone
+CREATE TABLE IF NOT EXISTS phone_history (
+  id BIGSERIAL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  old_phone TEXT NOT NULL,
+  new_phone TEXT NOT NULL,
+  actor_id BIGINT NOT NULL,
+  changed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS phone_history_user_id_idx ON phone_history (user_id);
+CREATE INDEX IF NOT EXISTS phone_history_old_phone_idx ON phone_history (old_phone);
+CREATE INDEX IF NOT EXISTS phone_history_new_phone_idx ON phone_history (new_phone);
@@ -0,0 +1,8 @@
+-- fails while any number is stored encrypted
+ALTER TABLE users ALTER COLUMN phone SET NOT NULL;
+DROP TABLE IF EXISTS user_phone_suffixes;
+DROP INDEX IF EXISTS users_phone_key_id_idx;
+DROP INDEX IF EXISTS users_phone_index_key;
+ALTER TABLE users DROP COLUMN IF EXISTS phone_index;
+ALTER TABLE users DROP COLUMN IF EXISTS phone_key_id;
+ALTER TABLE users DROP COLUMN IF EXISTS phone_ct;
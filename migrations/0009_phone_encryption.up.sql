@@ -0,0 +1,18 @@
+-- With a keyring configured the plaintext phone is NULL and the number is
+-- kept in phone_ct, encrypted under the key phone_key_id. phone_index is a
+-- keyed hash for exact lookups.
+ALTER TABLE users ALTER COLUMN phone DROP NOT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone_ct BYTEA;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone_key_id TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone_index BYTEA;
+CREATE UNIQUE INDEX IF NOT EXISTS users_phone_index_key ON users (phone_index);
+-- finds rows still in plaintext or under an old key
+CREATE INDEX IF NOT EXISTS users_phone_key_id_idx ON users (phone_key_id);
+
+-- keyed hashes of every suffix of an encrypted number, for partial search
+CREATE TABLE IF NOT EXISTS user_phone_suffixes (
+  token BYTEA NOT NULL,
+  user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  PRIMARY KEY (token, user_id)
+);
+CREATE INDEX IF NOT EXISTS user_phone_suffixes_user_id_idx ON user_phone_suffixes (user_id);
@@ -0,0 +1,7 @@
+-- Opaque id shown to clients and used as the token subject. The application
+-- assigns UUIDv7s; existing users get random ones.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS public_id UUID;
+UPDATE users SET public_id = gen_random_uuid() WHERE public_id IS NULL;
+ALTER TABLE users ALTER COLUMN public_id SET DEFAULT gen_random_uuid();
+ALTER TABLE users ALTER COLUMN public_id SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS users_public_id_key ON users (public_id);
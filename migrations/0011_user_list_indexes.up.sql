@@ -0,0 +1,4 @@
+-- Keyset pagination of the user listing. The last login expression must
+-- match the one ListUsers sorts by.
+CREATE INDEX IF NOT EXISTS users_registered_at_idx ON users (registered_at, id);
+CREATE INDEX IF NOT EXISTS users_last_login_at_idx ON users ((COALESCE(last_login_at, to_timestamp(0))), id);
@@ -0,0 +1,2 @@
+-- the extension is left in place; other objects may depend on it
+DROP INDEX IF EXISTS users_phone_trgm_idx;
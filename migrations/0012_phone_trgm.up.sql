@@ -0,0 +1,4 @@
+-- Contains and prefix searches of plaintext phone numbers. Creating the
+-- extension needs a role allowed to do so.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS users_phone_trgm_idx ON users USING gin (phone gin_trgm_ops);
@@ -0,0 +1,10 @@
+-- users provisioned over SCIM, with the tenant whose identity provider
+-- created them. Each tenant only sees its own users.
+CREATE TABLE IF NOT EXISTS scim_users (
+  user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  tenant TEXT NOT NULL,
+  external_id TEXT,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS scim_users_external_id_key ON scim_users (tenant, external_id);
+CREATE INDEX IF NOT EXISTS scim_users_tenant_idx ON scim_users (tenant, user_id);
@@ -0,0 +1,8 @@
+-- fails if the same phone number was registered in two tenants
+DROP INDEX IF EXISTS users_tenant_phone_index_key;
+DROP INDEX IF EXISTS users_tenant_phone_key;
+CREATE UNIQUE INDEX IF NOT EXISTS users_phone_index_key ON users (phone_index);
+ALTER TABLE users ADD CONSTRAINT users_phone_key UNIQUE (phone);
+ALTER TABLE users DROP COLUMN IF EXISTS tenant_id;
+DROP TABLE IF EXISTS tenant_hosts;
+DROP TABLE IF EXISTS tenants;
@@ -0,0 +1,33 @@
+-- Brands served by one deployment. NULL policy columns fall back to the
+-- service configuration; tenant 1 is the default tenant every existing user
+-- belongs to.
+CREATE TABLE IF NOT EXISTS tenants (
+  id BIGSERIAL PRIMARY KEY,
+  slug TEXT NOT NULL UNIQUE,
+  name TEXT NOT NULL DEFAULT '',
+  -- hex SHA-256 of the tenant's API key
+  api_key_hash TEXT UNIQUE,
+  otp_length INT,
+  otp_ttl_seconds INT,
+  rate_limit_max INT,
+  rate_limit_window_seconds INT,
+  otp_message_template TEXT,
+  token_ttl_seconds INT,
+  signing_key TEXT,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+INSERT INTO tenants (id, slug, name) VALUES (1, 'default', 'Default') ON CONFLICT DO NOTHING;
+SELECT setval(pg_get_serial_sequence('tenants', 'id'), GREATEST((SELECT max(id) FROM tenants), 1));
+
+CREATE TABLE IF NOT EXISTS tenant_hosts (
+  host TEXT PRIMARY KEY,
+  tenant_id BIGINT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS tenant_hosts_tenant_id_idx ON tenant_hosts (tenant_id);
+
+-- a phone number is unique within its tenant only
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id BIGINT NOT NULL DEFAULT 1 REFERENCES tenants(id);
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_phone_key;
+DROP INDEX IF EXISTS users_phone_index_key;
+CREATE UNIQUE INDEX IF NOT EXISTS users_tenant_phone_key ON users (tenant_id, phone);
+CREATE UNIQUE INDEX IF NOT EXISTS users_tenant_phone_index_key ON users (tenant_id, phone_index);
@@ -0,0 +1,17 @@
+-- Applications allowed to call the OTP endpoints. key_hash is the hex
+-- SHA-256 of the API key; key_prefix is its start, kept to identify it.
+CREATE TABLE IF NOT EXISTS client_apps (
+  id BIGSERIAL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  key_prefix TEXT NOT NULL UNIQUE,
+  key_hash TEXT NOT NULL UNIQUE,
+  -- space-separated; empty allows any origin
+  allowed_origins TEXT NOT NULL DEFAULT '',
+  rate_limit_max INT,
+  rate_limit_window_seconds INT,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+  last_used_at TIMESTAMP WITH TIME ZONE,
+  revoked_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS client_apps_tenant_id_idx ON client_apps (tenant_id);
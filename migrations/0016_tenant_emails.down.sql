@@ -0,0 +1,4 @@
+-- fails if the same email was verified in two tenants
+ALTER TABLE user_emails DROP CONSTRAINT IF EXISTS user_emails_pkey;
+ALTER TABLE user_emails ADD PRIMARY KEY (email);
+ALTER TABLE user_emails DROP COLUMN IF EXISTS tenant_id;
@@ -0,0 +1,6 @@
+-- an email is unique within its tenant only, like a phone number
+ALTER TABLE user_emails ADD COLUMN IF NOT EXISTS tenant_id BIGINT REFERENCES tenants(id);
+UPDATE user_emails e SET tenant_id = u.tenant_id FROM users u WHERE u.id = e.user_id;
+ALTER TABLE user_emails ALTER COLUMN tenant_id SET NOT NULL;
+ALTER TABLE user_emails DROP CONSTRAINT IF EXISTS user_emails_pkey;
+ALTER TABLE user_emails ADD PRIMARY KEY (tenant_id, email);
@@ -0,0 +1,22 @@
+DROP TRIGGER IF EXISTS auth_events_no_delete ON auth_events;
+DROP TRIGGER IF EXISTS auth_events_no_update ON auth_events;
+CREATE TRIGGER auth_events_no_update
+  BEFORE UPDATE OR DELETE OR TRUNCATE ON auth_events
+  FOR EACH STATEMENT EXECUTE FUNCTION auth_events_immutable();
+DROP FUNCTION IF EXISTS auth_events_redact_only();
+DROP INDEX IF EXISTS auth_events_phone_idx;
+DROP INDEX IF EXISTS auth_events_phone_index_idx;
+ALTER TABLE auth_events DROP COLUMN IF EXISTS redacted_by;
+ALTER TABLE auth_events DROP COLUMN IF EXISTS phone_index;
+
+DROP INDEX IF EXISTS phone_history_phone_key_id_idx;
+DROP INDEX IF EXISTS phone_history_new_phone_index_idx;
+DROP INDEX IF EXISTS phone_history_old_phone_index_idx;
+ALTER TABLE phone_history DROP COLUMN IF EXISTS new_phone_index;
+ALTER TABLE phone_history DROP COLUMN IF EXISTS old_phone_index;
+ALTER TABLE phone_history DROP COLUMN IF EXISTS phone_key_id;
+ALTER TABLE phone_history DROP COLUMN IF EXISTS new_phone_ct;
+ALTER TABLE phone_history DROP COLUMN IF EXISTS old_phone_ct;
+-- fails while any number is stored encrypted
+ALTER TABLE phone_history ALTER COLUMN new_phone SET NOT NULL;
+ALTER TABLE phone_history ALTER COLUMN old_phone SET NOT NULL;
@@ -0,0 +1,48 @@
+-- With a keyring configured phone_history keeps the numbers like users
+-- does: encrypted in old_phone_ct/new_phone_ct under phone_key_id, with a
+-- blind index of each for lookups. The plaintext columns are NULL.
+ALTER TABLE phone_history ALTER COLUMN old_phone DROP NOT NULL;
+ALTER TABLE phone_history ALTER COLUMN new_phone DROP NOT NULL;
+ALTER TABLE phone_history ADD COLUMN IF NOT EXISTS old_phone_ct BYTEA;
+ALTER TABLE phone_history ADD COLUMN IF NOT EXISTS new_phone_ct BYTEA;
+ALTER TABLE phone_history ADD COLUMN IF NOT EXISTS phone_key_id TEXT;
+ALTER TABLE phone_history ADD COLUMN IF NOT EXISTS old_phone_index BYTEA;
+ALTER TABLE phone_history ADD COLUMN IF NOT EXISTS new_phone_index BYTEA;
+CREATE INDEX IF NOT EXISTS phone_history_old_phone_index_idx ON phone_history (old_phone_index);
+CREATE INDEX IF NOT EXISTS phone_history_new_phone_index_idx ON phone_history (new_phone_index);
+CREATE INDEX IF NOT EXISTS phone_history_phone_key_id_idx ON phone_history (phone_key_id);
+
+-- auth_events records the blind index instead of the number. redacted_by is
+-- the phones_redacted event that removed the number from an older row.
+ALTER TABLE auth_events ADD COLUMN IF NOT EXISTS phone_index BYTEA;
+ALTER TABLE auth_events ADD COLUMN IF NOT EXISTS redacted_by BIGINT;
+CREATE INDEX IF NOT EXISTS auth_events_phone_index_idx ON auth_events (phone_index);
+-- finds rows still holding a number
+CREATE INDEX IF NOT EXISTS auth_events_phone_idx ON auth_events (id) WHERE phone <> '' AND redacted_by IS NULL;
+
+-- auth_events stays append-only, except that a row may be redacted once:
+-- its phone cleared and its details rewritten, everything else unchanged
+CREATE OR REPLACE FUNCTION auth_events_redact_only() RETURNS trigger AS $$
+BEGIN
+  IF OLD.redacted_by IS NULL AND NEW.redacted_by IS NOT NULL AND NEW.phone = ''
+    AND (NEW.phone_index IS NOT DISTINCT FROM OLD.phone_index OR OLD.phone_index IS NULL)
+    AND NEW.id = OLD.id AND NEW.event_type = OLD.event_type
+    AND NEW.user_id IS NOT DISTINCT FROM OLD.user_id
+    AND NEW.actor_id IS NOT DISTINCT FROM OLD.actor_id
+    AND NEW.ip = OLD.ip AND NEW.user_agent = OLD.user_agent AND NEW.request_id = OLD.request_id
+    AND NEW.created_at = OLD.created_at AND NEW.prev_hash = OLD.prev_hash AND NEW.hash = OLD.hash
+  THEN
+    RETURN NEW;
+  END IF;
+  RAISE EXCEPTION 'auth_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS auth_events_no_update ON auth_events;
+CREATE TRIGGER auth_events_no_update
+  BEFORE UPDATE ON auth_events
+  FOR EACH ROW EXECUTE FUNCTION auth_events_redact_only();
+DROP TRIGGER IF EXISTS auth_events_no_delete ON auth_events;
+CREATE TRIGGER auth_events_no_delete
+  BEFORE DELETE OR TRUNCATE ON auth_events
+  FOR EACH STATEMENT EXECUTE FUNCTION auth_events_immutable();
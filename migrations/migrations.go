@@ -0,0 +1,20 @@
+// Package migrations embeds the SQL schema migrations into the binary.
+//
+// Files are named NNNN_name.up.sql and NNNN_name.down.sql and are applied in
+// version order by internal/migrate. The Postgres migrations live in this
+// directory, the SQLite ones in sqlite/.
+package migrations
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed *.sql
+var FS embed.FS
+
+//go:embed sqlite/*.sql
+var sqliteFS embed.FS
+
+// SQLite holds the migrations of the SQLite backend
+var SQLite, _ = fs.Sub(sqliteFS, "sqlite")
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS token_revocations;
+DROP TABLE IF EXISTS rate_limits;
+DROP TABLE IF EXISTS otps;
+DROP TABLE IF EXISTS auth_events;
+DROP TABLE IF EXISTS user_notes;
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS users;
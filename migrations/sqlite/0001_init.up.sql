@@ -0,0 +1,101 @@
+-- SQLite schema for single-node deployments. Mirrors the Postgres
+-- migrations up to 0005 and adds the tables that replace Redis.
+
+CREATE TABLE IF NOT EXISTS users (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  phone TEXT NOT NULL UNIQUE,
+  status TEXT NOT NULL DEFAULT 'active'
+    CHECK (status IN ('active', 'suspended', 'banned', 'deleted')),
+  status_reason TEXT NOT NULL DEFAULT '',
+  status_changed_at DATETIME,
+  registered_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS users_status_idx ON users (status) WHERE status <> 'active';
+
+CREATE TABLE IF NOT EXISTS roles (
+  name TEXT PRIMARY KEY,
+  description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+  role TEXT NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+  permission TEXT NOT NULL,
+  PRIMARY KEY (role, permission)
+);
+
+-- the "user" role is implicit and never stored here
+CREATE TABLE IF NOT EXISTS user_roles (
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  role TEXT NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+  granted_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (user_id, role)
+);
+
+INSERT OR IGNORE INTO roles (name, description) VALUES
+  ('user', 'Regular end user'),
+  ('support', 'Customer support staff'),
+  ('admin', 'Full administrative access');
+
+INSERT OR IGNORE INTO role_permissions (role, permission) VALUES
+  ('user', 'profile:read'),
+  ('support', 'profile:read'),
+  ('support', 'users:read'),
+  ('admin', 'profile:read'),
+  ('admin', 'users:read'),
+  ('admin', 'users:write');
+
+CREATE TABLE IF NOT EXISTS user_notes (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  author_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+  body TEXT NOT NULL,
+  created_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS user_notes_user_id_idx ON user_notes (user_id);
+
+CREATE TABLE IF NOT EXISTS auth_events (
+  id INTEGER PRIMARY KEY,
+  event_type TEXT NOT NULL,
+  user_id INTEGER,
+  actor_id INTEGER,
+  phone TEXT NOT NULL DEFAULT '',
+  ip TEXT NOT NULL DEFAULT '',
+  user_agent TEXT NOT NULL DEFAULT '',
+  request_id TEXT NOT NULL DEFAULT '',
+  details TEXT NOT NULL DEFAULT '{}',
+  created_at DATETIME NOT NULL,
+  prev_hash TEXT NOT NULL,
+  hash TEXT NOT NULL UNIQUE
+);
+CREATE INDEX IF NOT EXISTS auth_events_user_id_idx ON auth_events (user_id);
+
+-- auth_events is append-only
+CREATE TRIGGER IF NOT EXISTS auth_events_no_update BEFORE UPDATE ON auth_events
+BEGIN
+  SELECT RAISE(ABORT, 'auth_events is append-only');
+END;
+CREATE TRIGGER IF NOT EXISTS auth_events_no_delete BEFORE DELETE ON auth_events
+BEGIN
+  SELECT RAISE(ABORT, 'auth_events is append-only');
+END;
+
+-- expiring keys, in unix milliseconds; rows past expires_at are ignored on
+-- read and removed by the cleanup loop
+CREATE TABLE IF NOT EXISTS otps (
+  phone TEXT PRIMARY KEY,
+  code TEXT NOT NULL,
+  expires_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS rate_limits (
+  key TEXT PRIMARY KEY,
+  count INTEGER NOT NULL,
+  expires_at INTEGER NOT NULL
+);
+
+-- revoked_at is in unix seconds, matching the precision of the iat claim
+CREATE TABLE IF NOT EXISTS token_revocations (
+  user_id INTEGER PRIMARY KEY,
+  revoked_at INTEGER NOT NULL,
+  expires_at INTEGER NOT NULL
+);
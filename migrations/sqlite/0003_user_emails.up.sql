@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS user_emails (
+  email TEXT PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  verified_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS user_emails_user_id_idx ON user_emails (user_id);
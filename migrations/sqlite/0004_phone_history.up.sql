@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS phone_history (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL,
+  old_phone TEXT NOT NULL,
+  new_phone TEXT NOT NULL,
+  actor_id INTEGER NOT NULL,
+  changed_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS phone_history_user_id_idx ON phone_history (user_id);
+CREATE INDEX IF NOT EXISTS phone_history_old_phone_idx ON phone_history (old_phone);
+CREATE INDEX IF NOT EXISTS phone_history_new_phone_idx ON phone_history (new_phone);
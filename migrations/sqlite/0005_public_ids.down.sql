@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_public_id_key;
+ALTER TABLE users DROP COLUMN public_id;
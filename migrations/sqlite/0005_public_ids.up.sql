@@ -0,0 +1,8 @@
+-- Existing users get random (version 4) ids; new ones are assigned UUIDv7s
+-- by the application.
+ALTER TABLE users ADD COLUMN public_id TEXT;
+UPDATE users SET public_id = lower(
+  hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-4' || substr(hex(randomblob(2)), 2) || '-' ||
+  substr('89ab', 1 + abs(random()) % 4, 1) || substr(hex(randomblob(2)), 2) || '-' || hex(randomblob(6)))
+WHERE public_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS users_public_id_key ON users (public_id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_last_login_at_idx;
+DROP INDEX IF EXISTS users_registered_at_idx;
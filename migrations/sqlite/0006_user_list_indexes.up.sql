@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS users_registered_at_idx ON users (registered_at, id);
+CREATE INDEX IF NOT EXISTS users_last_login_at_idx ON users (COALESCE(last_login_at, ''), id);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS scim_users (
+  user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  tenant TEXT NOT NULL,
+  external_id TEXT,
+  created_at DATETIME NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS scim_users_external_id_key ON scim_users (tenant, external_id);
+CREATE INDEX IF NOT EXISTS scim_users_tenant_idx ON scim_users (tenant, user_id);
@@ -0,0 +1,33 @@
+-- migrate:no-foreign-keys
+-- fails if the same phone number was registered in two tenants
+CREATE TABLE users_old (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  phone TEXT NOT NULL UNIQUE,
+  status TEXT NOT NULL DEFAULT 'active'
+    CHECK (status IN ('active', 'suspended', 'banned', 'deleted')),
+  status_reason TEXT NOT NULL DEFAULT '',
+  status_changed_at DATETIME,
+  registered_at DATETIME NOT NULL,
+  display_name TEXT NOT NULL DEFAULT '',
+  email TEXT NOT NULL DEFAULT '',
+  locale TEXT NOT NULL DEFAULT '',
+  timezone TEXT NOT NULL DEFAULT '',
+  avatar_url TEXT NOT NULL DEFAULT '',
+  metadata TEXT NOT NULL DEFAULT '{}',
+  last_login_at DATETIME,
+  login_count INTEGER NOT NULL DEFAULT 0,
+  public_id TEXT
+);
+INSERT INTO users_old (id, phone, status, status_reason, status_changed_at, registered_at,
+  display_name, email, locale, timezone, avatar_url, metadata, last_login_at, login_count, public_id)
+SELECT id, phone, status, status_reason, status_changed_at, registered_at,
+  display_name, email, locale, timezone, avatar_url, metadata, last_login_at, login_count, public_id
+FROM users;
+DROP TABLE users;
+ALTER TABLE users_old RENAME TO users;
+CREATE INDEX IF NOT EXISTS users_status_idx ON users (status) WHERE status <> 'active';
+CREATE UNIQUE INDEX IF NOT EXISTS users_public_id_key ON users (public_id);
+CREATE INDEX IF NOT EXISTS users_registered_at_idx ON users (registered_at, id);
+CREATE INDEX IF NOT EXISTS users_last_login_at_idx ON users (COALESCE(last_login_at, ''), id);
+DROP TABLE IF EXISTS tenant_hosts;
+DROP TABLE IF EXISTS tenants;
@@ -0,0 +1,60 @@
+-- migrate:no-foreign-keys
+-- Brands served by one deployment. NULL policy columns fall back to the
+-- service configuration; tenant 1 is the default tenant every existing user
+-- belongs to.
+CREATE TABLE IF NOT EXISTS tenants (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  slug TEXT NOT NULL UNIQUE,
+  name TEXT NOT NULL DEFAULT '',
+  -- hex SHA-256 of the tenant's API key
+  api_key_hash TEXT UNIQUE,
+  otp_length INTEGER,
+  otp_ttl_seconds INTEGER,
+  rate_limit_max INTEGER,
+  rate_limit_window_seconds INTEGER,
+  otp_message_template TEXT,
+  token_ttl_seconds INTEGER,
+  signing_key TEXT,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT OR IGNORE INTO tenants (id, slug, name) VALUES (1, 'default', 'Default');
+
+CREATE TABLE IF NOT EXISTS tenant_hosts (
+  host TEXT PRIMARY KEY,
+  tenant_id INTEGER NOT NULL REFERENCES tenants(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS tenant_hosts_tenant_id_idx ON tenant_hosts (tenant_id);
+
+-- A phone number is unique within its tenant only. The UNIQUE on phone is
+-- part of the table definition, so the table is copied.
+CREATE TABLE users_new (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  tenant_id INTEGER NOT NULL DEFAULT 1 REFERENCES tenants(id),
+  phone TEXT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'active'
+    CHECK (status IN ('active', 'suspended', 'banned', 'deleted')),
+  status_reason TEXT NOT NULL DEFAULT '',
+  status_changed_at DATETIME,
+  registered_at DATETIME NOT NULL,
+  display_name TEXT NOT NULL DEFAULT '',
+  email TEXT NOT NULL DEFAULT '',
+  locale TEXT NOT NULL DEFAULT '',
+  timezone TEXT NOT NULL DEFAULT '',
+  avatar_url TEXT NOT NULL DEFAULT '',
+  metadata TEXT NOT NULL DEFAULT '{}',
+  last_login_at DATETIME,
+  login_count INTEGER NOT NULL DEFAULT 0,
+  public_id TEXT,
+  UNIQUE (tenant_id, phone)
+);
+INSERT INTO users_new (id, phone, status, status_reason, status_changed_at, registered_at,
+  display_name, email, locale, timezone, avatar_url, metadata, last_login_at, login_count, public_id)
+SELECT id, phone, status, status_reason, status_changed_at, registered_at,
+  display_name, email, locale, timezone, avatar_url, metadata, last_login_at, login_count, public_id
+FROM users;
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
+CREATE INDEX IF NOT EXISTS users_status_idx ON users (status) WHERE status <> 'active';
+CREATE UNIQUE INDEX IF NOT EXISTS users_public_id_key ON users (public_id);
+CREATE INDEX IF NOT EXISTS users_registered_at_idx ON users (registered_at, id);
+CREATE INDEX IF NOT EXISTS users_last_login_at_idx ON users (COALESCE(last_login_at, ''), id);
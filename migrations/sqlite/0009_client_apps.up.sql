@@ -0,0 +1,17 @@
+-- Applications allowed to call the OTP endpoints. key_hash is the hex
+-- SHA-256 of the API key; key_prefix is its start, kept to identify it.
+CREATE TABLE IF NOT EXISTS client_apps (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  tenant_id INTEGER NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  key_prefix TEXT NOT NULL UNIQUE,
+  key_hash TEXT NOT NULL UNIQUE,
+  -- space-separated; empty allows any origin
+  allowed_origins TEXT NOT NULL DEFAULT '',
+  rate_limit_max INTEGER,
+  rate_limit_window_seconds INTEGER,
+  created_at DATETIME NOT NULL,
+  last_used_at DATETIME,
+  revoked_at DATETIME
+);
+CREATE INDEX IF NOT EXISTS client_apps_tenant_id_idx ON client_apps (tenant_id);
@@ -0,0 +1,18 @@
+-- State of the sliding window and token bucket rate limits; fixed windows
+-- stay in rate_limits. Times are unix milliseconds like the other expiring
+-- tables, which the cleanup loop purges by expires_at. A token bucket's
+-- credit counts a token as the window in milliseconds.
+CREATE TABLE IF NOT EXISTS rate_limit_log (
+  key TEXT NOT NULL,
+  at INTEGER NOT NULL,
+  expires_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS rate_limit_log_key_at_idx ON rate_limit_log (key, at);
+
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+  key TEXT PRIMARY KEY,
+  credit INTEGER NOT NULL,
+  at INTEGER NOT NULL,
+  expires_at INTEGER NOT NULL
+);
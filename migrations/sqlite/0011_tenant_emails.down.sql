@@ -0,0 +1,11 @@
+-- fails if the same email was verified in two tenants
+CREATE TABLE user_emails_old (
+  email TEXT PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  verified_at DATETIME NOT NULL
+);
+INSERT INTO user_emails_old (email, user_id, verified_at)
+SELECT email, user_id, verified_at FROM user_emails;
+DROP TABLE user_emails;
+ALTER TABLE user_emails_old RENAME TO user_emails;
+CREATE INDEX IF NOT EXISTS user_emails_user_id_idx ON user_emails (user_id);
@@ -0,0 +1,15 @@
+-- An email is unique within its tenant only, like a phone number. The
+-- primary key is part of the table definition, so the table is copied.
+CREATE TABLE user_emails_new (
+  tenant_id INTEGER NOT NULL REFERENCES tenants(id),
+  email TEXT NOT NULL,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  verified_at DATETIME NOT NULL,
+  PRIMARY KEY (tenant_id, email)
+);
+INSERT INTO user_emails_new (tenant_id, email, user_id, verified_at)
+SELECT u.tenant_id, e.email, e.user_id, e.verified_at
+FROM user_emails e JOIN users u ON u.id = e.user_id;
+DROP TABLE user_emails;
+ALTER TABLE user_emails_new RENAME TO user_emails;
+CREATE INDEX IF NOT EXISTS user_emails_user_id_idx ON user_emails (user_id);
@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS auth_events_no_update;
+CREATE TRIGGER auth_events_no_update BEFORE UPDATE ON auth_events
+BEGIN
+  SELECT RAISE(ABORT, 'auth_events is append-only');
+END;
+ALTER TABLE auth_events DROP COLUMN redacted_by;
+ALTER TABLE auth_events DROP COLUMN phone_index;
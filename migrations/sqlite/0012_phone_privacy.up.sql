@@ -0,0 +1,20 @@
+-- redacted_by is the phones_redacted event that removed the number from an
+-- older row. phone_index mirrors the Postgres schema.
+ALTER TABLE auth_events ADD COLUMN phone_index BLOB;
+ALTER TABLE auth_events ADD COLUMN redacted_by INTEGER;
+
+-- auth_events stays append-only, except that a row may be redacted once:
+-- its phone cleared and its details rewritten, everything else unchanged
+DROP TRIGGER IF EXISTS auth_events_no_update;
+CREATE TRIGGER auth_events_no_update BEFORE UPDATE ON auth_events
+WHEN NOT (
+  OLD.redacted_by IS NULL AND NEW.redacted_by IS NOT NULL AND NEW.phone = ''
+  AND (NEW.phone_index IS OLD.phone_index OR OLD.phone_index IS NULL)
+  AND NEW.id = OLD.id AND NEW.event_type = OLD.event_type
+  AND NEW.user_id IS OLD.user_id AND NEW.actor_id IS OLD.actor_id
+  AND NEW.ip = OLD.ip AND NEW.user_agent = OLD.user_agent AND NEW.request_id = OLD.request_id
+  AND NEW.created_at = OLD.created_at AND NEW.prev_hash = OLD.prev_hash AND NEW.hash = OLD.hash
+)
+BEGIN
+  SELECT RAISE(ABORT, 'auth_events is append-only');
+END;